@@ -10,10 +10,12 @@ import (
 	"github.com/ssbeatty/oms/internal/models"
 	"github.com/ssbeatty/oms/internal/server"
 	"github.com/ssbeatty/oms/pkg/logger"
+	"github.com/ssbeatty/oms/pkg/utils"
 	"github.com/ssbeatty/oms/version"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -46,7 +48,8 @@ func main() {
 	// flags & init conf
 
 	configPath := flag.String("config", "", "path of config")
-	act := flag.String("action", "", "install or uninstall")
+	act := flag.String("action", "", "install, uninstall or rotate-key")
+	newKeyFile := flag.String("new-key-file", "", "path of new master key file, used by rotate-key")
 	user := flag.String("user", "", "run with user")
 	flag.Parse()
 
@@ -130,6 +133,55 @@ func main() {
 		panic(fmt.Sprintf("init db error: %v", err))
 	}
 
+	masterKey, err := loadMasterKey(&conf.Secret)
+	if err != nil {
+		panic(fmt.Sprintf("load master key error: %v", err))
+	}
+
+	// 轮换主密钥, 完成后需要修改配置使用新的主密钥
+	if *act == "rotate-key" {
+		if *newKeyFile == "" {
+			panic("rotate-key need flag --new-key-file")
+		}
+		newMasterKey, _, err := readOrCreateKeyFile(*newKeyFile)
+		if err != nil {
+			panic(fmt.Sprintf("load new master key error: %v", err))
+		}
+		if err := models.RotateMasterKey(masterKey, newMasterKey); err != nil {
+			panic(fmt.Sprintf("rotate master key error: %v", err))
+		}
+		log.Infof("主密钥轮换成功, 请将配置 secret.master_key_file 修改为: %s", *newKeyFile)
+		return
+	}
+
+	if err := models.InitSecret(masterKey); err != nil {
+		panic(fmt.Sprintf("init secret error: %v", err))
+	}
+
+	// 首次启动创建管理员 密码优先使用配置文件, 其次环境变量, 都没有则随机生成
+	adminPassword := conf.Auth.AdminPassword
+	if adminPassword == "" {
+		adminPassword = os.Getenv("ENV_OMS_ADMIN_PASSWORD")
+	}
+	randomPassword := adminPassword == ""
+	if randomPassword {
+		adminPassword, err = utils.RandomToken(12)
+		if err != nil {
+			panic(fmt.Sprintf("generate admin password error: %v", err))
+		}
+	}
+	created, err := models.InitAdminUser(conf.Auth.AdminUser, adminPassword)
+	if err != nil {
+		panic(fmt.Sprintf("init admin user error: %v", err))
+	}
+	if created {
+		if randomPassword {
+			log.Warnf("创建管理员: %s, 随机密码: %s, 请登录后修改", conf.Auth.AdminUser, adminPassword)
+		} else {
+			log.Infof("创建管理员: %s", conf.Auth.AdminUser)
+		}
+	}
+
 	if conf.App.Mode == "dev" {
 		logger.SetLevelAndFormat(logger.DebugLevel, &log.TextFormatter{})
 	} else {
@@ -158,3 +210,47 @@ func main() {
 	}
 
 }
+
+// loadMasterKey 主密钥优先使用配置文件, 其次环境变量, 最后读取密钥文件, 密钥文件不存在时自动生成
+func loadMasterKey(conf *config.Secret) (string, error) {
+	if conf.MasterKey != "" {
+		return conf.MasterKey, nil
+	}
+	if key := os.Getenv("ENV_OMS_MASTER_KEY"); key != "" {
+		return key, nil
+	}
+	key, created, err := readOrCreateKeyFile(conf.MasterKeyFile)
+	if err != nil {
+		return "", err
+	}
+	if created {
+		log.Warnf("生成主密钥文件: %s, 请妥善备份, 丢失后将无法解密主机密码和密钥", conf.MasterKeyFile)
+	}
+	return key, nil
+}
+
+func readOrCreateKeyFile(path string) (string, bool, error) {
+	if ok, _ := utils.PathExists(path); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, err
+		}
+		key := strings.TrimSpace(string(data))
+		if key == "" {
+			return "", false, fmt.Errorf("master key file %s is empty", path)
+		}
+		return key, false, nil
+	}
+
+	key, err := utils.RandomToken(32)
+	if err != nil {
+		return "", false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", false, err
+	}
+	if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		return "", false, err
+	}
+	return key, true, nil
+}
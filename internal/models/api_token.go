@@ -0,0 +1,138 @@
+package models
+
+import (
+	"errors"
+	"github.com/ssbeatty/oms/pkg/utils"
+	"strings"
+	"time"
+)
+
+const (
+	// ApiTokenPrefix 用于区分 api token 和登录会话
+	ApiTokenPrefix     = "oms_"
+	apiTokenSize       = 32
+	apiTokenPrefixSize = 8
+	// 最近使用时间的更新间隔, 避免每个请求都写库
+	apiTokenTouchInterval = time.Minute
+
+	ScopeRead  = "read"
+	ScopeExec  = "exec"
+	ScopeWrite = "write"
+)
+
+var (
+	ErrApiTokenScope = errors.New("api token scope must be read, exec or write")
+)
+
+// ApiToken 用户的个人访问令牌 只保存token的摘要
+type ApiToken struct {
+	Id        int       `json:"id"`
+	UserId    int       `gorm:"index" json:"user_id"`
+	User      User      `gorm:"constraint:OnDelete:CASCADE;" json:"-"`
+	Name      string    `gorm:"size:128;not null" json:"name"`
+	Token     string    `gorm:"size:128;not null;unique" json:"-"`
+	Prefix    string    `gorm:"size:32" json:"prefix"`
+	Scopes    string    `gorm:"size:128" json:"scopes"`
+	ExpireAt  time.Time `gorm:"index" json:"expire_at"`
+	LastUsed  time.Time `json:"last_used"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HasScope write 包含全部权限
+func (t *ApiToken) HasScope(scope string) bool {
+	for _, s := range strings.Split(t.Scopes, ",") {
+		if s == scope || s == ScopeWrite {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseScopes 校验并规范化逗号分隔的 scope 列表
+func ParseScopes(raw string) (string, error) {
+	var scopes []string
+	seen := make(map[string]struct{})
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(s)
+		switch s {
+		case ScopeRead, ScopeExec, ScopeWrite:
+		default:
+			return "", ErrApiTokenScope
+		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		scopes = append(scopes, s)
+	}
+	return strings.Join(scopes, ","), nil
+}
+
+func GetApiTokensByUserId(userId int) ([]*ApiToken, error) {
+	var tokens []*ApiToken
+	err := db.Where("user_id = ?", userId).Order(defaultSort).Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func GetApiTokenById(id int) (*ApiToken, error) {
+	token := ApiToken{}
+	err := db.Where("id = ?", id).First(&token).Error
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// InsertApiToken 创建新的api token, 返回明文token, 明文只在创建时返回一次
+func InsertApiToken(userId int, name, scopes string, expire time.Duration) (string, *ApiToken, error) {
+	random, err := utils.RandomToken(apiTokenSize)
+	if err != nil {
+		return "", nil, err
+	}
+	raw := ApiTokenPrefix + random
+	token := ApiToken{
+		UserId:   userId,
+		Name:     name,
+		Token:    utils.HashSha256(raw),
+		Prefix:   raw[:len(ApiTokenPrefix)+apiTokenPrefixSize],
+		Scopes:   scopes,
+		ExpireAt: time.Now().Local().Add(expire),
+	}
+	err = db.Create(&token).Error
+	if err != nil {
+		return "", nil, err
+	}
+	return raw, &token, nil
+}
+
+// GetApiTokenByToken 通过明文token获取有效的api token, 并记录最近使用时间
+func GetApiTokenByToken(raw string) (*ApiToken, error) {
+	token := ApiToken{}
+	now := time.Now().Local()
+	err := db.Preload("User").
+		Where("token = ? AND expire_at > ?", utils.HashSha256(raw), now).
+		First(&token).Error
+	if err != nil {
+		return nil, err
+	}
+	if token.User.Disabled {
+		return nil, ErrUserDisabled
+	}
+	if now.Sub(token.LastUsed) > apiTokenTouchInterval {
+		token.LastUsed = now
+		db.Model(&ApiToken{}).Where("id = ?", token.Id).Update("last_used", now)
+	}
+	return &token, nil
+}
+
+func DeleteApiTokenById(id int) error {
+	return db.Where("id = ?", id).Delete(&ApiToken{}).Error
+}
+
+// ClearExpiredApiToken 删除过期的api token
+func ClearExpiredApiToken() error {
+	return db.Where("expire_at < ?", time.Now().Local()).Delete(&ApiToken{}).Error
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+
+	auditMaxExport   = 100000
+	auditExportBatch = 500
+)
+
+var (
+	ErrAuditAppendOnly = errors.New("audit event is append only")
+)
+
+// AuditEvent 操作审计, 只允许追加
+type AuditEvent struct {
+	Id        int       `json:"id"`
+	UserId    int       `gorm:"index" json:"user_id"`
+	Actor     string    `gorm:"size:128;index" json:"actor"`
+	ClientIP  string    `gorm:"size:64" json:"client_ip"`
+	Action    string    `gorm:"size:128;index" json:"action"` // 例如 POST /api/v1/host, ws.cmd, terminal.open
+	Path      string    `gorm:"size:255" json:"path"`
+	HostIds   string    `gorm:"size:1024" json:"-"` // ,1,2, 方便按主机过滤
+	Hosts     string    `gorm:"type:text" json:"hosts"`
+	Summary   string    `gorm:"type:text" json:"summary"`
+	Result    string    `gorm:"size:16;index" json:"result"`
+	Error     string    `gorm:"type:text" json:"error"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+
+	HostIdList []int `gorm:"-" json:"host_ids"`
+}
+
+// AuditFilter 查询审计记录的条件, 为空的条件不生效
+type AuditFilter struct {
+	Actor     string
+	Action    string
+	ClientIP  string
+	HostId    int
+	Result    string
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+func (a *AuditEvent) BeforeUpdate(*gorm.DB) error {
+	return ErrAuditAppendOnly
+}
+
+func (a *AuditEvent) BeforeDelete(*gorm.DB) error {
+	return ErrAuditAppendOnly
+}
+
+func (a *AuditEvent) AfterFind(*gorm.DB) error {
+	a.HostIdList = make([]int, 0)
+	for _, s := range strings.Split(strings.Trim(a.HostIds, ","), ",") {
+		if id, err := strconv.Atoi(s); err == nil {
+			a.HostIdList = append(a.HostIdList, id)
+		}
+	}
+	return nil
+}
+
+// SetHosts 记录操作涉及的主机
+func (a *AuditEvent) SetHosts(hosts []*Host) {
+	if len(hosts) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(hosts))
+	names := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		ids = append(ids, strconv.Itoa(host.Id))
+		names = append(names, host.Name)
+	}
+	a.HostIds = "," + strings.Join(ids, ",") + ","
+	a.Hosts = strings.Join(names, ",")
+	if len(a.HostIds) > 1024 {
+		a.HostIds = a.HostIds[:strings.LastIndex(a.HostIds[:1024], ",")+1]
+	}
+}
+
+func InsertAuditEvent(event *AuditEvent) error {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.Create(event).Error
+}
+
+func (f *AuditFilter) query() *gorm.DB {
+	d := db.Model(&AuditEvent{})
+	if f.Actor != "" {
+		d = d.Where("actor = ?", f.Actor)
+	}
+	if f.Action != "" {
+		d = d.Where("action LIKE ?", "%"+f.Action+"%")
+	}
+	if f.ClientIP != "" {
+		d = d.Where("client_ip = ?", f.ClientIP)
+	}
+	if f.HostId != 0 {
+		d = d.Where("host_ids LIKE ?", "%,"+strconv.Itoa(f.HostId)+",%")
+	}
+	if f.Result != "" {
+		d = d.Where("result = ?", f.Result)
+	}
+	if !f.StartTime.IsZero() {
+		d = d.Where("created_at >= ?", f.StartTime)
+	}
+	if !f.EndTime.IsZero() {
+		d = d.Where("created_at <= ?", f.EndTime)
+	}
+	return d
+}
+
+func GetAuditEvents(filter *AuditFilter, pageSize, page int) ([]*AuditEvent, int64, error) {
+	var (
+		total  int64
+		events []*AuditEvent
+	)
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	if page <= 0 {
+		page = 1
+	}
+
+	if err := filter.query().Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := filter.query().Order(defaultSort).Offset((page - 1) * pageSize).Limit(pageSize).Find(&events).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+// ExportAuditEvents 按时间倒序遍历全部符合条件的审计记录, 最多导出 auditMaxExport 条
+func ExportAuditEvents(filter *AuditFilter, fn func(event *AuditEvent) error) error {
+	var (
+		lastId   int
+		exported int
+	)
+	for exported < auditMaxExport {
+		var events []*AuditEvent
+		d := filter.query()
+		if lastId != 0 {
+			d = d.Where("id < ?", lastId)
+		}
+		if err := d.Order(defaultSort).Limit(auditExportBatch).Find(&events).Error; err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		if len(events) < auditExportBatch {
+			return nil
+		}
+		exported += len(events)
+		lastId = events[len(events)-1].Id
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// CertAuthority 内置的ssh证书签发机构, 主机信任公钥后可以使用签发的临时证书登录
+type CertAuthority struct {
+	Id          int       `json:"id"`
+	PrivateKey  string    `gorm:"type:text;not null;serializer:secret" json:"-"`
+	PublicKey   string    `gorm:"type:text;not null" json:"public_key"` // authorized_keys 格式
+	Fingerprint string    `gorm:"size:128" json:"fingerprint"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func GetCertAuthority() (*CertAuthority, error) {
+	ca := CertAuthority{}
+	err := db.First(&ca).Error
+	if err != nil {
+		return nil, err
+	}
+	return &ca, nil
+}
+
+func InsertCertAuthority(privateKey, publicKey, fingerprint string) (*CertAuthority, error) {
+	ca := CertAuthority{
+		PrivateKey:  privateKey,
+		PublicKey:   publicKey,
+		Fingerprint: fingerprint,
+	}
+	err := db.Create(&ca).Error
+	if err != nil {
+		return nil, err
+	}
+	return &ca, nil
+}
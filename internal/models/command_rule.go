@@ -0,0 +1,97 @@
+package models
+
+import "time"
+
+const (
+	CommandRuleDeny    = "deny"    // 拒绝执行
+	CommandRuleConfirm = "confirm" // 需要二次确认
+	CommandRuleAllow   = "allow"   // 放行, 用于在拒绝规则之前添加例外
+
+	CommandRuleTargetAll = "all"
+)
+
+// CommandRule 批量执行命令时的危险命令规则, 按 priority 从小到大匹配, 每台主机使用第一条匹配的规则,
+// 主机范围复用 host/group/tag 的选择方式, all 为所有主机
+type CommandRule struct {
+	Id         int       `json:"id"`
+	Name       string    `gorm:"size:128;not null" json:"name"`
+	Pattern    string    `gorm:"type:text;not null" json:"pattern"` // 正则表达式
+	Action     string    `gorm:"size:16;not null" json:"action"`
+	TargetType string    `gorm:"size:32;not null" json:"target_type"`
+	TargetId   int       `json:"target_id"`
+	Priority   int       `gorm:"index" json:"priority"`
+	Enable     bool      `json:"enable"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func GetAllCommandRules() ([]*CommandRule, error) {
+	var rules []*CommandRule
+	err := db.Order("priority, id").Find(&rules).Error
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// GetEnabledCommandRules 按匹配顺序返回启用的规则
+func GetEnabledCommandRules() ([]*CommandRule, error) {
+	var rules []*CommandRule
+	err := db.Where("enable = ?", true).Order("priority, id").Find(&rules).Error
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func GetCommandRuleById(id int) (*CommandRule, error) {
+	rule := CommandRule{}
+	err := db.Where("id = ?", id).First(&rule).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func InsertCommandRule(name, pattern, action, targetType string, targetId, priority int, enable bool) (*CommandRule, error) {
+	rule := CommandRule{
+		Name:       name,
+		Pattern:    pattern,
+		Action:     action,
+		TargetType: targetType,
+		TargetId:   targetId,
+		Priority:   priority,
+		Enable:     enable,
+	}
+	err := db.Create(&rule).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// UpdateCommandRule 整体覆盖规则
+func UpdateCommandRule(id int, name, pattern, action, targetType string, targetId, priority int, enable bool) (*CommandRule, error) {
+	rule := CommandRule{}
+	err := db.Where("id = ?", id).First(&rule).Error
+	if err != nil {
+		return nil, err
+	}
+	rule.Name = name
+	rule.Pattern = pattern
+	rule.Action = action
+	rule.TargetType = targetType
+	rule.TargetId = targetId
+	rule.Priority = priority
+	rule.Enable = enable
+
+	err = db.Save(&rule).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func DeleteCommandRuleById(id int) error {
+	return db.Delete(&CommandRule{}, id).Error
+}
@@ -0,0 +1,114 @@
+package models
+
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleReadOnly = "readonly"
+
+	GrantTypeHost  = "host"
+	GrantTypeGroup = "group"
+	GrantTypeTag   = "tag"
+)
+
+// UserGrant 用户可以访问的主机范围 复用 host/group/tag 的选择方式
+type UserGrant struct {
+	Id       int    `json:"id"`
+	UserId   int    `gorm:"index" json:"user_id"`
+	Type     string `gorm:"size:32;not null" json:"type"`
+	TargetId int    `gorm:"not null" json:"target_id"`
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// CanOperate 是否可以对主机执行操作(终端, 命令, 文件修改, 任务)
+func (u *User) CanOperate() bool {
+	return u.Role == RoleAdmin || u.Role == RoleOperator
+}
+
+func GetUserGrants(userId int) ([]*UserGrant, error) {
+	var grants []*UserGrant
+	err := db.Where("user_id = ?", userId).Find(&grants).Error
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// UpdateUserGrants 覆盖用户的授权范围
+func UpdateUserGrants(userId int, grants []UserGrant) error {
+	tx := db.Begin()
+
+	if err := tx.Where("user_id = ?", userId).Delete(&UserGrant{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, grant := range grants {
+		grant.Id = 0
+		grant.UserId = userId
+		if err := tx.Create(&grant).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// GetUserHostIds 解析用户可以访问的主机id, 管理员返回 all = true
+func GetUserHostIds(user *User) (ids map[int]struct{}, all bool, err error) {
+	if user.IsAdmin() {
+		return nil, true, nil
+	}
+	grants, err := GetUserGrants(user.Id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ids = make(map[int]struct{})
+	for _, grant := range grants {
+		hosts, err := ParseHostList(grant.Type, grant.TargetId)
+		if err != nil {
+			log.Errorf("GetUserHostIds error when parse grant: %d, err: %v", grant.Id, err)
+			continue
+		}
+		for _, host := range hosts {
+			ids[host.Id] = struct{}{}
+		}
+	}
+
+	return ids, false, nil
+}
+
+// FilterHostsByUser 过滤出用户有权限的主机
+func FilterHostsByUser(user *User, hosts []*Host) ([]*Host, error) {
+	ids, all, err := GetUserHostIds(user)
+	if err != nil {
+		return nil, err
+	}
+	if all {
+		return hosts, nil
+	}
+
+	var ret []*Host
+	for _, host := range hosts {
+		if _, ok := ids[host.Id]; ok {
+			ret = append(ret, host)
+		}
+	}
+	return ret, nil
+}
+
+// UserCanAccessHost 用户是否有单个主机的权限
+func UserCanAccessHost(user *User, hostId int) bool {
+	ids, all, err := GetUserHostIds(user)
+	if err != nil {
+		return false
+	}
+	if all {
+		return true
+	}
+	_, ok := ids[hostId]
+	return ok
+}
@@ -11,6 +11,9 @@ type Group struct {
 	Mode   int    `gorm:"default:0;not null" json:"mode"` //0.主机模式, 1.其他匹配模式主机不生效
 	Host   []Host `json:"-"`
 	Params string `json:"params"`
+	// 组内主机web终端和VNC的空闲超时和最长时长, 单位秒, 0 使用全局配置, 小于 0 不限制
+	IdleTimeout int `json:"idle_timeout"`
+	MaxDuration int `json:"max_duration"`
 }
 
 func GetAllGroup() ([]*Group, error) {
@@ -89,6 +92,26 @@ func UpdateGroup(id int, name string, params string, mode int) (*Group, error) {
 	return &group, nil
 }
 
+// UpdateGroupSessionLimit 为 nil 的字段保持不变
+func UpdateGroupSessionLimit(id int, idleTimeout, maxDuration *int) (*Group, error) {
+	group := Group{}
+	err := db.Where("id = ?", id).First(&group).Error
+	if err != nil {
+		return nil, err
+	}
+	if idleTimeout != nil {
+		group.IdleTimeout = *idleTimeout
+	}
+	if maxDuration != nil {
+		group.MaxDuration = *maxDuration
+	}
+	err = db.Model(&group).Select("IdleTimeout", "MaxDuration").Updates(&group).Error
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
 func DeleteGroupById(id int) error {
 	err := db.Delete(&Group{}, id).Error
 	if err != nil {
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"errors"
 	"gorm.io/gorm/clause"
 	"regexp"
 	"strings"
@@ -21,22 +22,43 @@ type HostExport struct {
 	KeyPhrase   string   `csv:"key_phrase"`
 }
 
+const (
+	// MaxJumpHosts 跳板机链的最大长度
+	MaxJumpHosts = 8
+	// ProxyDirect 主机不使用全局代理
+	ProxyDirect = "direct"
+	// ProxyGlobal 更新主机时恢复使用全局代理
+	ProxyGlobal = "global"
+)
+
+var (
+	ErrJumpHostLoop    = errors.New("jump host chain has a loop")
+	ErrJumpHostTooDeep = errors.New("jump host chain is too long")
+	ErrHostIsJumpHost  = errors.New("host is used as jump host by other hosts")
+)
+
 // Host Struct
 type Host struct {
-	Id           int        `json:"id"`
-	Name         string     `gorm:"size:128;not null" json:"name"`
-	User         string     `gorm:"size:128;not null" json:"user"`
-	Addr         string     `gorm:"size:128;not null" json:"addr"`
-	Port         int        `gorm:"default:22" json:"port"`
-	VNCPort      int        `gorm:"default:5900" json:"vnc_port"`
-	PassWord     string     `gorm:"size:128;not null" json:"-"`
-	Status       bool       `gorm:"default:false" json:"status"`
-	PrivateKey   PrivateKey `gorm:"constraint:OnDelete:SET NULL;" json:"-"`
-	PrivateKeyID int        `json:"private_key_id"`
-	GroupId      int        `json:"group_id"`
-	Group        Group      `gorm:"constraint:OnDelete:SET NULL;" json:"group"`
-	Tags         []Tag      `gorm:"many2many:host_tag" json:"tags"`
-	Tunnels      []Tunnel   `gorm:"constraint:OnDelete:CASCADE;" json:"tunnels"`
+	Id            int        `json:"id"`
+	Name          string     `gorm:"size:128;not null" json:"name"`
+	User          string     `gorm:"size:128;not null" json:"user"`
+	Addr          string     `gorm:"size:128;not null" json:"addr"`
+	Port          int        `gorm:"default:22" json:"port"`
+	VNCPort       int        `gorm:"default:5900" json:"vnc_port"`
+	PassWord      string     `gorm:"size:512;not null;serializer:secret" json:"-"`
+	Status        bool       `gorm:"default:false" json:"status"`
+	ErrorMsg      string     `gorm:"size:512" json:"error_msg"`
+	JumpHostId    int        `gorm:"default:0;index" json:"jump_host_id"` // 跳板机, 跳板机也可以配置跳板机
+	Proxy         string     `gorm:"size:255" json:"proxy"`               // 为空时使用全局代理, 为 direct 时不使用代理
+	ProxyUser     string     `gorm:"size:128" json:"proxy_user"`
+	ProxyPassword string     `gorm:"size:512;serializer:secret" json:"-"`
+	UseCA         bool       `gorm:"default:false" json:"use_ca"` // 使用内置CA签发的临时证书登录
+	PrivateKey    PrivateKey `gorm:"constraint:OnDelete:SET NULL;" json:"-"`
+	PrivateKeyID  int        `json:"private_key_id"`
+	GroupId       int        `json:"group_id"`
+	Group         Group      `gorm:"constraint:OnDelete:SET NULL;" json:"group"`
+	Tags          []Tag      `gorm:"many2many:host_tag" json:"tags"`
+	Tunnels       []Tunnel   `gorm:"constraint:OnDelete:CASCADE;" json:"tunnels"`
 }
 
 func ParseHostList(pType string, id int) ([]*Host, error) {
@@ -148,6 +170,14 @@ func DeleteHostById(id int) (*Host, error) {
 	if err != nil {
 		return nil, err
 	}
+	var count int64
+	err = db.Model(&Host{}).Where("jump_host_id = ?", id).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrHostIsJumpHost
+	}
 	if err := db.Model(&host).Association("Tags").Clear(); err != nil {
 		log.Errorf("DeleteHostById error Association tag Clear, err: %v", err)
 	}
@@ -155,11 +185,18 @@ func DeleteHostById(id int) (*Host, error) {
 	if err != nil {
 		return nil, err
 	}
+	// 主机 ID 可能被复用, 公钥记录随主机删除
+	if err := DeleteKnownHostByHostId(id); err != nil {
+		log.Errorf("DeleteHostById error when delete known host, err: %v", err)
+	}
 
 	return &host, nil
 }
 
-func InsertHost(hostname string, user string, addr string, port int, password string, groupId int, tags []int, privateKeyID, vncPort int) (*Host, error) {
+func InsertHost(hostname string, user string, addr string, port int, password string, groupId int, tags []int, privateKeyID, vncPort, jumpHostId int, proxy, proxyUser, proxyPassword string, useCA bool) (*Host, error) {
+	if err := CheckJumpHost(0, jumpHostId); err != nil {
+		return nil, err
+	}
 	var tagObjs []Tag
 	for _, tagId := range tags {
 		tag := Tag{}
@@ -179,7 +216,10 @@ func InsertHost(hostname string, user string, addr string, port int, password st
 		PrivateKeyID: privateKeyID,
 		Tags:         tagObjs,
 		VNCPort:      vncPort,
+		JumpHostId:   jumpHostId,
+		UseCA:        useCA,
 	}
+	host.setProxy(proxy, proxyUser, proxyPassword)
 	err := db.Omit("GroupId", "PrivateKeyID").Create(&host).Error
 	if err != nil {
 		return nil, err
@@ -207,12 +247,19 @@ func InsertHost(hostname string, user string, addr string, port int, password st
 	return &host, nil
 }
 
-func UpdateHost(id int, hostname string, user string, addr string, port int, password string, groupId int, tags []int, privateKeyID, vncPort int) (*Host, error) {
+// UpdateHost 更新主机, jumpHostId 为 nil 时不修改跳板机, 为 0 时取消跳板机; proxy 为空、useCA 为 nil 时不修改
+func UpdateHost(id int, hostname string, user string, addr string, port int, password string, groupId int, tags []int, privateKeyID, vncPort int, jumpHostId *int, proxy, proxyUser, proxyPassword string, useCA *bool) (*Host, error) {
 	host := Host{Id: id}
 	err := db.Where("id = ?", id).First(&host).Error
 	if err != nil {
 		return nil, err
 	}
+	if jumpHostId != nil {
+		if err := CheckJumpHost(id, *jumpHostId); err != nil {
+			return nil, err
+		}
+		host.JumpHostId = *jumpHostId
+	}
 
 	if len(tags) > 0 {
 		var tagObjs []Tag
@@ -243,6 +290,7 @@ func UpdateHost(id int, hostname string, user string, addr string, port int, pas
 	if user != "" {
 		host.User = user
 	}
+	oldAddr := KnownHostAddr(host.Addr, host.Port)
 	if port != 0 {
 		host.Port = port
 	}
@@ -255,6 +303,12 @@ func UpdateHost(id int, hostname string, user string, addr string, port int, pas
 	if vncPort != 0 {
 		host.VNCPort = vncPort
 	}
+	if proxy != "" {
+		host.setProxy(proxy, proxyUser, proxyPassword)
+	}
+	if useCA != nil {
+		host.UseCA = *useCA
+	}
 	if groupId != 0 {
 		group := Group{}
 		err := db.Where("id = ?", groupId).First(&group).Error
@@ -289,9 +343,47 @@ func UpdateHost(id int, hostname string, user string, addr string, port int, pas
 			return nil, err
 		}
 	}
+	// 地址变化后可能是另一台机器, 重新记录公钥
+	if KnownHostAddr(host.Addr, host.Port) != oldAddr {
+		if err := DeleteKnownHostByHostId(id); err != nil {
+			log.Errorf("UpdateHost error when delete known host, err: %v", err)
+		}
+	}
 	return &host, nil
 }
 
+// setProxy 设置主机的代理, 没有用户名时清除认证信息, 密码为空时保留原来的密码
+func (h *Host) setProxy(proxy, proxyUser, proxyPassword string) {
+	if proxy == ProxyGlobal {
+		proxy = ""
+	}
+	h.Proxy = proxy
+	h.ProxyUser = proxyUser
+	if proxyUser == "" {
+		h.ProxyPassword = ""
+	} else if proxyPassword != "" {
+		h.ProxyPassword = proxyPassword
+	}
+}
+
+// CheckJumpHost 检查跳板机链是否存在循环, id 为当前主机, 新建主机时为0
+func CheckJumpHost(id, jumpHostId int) error {
+	for depth := 0; jumpHostId != 0; depth++ {
+		if jumpHostId == id {
+			return ErrJumpHostLoop
+		}
+		if depth >= MaxJumpHosts {
+			return ErrJumpHostTooDeep
+		}
+		jumpHost, err := GetHostById(jumpHostId)
+		if err != nil {
+			return err
+		}
+		jumpHostId = jumpHost.JumpHostId
+	}
+	return nil
+}
+
 func GetAllHost() ([]*Host, error) {
 	var hosts []*Host
 	err := db.Preload(clause.Associations).Find(&hosts).Error
@@ -370,7 +462,7 @@ func UpdateHostStatus(host *Host) error {
 	db.Lock()
 	defer db.Unlock()
 
-	if err := db.Select("Status").Save(&host).Error; err != nil {
+	if err := db.Select("Status", "ErrorMsg").Save(&host).Error; err != nil {
 		return err
 	}
 	return nil
@@ -9,12 +9,36 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	InstanceStatusRunning = "running"
-	InstanceStatusDone    = "done"
+	InstanceStatusRunning   = "running"
+	InstanceStatusDone      = "done"
+	InstanceStatusCancelled = "cancelled"
+	InstanceStatusTimeout   = "timeout"
+	InstanceStatusSkipped   = "skipped" // 上一次调度还在执行, 按重叠策略跳过
+
+	HostResultSuccess   = "success"
+	HostResultFailed    = "failed"
+	HostResultSkipped   = "skipped"   // 因为失败过多, 实例被取消或者超时, 没有执行
+	HostResultCancelled = "cancelled" // 执行中被取消
+	HostResultTimeout   = "timeout"   // 主机或者任务执行超时
+
+	RetryOnAll     = "all"     // 所有失败都重试
+	RetryOnConnect = "connect" // 只重试连接失败
+	RetryOnExit    = "exit"    // 只重试命令失败(非 0 退出码, 超时等)
+
+	// MaxRetryCount 最多重试的次数
+	MaxRetryCount = 10
+	// MaxRetryBackoff 重试前等待的最长时间
+	MaxRetryBackoff = 10 * time.Minute
+
+	OverlapAllow = "allow" // 允许同时执行
+	OverlapSkip  = "skip"  // 跳过本次调度
+	OverlapQueue = "queue" // 等待上一次执行结束后再执行
 )
 
 type Job struct {
@@ -29,6 +53,100 @@ type Job struct {
 	ExecuteID   int            `json:"execute_id"`
 	ExecuteType string         `gorm:"size:64" json:"execute_type"`
 	Instances   []TaskInstance `gorm:"constraint:OnDelete:CASCADE;" json:"instances"`
+	// 上一次调度还在执行时的策略: allow, skip, queue, 为空时同 allow
+	OverlapPolicy string `gorm:"size:32" json:"overlap_policy"`
+	ExecStrategy
+	RetryPolicy
+	GuardConfirmation
+}
+
+// ExecStrategy 批量执行的策略, 零值表示所有主机同时执行
+type ExecStrategy struct {
+	MaxParallel  int `json:"max_parallel"`  // 同时执行的最大主机数, 0 不限制
+	BatchSize    int `json:"batch_size"`    // 每批的主机数, 0 不分批
+	BatchPercent int `json:"batch_percent"` // 每批占主机总数的百分比, 设置了 batch_size 时不生效
+	BatchPause   int `json:"batch_pause"`   // 批次之间暂停的秒数
+	AbortPercent int `json:"abort_percent"` // 一批结束时失败的主机超过已执行主机的这个百分比则中止剩余的批次, 0 不中止
+}
+
+func (s *ExecStrategy) Validate() error {
+	if s.MaxParallel < 0 || s.BatchSize < 0 || s.BatchPause < 0 {
+		return errors.New("max_parallel, batch_size and batch_pause can not be negative")
+	}
+	if s.BatchPercent < 0 || s.BatchPercent > 100 || s.AbortPercent < 0 || s.AbortPercent > 100 {
+		return errors.New("batch_percent and abort_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// GuardConfirmation 保存任务时确认过的危险命令, 定时执行时命中 confirm 规则的命令和主机必须在确认范围内
+type GuardConfirmation struct {
+	ConfirmedDigest  string `gorm:"size:64" json:"-"`   // 确认时命令的摘要
+	ConfirmedHostIds string `gorm:"type:text" json:"-"` // 确认时命中 confirm 规则的主机, 例如 ,1,2,
+}
+
+func NewGuardConfirmation(digest string, hosts []*Host) GuardConfirmation {
+	if len(hosts) == 0 {
+		return GuardConfirmation{}
+	}
+	ids := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		ids = append(ids, strconv.Itoa(host.Id))
+	}
+	return GuardConfirmation{
+		ConfirmedDigest:  digest,
+		ConfirmedHostIds: "," + strings.Join(ids, ",") + ",",
+	}
+}
+
+// Covers 命令没有变化并且主机确认过
+func (c *GuardConfirmation) Covers(digest string, hostId int) bool {
+	if c.ConfirmedDigest == "" || c.ConfirmedDigest != digest {
+		return false
+	}
+	return strings.Contains(c.ConfirmedHostIds, ","+strconv.Itoa(hostId)+",")
+}
+
+// RetryPolicy 任务的超时和重试策略, 零值表示不超时也不重试
+type RetryPolicy struct {
+	Timeout      int    `json:"timeout"`                 // 一次执行的超时秒数, 超时后中断所有主机, 0 不限制
+	HostTimeout  int    `json:"host_timeout"`            // 每台主机每次尝试的超时秒数, 0 不限制
+	RetryCount   int    `json:"retry_count"`             // 失败后重试的次数, 最多 MaxRetryCount
+	RetryBackoff int    `json:"retry_backoff"`           // 第一次重试前等待的秒数, 之后每次翻倍, 最多 MaxRetryBackoff
+	RetryOn      string `gorm:"size:32" json:"retry_on"` // 哪些失败需要重试: all, connect, exit, 为空时同 all
+}
+
+// ShouldRetry 按策略判断第 attempt 次尝试失败之后是否重试, connectErr 表示连接主机失败
+func (p *RetryPolicy) ShouldRetry(attempt int, connectErr bool) bool {
+	if attempt > p.RetryCount || attempt > MaxRetryCount {
+		return false
+	}
+	switch p.RetryOn {
+	case RetryOnConnect:
+		return connectErr
+	case RetryOnExit:
+		return !connectErr
+	default:
+		return true
+	}
+}
+
+// Backoff 第 attempt 次尝试失败之后等待的时间, 不超过 MaxRetryBackoff
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	if p.RetryBackoff <= 0 {
+		return 0
+	}
+	if p.RetryBackoff >= int(MaxRetryBackoff/time.Second) {
+		return MaxRetryBackoff
+	}
+	backoff := time.Duration(p.RetryBackoff) * time.Second
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if backoff >= MaxRetryBackoff {
+			return MaxRetryBackoff
+		}
+	}
+	return backoff
 }
 
 type TaskInstance struct {
@@ -41,6 +159,25 @@ type TaskInstance struct {
 	Status    string    `gorm:"size:64;default: ready" json:"status"`
 	LogPath   string    `gorm:"size:256" json:"log_path"`
 	LogData   string    `gorm:"type:text" json:"log_data"`
+
+	HostResults []TaskInstanceHostResult `gorm:"foreignKey:InstanceId;constraint:OnDelete:CASCADE;" json:"host_results"`
+}
+
+// TaskInstanceHostResult 任务实例在每台主机上的执行结果, 主机的输出在实例日志文件中的位置为 OutputOffset 开始的 OutputSize 字节
+type TaskInstanceHostResult struct {
+	Id           int       `json:"id"`
+	InstanceId   int       `gorm:"index" json:"instance_id"`
+	HostId       int       `gorm:"index" json:"host_id"`
+	HostName     string    `gorm:"size:128" json:"hostname"`
+	Status       string    `gorm:"size:64" json:"status"`
+	ExitCode     int       `json:"exit_code"` // 没有退出码时为 -1
+	Signal       string    `gorm:"size:32" json:"signal"`
+	Error        string    `gorm:"size:512" json:"error"`
+	StartTime    time.Time `json:"start_time"`
+	EndTime      time.Time `json:"end_time"`
+	OutputOffset int64     `json:"output_offset"`
+	OutputSize   int64     `json:"output_size"`
+	Attempt      int       `gorm:"default:1" json:"attempt"` // 第几次尝试, 重试时每次尝试一条记录
 }
 
 func GetAllJob() ([]*Job, error) {
@@ -61,16 +198,17 @@ func GetJobById(id int) (*Job, error) {
 	return &job, nil
 }
 
-func InsertJob(name, t, spec, cmd string, executeID, cmdId int, executeType, cmdType string) (*Job, error) {
+func InsertJob(name, t, spec, cmd string, executeID, cmdId int, executeType, cmdType, overlapPolicy string) (*Job, error) {
 	job := Job{
-		Name:        name,
-		Type:        t,
-		Spec:        spec,
-		Cmd:         cmd,
-		CmdId:       cmdId,
-		ExecuteID:   executeID,
-		ExecuteType: executeType,
-		CmdType:     cmdType,
+		Name:          name,
+		Type:          t,
+		Spec:          spec,
+		Cmd:           cmd,
+		CmdId:         cmdId,
+		ExecuteID:     executeID,
+		ExecuteType:   executeType,
+		CmdType:       cmdType,
+		OverlapPolicy: overlapPolicy,
 	}
 	err := db.Create(&job).Error
 	if err != nil {
@@ -79,7 +217,7 @@ func InsertJob(name, t, spec, cmd string, executeID, cmdId int, executeType, cmd
 	return &job, nil
 }
 
-func UpdateJob(id int, name, t, spec, cmd, cmdType string, cmdId, executeId int, executeType string) (*Job, error) {
+func UpdateJob(id int, name, t, spec, cmd, cmdType string, cmdId, executeId int, executeType, overlapPolicy string) (*Job, error) {
 	job := Job{Id: id}
 	err := db.Where("id = ?", id).First(&job).Error
 	if err != nil {
@@ -109,6 +247,9 @@ func UpdateJob(id int, name, t, spec, cmd, cmdType string, cmdId, executeId int,
 	if executeType != "" {
 		job.ExecuteType = executeType
 	}
+	if overlapPolicy != "" {
+		job.OverlapPolicy = overlapPolicy
+	}
 	err = db.Save(&job).Error
 	if err != nil {
 		return nil, err
@@ -116,6 +257,48 @@ func UpdateJob(id int, name, t, spec, cmd, cmdType string, cmdId, executeId int,
 	return &job, nil
 }
 
+func UpdateJobStrategy(id int, strategy ExecStrategy) (*Job, error) {
+	job := Job{}
+	err := db.Where("id = ?", id).First(&job).Error
+	if err != nil {
+		return nil, err
+	}
+	job.ExecStrategy = strategy
+	err = db.Model(&job).Select("MaxParallel", "BatchSize", "BatchPercent", "BatchPause", "AbortPercent").Updates(&job).Error
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func UpdateJobRetryPolicy(id int, policy RetryPolicy) (*Job, error) {
+	job := Job{}
+	err := db.Where("id = ?", id).First(&job).Error
+	if err != nil {
+		return nil, err
+	}
+	job.RetryPolicy = policy
+	err = db.Model(&job).Select("Timeout", "HostTimeout", "RetryCount", "RetryBackoff", "RetryOn").Updates(&job).Error
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func UpdateJobGuardConfirmation(id int, confirmation GuardConfirmation) (*Job, error) {
+	job := Job{}
+	err := db.Where("id = ?", id).First(&job).Error
+	if err != nil {
+		return nil, err
+	}
+	job.GuardConfirmation = confirmation
+	err = db.Model(&job).Select("ConfirmedDigest", "ConfirmedHostIds").Updates(&job).Error
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
 func UpdateJobStatus(id int, status string) (*Job, error) {
 	db.Lock()
 	defer db.Unlock()
@@ -169,8 +352,22 @@ func (ti *TaskInstance) UpdateStatus(status string) error {
 }
 
 func (ti *TaskInstance) Done() error {
+	return ti.Finish(InstanceStatusDone)
+}
+
+// Finish 记录结束时间并更新为结束状态
+func (ti *TaskInstance) Finish(status string) error {
 	db.Model(&TaskInstance{}).Where("id", ti.Id).Update("end_time", time.Now().Local())
-	return ti.UpdateStatus(InstanceStatusDone)
+	return ti.UpdateStatus(status)
+}
+
+// IsFinished 实例已经执行结束, 被取消, 超时或者被跳过
+func (ti *TaskInstance) IsFinished() bool {
+	switch ti.Status {
+	case InstanceStatusDone, InstanceStatusCancelled, InstanceStatusTimeout, InstanceStatusSkipped:
+		return true
+	}
+	return false
 }
 
 func GetTaskInstanceById(id int) (*TaskInstance, error) {
@@ -182,6 +379,33 @@ func GetTaskInstanceById(id int) (*TaskInstance, error) {
 	return instance, nil
 }
 
+func InsertTaskInstanceHostResult(result *TaskInstanceHostResult) error {
+	return db.Create(result).Error
+}
+
+func GetTaskInstanceHostResultById(id int) (*TaskInstanceHostResult, error) {
+	result := TaskInstanceHostResult{}
+	err := db.Where("id = ?", id).First(&result).Error
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetTaskInstanceHostResults 获取实例每台主机的结果, status 为空时返回所有主机
+func GetTaskInstanceHostResults(instanceId int, status string) ([]*TaskInstanceHostResult, error) {
+	var results []*TaskInstanceHostResult
+	d := db.Where("instance_id = ?", instanceId)
+	if status != "" {
+		d = d.Where("status = ?", status)
+	}
+	err := d.Order("id").Find(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
 func UpdateTaskInstanceLogTrace(instance *TaskInstance, logPath string) error {
 	instance.LogPath = logPath
 	return db.Model(&TaskInstance{}).Where("id", instance.Id).Update("log_path", logPath).Error
@@ -238,8 +462,12 @@ func ClearInstance(sinceBefore time.Time, jobId int) (err error) {
 		if err != nil {
 			return err
 		}
+		db.Where("instance_id IN (?)", db.Model(&TaskInstance{}).Select("id").
+			Where("job_id", jobId).Where("end_time < ?", sinceBefore)).Delete(&TaskInstanceHostResult{})
 		db.Where("job_id", jobId).Where("end_time < ?", sinceBefore).Delete(&TaskInstance{})
 	} else {
+		db.Where("instance_id IN (?)", db.Model(&TaskInstance{}).Select("id").
+			Where("end_time < ?", sinceBefore)).Delete(&TaskInstanceHostResult{})
 		db.Where("end_time < ?", sinceBefore).Delete(&TaskInstance{})
 	}
 
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff int
+		attempt int
+		want    time.Duration
+	}{
+		{"disabled", 0, 3, 0},
+		{"first retry", 2, 1, 2 * time.Second},
+		{"doubles", 2, 3, 8 * time.Second},
+		{"clamped", 2, 20, MaxRetryBackoff},
+		{"no overflow", 1, 200, MaxRetryBackoff},
+		{"large base", 1 << 40, 1, MaxRetryBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &RetryPolicy{RetryBackoff: tt.backoff}
+			if got := p.Backoff(tt.attempt); got != tt.want {
+				t.Errorf("Backoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     RetryPolicy
+		attempt    int
+		connectErr bool
+		want       bool
+	}{
+		{"no retry", RetryPolicy{}, 1, true, false},
+		{"retry all connect", RetryPolicy{RetryCount: 2}, 1, true, true},
+		{"retry all exit", RetryPolicy{RetryCount: 2, RetryOn: RetryOnAll}, 2, false, true},
+		{"exhausted", RetryPolicy{RetryCount: 2}, 3, false, false},
+		{"connect only skips exit", RetryPolicy{RetryCount: 1, RetryOn: RetryOnConnect}, 1, false, false},
+		{"exit only skips connect", RetryPolicy{RetryCount: 1, RetryOn: RetryOnExit}, 1, true, false},
+		{"exit only", RetryPolicy{RetryCount: 1, RetryOn: RetryOnExit}, 1, false, true},
+		{"count is capped", RetryPolicy{RetryCount: 1000}, MaxRetryCount + 1, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.ShouldRetry(tt.attempt, tt.connectErr); got != tt.want {
+				t.Errorf("ShouldRetry(%d, %v) = %v, want %v", tt.attempt, tt.connectErr, got, tt.want)
+			}
+		})
+	}
+}
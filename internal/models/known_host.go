@@ -0,0 +1,101 @@
+package models
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoPendingKey = errors.New("no pending host key to accept")
+)
+
+// KnownHost 主机公钥, 首次连接时记录(trust on first use), 之后公钥变化会拒绝连接
+// 按主机记录, 不同跳板机或者代理后面的主机可能使用相同的地址
+type KnownHost struct {
+	Id          int    `json:"id"`
+	HostId      int    `gorm:"not null;uniqueIndex" json:"host_id"`
+	Addr        string `gorm:"size:255" json:"addr"` // 记录时主机的 host:port
+	KeyType     string `gorm:"size:64" json:"key_type"`
+	PublicKey   string `gorm:"type:text" json:"public_key"` // authorized_keys 格式
+	Fingerprint string `gorm:"size:128" json:"fingerprint"`
+	// 最近一次校验失败时远端提供的公钥, 确认后替换当前公钥
+	PendingKey         string    `gorm:"type:text" json:"pending_key"`
+	PendingFingerprint string    `gorm:"size:128" json:"pending_fingerprint"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+func GetKnownHostByHostId(hostId int) (*KnownHost, error) {
+	knownHost := KnownHost{}
+	err := db.Where("host_id = ?", hostId).First(&knownHost).Error
+	if err != nil {
+		return nil, err
+	}
+	return &knownHost, nil
+}
+
+// InsertOrUpdateKnownHost 记录主机公钥, 已存在时覆盖并清空待确认的公钥
+func InsertOrUpdateKnownHost(hostId int, addr, publicKey, fingerprint string) (*KnownHost, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	knownHost := KnownHost{}
+	err := db.Where("host_id = ?", hostId).Find(&knownHost).Error
+	if err != nil {
+		return nil, err
+	}
+	knownHost.HostId = hostId
+	knownHost.Addr = addr
+	// authorized_keys 格式的第一段为公钥类型
+	if fields := strings.Fields(publicKey); len(fields) > 0 {
+		knownHost.KeyType = fields[0]
+	}
+	knownHost.PublicKey = publicKey
+	knownHost.Fingerprint = fingerprint
+	knownHost.PendingKey = ""
+	knownHost.PendingFingerprint = ""
+
+	err = db.Save(&knownHost).Error
+	if err != nil {
+		return nil, err
+	}
+	return &knownHost, nil
+}
+
+// UpdateKnownHostPending 记录校验失败时远端提供的公钥
+func UpdateKnownHostPending(hostId int, publicKey, fingerprint string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.Model(&KnownHost{}).Where("host_id = ?", hostId).Updates(map[string]interface{}{
+		"pending_key":         publicKey,
+		"pending_fingerprint": fingerprint,
+	}).Error
+}
+
+// AcceptKnownHostPending 使用待确认的公钥替换当前公钥
+func AcceptKnownHostPending(hostId int) (*KnownHost, error) {
+	knownHost, err := GetKnownHostByHostId(hostId)
+	if err != nil {
+		return nil, err
+	}
+	if knownHost.PendingKey == "" {
+		return nil, ErrNoPendingKey
+	}
+	return InsertOrUpdateKnownHost(hostId, knownHost.Addr, knownHost.PendingKey, knownHost.PendingFingerprint)
+}
+
+func DeleteKnownHostByHostId(hostId int) error {
+	return db.Where("host_id = ?", hostId).Delete(&KnownHost{}).Error
+}
+
+// KnownHostAddr 主机的 host:port, 和 ssh 拨号时的地址保持一致
+func KnownHostAddr(addr string, port int) string {
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(addr, strconv.Itoa(port))
+}
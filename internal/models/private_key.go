@@ -1,10 +1,11 @@
 package models
 
 type PrivateKey struct {
-	Id         int    `json:"id"`
-	Name       string `gorm:"size:128;not null" json:"name"`
-	KeyFile    string `gorm:"type:text" json:"-"`
-	Passphrase string `json:"-"`
+	Id          int    `json:"id"`
+	Name        string `gorm:"size:128;not null" json:"name"`
+	KeyFile     string `gorm:"type:text;serializer:secret" json:"-"`
+	Passphrase  string `gorm:"size:512;serializer:secret" json:"-"`
+	Certificate string `gorm:"type:text" json:"certificate"` // 密钥对应的 -cert.pub 证书, 不需要加密
 }
 
 func GetAllPrivateKey() ([]*PrivateKey, error) {
@@ -34,11 +35,12 @@ func GetPrivateKeyByName(name string) (*PrivateKey, error) {
 	return &privateKey, nil
 }
 
-func InsertPrivateKey(name, keyFile, passphrase string) (*PrivateKey, error) {
+func InsertPrivateKey(name, keyFile, passphrase, certificate string) (*PrivateKey, error) {
 	privateKey := PrivateKey{
-		Name:       name,
-		KeyFile:    keyFile,
-		Passphrase: passphrase,
+		Name:        name,
+		KeyFile:     keyFile,
+		Passphrase:  passphrase,
+		Certificate: certificate,
 	}
 	err := db.Create(&privateKey).Error
 	if err != nil {
@@ -47,7 +49,7 @@ func InsertPrivateKey(name, keyFile, passphrase string) (*PrivateKey, error) {
 	return &privateKey, nil
 }
 
-func UpdatePrivateKey(id int, name, keyFile, passphrase string) (*PrivateKey, error) {
+func UpdatePrivateKey(id int, name, keyFile, passphrase, certificate string) (*PrivateKey, error) {
 	privateKey := PrivateKey{Id: id}
 	err := db.Where("id = ?", id).First(&privateKey).Error
 	if err != nil {
@@ -62,6 +64,9 @@ func UpdatePrivateKey(id int, name, keyFile, passphrase string) (*PrivateKey, er
 	if passphrase != "" {
 		privateKey.Passphrase = passphrase
 	}
+	if certificate != "" {
+		privateKey.Certificate = certificate
+	}
 	err = db.Save(&privateKey).Error
 	if err != nil {
 		return nil, err
@@ -82,14 +87,17 @@ func DeletePrivateKeyById(id int) error {
 	return nil
 }
 
+// ExistedPrivateKey 密钥加密保存 无法直接在数据库中比较, 需要解密后比较
 func ExistedPrivateKey(keyFile string) bool {
 	var pKeys []*PrivateKey
-	err := db.Where(&PrivateKey{KeyFile: keyFile}).Find(&pKeys).Error
+	err := db.Find(&pKeys).Error
 	if err != nil {
 		return false
 	}
-	if len(pKeys) == 0 {
-		return false
+	for _, pKey := range pKeys {
+		if pKey.KeyFile == keyFile {
+			return true
+		}
 	}
-	return true
+	return false
 }
@@ -0,0 +1,186 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/ssbeatty/oms/internal/config"
+	"gorm.io/gorm"
+	"os"
+	"path"
+	"time"
+)
+
+// SessionRecording web终端的录像, 文件为 asciicast v2 格式
+type SessionRecording struct {
+	Id        int       `json:"id"`
+	Uid       string    `gorm:"size:64" json:"uid"`
+	HostId    int       `gorm:"index" json:"host_id"`
+	HostName  string    `gorm:"size:128" json:"host_name"` // 主机删除后仍然可以看到主机名
+	Addr      string    `gorm:"size:255" json:"addr"`
+	UserId    int       `gorm:"index" json:"user_id"`
+	Username  string    `gorm:"size:128" json:"username"`
+	ClientIP  string    `gorm:"size:64" json:"client_ip"`
+	Cols      int       `json:"cols"`
+	Rows      int       `json:"rows"`
+	WithInput bool      `json:"with_input"`
+	FilePath  string    `gorm:"size:512" json:"-"`
+	Size      int64     `json:"size"`
+	Duration  float64   `json:"duration"` // 秒
+	StartTime time.Time `gorm:"index" json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+// SessionRecordingFilter 查询录像的条件, 为空的条件不生效
+type SessionRecordingFilter struct {
+	HostId    int
+	UserId    int
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+func (f *SessionRecordingFilter) query() *gorm.DB {
+	d := db.Model(&SessionRecording{})
+	if f.HostId != 0 {
+		d = d.Where("host_id = ?", f.HostId)
+	}
+	if f.UserId != 0 {
+		d = d.Where("user_id = ?", f.UserId)
+	}
+	if !f.StartTime.IsZero() {
+		d = d.Where("start_time >= ?", f.StartTime)
+	}
+	if !f.EndTime.IsZero() {
+		d = d.Where("start_time <= ?", f.EndTime)
+	}
+	return d
+}
+
+// RecordingFilePath 录像文件按天保存在 data_path/recordings 下
+func RecordingFilePath(start time.Time, uid string) string {
+	return path.Join(dataPath, config.RecordingPath, start.Format("20060102"), fmt.Sprintf("%s.cast", uid))
+}
+
+func InsertSessionRecording(host *Host, user *User, clientIP string, cols, rows int, withInput bool) (*SessionRecording, error) {
+	record := SessionRecording{
+		Uid:       uuid.NewString(),
+		HostId:    host.Id,
+		HostName:  host.Name,
+		Addr:      host.Addr,
+		ClientIP:  clientIP,
+		Cols:      cols,
+		Rows:      rows,
+		WithInput: withInput,
+		StartTime: time.Now(),
+	}
+	if user != nil {
+		record.UserId = user.Id
+		record.Username = user.Username
+	}
+	record.FilePath = RecordingFilePath(record.StartTime, record.Uid)
+
+	db.Lock()
+	defer db.Unlock()
+
+	err := db.Create(&record).Error
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// UpdateSessionRecordingDone 录像结束后记录大小和时长
+func UpdateSessionRecordingDone(id int, size int64, duration time.Duration) error {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.Model(&SessionRecording{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"size":     size,
+		"duration": duration.Seconds(),
+		"end_time": time.Now(),
+	}).Error
+}
+
+func GetSessionRecordingById(id int) (*SessionRecording, error) {
+	record := SessionRecording{}
+	err := db.Where("id = ?", id).First(&record).Error
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func GetSessionRecordings(filter *SessionRecordingFilter, pageSize, page int) ([]*SessionRecording, int64, error) {
+	var (
+		total   int64
+		records []*SessionRecording
+	)
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	if page <= 0 {
+		page = 1
+	}
+
+	if err := filter.query().Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := filter.query().Order(defaultSort).Offset((page - 1) * pageSize).Limit(pageSize).Find(&records).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return records, total, nil
+}
+
+// SearchSessionRecordings 按条件获取最近的录像, 用于全文搜索
+func SearchSessionRecordings(filter *SessionRecordingFilter, limit int) ([]*SessionRecording, error) {
+	var records []*SessionRecording
+	err := filter.query().Order(defaultSort).Limit(limit).Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// DeleteSessionRecordingById 删除录像和录像文件
+func DeleteSessionRecordingById(id int) error {
+	record, err := GetSessionRecordingById(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(record.FilePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	return db.Delete(&SessionRecording{Id: id}).Error
+}
+
+// ClearSessionRecordings 删除 sinceBefore 之前开始的录像
+func ClearSessionRecordings(sinceBefore time.Time) (int, error) {
+	if sinceBefore.IsZero() {
+		return 0, errors.New("must have a sinceBefore")
+	}
+	var records []*SessionRecording
+	err := db.Where("start_time < ?", sinceBefore).Find(&records).Error
+	if err != nil {
+		return 0, err
+	}
+	for _, record := range records {
+		if err := DeleteSessionRecordingById(record.Id); err != nil {
+			log.Errorf("delete session recording %d error: %v", record.Id, err)
+		}
+	}
+
+	// 删除空的日期目录
+	recordingPath := path.Join(dataPath, config.RecordingPath)
+	dirs, _ := os.ReadDir(recordingPath)
+	for _, dir := range dirs {
+		if parse, err := time.Parse("20060102", dir.Name()); err == nil && parse.Before(sinceBefore) {
+			_ = os.Remove(path.Join(recordingPath, dir.Name()))
+		}
+	}
+	return len(records), nil
+}
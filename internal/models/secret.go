@@ -0,0 +1,212 @@
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/ssbeatty/oms/pkg/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	secretSerializerName = "secret"
+	// secretPrefix 加密后的字段前缀, 没有前缀的视为旧版本的明文数据
+	secretPrefix  = "enc:v1:"
+	dataKeyLength = 32
+)
+
+var (
+	// dataKey 数据密钥, 启动时使用主密钥解密
+	dataKey []byte
+
+	ErrSecretNotInit = errors.New("secret key is not initialized")
+	ErrMasterKey     = errors.New("master key can not decrypt the data key")
+)
+
+func init() {
+	schema.RegisterSerializer(secretSerializerName, SecretSerializer{})
+}
+
+// SecretKey 数据密钥 使用主密钥加密后保存, 轮换主密钥时只需要重新加密数据密钥
+type SecretKey struct {
+	Id         int       `json:"id"`
+	WrappedKey string    `gorm:"type:text;not null" json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// SecretSerializer 敏感字段的序列化, 写入时加密 读取时解密
+type SecretSerializer struct{}
+
+func (SecretSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var raw string
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		raw = string(v)
+	case string:
+		raw = v
+	default:
+		return fmt.Errorf("invalid secret value: %#v", dbValue)
+	}
+	plain, err := decryptSecret(raw)
+	if err != nil {
+		return err
+	}
+	return field.Set(ctx, dst, plain)
+}
+
+func (SecretSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plain, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid secret field type %#v, only string supported", fieldValue)
+	}
+	return encryptSecret(plain)
+}
+
+func encryptSecret(plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	if dataKey == nil {
+		return "", ErrSecretNotInit
+	}
+	data, err := utils.AesGcmEncrypt(dataKey, []byte(plain))
+	if err != nil {
+		return "", err
+	}
+	return secretPrefix + base64.StdEncoding.EncodeToString(data), nil
+}
+
+func decryptSecret(raw string) (string, error) {
+	if !strings.HasPrefix(raw, secretPrefix) {
+		return raw, nil
+	}
+	if dataKey == nil {
+		return "", ErrSecretNotInit
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(raw, secretPrefix))
+	if err != nil {
+		return "", err
+	}
+	plain, err := utils.AesGcmDecrypt(dataKey, data)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// InitSecret 使用主密钥加载数据密钥, 首次启动时生成数据密钥, 并加密数据库中已有的明文数据
+func InitSecret(masterKey string) error {
+	secretKey := SecretKey{}
+	err := db.First(&secretKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		key, err := utils.RandomBytes(dataKeyLength)
+		if err != nil {
+			return err
+		}
+		wrapped, err := utils.AesGcmEncrypt(utils.DeriveKey(masterKey), key)
+		if err != nil {
+			return err
+		}
+		secretKey.WrappedKey = base64.StdEncoding.EncodeToString(wrapped)
+		if err := db.Create(&secretKey).Error; err != nil {
+			return err
+		}
+		dataKey = key
+	} else if err != nil {
+		return err
+	} else {
+		key, err := unwrapDataKey(&secretKey, masterKey)
+		if err != nil {
+			return err
+		}
+		dataKey = key
+	}
+
+	return encryptExistedSecrets()
+}
+
+func unwrapDataKey(secretKey *SecretKey, masterKey string) ([]byte, error) {
+	wrapped, err := base64.StdEncoding.DecodeString(secretKey.WrappedKey)
+	if err != nil {
+		return nil, ErrMasterKey
+	}
+	key, err := utils.AesGcmDecrypt(utils.DeriveKey(masterKey), wrapped)
+	if err != nil {
+		return nil, ErrMasterKey
+	}
+	return key, nil
+}
+
+// RotateMasterKey 使用新的主密钥重新加密数据密钥, 业务数据不需要重新加密
+func RotateMasterKey(oldMasterKey, newMasterKey string) error {
+	secretKey := SecretKey{}
+	if err := db.First(&secretKey).Error; err != nil {
+		return err
+	}
+	key, err := unwrapDataKey(&secretKey, oldMasterKey)
+	if err != nil {
+		return err
+	}
+	wrapped, err := utils.AesGcmEncrypt(utils.DeriveKey(newMasterKey), key)
+	if err != nil {
+		return err
+	}
+	secretKey.WrappedKey = base64.StdEncoding.EncodeToString(wrapped)
+	return db.Save(&secretKey).Error
+}
+
+// encryptExistedSecrets 将旧版本保存的明文数据加密, 已加密的数据跳过
+func encryptExistedSecrets() error {
+	columns := []struct {
+		model  interface{}
+		column string
+	}{
+		{&Host{}, "pass_word"},
+		{&PrivateKey{}, "key_file"},
+		{&PrivateKey{}, "passphrase"},
+	}
+
+	for _, c := range columns {
+		stmt := &gorm.Statement{DB: db.DB}
+		if err := stmt.Parse(c.model); err != nil {
+			return err
+		}
+		table := stmt.Schema.Table
+
+		var rows []struct {
+			Id    int
+			Value string
+		}
+		err := db.Table(table).Select(fmt.Sprintf("id, %s AS value", c.column)).Scan(&rows).Error
+		if err != nil {
+			return err
+		}
+		var total int
+		for _, row := range rows {
+			if row.Value == "" || strings.HasPrefix(row.Value, secretPrefix) {
+				continue
+			}
+			enc, err := encryptSecret(row.Value)
+			if err != nil {
+				return err
+			}
+			err = db.Table(table).Where("id = ?", row.Id).UpdateColumn(c.column, enc).Error
+			if err != nil {
+				return err
+			}
+			total++
+		}
+		if total > 0 {
+			log.Infof("encrypt existed secrets, table: %s, column: %s, total: %d", table, c.column, total)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"errors"
+	"github.com/ssbeatty/oms/pkg/utils"
+	"strings"
+	"testing"
+)
+
+func initSecretDB(t *testing.T) {
+	t.Helper()
+	dataKey = nil
+	t.Cleanup(func() { dataKey = nil })
+	if err := InitModels("", "", "", "", DBDriverSqlite, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+}
+
+// rawColumn 读取数据库中保存的原始值, 不经过 SecretSerializer
+func rawColumn(t *testing.T, id int, column string) string {
+	t.Helper()
+	var value string
+	err := db.Table("private_keys").Select(column).Where("id = ?", id).Row().Scan(&value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestSecretRoundTrip(t *testing.T) {
+	initSecretDB(t)
+	if _, err := encryptSecret("password"); !errors.Is(err, ErrSecretNotInit) {
+		t.Fatalf("encrypt before init err = %v, want %v", err, ErrSecretNotInit)
+	}
+	if err := InitSecret("master"); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := InsertPrivateKey("test", "key file", "passphrase", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := rawColumn(t, key.Id, "key_file")
+	if !strings.HasPrefix(raw, secretPrefix) || strings.Contains(raw, "key file") {
+		t.Fatalf("key_file is saved as %q, want encrypted", raw)
+	}
+
+	got, err := GetPrivateKeyById(key.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.KeyFile != "key file" || got.Passphrase != "passphrase" {
+		t.Errorf("got key_file %q passphrase %q", got.KeyFile, got.Passphrase)
+	}
+}
+
+func TestSecretPlaintextPassthrough(t *testing.T) {
+	initSecretDB(t)
+	if err := InitSecret("master"); err != nil {
+		t.Fatal(err)
+	}
+	// 旧版本的明文数据没有前缀, 读取时原样返回
+	for _, raw := range []string{"", "password", "enc:v2:password"} {
+		got, err := decryptSecret(raw)
+		if err != nil || got != raw {
+			t.Errorf("decryptSecret(%q) = %q, %v", raw, got, err)
+		}
+	}
+	if got, err := encryptSecret(""); err != nil || got != "" {
+		t.Errorf("encryptSecret(\"\") = %q, %v", got, err)
+	}
+}
+
+func TestSecretTampered(t *testing.T) {
+	initSecretDB(t)
+	if err := InitSecret("master"); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := encryptSecret("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := []byte(enc)
+	i := len(secretPrefix) + 20
+	if tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+	if _, err := decryptSecret(string(tampered)); !errors.Is(err, utils.ErrCipherText) {
+		t.Errorf("tampered err = %v, want %v", err, utils.ErrCipherText)
+	}
+	if _, err := decryptSecret(secretPrefix + "not base64!"); err == nil {
+		t.Error("invalid base64 is decrypted")
+	}
+}
+
+func TestInitSecretEncryptsExisted(t *testing.T) {
+	initSecretDB(t)
+	err := db.Exec("INSERT INTO private_keys (name, key_file, passphrase) VALUES (?, ?, ?)", "old", "key file", "").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := InitSecret("master"); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := GetPrivateKeyByName("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw := rawColumn(t, key.Id, "key_file"); !strings.HasPrefix(raw, secretPrefix) {
+		t.Errorf("existed key_file is saved as %q, want encrypted", raw)
+	}
+	if raw := rawColumn(t, key.Id, "passphrase"); raw != "" {
+		t.Errorf("empty passphrase is saved as %q", raw)
+	}
+	if key.KeyFile != "key file" {
+		t.Errorf("got key_file %q", key.KeyFile)
+	}
+}
+
+func TestInitSecretWrongMasterKey(t *testing.T) {
+	initSecretDB(t)
+	if err := InitSecret("master"); err != nil {
+		t.Fatal(err)
+	}
+	dataKey = nil
+	if err := InitSecret("other"); !errors.Is(err, ErrMasterKey) {
+		t.Errorf("InitSecret() err = %v, want %v", err, ErrMasterKey)
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	initSecretDB(t)
+	if err := InitSecret("master"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := InsertPrivateKey("test", "key file", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := rawColumn(t, key.Id, "key_file")
+
+	if err := RotateMasterKey("other", "new"); !errors.Is(err, ErrMasterKey) {
+		t.Fatalf("rotate with wrong key err = %v, want %v", err, ErrMasterKey)
+	}
+	if err := RotateMasterKey("master", "new"); err != nil {
+		t.Fatal(err)
+	}
+	// 只重新加密数据密钥, 业务数据不变
+	if got := rawColumn(t, key.Id, "key_file"); got != raw {
+		t.Errorf("key_file is re-encrypted after rotation")
+	}
+
+	dataKey = nil
+	if err := InitSecret("master"); !errors.Is(err, ErrMasterKey) {
+		t.Errorf("old master key err = %v, want %v", err, ErrMasterKey)
+	}
+	if err := InitSecret("new"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetPrivateKeyById(key.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.KeyFile != "key file" {
+		t.Errorf("got key_file %q after rotation", got.KeyFile)
+	}
+}
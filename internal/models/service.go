@@ -154,7 +154,8 @@ func InitModels(dsn, dbName, user, pass, driver, _dataPath string) error {
 
 	if err = db.AutoMigrate(
 		new(Tag), new(Group), new(Host), new(Tunnel), new(Job), new(PrivateKey), new(TaskInstance), new(PlayBook),
-		new(CommandHistory), new(QuicklyCommand),
+		new(CommandHistory), new(QuicklyCommand), new(User), new(UserSession), new(UserGrant), new(ApiToken), new(SecretKey), new(KnownHost),
+		new(CertAuthority), new(AuditEvent), new(SessionRecording), new(CommandRule), new(TaskInstanceHostResult),
 	); err != nil {
 		log.Errorf("Migrate error! err: %v", err)
 		return err
@@ -0,0 +1,220 @@
+package models
+
+import (
+	"errors"
+	"github.com/ssbeatty/oms/pkg/utils"
+	"time"
+)
+
+const (
+	sessionTokenSize = 32
+)
+
+var (
+	ErrUserPassword = errors.New("username or password error")
+	ErrUserDisabled = errors.New("user is disabled")
+)
+
+type User struct {
+	Id        int         `json:"id"`
+	Username  string      `gorm:"size:128;not null;unique" json:"username"`
+	Password  string      `gorm:"size:256;not null" json:"-"`
+	Role      string      `gorm:"size:32;default:admin" json:"role"`
+	Disabled  bool        `gorm:"default:false" json:"disabled"`
+	Grants    []UserGrant `gorm:"constraint:OnDelete:CASCADE;" json:"grants"`
+	LastLogin time.Time   `json:"last_login"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// UserSession 登录会话 只保存token的摘要
+type UserSession struct {
+	Id        int       `json:"id"`
+	UserId    int       `gorm:"index" json:"user_id"`
+	User      User      `gorm:"constraint:OnDelete:CASCADE;" json:"-"`
+	Token     string    `gorm:"size:128;not null;unique" json:"-"`
+	ClientIP  string    `gorm:"size:64" json:"client_ip"`
+	ExpireAt  time.Time `gorm:"index" json:"expire_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func GetAllUser() ([]*User, error) {
+	var users []*User
+	err := db.Preload("Grants").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func GetUserById(id int) (*User, error) {
+	user := User{}
+	err := db.Preload("Grants").Where("id = ?", id).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func GetUserByName(username string) (*User, error) {
+	user := User{}
+	err := db.Where("username = ?", username).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func ExistedUser(username string) bool {
+	var users []*User
+	err := db.Where("username = ?", username).Find(&users).Error
+	if err != nil {
+		return false
+	}
+	if len(users) == 0 {
+		return false
+	}
+	return true
+}
+
+func InsertUser(username, password, role string) (*User, error) {
+	hashed, err := utils.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	user := User{
+		Username: username,
+		Password: hashed,
+		Role:     role,
+	}
+	err = db.Create(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UpdateUser 空字段保持不变, disabled 为 nil 时不修改禁用状态
+func UpdateUser(id int, username, password, role string, disabled *bool) (*User, error) {
+	user := User{Id: id}
+	err := db.Where("id = ?", id).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	if username != "" {
+		user.Username = username
+	}
+	if password != "" {
+		user.Password, err = utils.HashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		// 修改密码后之前的会话全部失效
+		db.Where("user_id = ?", id).Delete(&UserSession{})
+	}
+	if role != "" {
+		user.Role = role
+	}
+	if disabled != nil && user.Disabled != *disabled {
+		user.Disabled = *disabled
+		if user.Disabled {
+			db.Where("user_id = ?", id).Delete(&UserSession{})
+		}
+	}
+	err = db.Save(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func DeleteUserById(id int) error {
+	user := User{}
+	err := db.Where("id = ?", id).First(&user).Error
+	if err != nil {
+		return err
+	}
+	db.Where("user_id = ?", id).Delete(&UserSession{})
+	db.Where("user_id = ?", id).Delete(&UserGrant{})
+	db.Where("user_id = ?", id).Delete(&ApiToken{})
+	err = db.Delete(&user).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// AuthUser 校验用户名密码
+func AuthUser(username, password string) (*User, error) {
+	user, err := GetUserByName(username)
+	if err != nil {
+		return nil, ErrUserPassword
+	}
+	if !utils.CheckPassword(password, user.Password) {
+		return nil, ErrUserPassword
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	return user, nil
+}
+
+// InitAdminUser 数据库中没有任何用户时创建管理员, 返回是否创建
+func InitAdminUser(username, password string) (bool, error) {
+	var total int64
+	if err := db.Model(&User{}).Count(&total).Error; err != nil {
+		return false, err
+	}
+	if total > 0 {
+		return false, nil
+	}
+	if _, err := InsertUser(username, password, RoleAdmin); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// InsertUserSession 为用户创建新的会话, 返回明文token
+func InsertUserSession(user *User, clientIP string, expire time.Duration) (string, *UserSession, error) {
+	token, err := utils.RandomToken(sessionTokenSize)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now().Local()
+	session := UserSession{
+		UserId:   user.Id,
+		Token:    utils.HashSha256(token),
+		ClientIP: clientIP,
+		ExpireAt: now.Add(expire),
+	}
+	err = db.Create(&session).Error
+	if err != nil {
+		return "", nil, err
+	}
+	db.Model(&User{}).Where("id = ?", user.Id).Update("last_login", now)
+
+	return token, &session, nil
+}
+
+// GetUserBySessionToken 通过明文token获取有效会话的用户
+func GetUserBySessionToken(token string) (*User, error) {
+	session := UserSession{}
+	err := db.Preload("User").
+		Where("token = ? AND expire_at > ?", utils.HashSha256(token), time.Now().Local()).
+		First(&session).Error
+	if err != nil {
+		return nil, err
+	}
+	if session.User.Disabled {
+		return nil, ErrUserDisabled
+	}
+	return &session.User, nil
+}
+
+func DeleteUserSession(token string) error {
+	return db.Where("token = ?", utils.HashSha256(token)).Delete(&UserSession{}).Error
+}
+
+// ClearExpiredSession 删除过期的会话
+func ClearExpiredSession() error {
+	return db.Where("expire_at < ?", time.Now().Local()).Delete(&UserSession{}).Error
+}
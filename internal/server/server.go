@@ -33,5 +33,5 @@ func NewServer(cfg *config.Conf) *Server {
 }
 
 func (s *Server) Run() {
-	web.Serve(s.cfg.App, s.sshManager, s.taskManager, s.tunnelManager)
+	web.Serve(s.cfg, s.sshManager, s.taskManager, s.tunnelManager)
 }
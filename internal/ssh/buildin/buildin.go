@@ -47,6 +47,11 @@ func (bs *RunCmdStep) Exec(session *transport.Session, sudo bool) ([]byte, error
 	return session.Output(bs.cfg.Cmd)
 }
 
+// Command 执行的命令
+func (bs *RunCmdStep) Command() string {
+	return bs.cfg.Cmd
+}
+
 func (bs *RunCmdStep) Create(conf []byte) (types.Step, error) {
 	cfg := &runCmdStepConfig{}
 
@@ -93,6 +98,11 @@ func (bs *RunShellStep) Exec(session *transport.Session, sudo bool) ([]byte, err
 	return session.RunScript(bs.cfg.Shell, sudo, tmpPath)
 }
 
+// Command 执行的脚本
+func (bs *RunShellStep) Command() string {
+	return bs.cfg.Shell
+}
+
 func (bs *RunShellStep) Create(conf []byte) (types.Step, error) {
 	cfg := &runShellStepConfig{}
 
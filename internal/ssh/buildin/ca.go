@@ -0,0 +1,115 @@
+package buildin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/pkg/transport"
+	"github.com/ssbeatty/oms/pkg/types"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	StepNameTrustCA = "trust_ca"
+
+	DefaultTrustCAPath = "/etc/ssh/oms_user_ca.pub"
+)
+
+// trustCAScript 写入CA公钥, 在 sshd_config 开头添加 TrustedUserCAKeys, 校验配置后重新加载 sshd
+const trustCAScript = `#!/bin/sh
+set -e
+CA_PATH='%s'
+CONFIG=/etc/ssh/sshd_config
+
+mkdir -p "$(dirname "$CA_PATH")"
+echo '%s' > "$CA_PATH"
+chmod 644 "$CA_PATH"
+
+if grep -qE "^[[:space:]]*TrustedUserCAKeys[[:space:]]+$CA_PATH[[:space:]]*$" "$CONFIG"; then
+  echo "TrustedUserCAKeys already configured"
+elif grep -qiE "^[[:space:]]*TrustedUserCAKeys[[:space:]]" "$CONFIG"; then
+  echo "another TrustedUserCAKeys is configured in $CONFIG, please merge $CA_PATH manually" >&2
+  exit 1
+else
+  cp "$CONFIG" "$CONFIG.oms.bak"
+  { echo "TrustedUserCAKeys $CA_PATH"; cat "$CONFIG.oms.bak"; } > "$CONFIG"
+  echo "add TrustedUserCAKeys $CA_PATH to $CONFIG"
+fi
+
+SSHD=$(command -v sshd || echo /usr/sbin/sshd)
+if ! "$SSHD" -t; then
+  cp "$CONFIG.oms.bak" "$CONFIG"
+  echo "sshd config test failed, restore $CONFIG" >&2
+  exit 1
+fi
+
+if command -v systemctl >/dev/null 2>&1; then
+  systemctl reload sshd 2>/dev/null || systemctl reload ssh
+elif command -v service >/dev/null 2>&1; then
+  service sshd reload 2>/dev/null || service ssh reload
+else
+  kill -HUP "$(cat /var/run/sshd.pid)"
+fi
+echo "sshd reloaded"
+`
+
+// TrustCAStep 让主机信任内置CA签发的用户证书
+type TrustCAStep struct {
+	types.BaseStep
+	cfg *trustCAStepConfig
+}
+
+type trustCAStepConfig struct {
+	Path string `json:"path" jsonschema:"default=/etc/ssh/oms_user_ca.pub" jsonschema_description:"CA公钥在远端保存的路径"`
+}
+
+func (bs *TrustCAStep) Exec(session *transport.Session, sudo bool) ([]byte, error) {
+	ca, err := models.GetCertAuthority()
+	if err != nil {
+		return nil, errors.Wrap(err, "get cert authority error")
+	}
+
+	path := bs.cfg.Path
+	if path == "" {
+		path = DefaultTrustCAPath
+	}
+	if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, "'\"$` \t\r\n") {
+		return nil, fmt.Errorf("invalid ca path: %s", path)
+	}
+
+	tmpPath := filepath.ToSlash(filepath.Join(ShellTmpPath, uuid.NewString()))
+
+	return session.RunScript(fmt.Sprintf(trustCAScript, path, ca.PublicKey), sudo, tmpPath)
+}
+
+func (bs *TrustCAStep) Create(conf []byte) (types.Step, error) {
+	cfg := &trustCAStepConfig{}
+
+	err := json.Unmarshal(conf, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &TrustCAStep{
+		cfg: cfg,
+	}, nil
+}
+
+func (bs *TrustCAStep) Config() interface{} {
+	return bs.cfg
+}
+
+func (bs *TrustCAStep) Name() string {
+	return StepNameTrustCA
+}
+
+func (bs *TrustCAStep) Desc() string {
+	return "信任内置CA签发的用户证书"
+}
+
+func (bs *TrustCAStep) GetSchema() (interface{}, error) {
+
+	return types.GetSchema(bs.cfg)
+}
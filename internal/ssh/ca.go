@@ -0,0 +1,119 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/ssbeatty/oms/internal/models"
+	gossh "golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+const (
+	// SystemCertUser 任务、隧道等后台连接签发证书时使用的身份
+	SystemCertUser = "oms"
+	// certClockSkew 证书生效时间提前, 避免主机时间不一致导致证书未生效
+	certClockSkew = time.Minute
+)
+
+var (
+	ErrCertAuthorityNotInit = errors.New("cert authority is not initialized")
+
+	// certExtensions 和 ssh-keygen 签发用户证书的默认权限一致
+	certExtensions = map[string]string{
+		"permit-X11-forwarding":   "",
+		"permit-agent-forwarding": "",
+		"permit-port-forwarding":  "",
+		"permit-pty":              "",
+		"permit-user-rc":          "",
+	}
+)
+
+// initCertAuthority 加载内置CA, 首次启动时生成 ed25519 的CA密钥
+func (m *Manager) initCertAuthority() error {
+	ca, err := models.GetCertAuthority()
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ca, err = generateCertAuthority()
+		if err != nil {
+			return err
+		}
+		m.logger.Infof("generate cert authority, fingerprint: %s", ca.Fingerprint)
+	} else if err != nil {
+		return err
+	}
+
+	signer, err := gossh.ParsePrivateKey([]byte(ca.PrivateKey))
+	if err != nil {
+		return err
+	}
+	m.caSigner = signer
+	return nil
+}
+
+func generateCertAuthority() (*models.CertAuthority, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := gossh.MarshalPrivateKey(priv, "oms cert authority")
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return models.InsertCertAuthority(
+		string(pem.EncodeToMemory(block)),
+		strings.TrimSpace(string(gossh.MarshalAuthorizedKey(sshPub))),
+		gossh.FingerprintSHA256(sshPub),
+	)
+}
+
+// SignCertificate 为连接生成临时密钥并签发证书, 证书的 KeyId 记录oms用户, principal 为主机的登录用户
+func (m *Manager) SignCertificate(host *models.Host, owner string) (gossh.Signer, error) {
+	if m.caSigner == nil {
+		return nil, ErrCertAuthorityNotInit
+	}
+	if owner == "" {
+		owner = SystemCertUser
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cert := &gossh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        gossh.UserCert,
+		KeyId:           fmt.Sprintf("oms:%s", owner),
+		ValidPrincipals: []string{host.User},
+		ValidAfter:      uint64(now.Add(-certClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(m.cfg.SSH.CertTTL).Unix()),
+		Permissions: gossh.Permissions{
+			Extensions: certExtensions,
+		},
+	}
+	if err := cert.SignCert(rand.Reader, m.caSigner); err != nil {
+		return nil, err
+	}
+	m.logger.Debugf("sign certificate for %s@%s, key id: %s, serial: %d", host.User, host.Addr, cert.KeyId, cert.Serial)
+
+	return gossh.NewCertSigner(cert, signer)
+}
@@ -0,0 +1,358 @@
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/pkg/logger"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuditActionCommandGuard = "command.guard"
+
+	GuardSourceWsCmd    = "ws.cmd"
+	GuardSourceToolsCmd = "tools.cmd"
+	GuardSourceJob      = "job"
+
+	// confirmTokenTTL 二次确认 token 的有效期, 只能使用一次
+	confirmTokenTTL = 5 * time.Minute
+)
+
+// GuardRequest 需要校验的批量命令
+type GuardRequest struct {
+	Source       string // 命令来源, 例如 ws.cmd, tools.cmd, job
+	User         *models.User
+	Actor        string // 没有用户时审计记录的操作者, 例如定时任务
+	ClientIP     string
+	Cmd          string
+	Cmds         []string // 剧本每一步的命令, 和 Cmd 分别匹配, 任意一条命中规则即命中
+	Hosts        []*models.Host
+	ConfirmToken string
+	// Unattended 定时任务等无人值守的执行, 没有人能确认, 命中 confirm 规则的命令和主机不在 Confirmed 范围内时按 deny 处理
+	Unattended bool
+	Confirmed  *models.GuardConfirmation // 保存任务时确认过的命令和主机
+}
+
+// GuardHit 匹配到规则的主机
+type GuardHit struct {
+	Rule  *models.CommandRule
+	Hosts []*models.Host
+}
+
+// CommandDeniedError 命令被 deny 规则拒绝
+type CommandDeniedError struct {
+	Hits []*GuardHit
+}
+
+func (e *CommandDeniedError) Error() string {
+	return fmt.Sprintf("command denied by %s", describeHits(e.Hits))
+}
+
+// CommandConfirmError 命令需要二次确认, 携带 Token 重新提交后执行
+type CommandConfirmError struct {
+	Hits      []*GuardHit
+	Token     string
+	ExpiresAt time.Time
+}
+
+func (e *CommandConfirmError) Error() string {
+	return fmt.Sprintf("command requires confirmation by %s, resend with confirm_token in %s",
+		describeHits(e.Hits), confirmTokenTTL)
+}
+
+type pendingConfirm struct {
+	key       string
+	expiresAt time.Time
+}
+
+// CommandGuard 批量执行前按照危险命令规则校验命令
+type CommandGuard struct {
+	mu      sync.Mutex
+	pending map[string]*pendingConfirm // 二次确认 token
+	logger  *logger.Logger
+}
+
+func NewCommandGuard() *CommandGuard {
+	return &CommandGuard{
+		pending: make(map[string]*pendingConfirm),
+		logger:  logger.NewLogger("commandGuard"),
+	}
+}
+
+// Check 校验命令, 有主机匹配 deny 规则时返回 *CommandDeniedError,
+// 匹配 confirm 规则且没有有效的确认 token 时返回 *CommandConfirmError, 所有命中都会记录审计日志
+func (g *CommandGuard) Check(req *GuardRequest) error {
+	hits, err := g.match(req.commands(), req.Hosts)
+	if err != nil {
+		return err
+	}
+	if len(hits) == 0 {
+		return nil
+	}
+
+	var denied, confirm []*GuardHit
+	for _, hit := range hits {
+		switch hit.Rule.Action {
+		case models.CommandRuleDeny:
+			denied = append(denied, hit)
+		case models.CommandRuleConfirm:
+			confirm = append(confirm, hit)
+		}
+	}
+
+	if req.Unattended {
+		denied = append(denied, req.unconfirmed(confirm)...)
+		confirm = nil
+	}
+
+	switch {
+	case len(denied) > 0:
+		err = &CommandDeniedError{Hits: denied}
+	case len(confirm) > 0:
+		key := confirmKey(req)
+		if req.ConfirmToken != "" && g.consume(req.ConfirmToken, key) {
+			break
+		}
+		token, expiresAt := g.issue(key)
+		err = &CommandConfirmError{Hits: confirm, Token: token, ExpiresAt: expiresAt}
+	}
+
+	g.record(req, hits, err)
+	return err
+}
+
+// Confirmation 命中 confirm 规则的命令和主机, 保存任务时在确认之后记录
+func (g *CommandGuard) Confirmation(req *GuardRequest) (models.GuardConfirmation, error) {
+	hits, err := g.match(req.commands(), req.Hosts)
+	if err != nil {
+		return models.GuardConfirmation{}, err
+	}
+	var hosts []*models.Host
+	for _, hit := range hits {
+		if hit.Rule.Action == models.CommandRuleConfirm {
+			hosts = append(hosts, hit.Hosts...)
+		}
+	}
+	return models.NewGuardConfirmation(commandDigest(req.commands()), hosts), nil
+}
+
+// unconfirmed 不在 Confirmed 范围内的 confirm 规则命中, 保存任务之后修改了剧本或者分组加入了新主机时需要重新确认
+func (req *GuardRequest) unconfirmed(hits []*GuardHit) []*GuardHit {
+	digest := commandDigest(req.commands())
+
+	var result []*GuardHit
+	for _, hit := range hits {
+		unconfirmed := &GuardHit{Rule: hit.Rule}
+		for _, host := range hit.Hosts {
+			if req.Confirmed == nil || !req.Confirmed.Covers(digest, host.Id) {
+				unconfirmed.Hosts = append(unconfirmed.Hosts, host)
+			}
+		}
+		if len(unconfirmed.Hosts) > 0 {
+			result = append(result, unconfirmed)
+		}
+	}
+	return result
+}
+
+// commands 需要匹配的所有命令
+func (req *GuardRequest) commands() []string {
+	cmds := make([]string, 0, len(req.Cmds)+1)
+	for _, cmd := range append([]string{req.Cmd}, req.Cmds...) {
+		if cmd != "" {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+// match 按顺序匹配规则, 每台主机使用第一条匹配的规则
+func (g *CommandGuard) match(cmds []string, hosts []*models.Host) ([]*GuardHit, error) {
+	rules, err := models.GetEnabledCommandRules()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		hits    []*GuardHit
+		matched = make(map[int]struct{})
+	)
+	for _, rule := range rules {
+		if len(matched) == len(hosts) {
+			break
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			g.logger.Errorf("compile command rule: %d pattern error: %v", rule.Id, err)
+			continue
+		}
+		if !matchAny(re, cmds) {
+			continue
+		}
+		targets, err := ruleTargets(rule)
+		if err != nil {
+			g.logger.Errorf("parse command rule: %d targets error: %v", rule.Id, err)
+			continue
+		}
+
+		hit := &GuardHit{Rule: rule}
+		for _, host := range hosts {
+			if _, ok := matched[host.Id]; ok {
+				continue
+			}
+			if _, ok := targets[host.Id]; ok || targets == nil {
+				matched[host.Id] = struct{}{}
+				hit.Hosts = append(hit.Hosts, host)
+			}
+		}
+		if len(hit.Hosts) > 0 {
+			hits = append(hits, hit)
+		}
+	}
+	return hits, nil
+}
+
+func matchAny(re *regexp.Regexp, cmds []string) bool {
+	for _, cmd := range cmds {
+		if re.MatchString(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleTargets 规则范围内的主机 ID, 所有主机时返回 nil
+func ruleTargets(rule *models.CommandRule) (map[int]struct{}, error) {
+	if rule.TargetType == models.CommandRuleTargetAll {
+		return nil, nil
+	}
+	hosts, err := models.ParseHostList(rule.TargetType, rule.TargetId)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[int]struct{}, len(hosts))
+	for _, host := range hosts {
+		ids[host.Id] = struct{}{}
+	}
+	return ids, nil
+}
+
+func (g *CommandGuard) issue(key string) (string, time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for token, p := range g.pending {
+		if now.After(p.expiresAt) {
+			delete(g.pending, token)
+		}
+	}
+	token := uuid.NewString()
+	expiresAt := now.Add(confirmTokenTTL)
+	g.pending[token] = &pendingConfirm{key: key, expiresAt: expiresAt}
+	return token, expiresAt
+}
+
+// consume 使用确认 token, 只有同一个用户对同样的主机执行同样的命令时有效
+func (g *CommandGuard) consume(token, key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	p, ok := g.pending[token]
+	if !ok || p.key != key {
+		return false
+	}
+	delete(g.pending, token)
+	return time.Now().Before(p.expiresAt)
+}
+
+func (g *CommandGuard) record(req *GuardRequest, hits []*GuardHit, err error) {
+	result := "allowed"
+	switch err.(type) {
+	case *CommandDeniedError:
+		result = "denied"
+	case *CommandConfirmError:
+		result = "confirm required"
+	default:
+		for _, hit := range hits {
+			if hit.Rule.Action == models.CommandRuleConfirm {
+				result = "confirmed"
+			}
+		}
+	}
+
+	event := &models.AuditEvent{
+		Actor:    req.Actor,
+		ClientIP: req.ClientIP,
+		Action:   AuditActionCommandGuard,
+		Summary:  fmt.Sprintf("source=%s result=%s rules=%s cmd=%s", req.Source, result, describeHits(hits), strings.Join(req.commands(), "; ")),
+		Result:   models.AuditResultSuccess,
+	}
+	if req.User != nil {
+		event.UserId = req.User.Id
+		event.Actor = req.User.Username
+	}
+	var hosts []*models.Host
+	for _, hit := range hits {
+		hosts = append(hosts, hit.Hosts...)
+	}
+	event.SetHosts(hosts)
+	if err != nil {
+		event.Result = models.AuditResultFailure
+		event.Error = err.Error()
+	}
+
+	g.logger.Warnf("command guard hit, source: %s, user: %s, result: %s, rules: %s, cmd: %s",
+		req.Source, event.Actor, result, describeHits(hits), strings.Join(req.commands(), "; "))
+	if err := models.InsertAuditEvent(event); err != nil {
+		g.logger.Errorf("insert audit event error: %v", err)
+	}
+}
+
+// confirmKey 确认 token 绑定的用户, 命令和主机
+func confirmKey(req *GuardRequest) string {
+	ids := make([]int, 0, len(req.Hosts))
+	for _, host := range req.Hosts {
+		ids = append(ids, host.Id)
+	}
+	sort.Ints(ids)
+
+	parts := make([]string, 0, len(ids)+len(req.Cmds)+2)
+	if req.User != nil {
+		parts = append(parts, strconv.Itoa(req.User.Id))
+	} else {
+		parts = append(parts, req.Actor)
+	}
+	for _, id := range ids {
+		parts = append(parts, strconv.Itoa(id))
+	}
+	parts = append(parts, req.Cmd)
+	parts = append(parts, req.Cmds...)
+	return strings.Join(parts, "\x00")
+}
+
+func commandDigest(cmds []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(cmds, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// describeHits 例如 rule "rm-root"(deny) on web1,web2
+func describeHits(hits []*GuardHit) string {
+	parts := make([]string, 0, len(hits))
+	for _, hit := range hits {
+		names := make([]string, 0, len(hit.Hosts))
+		for _, host := range hit.Hosts {
+			names = append(names, host.Name)
+		}
+		parts = append(parts, fmt.Sprintf("rule %q(%s) on %s", hit.Rule.Name, hit.Rule.Action, strings.Join(names, ",")))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"errors"
+	"github.com/ssbeatty/oms/internal/models"
+	"reflect"
+	"testing"
+)
+
+func initGuardDB(t *testing.T) {
+	t.Helper()
+	if err := models.InitModels("", "", "", "", models.DBDriverSqlite, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.InsertCommandRule("reboot", "reboot", models.CommandRuleConfirm, models.CommandRuleTargetAll, 0, 0, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func deniedHostIds(t *testing.T, err error) []int {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var deniedErr *CommandDeniedError
+	if !errors.As(err, &deniedErr) {
+		t.Fatalf("err = %v, want *CommandDeniedError", err)
+	}
+	var ids []int
+	for _, hit := range deniedErr.Hits {
+		ids = append(ids, hostIds(hit.Hosts)...)
+	}
+	return ids
+}
+
+func TestGuardUnattendedConfirmed(t *testing.T) {
+	initGuardDB(t)
+	guard := NewCommandGuard()
+
+	saved := &GuardRequest{Cmds: []string{"uptime", "reboot"}, Hosts: testHosts(2)}
+	confirmation, err := guard.Confirmation(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cmds   []string
+		hosts  []*models.Host
+		denied []int
+	}{
+		{"confirmed", []string{"uptime", "reboot"}, testHosts(2), nil},
+		{"fewer hosts", []string{"uptime", "reboot"}, testHosts(1), nil},
+		{"new host", []string{"uptime", "reboot"}, testHosts(3), []int{3}},
+		{"playbook changed", []string{"reboot"}, testHosts(2), []int{1, 2}},
+		{"no hit", []string{"uptime"}, testHosts(3), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := guard.Check(&GuardRequest{
+				Source:     GuardSourceJob,
+				Cmds:       tt.cmds,
+				Hosts:      tt.hosts,
+				Unattended: true,
+				Confirmed:  &confirmation,
+			})
+			if got := deniedHostIds(t, err); !reflect.DeepEqual(got, tt.denied) {
+				t.Errorf("denied hosts = %v, want %v", got, tt.denied)
+			}
+		})
+	}
+}
+
+func TestGuardUnattendedNotConfirmed(t *testing.T) {
+	initGuardDB(t)
+	guard := NewCommandGuard()
+
+	// 没有记录确认范围的任务命中 confirm 规则时拒绝, 不会返回需要确认
+	err := guard.Check(&GuardRequest{Source: GuardSourceJob, Cmd: "reboot", Hosts: testHosts(2), Unattended: true})
+	if got := deniedHostIds(t, err); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("denied hosts = %v, want [1 2]", got)
+	}
+}
@@ -0,0 +1,189 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/ssbeatty/oms/internal/models"
+	gossh "golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	hashedHostPrefix = "|1|"
+)
+
+// HostKeyError 主机公钥和记录的不一致, 可能是主机重装或者连接被劫持
+type HostKeyError struct {
+	Addr string
+	Want string
+	Got  string
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf(
+		"host key mismatch for %s, expected fingerprint %s but got %s, accept the new key if the change is expected",
+		e.Addr, e.Want, e.Got)
+}
+
+// HostKeyCallback 首次连接时记录主机公钥, 之后公钥不一致时拒绝连接
+// 公钥按主机记录, 不使用拨号的地址, 不同跳板机或者代理后面的主机可能使用相同的地址
+func (m *Manager) HostKeyCallback(host *models.Host) gossh.HostKeyCallback {
+	hostId, addr := host.Id, models.KnownHostAddr(host.Addr, host.Port)
+
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		publicKey := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+		fingerprint := gossh.FingerprintSHA256(key)
+
+		knownHost, err := models.GetKnownHostByHostId(hostId)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			_, err = models.InsertOrUpdateKnownHost(hostId, addr, publicKey, fingerprint)
+			if err != nil {
+				return err
+			}
+			m.logger.Infof("trust host key on first use, host: %d, addr: %s, fingerprint: %s", hostId, addr, fingerprint)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if knownHost.PublicKey == publicKey {
+			return nil
+		}
+		if err := models.UpdateKnownHostPending(hostId, publicKey, fingerprint); err != nil {
+			m.logger.Errorf("error when update pending host key, host: %d, err: %v", hostId, err)
+		}
+		m.logger.Warnf("host key mismatch, host: %d, addr: %s, expected: %s, got: %s", hostId, addr, knownHost.Fingerprint, fingerprint)
+
+		return &HostKeyError{
+			Addr: addr,
+			Want: knownHost.Fingerprint,
+			Got:  fingerprint,
+		}
+	}
+}
+
+// hostKeyAlgorithms 已经记录公钥时只协商该类型的公钥, 避免服务端提供其他类型的公钥导致校验失败
+func hostKeyAlgorithms(hostId int) []string {
+	knownHost, err := models.GetKnownHostByHostId(hostId)
+	if err != nil || knownHost.KeyType == "" {
+		return nil
+	}
+	if knownHost.KeyType == gossh.KeyAlgoRSA {
+		return []string{gossh.KeyAlgoRSASHA512, gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSA}
+	}
+	return []string{knownHost.KeyType}
+}
+
+// ImportKnownHosts 导入 OpenSSH 的 known_hosts 文件, 公钥记录到地址匹配的已添加主机
+func ImportKnownHosts(data []byte) (int, error) {
+	var (
+		total int
+		rest  = data
+	)
+
+	hosts, err := models.GetAllHostWithOutPreload()
+	if err != nil {
+		return 0, err
+	}
+
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var (
+			marker   string
+			patterns []string
+			key      gossh.PublicKey
+		)
+		marker, patterns, key, _, rest, err = gossh.ParseKnownHosts(rest)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return total, err
+		}
+		// 不支持 @cert-authority 和 @revoked
+		if marker != "" {
+			continue
+		}
+
+		publicKey := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+		fingerprint := gossh.FingerprintSHA256(key)
+
+		for _, host := range knownHostsMatch(patterns, hosts) {
+			addr := models.KnownHostAddr(host.Addr, host.Port)
+			if _, err := models.InsertOrUpdateKnownHost(host.Id, addr, publicKey, fingerprint); err != nil {
+				return total, err
+			}
+			total++
+		}
+	}
+
+	return total, nil
+}
+
+// knownHostsMatch 返回 known_hosts 中的主机名匹配的主机, 跳过通配符和否定的规则
+func knownHostsMatch(patterns []string, hosts []*models.Host) []*models.Host {
+	var addrs []string
+	for _, pattern := range patterns {
+		switch {
+		case strings.HasPrefix(pattern, hashedHostPrefix):
+			addrs = append(addrs, pattern)
+		case strings.ContainsAny(pattern, "*?!"):
+			continue
+		case strings.HasPrefix(pattern, "["):
+			h, p, err := net.SplitHostPort(pattern)
+			if err != nil {
+				continue
+			}
+			port, err := strconv.Atoi(p)
+			if err != nil {
+				continue
+			}
+			addrs = append(addrs, models.KnownHostAddr(h, port))
+		default:
+			addrs = append(addrs, models.KnownHostAddr(pattern, 22))
+		}
+	}
+
+	var matched []*models.Host
+	for _, host := range hosts {
+		hostAddr := models.KnownHostAddr(host.Addr, host.Port)
+		for _, addr := range addrs {
+			if addr == hostAddr || (strings.HasPrefix(addr, hashedHostPrefix) && matchHashedHost(addr, host)) {
+				matched = append(matched, host)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// matchHashedHost 哈希格式为 |1|base64(salt)|base64(hmac-sha1(salt, host))
+func matchHashedHost(pattern string, host *models.Host) bool {
+	parts := strings.Split(strings.TrimPrefix(pattern, hashedHostPrefix), "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	name := host.Addr
+	if host.Port != 0 && host.Port != 22 {
+		name = fmt.Sprintf("[%s]:%d", host.Addr, host.Port)
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
@@ -7,17 +7,33 @@ import (
 	"github.com/fatih/color"
 	"github.com/ssbeatty/oms/pkg/transport"
 	"github.com/ssbeatty/oms/pkg/types"
+	"io"
+	"sync"
+	"time"
 )
 
 var (
 	cyan = color.New(color.FgCyan).SprintFunc()
 )
 
+// StepResult 剧本中一步的执行结果
+type StepResult struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Status   bool   `json:"status"`
+	ExitCode int    `json:"exit_code"` // 没有退出码时为 -1
+	Signal   string `json:"signal,omitempty"`
+	Duration int64  `json:"duration"` // 毫秒
+	Error    string `json:"error,omitempty"`
+}
+
 type Player struct {
-	sudo   bool
-	client *transport.Client
-	Steps  []types.Step `json:"steps"`
-	size   *WindowSize
+	sudo    bool
+	client  *transport.Client
+	Steps   []types.Step `json:"steps"`
+	size    *WindowSize
+	results []*StepResult
+	output  io.Writer
 }
 
 func NewPlayer(client *transport.Client, steps []types.Step, sudo bool, size *WindowSize) *Player {
@@ -29,18 +45,30 @@ func NewPlayer(client *transport.Client, steps []types.Step, sudo bool, size *Wi
 	}
 }
 
+// SetOutput 每一步执行完成后把这一步的输出同时写入 output, 用于实时返回剧本的输出
+func (p *Player) SetOutput(output io.Writer) {
+	p.output = output
+}
+
 func (p *Player) Run(ctx context.Context) ([]byte, error) {
 	var (
 		buf     bytes.Buffer
+		out     io.Writer = &buf
+		mu      sync.Mutex
 		session *transport.Session
 		quit    = make(chan struct{}, 1)
 	)
+	if p.output != nil {
+		out = io.MultiWriter(&buf, p.output)
+	}
 
 	defer close(quit)
 
 	go func() {
 		select {
 		case <-ctx.Done():
+			mu.Lock()
+			defer mu.Unlock()
 			if session != nil {
 				session.Close()
 			}
@@ -52,29 +80,66 @@ func (p *Player) Run(ctx context.Context) ([]byte, error) {
 	for _, step := range p.Steps {
 		var (
 			err error
+			s   *transport.Session
 		)
 
 		if p.size != nil {
-			session, err = p.client.NewSessionWithPty(p.size.Cols, p.size.Rows)
+			s, err = p.client.NewSessionWithPty(p.size.Cols, p.size.Rows)
 		} else {
-			session, err = p.client.NewPty()
+			s, err = p.client.NewPty()
 		}
 		if err != nil {
-			buf.Write([]byte(err.Error()))
+			_, _ = io.WriteString(out, err.Error())
+			return buf.Bytes(), err
+		}
+
+		// 取消之后不再执行剩余的步骤
+		mu.Lock()
+		session = s
+		mu.Unlock()
+		if err := ctx.Err(); err != nil {
+			s.Close()
+			_, _ = io.WriteString(out, err.Error())
 			return buf.Bytes(), err
 		}
 
-		buf.WriteString(cyan(fmt.Sprintf("[Step %8s] ==> \"%s\"\r\n", step.Name(), step.ID())))
-		msg, err := step.Exec(session, p.sudo)
+		_, _ = io.WriteString(out, cyan(fmt.Sprintf("[Step %8s] ==> \"%s\"\r\n", step.Name(), step.ID())))
+		start := time.Now()
+		msg, err := step.Exec(s, p.sudo)
 
-		buf.Write(msg)
+		_, _ = out.Write(msg)
 
+		result := &StepResult{
+			Id:       step.ID(),
+			Name:     step.Name(),
+			Status:   err == nil,
+			ExitCode: transport.ExitCode(err),
+			Signal:   transport.ExitSignal(err),
+			Duration: time.Since(start).Milliseconds(),
+		}
 		if err != nil {
-			buf.Write([]byte(err.Error()))
+			result.Error = err.Error()
+			_, _ = io.WriteString(out, err.Error())
 		}
+		p.results = append(p.results, result)
 
-		session.Close()
+		s.Close()
 	}
 
 	return buf.Bytes(), nil
 }
+
+// Results 每一步的执行结果, 在 Run 返回之后调用
+func (p *Player) Results() []*StepResult {
+	return p.results
+}
+
+// ExitCode 第一个失败的步骤的退出码, 所有步骤都成功时返回 0
+func (p *Player) ExitCode() int {
+	for _, result := range p.results {
+		if !result.Status {
+			return result.ExitCode
+		}
+	}
+	return 0
+}
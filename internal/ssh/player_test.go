@@ -3,10 +3,10 @@ package ssh
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"github.com/ssbeatty/oms/internal/ssh/buildin"
+	"github.com/ssbeatty/oms/pkg/transport"
+	"github.com/ssbeatty/oms/pkg/types"
 	"io/ioutil"
-	"oms/internal/ssh/buildin"
-	"oms/pkg/transport"
 	"testing"
 )
 
@@ -33,60 +33,61 @@ func init() {
 		return
 	}
 
-	client, err = transport.New(host.Addr, host.User, host.PassWord, "", nil, host.Port)
+	client, err = transport.New(&transport.ClientConfig{
+		Host:     host.Addr,
+		User:     host.User,
+		Password: host.PassWord,
+		KeyBytes: host.KeyBytes,
+		Port:     host.Port,
+	})
 	if err != nil {
 		return
 	}
 }
 
 func TestGenJsonSchema(t *testing.T) {
-	r := buildin.RunCmdStep{}
-	schema, err := r.GetSchema(&r)
-	if err != nil {
-		return
+	for _, plugin := range []types.Step{&buildin.RunCmdStep{}, &buildin.RunShellStep{}, &buildin.FileUploadStep{}} {
+		step, err := plugin.Create([]byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema, err := step.GetSchema()
+		if err != nil {
+			t.Fatalf("get schema of %s: %v", step.Name(), err)
+		}
+		marshal, err := json.Marshal(schema)
+		if err != nil {
+			t.Fatalf("marshal schema of %s: %v", step.Name(), err)
+		}
+		if len(marshal) == 0 || string(marshal) == "null" {
+			t.Errorf("schema of %s is empty", step.Name())
+		}
 	}
+}
 
-	marshal, _ := json.Marshal(schema)
-
-	fmt.Println(string(marshal))
+func TestPlayerRun(t *testing.T) {
+	if client == nil {
+		t.Skip("no test host in pkg/transport/hosts")
+	}
+	var steps []types.Step
 
-	s := buildin.RunShellStep{}
-	schema, err = s.GetSchema(&s)
+	step, err := (&buildin.RunCmdStep{}).Create([]byte(`{"cmd": "ls -a"}`))
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
-	marshal, _ = json.Marshal(schema)
-
-	fmt.Println(string(marshal))
+	steps = append(steps, step)
 
-	f := buildin.FileUploadStep{}
-	schema, err = f.GetSchema(&f)
+	step, err = (&buildin.RunShellStep{}).Create([]byte(`{"shell": "ls -l"}`))
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
-
-	marshal, _ = json.Marshal(schema)
-
-	fmt.Println(string(marshal))
-}
-
-func TestPlayerRun(t *testing.T) {
-	var steps []buildin.Step
-
-	steps = append(steps, &buildin.RunCmdStep{
-		Cmd: "ls -a",
-	})
-
-	steps = append(steps, &buildin.RunShellStep{
-		Shell: "ls -l",
-	})
+	steps = append(steps, step)
 
 	player := NewPlayer(client, steps, true, nil)
 
 	output, err := player.Run(context.Background())
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
-
-	fmt.Println(string(output))
+	t.Log(string(output))
 }
@@ -229,8 +229,8 @@ func (m *Manager) UploadFileStream(c *transport.Client, remote string, addr stri
 }
 
 // NewClientWithSftp 创建新的ssh client并创建sftp客户端
-func (m *Manager) NewClientWithSftp(host *models.Host) (*transport.Client, error) {
-	client, err := m.NewClient(host)
+func (m *Manager) NewClientWithSftp(host *models.Host, opts ClientOptions) (*transport.Client, error) {
+	client, err := m.NewClientWithOptions(host, opts)
 	if err != nil {
 		return nil, err
 	}
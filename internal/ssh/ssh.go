@@ -15,12 +15,15 @@ import (
 	"github.com/ssbeatty/oms/pkg/utils"
 	"github.com/traefik/yaegi/interp"
 	"github.com/traefik/yaegi/stdlib"
+	gossh "golang.org/x/crypto/ssh"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -49,13 +52,81 @@ type WindowSize struct {
 	Rows int `json:"rows"`
 }
 
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// OutputFunc 流式执行命令时实时回调的输出, stream 为 stdout 或 stderr, 可能被并发调用
+type OutputFunc func(stream string, data []byte)
+
 type Result struct {
-	Seq      int    `json:"seq"`
-	Status   bool   `json:"status"`
-	HostId   int    `json:"host_id"`
-	HostName string `json:"hostname"`
-	Msg      string `json:"msg"`
-	Addr     string `json:"addr"`
+	Seq      int           `json:"seq"`
+	Status   bool          `json:"status"`
+	HostId   int           `json:"host_id"`
+	HostName string        `json:"hostname"`
+	Msg      string        `json:"msg"` // stdout 和 stderr 按顺序合并的输出, 没有执行命令时为错误信息
+	Addr     string        `json:"addr"`
+	Stdout   string        `json:"stdout"`
+	Stderr   string        `json:"stderr"`
+	ExitCode int           `json:"exit_code"` // 没有退出码(连接失败, 超时, 被取消等)时为 -1
+	Signal   string        `json:"signal,omitempty"`
+	Duration int64         `json:"duration"` // 毫秒
+	Error    string        `json:"error,omitempty"`
+	Steps    []*StepResult `json:"steps,omitempty"` // 剧本每一步的结果
+}
+
+// NewErrorResult 没有执行命令(连接失败等)时的结果
+func NewErrorResult(host *models.Host, err error) *Result {
+	return &Result{
+		HostId:   host.Id,
+		HostName: host.Name,
+		Status:   false,
+		Msg:      err.Error(),
+		Addr:     host.Addr,
+		ExitCode: -1,
+		Error:    err.Error(),
+	}
+}
+
+// NewExecResult 执行命令后的结果, err 为 transport.Session.ExecContext 返回的错误
+func NewExecResult(host *models.Host, res *transport.ExecResult, err error) *Result {
+	result := &Result{
+		HostId:   host.Id,
+		HostName: host.Name,
+		Status:   err == nil,
+		Msg:      string(res.Combined),
+		Addr:     host.Addr,
+		Stdout:   string(res.Stdout),
+		Stderr:   string(res.Stderr),
+		ExitCode: res.ExitCode,
+		Signal:   res.Signal,
+		Duration: res.Duration.Milliseconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// NewPlayerResult 执行剧本后的结果, 任意一步失败时 Status 为 false, ExitCode 为第一个失败的步骤的退出码
+func NewPlayerResult(host *models.Host, player *Player, msg []byte, duration time.Duration, err error) *Result {
+	result := &Result{
+		HostId:   host.Id,
+		HostName: host.Name,
+		Status:   err == nil && player.ExitCode() == 0,
+		Msg:      string(msg),
+		Addr:     host.Addr,
+		Stdout:   string(msg),
+		ExitCode: player.ExitCode(),
+		Duration: duration.Milliseconds(),
+		Steps:    player.Results(),
+	}
+	if err != nil {
+		result.ExitCode = -1
+		result.Error = err.Error()
+	}
+	return result
 }
 
 type Manager struct {
@@ -69,6 +140,16 @@ type Manager struct {
 	statusChan     chan *transport.Client
 	pluginPath     string
 	interpreter    *interp.Interpreter
+	caSigner       gossh.Signer
+	guard          *CommandGuard
+}
+
+// ClientOptions 创建连接时的可选参数
+type ClientOptions struct {
+	// Prompt 用于在终端中回答动态口令等问题
+	Prompt transport.KeyboardInteractiveFunc
+	// User 当前的oms用户, 使用内置CA时证书和连接都绑定到该用户
+	User string
 }
 
 func NewManager(cfg *config.Conf) *Manager {
@@ -83,9 +164,15 @@ func NewManager(cfg *config.Conf) *Manager {
 		cfg:        cfg,
 		statusChan: make(chan *transport.Client),
 		pluginPath: pluginPath,
+		guard:      NewCommandGuard(),
 	}
 }
 
+// Guard 批量执行命令前的危险命令校验
+func (m *Manager) Guard() *CommandGuard {
+	return m.guard
+}
+
 // 从ssh manager poll删除死掉的客户端
 func (m *Manager) doResolveStatus() {
 	for {
@@ -110,6 +197,10 @@ func (m *Manager) Init() *Manager {
 
 	m.initAllPlugins()
 
+	if err := m.initCertAuthority(); err != nil {
+		m.logger.Errorf("init cert authority error: %v", err)
+	}
+
 	return m
 }
 
@@ -176,6 +267,7 @@ func (m *Manager) initAllPlugins() {
 		buildin.StepMultiNameFile: &buildin.MultiFileUploadStep{},
 		buildin.StepNameZipFile:   &buildin.ZipFileStep{},
 		buildin.StepNameYamlJson:  &buildin.JsonYamlReplaceStep{},
+		buildin.StepNameTrustCA:   &buildin.TrustCAStep{},
 	}
 
 	m.ReloadAllFilePlugins(m.pluginPath)
@@ -190,37 +282,35 @@ func (m *Manager) GetFileList() *utils.SafeMap {
 }
 
 func (m *Manager) NewClient(host *models.Host) (*transport.Client, error) {
+	return m.NewClientWithOptions(host, ClientOptions{})
+}
+
+// NewClientWithOptions 登录成功后连接放在 sshPoll 中, 其他功能可以复用
+func (m *Manager) NewClientWithOptions(host *models.Host, opts ClientOptions) (*transport.Client, error) {
 	var (
-		err       error
-		cli       *transport.Client
-		newStatus = host.Status
+		err         error
+		cli         *transport.Client
+		newStatus   = host.Status
+		newErrorMsg = host.ErrorMsg
 	)
 
 	defer func() {
 		if cli == nil && err != nil {
 			newStatus = false
+			newErrorMsg = err.Error()
+		} else if newStatus {
+			newErrorMsg = ""
 		}
-		if host.Status != newStatus {
+		if host.Status != newStatus || host.ErrorMsg != newErrorMsg {
 			host.Status = newStatus
+			host.ErrorMsg = newErrorMsg
 			_ = models.UpdateHostStatus(host)
 		}
 	}()
 
-	var c = &transport.ClientConfig{
-		ID:       host.Id,
-		Host:     host.Addr,
-		Port:     host.Port,
-		User:     host.User,
-		Password: host.PassWord,
-	}
-	if host.PrivateKeyID != 0 {
-		privateKey, err := models.GetPrivateKeyById(host.PrivateKeyID)
-		if err != nil {
-			m.logger.Errorf("error when get private key")
-			return nil, err
-		}
-		c.KeyBytes = []byte(privateKey.KeyFile)
-		c.Passphrase = privateKey.Passphrase
+	c, err := m.newClientConfig(host, opts)
+	if err != nil {
+		return nil, err
 	}
 	if cli, ok := m.sshPoll.Get(c.Serialize()); ok {
 		err := cli.(*transport.Client).Ping()
@@ -247,6 +337,91 @@ func (m *Manager) NewClient(host *models.Host) (*transport.Client, error) {
 	return cli, nil
 }
 
+// NewClientConfig 根据主机生成ssh连接配置, 包含密钥和主机公钥的校验
+func (m *Manager) NewClientConfig(host *models.Host) (*transport.ClientConfig, error) {
+	return m.newClientConfig(host, ClientOptions{})
+}
+
+func (m *Manager) newClientConfig(host *models.Host, opts ClientOptions) (*transport.ClientConfig, error) {
+	var c = &transport.ClientConfig{
+		ID:                host.Id,
+		Host:              host.Addr,
+		Port:              host.Port,
+		User:              host.User,
+		Password:          host.PassWord,
+		Prompt:            opts.Prompt,
+		HostKeyCallback:   m.HostKeyCallback(host),
+		HostKeyAlgorithms: hostKeyAlgorithms(host.Id),
+	}
+	if host.PrivateKeyID != 0 {
+		privateKey, err := models.GetPrivateKeyById(host.PrivateKeyID)
+		if err != nil {
+			m.logger.Errorf("error when get private key")
+			return nil, err
+		}
+		c.KeyBytes = []byte(privateKey.KeyFile)
+		c.Passphrase = privateKey.Passphrase
+		if privateKey.Certificate != "" {
+			c.CertBytes = []byte(privateKey.Certificate)
+		}
+	}
+	if host.UseCA {
+		owner := opts.User
+		if owner == "" {
+			owner = SystemCertUser
+		}
+		// 连接池中已有连接时不需要重新签发
+		c.Signers = func() ([]gossh.Signer, error) {
+			signer, err := m.SignCertificate(host, owner)
+			if err != nil {
+				return nil, err
+			}
+			return []gossh.Signer{signer}, nil
+		}
+		c.Owner = owner
+	}
+	if host.JumpHostId != 0 {
+		if err := models.CheckJumpHost(host.Id, host.JumpHostId); err != nil {
+			return nil, err
+		}
+		c.JumpID = host.JumpHostId
+		c.JumpClient = m.jumpClient(host.JumpHostId, opts)
+	} else {
+		proxy, err := m.hostProxy(host)
+		if err != nil {
+			return nil, err
+		}
+		c.Proxy = proxy
+	}
+	return c, nil
+}
+
+// hostProxy 主机没有配置代理时使用全局代理
+func (m *Manager) hostProxy(host *models.Host) (*transport.ProxyConfig, error) {
+	switch host.Proxy {
+	case models.ProxyDirect:
+		return nil, nil
+	case "":
+		if m.cfg.SSH.Proxy == "" {
+			return nil, nil
+		}
+		return transport.ParseProxy(m.cfg.SSH.Proxy, "", "")
+	default:
+		return transport.ParseProxy(host.Proxy, host.ProxyUser, host.ProxyPassword)
+	}
+}
+
+// jumpClient 跳板机的连接同样放在 sshPoll 中, 同一个跳板机后面的主机共用一个连接
+func (m *Manager) jumpClient(jumpHostId int, opts ClientOptions) transport.JumpClientFunc {
+	return func() (*transport.Client, error) {
+		jumpHost, err := models.GetHostById(jumpHostId)
+		if err != nil {
+			return nil, errors.Wrap(err, "get jump host")
+		}
+		return m.NewClientWithOptions(jumpHost, opts)
+	}
+}
+
 func (m *Manager) GetStatus(host *models.Host) bool {
 	client, err := m.NewClient(host)
 	if err != nil {
@@ -266,11 +441,18 @@ func (m *Manager) GetStatus(host *models.Host) bool {
 }
 
 func (m *Manager) RemoveCache(host *models.Host) {
-	m.removeCache(utils.InetAtoN(host.Addr, host.Port))
+	key := transport.SerializeAddr(host.Addr, host.Port, host.JumpHostId)
+	m.removeCache(key)
+	// 经过代理和绑定用户的连接, 主机修改代理后旧代理的连接也需要删除
+	for _, k := range m.sshPoll.Keys() {
+		if s, ok := k.(string); ok && (strings.HasPrefix(s, key+"|") || strings.HasPrefix(s, key+"#")) {
+			m.removeCache(s)
+		}
+	}
 }
 
-func (m *Manager) removeCache(inet int64) {
-	m.sshPoll.Remove(inet)
+func (m *Manager) removeCache(key string) {
+	m.sshPoll.Remove(key)
 }
 
 func (m *Manager) GetAllPluginSchema() []Schema {
@@ -338,6 +520,26 @@ func (m *Manager) ParseSteps(params string) ([]types.Step, error) {
 	return steps, nil
 }
 
+// commandStep 会在远端执行命令的步骤, 例如 cmd 和 shell
+type commandStep interface {
+	Command() string
+}
+
+// PlayerCommands 解析剧本的步骤, 返回每一步在远端执行的命令, 用于危险命令校验
+func (m *Manager) PlayerCommands(params string) ([]string, error) {
+	steps, err := m.ParseSteps(params)
+	if err != nil {
+		return nil, err
+	}
+	var cmds []string
+	for _, step := range steps {
+		if cs, ok := step.(commandStep); ok {
+			cmds = append(cmds, cs.Command())
+		}
+	}
+	return cmds, nil
+}
+
 func RunTaskWithQuit(client *transport.Client, cmd string, quitCh chan bool, writer io.Writer) (err error) {
 	session, err := client.NewPty()
 	if err != nil {
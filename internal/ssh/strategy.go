@@ -0,0 +1,113 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"github.com/ssbeatty/oms/internal/models"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBatchAborted 失败的主机过多或者被取消, 剩余的主机没有执行
+	ErrBatchAborted = errors.New("skipped because the batch was aborted")
+)
+
+// SplitBatches 按策略把主机分批, 没有设置分批时只有一批
+func SplitBatches(strategy models.ExecStrategy, hosts []*models.Host) [][]*models.Host {
+	size := strategy.BatchSize
+	if size == 0 && strategy.BatchPercent > 0 {
+		size = (len(hosts)*strategy.BatchPercent + 99) / 100
+	}
+	if size <= 0 || size >= len(hosts) {
+		return [][]*models.Host{hosts}
+	}
+
+	var batches [][]*models.Host
+	for i := 0; i < len(hosts); i += size {
+		end := i + size
+		if end > len(hosts) {
+			end = len(hosts)
+		}
+		batches = append(batches, hosts[i:end])
+	}
+	return batches
+}
+
+// RunWithStrategy 按策略分批执行, run 阻塞执行一台主机并返回是否成功, 每批结束后才开始下一批.
+// 一批结束时失败的主机超过已执行主机的 abort_percent 则不再执行剩余的批次, ctx 结束时不再启动剩余的主机,
+// 返回这些没有执行的主机
+func RunWithStrategy(ctx context.Context, strategy models.ExecStrategy, hosts []*models.Host, run func(host *models.Host) bool) []*models.Host {
+	var (
+		mu           sync.Mutex
+		done, failed int
+		parallel     = strategy.MaxParallel
+	)
+	if len(hosts) == 0 {
+		return nil
+	}
+	if parallel <= 0 {
+		parallel = len(hosts)
+	}
+	sem := make(chan struct{}, parallel)
+
+	// 只在批次之间判断, 同一批的主机总是全部执行
+	aborted := func() bool {
+		if ctx.Err() != nil {
+			return true
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return strategy.AbortPercent > 0 && done > 0 && failed*100 > strategy.AbortPercent*done
+	}
+
+	batches := SplitBatches(strategy, hosts)
+	for i, batch := range batches {
+		if i > 0 && strategy.BatchPause > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(strategy.BatchPause) * time.Second):
+			}
+		}
+
+		var wg sync.WaitGroup
+		for j, host := range batch {
+			sem <- struct{}{}
+			if ctx.Err() != nil {
+				<-sem
+				wg.Wait()
+				return remainHosts(batches, i, j)
+			}
+
+			wg.Add(1)
+			go func(host *models.Host) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				ok := run(host)
+
+				mu.Lock()
+				defer mu.Unlock()
+				done++
+				if !ok {
+					failed++
+				}
+			}(host)
+		}
+		wg.Wait()
+
+		if i < len(batches)-1 && aborted() {
+			return remainHosts(batches, i+1, 0)
+		}
+	}
+	return nil
+}
+
+// remainHosts 从第 i 批的第 j 台主机开始剩余的主机
+func remainHosts(batches [][]*models.Host, i, j int) []*models.Host {
+	remain := append([]*models.Host(nil), batches[i][j:]...)
+	for _, batch := range batches[i+1:] {
+		remain = append(remain, batch...)
+	}
+	return remain
+}
@@ -0,0 +1,170 @@
+package ssh
+
+import (
+	"context"
+	"github.com/ssbeatty/oms/internal/models"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testHosts(n int) []*models.Host {
+	hosts := make([]*models.Host, 0, n)
+	for i := 1; i <= n; i++ {
+		hosts = append(hosts, &models.Host{Id: i})
+	}
+	return hosts
+}
+
+func hostIds(hosts []*models.Host) []int {
+	ids := make([]int, 0, len(hosts))
+	for _, host := range hosts {
+		ids = append(ids, host.Id)
+	}
+	return ids
+}
+
+func TestSplitBatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		hosts    int
+		strategy models.ExecStrategy
+		want     []int // 每批的主机数
+	}{
+		{"no batch", 10, models.ExecStrategy{}, []int{10}},
+		{"batch size", 10, models.ExecStrategy{BatchSize: 3}, []int{3, 3, 3, 1}},
+		{"batch size larger than hosts", 10, models.ExecStrategy{BatchSize: 20}, []int{10}},
+		{"percent rounds up", 10, models.ExecStrategy{BatchPercent: 25}, []int{3, 3, 3, 1}},
+		{"percent exact", 10, models.ExecStrategy{BatchPercent: 50}, []int{5, 5}},
+		{"small percent at least one", 3, models.ExecStrategy{BatchPercent: 1}, []int{1, 1, 1}},
+		{"percent 100", 4, models.ExecStrategy{BatchPercent: 100}, []int{4}},
+		{"size takes precedence", 10, models.ExecStrategy{BatchSize: 5, BatchPercent: 10}, []int{5, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, batch := range SplitBatches(tt.strategy, testHosts(tt.hosts)) {
+				got = append(got, len(batch))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitBatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunWithStrategyAbort(t *testing.T) {
+	tests := []struct {
+		name     string
+		hosts    int
+		strategy models.ExecStrategy
+		fail     []int
+		skipped  []int
+	}{
+		{"abort disabled", 4, models.ExecStrategy{BatchSize: 1}, []int{1, 2, 3}, []int{}},
+		{"single batch never aborts", 4, models.ExecStrategy{MaxParallel: 1, AbortPercent: 10}, []int{1}, []int{}},
+		{"equal to percent continues", 6, models.ExecStrategy{BatchSize: 2, AbortPercent: 50}, []int{1}, []int{}},
+		{"over percent aborts", 6, models.ExecStrategy{BatchSize: 2, AbortPercent: 50}, []int{1, 2}, []int{3, 4, 5, 6}},
+		{"cumulative over percent", 6, models.ExecStrategy{BatchSize: 2, AbortPercent: 20}, []int{3}, []int{5, 6}},
+		{"last batch failures skip nothing", 4, models.ExecStrategy{BatchSize: 2, AbortPercent: 10}, []int{3, 4}, []int{}},
+		{"percent batches", 10, models.ExecStrategy{BatchPercent: 30, AbortPercent: 15}, []int{4}, []int{7, 8, 9, 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fail := make(map[int]bool)
+			for _, id := range tt.fail {
+				fail[id] = true
+			}
+			var (
+				mu  sync.Mutex
+				ran []int
+			)
+			skipped := RunWithStrategy(context.Background(), tt.strategy, testHosts(tt.hosts), func(host *models.Host) bool {
+				mu.Lock()
+				defer mu.Unlock()
+				ran = append(ran, host.Id)
+				return !fail[host.Id]
+			})
+			if got := hostIds(skipped); !reflect.DeepEqual(got, tt.skipped) {
+				t.Errorf("skipped = %v, want %v", got, tt.skipped)
+			}
+			if len(ran)+len(skipped) != tt.hosts {
+				t.Errorf("ran %d hosts and skipped %d, want %d in total", len(ran), len(skipped), tt.hosts)
+			}
+		})
+	}
+}
+
+func TestRunWithStrategyMaxParallel(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy models.ExecStrategy
+		want     int32
+	}{
+		{"unlimited", models.ExecStrategy{}, 6},
+		{"max parallel", models.ExecStrategy{MaxParallel: 2}, 2},
+		{"max parallel in batches", models.ExecStrategy{MaxParallel: 2, BatchSize: 3}, 2},
+		{"batch smaller than max parallel", models.ExecStrategy{MaxParallel: 4, BatchSize: 3}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var running, peak int32
+			RunWithStrategy(context.Background(), tt.strategy, testHosts(6), func(host *models.Host) bool {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					old := atomic.LoadInt32(&peak)
+					if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				return true
+			})
+			if peak != tt.want {
+				t.Errorf("peak parallel = %d, want %d", peak, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunWithStrategyCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	skipped := RunWithStrategy(ctx, models.ExecStrategy{MaxParallel: 1}, testHosts(5), func(host *models.Host) bool {
+		if host.Id == 2 {
+			cancel()
+		}
+		return true
+	})
+	if got, want := hostIds(skipped), []int{3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("skipped = %v, want %v", got, want)
+	}
+
+	// 批次之间暂停时取消不需要等到暂停结束
+	ctx, cancel = context.WithCancel(context.Background())
+	start := time.Now()
+	skipped = RunWithStrategy(ctx, models.ExecStrategy{BatchSize: 1, BatchPause: 10}, testHosts(3), func(host *models.Host) bool {
+		cancel()
+		return true
+	})
+	if got, want := hostIds(skipped), []int{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("skipped = %v, want %v", got, want)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("cancel during batch pause took %s", time.Since(start))
+	}
+}
+
+func TestRunWithStrategyEmpty(t *testing.T) {
+	skipped := RunWithStrategy(context.Background(), models.ExecStrategy{BatchSize: 2}, nil, func(host *models.Host) bool {
+		t.Fatal("run called without hosts")
+		return true
+	})
+	if len(skipped) != 0 {
+		t.Errorf("skipped = %v, want none", hostIds(skipped))
+	}
+}
@@ -12,44 +12,61 @@ import (
 func init() {
 	Symbols["github.com/ssbeatty/oms/pkg/transport/transport"] = map[string]reflect.Value{
 		// function, constant and variable definitions
-		"ArchAmd64":               reflect.ValueOf(constant.MakeFromLiteral("\"amd64\"", token.STRING, 0)),
-		"ArchArm":                 reflect.ValueOf(constant.MakeFromLiteral("\"arm\"", token.STRING, 0)),
-		"ArchI386":                reflect.ValueOf(constant.MakeFromLiteral("\"386\"", token.STRING, 0)),
-		"ArchUnknown":             reflect.ValueOf(constant.MakeFromLiteral("\"unknown\"", token.STRING, 0)),
-		"AuthWithAgent":           reflect.ValueOf(transport.AuthWithAgent),
-		"AuthWithPrivateKeyBytes": reflect.ValueOf(transport.AuthWithPrivateKeyBytes),
-		"CmiTimeLayout":           reflect.ValueOf(constant.MakeFromLiteral("\"20060102150405.999999\"", token.STRING, 0)),
-		"DefaultPtyCols":          reflect.ValueOf(constant.MakeFromLiteral("200", token.INT, 0)),
-		"DefaultPtyRows":          reflect.ValueOf(constant.MakeFromLiteral("40", token.INT, 0)),
-		"DefaultRWTimeoutSec":     reflect.ValueOf(&transport.DefaultRWTimeoutSec).Elem(),
-		"DefaultTimeoutSec":       reflect.ValueOf(&transport.DefaultTimeoutSec).Elem(),
-		"Dial":                    reflect.ValueOf(transport.Dial),
-		"GOOSDarwin":              reflect.ValueOf(constant.MakeFromLiteral("\"darwin\"", token.STRING, 0)),
-		"GOOSFreeBSD":             reflect.ValueOf(constant.MakeFromLiteral("\"freebsd\"", token.STRING, 0)),
-		"GOOSLinux":               reflect.ValueOf(constant.MakeFromLiteral("\"linux\"", token.STRING, 0)),
-		"GOOSUnknown":             reflect.ValueOf(constant.MakeFromLiteral("\"unknown\"", token.STRING, 0)),
-		"GOOSWindows":             reflect.ValueOf(constant.MakeFromLiteral("\"windows\"", token.STRING, 0)),
-		"GetAllStats":             reflect.ValueOf(transport.GetAllStats),
-		"KeepAliveMessage":        reflect.ValueOf(constant.MakeFromLiteral("\"keepalive@golang.org\"", token.STRING, 0)),
-		"KillSignal":              reflect.ValueOf(constant.MakeFromLiteral("\"0x09\"", token.STRING, 0)),
-		"LinuxShellExt":           reflect.ValueOf(constant.MakeFromLiteral("\".sh\"", token.STRING, 0)),
-		"New":                     reflect.ValueOf(transport.New),
-		"NewStatus":               reflect.ValueOf(transport.NewStatus),
-		"RegisterSessionGauge":    reflect.ValueOf(transport.RegisterSessionGauge),
-		"SSHDialTimeout":          reflect.ValueOf(&transport.SSHDialTimeout).Elem(),
-		"SSHRWTimeout":            reflect.ValueOf(&transport.SSHRWTimeout).Elem(),
-		"WindowsShellExt":         reflect.ValueOf(constant.MakeFromLiteral("\".bat\"", token.STRING, 0)),
+		"ArchAmd64":                   reflect.ValueOf(constant.MakeFromLiteral("\"amd64\"", token.STRING, 0)),
+		"ArchArm":                     reflect.ValueOf(constant.MakeFromLiteral("\"arm\"", token.STRING, 0)),
+		"ArchI386":                    reflect.ValueOf(constant.MakeFromLiteral("\"386\"", token.STRING, 0)),
+		"ArchUnknown":                 reflect.ValueOf(constant.MakeFromLiteral("\"unknown\"", token.STRING, 0)),
+		"AuthWithAgent":               reflect.ValueOf(transport.AuthWithAgent),
+		"AuthWithCertificate":         reflect.ValueOf(transport.AuthWithCertificate),
+		"AuthWithKeyboardInteractive": reflect.ValueOf(transport.AuthWithKeyboardInteractive),
+		"AuthWithPrivateKeyBytes":     reflect.ValueOf(transport.AuthWithPrivateKeyBytes),
+		"CmiTimeLayout":               reflect.ValueOf(constant.MakeFromLiteral("\"20060102150405.999999\"", token.STRING, 0)),
+		"DefaultPtyCols":              reflect.ValueOf(constant.MakeFromLiteral("200", token.INT, 0)),
+		"DefaultPtyRows":              reflect.ValueOf(constant.MakeFromLiteral("40", token.INT, 0)),
+		"DefaultRWTimeoutSec":         reflect.ValueOf(&transport.DefaultRWTimeoutSec).Elem(),
+		"DefaultTimeoutSec":           reflect.ValueOf(&transport.DefaultTimeoutSec).Elem(),
+		"Dial":                        reflect.ValueOf(transport.Dial),
+		"DialWithJump":                reflect.ValueOf(transport.DialWithJump),
+		"DialWithProxy":               reflect.ValueOf(transport.DialWithProxy),
+		"ErrNotCertificate":           reflect.ValueOf(&transport.ErrNotCertificate).Elem(),
+		"ErrProxyAuth":                reflect.ValueOf(&transport.ErrProxyAuth).Elem(),
+		"ErrProxyType":                reflect.ValueOf(&transport.ErrProxyType).Elem(),
+		"GOOSDarwin":                  reflect.ValueOf(constant.MakeFromLiteral("\"darwin\"", token.STRING, 0)),
+		"GOOSFreeBSD":                 reflect.ValueOf(constant.MakeFromLiteral("\"freebsd\"", token.STRING, 0)),
+		"GOOSLinux":                   reflect.ValueOf(constant.MakeFromLiteral("\"linux\"", token.STRING, 0)),
+		"GOOSUnknown":                 reflect.ValueOf(constant.MakeFromLiteral("\"unknown\"", token.STRING, 0)),
+		"GOOSWindows":                 reflect.ValueOf(constant.MakeFromLiteral("\"windows\"", token.STRING, 0)),
+		"GetAllStats":                 reflect.ValueOf(transport.GetAllStats),
+		"KeepAliveMessage":            reflect.ValueOf(constant.MakeFromLiteral("\"keepalive@golang.org\"", token.STRING, 0)),
+		"KillSignal":                  reflect.ValueOf(constant.MakeFromLiteral("\"0x09\"", token.STRING, 0)),
+		"LinuxShellExt":               reflect.ValueOf(constant.MakeFromLiteral("\".sh\"", token.STRING, 0)),
+		"New":                         reflect.ValueOf(transport.New),
+		"NewStatus":                   reflect.ValueOf(transport.NewStatus),
+		"ParseCertificate":            reflect.ValueOf(transport.ParseCertificate),
+		"ParseProxy":                  reflect.ValueOf(transport.ParseProxy),
+		"ProxyTypeHttp":               reflect.ValueOf(constant.MakeFromLiteral("\"http\"", token.STRING, 0)),
+		"ProxyTypeSocks5":             reflect.ValueOf(constant.MakeFromLiteral("\"socks5\"", token.STRING, 0)),
+		"RegisterSessionGauge":        reflect.ValueOf(transport.RegisterSessionGauge),
+		"SSHDialTimeout":              reflect.ValueOf(&transport.SSHDialTimeout).Elem(),
+		"SSHRWTimeout":                reflect.ValueOf(&transport.SSHRWTimeout).Elem(),
+		"SerializeAddr":               reflect.ValueOf(transport.SerializeAddr),
+		"WindowsShellExt":             reflect.ValueOf(constant.MakeFromLiteral("\".bat\"", token.STRING, 0)),
 
 		// type definitions
-		"CPUInfo":      reflect.ValueOf((*transport.CPUInfo)(nil)),
-		"Client":       reflect.ValueOf((*transport.Client)(nil)),
-		"ClientConfig": reflect.ValueOf((*transport.ClientConfig)(nil)),
-		"FSInfo":       reflect.ValueOf((*transport.FSInfo)(nil)),
-		"Gauge":        reflect.ValueOf((*transport.Gauge)(nil)),
-		"MachineInfo":  reflect.ValueOf((*transport.MachineInfo)(nil)),
-		"NetIntfInfo":  reflect.ValueOf((*transport.NetIntfInfo)(nil)),
-		"Session":      reflect.ValueOf((*transport.Session)(nil)),
-		"Stats":        reflect.ValueOf((*transport.Stats)(nil)),
+		"CPUInfo":                 reflect.ValueOf((*transport.CPUInfo)(nil)),
+		"Client":                  reflect.ValueOf((*transport.Client)(nil)),
+		"ClientConfig":            reflect.ValueOf((*transport.ClientConfig)(nil)),
+		"FSInfo":                  reflect.ValueOf((*transport.FSInfo)(nil)),
+		"Gauge":                   reflect.ValueOf((*transport.Gauge)(nil)),
+		"JumpClientFunc":          reflect.ValueOf((*transport.JumpClientFunc)(nil)),
+		"KeyboardInteractiveFunc": reflect.ValueOf((*transport.KeyboardInteractiveFunc)(nil)),
+		"MachineInfo":             reflect.ValueOf((*transport.MachineInfo)(nil)),
+		"NetIntfInfo":             reflect.ValueOf((*transport.NetIntfInfo)(nil)),
+		"PromptRequiredError":     reflect.ValueOf((*transport.PromptRequiredError)(nil)),
+		"ProxyConfig":             reflect.ValueOf((*transport.ProxyConfig)(nil)),
+		"ProxyError":              reflect.ValueOf((*transport.ProxyError)(nil)),
+		"Session":                 reflect.ValueOf((*transport.Session)(nil)),
+		"Stats":                   reflect.ValueOf((*transport.Stats)(nil)),
 
 		// interface wrapper definitions
 		"_Gauge": reflect.ValueOf((*_github_com_ssbeatty_oms_pkg_transport_Gauge)(nil)),
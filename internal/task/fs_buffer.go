@@ -2,7 +2,6 @@ package task
 
 import (
 	"bytes"
-	"fmt"
 	"os"
 	"sync"
 	"time"
@@ -22,28 +21,39 @@ func NewSyncBuffer(fd *os.File) *syncBuffer {
 
 type syncBuffer struct {
 	bytes.Buffer
-	fd   *os.File
-	quit chan struct{}
-	mu   sync.Mutex
+	fd      *os.File
+	quit    chan struct{}
+	mu      sync.Mutex
+	written int64 // 已经写入的字节数, 即下一次写入在文件中的偏移
 }
 
 func (w *syncBuffer) Write(p []byte) (int, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	return w.Buffer.Write(p)
+	n, err := w.Buffer.Write(p)
+	w.written += int64(n)
+	return n, err
 }
 
-func (w *syncBuffer) WriteWithMsg(output []byte, msg string) (int, error) {
+// WriteWithMsg 先写入 msg 再写入 output, 返回 output 在文件中的偏移
+func (w *syncBuffer) WriteWithMsg(output []byte, msg string) (int64, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	_, _ = fmt.Fprintf(&w.Buffer, msg)
+	n, _ := w.Buffer.WriteString(msg)
+	w.written += int64(n)
+	offset := w.written
 
-	return w.Buffer.Write(output)
+	n, err := w.Buffer.Write(output)
+	w.written += int64(n)
+	return offset, err
 }
 
 func (w *syncBuffer) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	if w.Buffer.Len() != 0 {
 		_, err := w.fd.Write(w.Buffer.Bytes())
 		if err != nil {
@@ -2,6 +2,7 @@ package task
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ssbeatty/oms/internal/config"
 	"github.com/ssbeatty/oms/internal/models"
@@ -13,6 +14,7 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,26 +26,33 @@ const (
 	JobStatusSchedule JobStatus = "schedule"
 	JobStatusStopped  JobStatus = "stopped"
 
-	MarkText     = "###mark###"
-	ErrorText    = "[error]"
-	DoneMartText = "###done###"
+	MarkText      = "###mark###"
+	ErrorText     = "[error]"
+	DoneMartText  = "###done###"
+	CancelledText = "[cancelled]" // 实例被取消时跟在结束标记之后
+	TimeoutText   = "[timeout]"   // 实例超时时跟在结束标记之后
 )
 
 // Job is cron task or long task
 type Job struct {
-	ID      int
-	name    string
-	hosts   []*models.Host
-	cmd     string
-	cmdType string
-	status  atomic.Value
-	log     string // log path
-	spec    string
-	engine  *Manager
-	cmdId   int
+	ID       int
+	name     string
+	hosts    []*models.Host
+	cmd      string
+	cmdType  string
+	status   atomic.Value
+	log      string // log path
+	spec     string
+	engine   *Manager
+	cmdId    int
+	strategy models.ExecStrategy
+	retry    models.RetryPolicy
+	overlap  string
+	// running 重叠策略为 skip 或 queue 时, 定时调度和手动执行共用, 保证同一时间只有一个实例
+	running sync.Mutex
 }
 
-func (m *Manager) NewJob(id int, name, cmd, spec, cmdType string, cmdId int, host []*models.Host) *Job {
+func (m *Manager) NewJob(id int, name, cmd, spec, cmdType string, cmdId int, host []*models.Host, strategy models.ExecStrategy, retry models.RetryPolicy, overlap string) *Job {
 
 	if name == "" {
 		name = strconv.Itoa(id)
@@ -51,81 +60,218 @@ func (m *Manager) NewJob(id int, name, cmd, spec, cmdType string, cmdId int, hos
 	log := filepath.Join(path.Join(m.config().App.DataPath, config.DefaultTaskTmpPath), fmt.Sprintf("%d-%s", id, name))
 
 	job := &Job{
-		ID:      id,
-		name:    name,
-		hosts:   host,
-		cmd:     cmd,
-		cmdType: cmdType,
-		spec:    spec,
-		engine:  m,
-		log:     log,
-		cmdId:   cmdId,
+		ID:       id,
+		name:     name,
+		hosts:    host,
+		cmd:      cmd,
+		cmdType:  cmdType,
+		spec:     spec,
+		engine:   m,
+		log:      log,
+		cmdId:    cmdId,
+		strategy: strategy,
+		retry:    retry,
+		overlap:  overlap,
 	}
 	job.UpdateStatus(JobStatusSchedule)
 
 	return job
 }
 
-func (j *Job) runPlayer(ctx context.Context, client *transport.Client) ([]byte, error) {
+func (j *Job) runPlayer(ctx context.Context, client *transport.Client) ([]byte, int, error) {
 	modPlayer, err := models.GetPlayBookById(j.cmdId)
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
 	steps, err := j.engine.sshManager.ParseSteps(modPlayer.Steps)
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
 	player := ssh.NewPlayer(client, steps, true, nil)
 
-	return player.Run(ctx)
-
+	output, err := player.Run(ctx)
+	if err != nil {
+		return output, -1, err
+	}
+	if code := player.ExitCode(); code != 0 {
+		return output, code, fmt.Errorf("playbook step failed, exit code: %d", code)
+	}
+	return output, 0, nil
 }
 
-func (j *Job) runCmd(ctx context.Context, client *transport.Client) ([]byte, error) {
-	session, err := client.NewPty()
+func (j *Job) runCmd(ctx context.Context, client *transport.Client) (*transport.ExecResult, error) {
+	session, err := client.NewSession()
 	if err != nil {
-		j.engine.logger.Errorf("create new session failed, host name: %s, err: %v", err)
+		j.engine.logger.Errorf("create new session failed, host: %s, err: %v", client.Conf.Host, err)
+		return nil, err
 	}
 	defer session.Close()
 
-	return session.SudoContext(ctx, j.cmd, client.Conf.Password)
+	return session.SudoExecContext(ctx, j.cmd, client.Conf.Password)
 }
 
-func (j *Job) run(client *transport.Client, host *models.Host, wg *sync.WaitGroup, std *syncBuffer) {
-	defer wg.Done()
-
+func (j *Job) run(ctx context.Context, client *transport.Client, host *models.Host, attempt int, std *syncBuffer) *models.TaskInstanceHostResult {
 	var (
 		err    error
 		output []byte
+		result = &models.TaskInstanceHostResult{
+			HostId:    host.Id,
+			HostName:  host.Name,
+			Status:    models.HostResultSuccess,
+			ExitCode:  -1,
+			StartTime: time.Now(),
+			Attempt:   attempt,
+		}
 	)
 
+	hostCtx := ctx
+	if j.retry.HostTimeout > 0 {
+		var cancel context.CancelFunc
+		hostCtx, cancel = context.WithTimeout(ctx, time.Duration(j.retry.HostTimeout)*time.Second)
+		defer cancel()
+	}
+
 	switch j.cmdType {
 	case ssh.CMDTypePlayer:
-		output, err = j.runPlayer(context.Background(), client)
+		output, result.ExitCode, err = j.runPlayer(hostCtx, client)
 	default:
-		output, err = j.runCmd(context.Background(), client)
+		var res *transport.ExecResult
+		res, err = j.runCmd(hostCtx, client)
+		if res != nil {
+			output = res.Combined
+			result.ExitCode = res.ExitCode
+			result.Signal = res.Signal
+		}
 	}
+	result.EndTime = time.Now()
 
-	if err != nil {
+	status, reason := interruptReason(ctx)
+	if reason == nil && hostCtx.Err() != nil {
+		status, reason = models.HostResultTimeout, ErrHostTimeout
+	}
+	if reason != nil {
+		// 远端的会话已经关闭, 保留中断之前的输出
+		err = reason
+		result.Status = status
+		result.Error = err.Error()
+		output = append(output, fmt.Sprintf("\n[%s]: %s\n", strings.ToUpper(status), err)...)
+	} else if err != nil {
 		j.engine.logger.Errorf("error when run cmd: %v, host name: %s, msg: %s", err, host.Name, output)
-		_, err = std.WriteWithMsg(output, fmt.Sprintf("%s[host_id:%d]%s\n", MarkText, host.Id, ErrorText))
-		return
+		result.Status = models.HostResultFailed
+		result.Error = err.Error()
+		if len(output) == 0 {
+			output = []byte(err.Error())
+		}
 	}
 
-	_, err = std.WriteWithMsg(output, fmt.Sprintf("%s[host_id:%d]\n", MarkText, host.Id))
+	mark := &HostMark{
+		HostId:   host.Id,
+		ExitCode: result.ExitCode,
+		Signal:   result.Signal,
+		Duration: result.EndTime.Sub(result.StartTime).Round(time.Millisecond),
+		Attempt:  attempt,
+		Failed:   err != nil,
+	}
+	offset, werr := std.WriteWithMsg(output, mark.String()+"\n")
+	if werr != nil {
+		j.engine.logger.Debugf("error write outputs, err: %v", werr)
+	}
+	result.OutputOffset = offset
+	result.OutputSize = int64(len(output))
+
+	return result
+}
+
+// runHost 校验后在主机上执行, 失败时按重试策略重新执行, 每次尝试都会保存结果, 返回最后一次的结果
+func (j *Job) runHost(ctx context.Context, instance *models.TaskInstance, host *models.Host, denied map[int]string, std *syncBuffer) *models.TaskInstanceHostResult {
+	if reason, ok := denied[host.Id]; ok {
+		result := writeHostError(std, host, 1, models.HostResultFailed, reason, time.Now())
+		j.saveHostResult(instance, result)
+		return result
+	}
+
+	for attempt := 1; ; attempt++ {
+		result, connectErr := j.attemptHost(ctx, host, attempt, std)
+		j.saveHostResult(instance, result)
+		if result.Status == models.HostResultSuccess || ctx.Err() != nil || !j.retry.ShouldRetry(attempt, connectErr) {
+			return result
+		}
+
+		backoff := j.retry.Backoff(attempt)
+		j.engine.logger.Infof("job, name: %s, host: %s, attempt %d failed, retry after %s", j.name, host.Name, attempt, backoff)
+		select {
+		case <-ctx.Done():
+			return result
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// attemptHost 连接主机并执行一次, connectErr 表示连接主机失败
+func (j *Job) attemptHost(ctx context.Context, host *models.Host, attempt int, std *syncBuffer) (result *models.TaskInstanceHostResult, connectErr bool) {
+	start := time.Now()
+	// 任务由系统执行, 使用内置CA时证书的身份为 SystemCertUser
+	client, err := j.engine.sshManager.NewClientWithSftp(host, ssh.ClientOptions{})
 	if err != nil {
-		j.engine.logger.Debugf("error write outputs, err: %v", err)
+		j.engine.logger.Errorf("error when new ssh client, host name: %s, err: %v", host.Name, err)
+		return writeHostError(std, host, attempt, models.HostResultFailed, err.Error(), start), true
+	}
+	if _, reason := interruptReason(ctx); reason != nil {
+		return writeHostError(std, host, attempt, models.HostResultSkipped, reason.Error(), start), false
 	}
 
+	return j.run(ctx, client, host, attempt, std), false
+}
+
+// interruptReason ctx 结束的原因和被中断的主机的状态, 没有结束时 reason 为 nil
+func interruptReason(ctx context.Context) (status string, reason error) {
+	switch ctx.Err() {
+	case nil:
+		return "", nil
+	case context.DeadlineExceeded:
+		return models.HostResultTimeout, ErrJobTimeout
+	default:
+		return models.HostResultCancelled, ErrInstanceCancelled
+	}
+}
+
+// writeHostError 记录没有执行命令的主机
+func writeHostError(std *syncBuffer, host *models.Host, attempt int, status, reason string, start time.Time) *models.TaskInstanceHostResult {
+	mark := &HostMark{HostId: host.Id, ExitCode: -1, Attempt: attempt, Failed: true}
+	output := []byte(fmt.Sprintf("[FATIL ERROR]: %s: \n", reason))
+	offset, _ := std.WriteWithMsg(output, mark.String()+"\n")
+
+	return &models.TaskInstanceHostResult{
+		HostId:       host.Id,
+		HostName:     host.Name,
+		Status:       status,
+		ExitCode:     -1,
+		Error:        reason,
+		StartTime:    start,
+		EndTime:      time.Now(),
+		OutputOffset: offset,
+		OutputSize:   int64(len(output)),
+		Attempt:      attempt,
+	}
+}
+
+func (j *Job) saveHostResult(instance *models.TaskInstance, result *models.TaskInstanceHostResult) {
+	result.InstanceId = instance.Id
+	if err := models.InsertTaskInstanceHostResult(result); err != nil {
+		j.engine.logger.Errorf("error when save host result, instance_id: %d, host name: %s, err: %v",
+			instance.Id, result.HostName, err)
+	}
 }
 
 func (j *Job) exec() {
+	j.execHosts(j.hosts)
+}
+
+// execHosts 在指定的主机上执行一次, 用于重新执行失败的主机
+func (j *Job) execHosts(hosts []*models.Host) {
 	j.engine.logger.Debugf("job, name: %s, cmd: %s, running.", j.name, j.cmd)
 	defer j.engine.logger.Debugf("job, name: %s, cmd: %s, done.", j.name, j.cmd)
 
-	var wg sync.WaitGroup
-	wg.Add(len(j.hosts))
-
 	instance, err := j.createInstance()
 	if err != nil {
 		j.engine.logger.Errorf("error when create instance, err: %v", err)
@@ -140,27 +286,108 @@ func (j *Job) exec() {
 
 	std := NewSyncBuffer(fd)
 
-	defer std.Close()
+	// 注册到 manager, 执行中可以通过 CancelInstance 取消
+	ctx, cancel := context.WithCancel(context.Background())
+	if j.retry.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, time.Duration(j.retry.Timeout)*time.Second)
+		defer cancelTimeout()
+	}
+	j.engine.instances.Store(instance.Id, cancel)
+	defer func() {
+		j.engine.instances.Delete(instance.Id)
+		cancel()
+	}()
 
 	_ = instance.UpdateStatus(models.InstanceStatusRunning)
-	for _, host := range j.hosts {
-		client, err := j.engine.sshManager.NewClientWithSftp(host)
+	denied := j.checkCommand(hosts)
+	skipped := ssh.RunWithStrategy(ctx, j.strategy, hosts, func(host *models.Host) bool {
+		result := j.runHost(ctx, instance, host, denied, std)
 
-		if err != nil {
-			j.engine.logger.Errorf("error when new ssh client, host name: %s, err: %v", err, host.Name)
+		return result.Status == models.HostResultSuccess
+	})
 
-			_, _ = fmt.Fprintf(std, "%s[host_id:%d]%s\n[FATIL ERROR]: %s: \n", MarkText, host.Id, ErrorText, err.Error())
-			continue
-		}
+	_, reason := interruptReason(ctx)
+	if reason == nil {
+		reason = ssh.ErrBatchAborted
+	}
+	if len(skipped) > 0 {
+		j.engine.logger.Errorf("job, name: %s, %v, %d hosts skipped", j.name, reason, len(skipped))
+	}
+	for _, host := range skipped {
+		j.saveHostResult(instance, writeHostError(std, host, 1, models.HostResultSkipped, reason.Error(), time.Now()))
+	}
 
-		go j.run(client, host, &wg, std)
+	done, status := DoneMartText, models.InstanceStatusDone
+	switch ctx.Err() {
+	case context.Canceled:
+		done, status = done+CancelledText, models.InstanceStatusCancelled
+	case context.DeadlineExceeded:
+		done, status = done+TimeoutText, models.InstanceStatusTimeout
 	}
+	_, _ = fmt.Fprintf(std, "%s\n", done)
+	// 先写完日志再结束实例, 实时日志读到结束状态时不会漏掉最后的输出
+	std.Close()
 
-	wg.Wait()
+	if status != models.InstanceStatusDone {
+		j.engine.logger.Infof("job, name: %s, instance: %d, %s.", j.name, instance.Id, status)
+	}
+	_ = instance.Finish(status)
+}
 
-	_, _ = fmt.Fprintf(std, "%s\n", DoneMartText)
+// checkCommand 按危险命令规则校验任务的命令或者剧本每一步的命令, 返回被拒绝的主机和原因, 校验出错时拒绝所有主机
+func (j *Job) checkCommand(hosts []*models.Host) map[int]string {
+	req := &ssh.GuardRequest{
+		Source:     ssh.GuardSourceJob,
+		Actor:      fmt.Sprintf("job:%s", j.name),
+		Cmd:        j.cmd,
+		Hosts:      hosts,
+		Unattended: true,
+	}
+	// 执行时重新读取确认范围, 确认之后修改的剧本和分组新加入的主机命中 confirm 规则时拒绝
+	job, err := models.GetJobById(j.ID)
+	if err == nil {
+		req.Confirmed = &job.GuardConfirmation
+	}
+	if err == nil && j.cmdType == ssh.CMDTypePlayer {
+		req.Cmd = ""
+		req.Cmds, err = j.playerCommands()
+	}
+	if err == nil {
+		err = j.engine.sshManager.Guard().Check(req)
+	}
+	if err == nil {
+		return nil
+	}
+	j.engine.logger.Errorf("job, name: %s, cmd: %s, rejected by command guard: %v", j.name, j.cmd, err)
+
+	denied := make(map[int]string)
+	var deniedErr *ssh.CommandDeniedError
+	if errors.As(err, &deniedErr) {
+		for _, hit := range deniedErr.Hits {
+			reason := fmt.Sprintf("command denied by rule %q", hit.Rule.Name)
+			if hit.Rule.Action == models.CommandRuleConfirm {
+				reason = fmt.Sprintf("command requires confirmation by rule %q, save the job again to confirm", hit.Rule.Name)
+			}
+			for _, host := range hit.Hosts {
+				denied[host.Id] = reason
+			}
+		}
+		return denied
+	}
+	for _, host := range hosts {
+		denied[host.Id] = err.Error()
+	}
+	return denied
+}
 
-	_ = instance.Done()
+// playerCommands 剧本每一步的命令, 执行时重新读取剧本, 保存任务之后修改的剧本也会校验
+func (j *Job) playerCommands() ([]string, error) {
+	modPlayer, err := models.GetPlayBookById(j.cmdId)
+	if err != nil {
+		return nil, err
+	}
+	return j.engine.sshManager.PlayerCommands(modPlayer.Steps)
 }
 
 func (j *Job) Run() {
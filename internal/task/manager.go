@@ -5,7 +5,9 @@ Manager of cron | task , base on ssh Manager
 package task
 
 import (
+	"context"
 	"errors"
+	"github.com/robfig/cron/v3"
 	"github.com/ssbeatty/oms/internal/config"
 	"github.com/ssbeatty/oms/internal/models"
 	"github.com/ssbeatty/oms/internal/ssh"
@@ -21,14 +23,26 @@ import (
 	"sync/atomic"
 )
 
+var (
+	ErrInstanceNotRunning = errors.New("instance is not running")
+	// ErrInstanceCancelled 实例被取消, 记录在被中断和没有执行的主机上
+	ErrInstanceCancelled = errors.New("instance cancelled")
+	// ErrJobTimeout 一次执行超过了任务的超时时间
+	ErrJobTimeout = errors.New("job timeout")
+	// ErrHostTimeout 一次尝试超过了每台主机的超时时间
+	ErrHostTimeout = errors.New("host timeout")
+)
+
 type Manager struct {
 	// cron schedule engine
 	taskService *schedule.Schedule
 	// all cron & task in map
 	taskPoll *utils.SafeMap
-	onceJob  sync.Once
-	logger   *logger.Logger
-	cfg      atomic.Value
+	// running instance id => context.CancelFunc
+	instances *utils.SafeMap
+	onceJob   sync.Once
+	logger    *logger.Logger
+	cfg       atomic.Value
 
 	// base
 	sshManager *ssh.Manager
@@ -38,6 +52,7 @@ func NewManager(sshManager *ssh.Manager, cfg *config.Conf) *Manager {
 	manager := &Manager{
 		taskService: schedule.NewSchedule(),
 		taskPoll:    utils.NewSafeMap(),
+		instances:   utils.NewSafeMap(),
 		onceJob:     sync.Once{},
 		sshManager:  sshManager,
 		logger:      logger.NewLogger("taskManager"),
@@ -82,6 +97,12 @@ func (m *Manager) Init() *Manager {
 	if err := m.taskService.AddByFunc("build-in-loop-clear-upload", "0 0 0 * * *", m.CronClearUploadFiles, true); err != nil {
 		m.logger.Errorf("init build-in-loop-clear-upload: %v", err)
 	}
+	if err := m.taskService.AddByFunc("build-in-loop-clear-session", "0 0 * * * *", m.CronClearUserSession, true); err != nil {
+		m.logger.Errorf("init build-in-loop-clear-session: %v", err)
+	}
+	if err := m.taskService.AddByFunc("build-in-loop-clear-recording", "0 30 0 * * *", m.CronClearSessionRecording, true); err != nil {
+		m.logger.Errorf("init build-in-loop-clear-recording: %v", err)
+	}
 
 	// path for job log
 	err := os.MkdirAll(path.Join(m.config().App.DataPath, config.DefaultTmpPath), fs.ModePerm)
@@ -158,7 +179,7 @@ func (m *Manager) NewRealJob(modelJob *models.Job) (*Job, error) {
 	}
 
 	realJob := m.NewJob(
-		modelJob.Id, modelJob.Name, modelJob.Cmd, modelJob.Spec, modelJob.CmdType, modelJob.CmdId, hosts)
+		modelJob.Id, modelJob.Name, modelJob.Cmd, modelJob.Spec, modelJob.CmdType, modelJob.CmdId, hosts, modelJob.ExecStrategy, modelJob.RetryPolicy, modelJob.OverlapPolicy)
 
 	return realJob, nil
 }
@@ -200,7 +221,7 @@ func (m *Manager) ScheduleJob(job *Job) error {
 	if existed {
 		return nil
 	}
-	err := m.taskService.AddByJob(jId, job.spec, job)
+	err := m.taskService.AddByJob(jId, job.spec, cron.NewChain(job.overlapWrappers()...).Then(job))
 	if err != nil {
 		m.logger.Errorf("error when register job, err: %v", err)
 		return err
@@ -224,10 +245,37 @@ func (m *Manager) ExecJob(modelJob *models.Job) error {
 		}
 	}
 
-	realJob.exec()
+	return realJob.execOnce(realJob.hosts)
+}
 
-	return nil
+// ExecJobHosts 在指定的主机上单次执行任务, 用于重新执行失败的主机
+func (m *Manager) ExecJobHosts(modelJob *models.Job, hosts []*models.Host) error {
+	var (
+		err error
+	)
 
+	m.logger.Infof("received signal to exec job once on %d hosts: %s", len(hosts), modelJob.Name)
+	realJob, ok := m.GetJob(modelJob.Id)
+	if !ok {
+		realJob, err = m.NewRealJob(modelJob)
+		if err != nil {
+			return err
+		}
+	}
+
+	return realJob.execOnce(hosts)
+}
+
+// CancelInstance 取消正在执行的实例, 正在执行的主机会被中断, 剩余的主机不再执行
+func (m *Manager) CancelInstance(id int) error {
+	cancel, ok := m.instances.Load(id)
+	if !ok {
+		return ErrInstanceNotRunning
+	}
+	m.logger.Infof("received signal to cancel instance: %d", id)
+	cancel.(context.CancelFunc)()
+
+	return nil
 }
 
 // StartJob 从models注册并启动调度
@@ -0,0 +1,76 @@
+package task
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var markFieldRegex = regexp.MustCompile(`\[(\w+):([^\]]*)]`)
+
+// HostMark 日志中每台主机输出之前的标记行, 例如:
+// ###mark###[host_id:1][exit_code:2][duration:1.2s][signal:KILL][attempt:2][error]
+// host_id 总是第一个字段, 失败时以 [error] 结尾, 第一次尝试不写 attempt
+type HostMark struct {
+	HostId   int
+	ExitCode int // 没有退出码(连接失败, 被拒绝等)时为 -1
+	Signal   string
+	Duration time.Duration
+	Attempt  int
+	Failed   bool
+}
+
+func (m *HostMark) String() string {
+	var b strings.Builder
+
+	b.WriteString(MarkText)
+	_, _ = fmt.Fprintf(&b, "[host_id:%d][exit_code:%d][duration:%s]", m.HostId, m.ExitCode, m.Duration)
+	if m.Signal != "" {
+		_, _ = fmt.Fprintf(&b, "[signal:%s]", m.Signal)
+	}
+	if m.Attempt > 1 {
+		_, _ = fmt.Fprintf(&b, "[attempt:%d]", m.Attempt)
+	}
+	if m.Failed {
+		b.WriteString(ErrorText)
+	}
+	return b.String()
+}
+
+// ParseHostMark 解析标记行, 兼容只有 host_id 的旧日志
+func ParseHostMark(line string) (*HostMark, error) {
+	if !strings.HasPrefix(line, MarkText) {
+		return nil, fmt.Errorf("not a host mark: %s", line)
+	}
+	mark := &HostMark{
+		ExitCode: -1,
+		Attempt:  1,
+		Failed:   strings.HasSuffix(line, ErrorText),
+	}
+	hasId := false
+	for _, field := range markFieldRegex.FindAllStringSubmatch(line, -1) {
+		var err error
+		switch field[1] {
+		case "host_id":
+			mark.HostId, err = strconv.Atoi(field[2])
+			hasId = err == nil
+		case "exit_code":
+			mark.ExitCode, err = strconv.Atoi(field[2])
+		case "duration":
+			mark.Duration, err = time.ParseDuration(field[2])
+		case "signal":
+			mark.Signal = field[2]
+		case "attempt":
+			mark.Attempt, err = strconv.Atoi(field[2])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse field %s of host mark: %v", field[1], err)
+		}
+	}
+	if !hasId {
+		return nil, fmt.Errorf("host_id not found in host mark: %s", line)
+	}
+	return mark, nil
+}
@@ -0,0 +1,91 @@
+package task
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHostMark(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want *HostMark
+	}{
+		{
+			"legacy",
+			"###mark###[host_id:3]",
+			&HostMark{HostId: 3, ExitCode: -1, Attempt: 1},
+		},
+		{
+			"legacy error",
+			"###mark###[host_id:3][error]",
+			&HostMark{HostId: 3, ExitCode: -1, Attempt: 1, Failed: true},
+		},
+		{
+			"full",
+			"###mark###[host_id:1][exit_code:2][duration:1.2s][signal:KILL][attempt:2][error]",
+			&HostMark{HostId: 1, ExitCode: 2, Signal: "KILL", Duration: 1200 * time.Millisecond, Attempt: 2, Failed: true},
+		},
+		{
+			"success",
+			"###mark###[host_id:1][exit_code:0][duration:150ms]",
+			&HostMark{HostId: 1, ExitCode: 0, Duration: 150 * time.Millisecond, Attempt: 1},
+		},
+		{
+			"unknown field",
+			"###mark###[host_id:1][foo:bar]",
+			&HostMark{HostId: 1, ExitCode: -1, Attempt: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHostMark(tt.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseHostMark() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHostMarkInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"no prefix", "[host_id:1]"},
+		{"output", "hello world"},
+		{"no host id", "###mark###[exit_code:0]"},
+		{"bad host id", "###mark###[host_id:abc]"},
+		{"bad exit code", "###mark###[host_id:1][exit_code:x]"},
+		{"bad duration", "###mark###[host_id:1][duration:1x]"},
+		{"bad attempt", "###mark###[host_id:1][attempt:]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if mark, err := ParseHostMark(tt.line); err == nil {
+				t.Errorf("ParseHostMark(%q) = %+v, want error", tt.line, mark)
+			}
+		})
+	}
+}
+
+func TestHostMarkRoundTrip(t *testing.T) {
+	marks := []*HostMark{
+		{HostId: 1, ExitCode: 0, Duration: time.Second, Attempt: 1},
+		{HostId: 2, ExitCode: -1, Duration: 0, Attempt: 1, Failed: true},
+		{HostId: 3, ExitCode: 137, Signal: "KILL", Duration: 2500 * time.Millisecond, Attempt: 3, Failed: true},
+	}
+	for _, mark := range marks {
+		got, err := ParseHostMark(mark.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, mark) {
+			t.Errorf("ParseHostMark(%q) = %+v, want %+v", mark.String(), got, mark)
+		}
+	}
+}
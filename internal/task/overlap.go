@@ -0,0 +1,81 @@
+package task
+
+import (
+	"errors"
+	"github.com/robfig/cron/v3"
+	"github.com/ssbeatty/oms/internal/models"
+	"sync"
+	"time"
+)
+
+// ErrJobRunning 重叠策略为 skip 或 queue 时上一次执行还没有结束, 拒绝手动执行
+var ErrJobRunning = errors.New("job is still running")
+
+// overlapWrappers 按任务的重叠策略包装 cron 调度的任务, 和手动执行共用 j.running
+func (j *Job) overlapWrappers() []cron.JobWrapper {
+	switch j.overlap {
+	case models.OverlapSkip:
+		return []cron.JobWrapper{skipIfStillRunning(&j.running, j.skip)}
+	case models.OverlapQueue:
+		return []cron.JobWrapper{delayIfStillRunning(&j.running, j.delay)}
+	default:
+		return nil
+	}
+}
+
+// skipIfStillRunning 同 cron.SkipIfStillRunning, 上一次执行还没有结束时调用 onSkip
+func skipIfStillRunning(running *sync.Mutex, onSkip func()) cron.JobWrapper {
+	return func(job cron.Job) cron.Job {
+		return cron.FuncJob(func() {
+			if !running.TryLock() {
+				onSkip()
+				return
+			}
+			defer running.Unlock()
+			job.Run()
+		})
+	}
+}
+
+// delayIfStillRunning 同 cron.DelayIfStillRunning, 等待上一次执行结束后再执行
+func delayIfStillRunning(running *sync.Mutex, onDelay func()) cron.JobWrapper {
+	return func(job cron.Job) cron.Job {
+		return cron.FuncJob(func() {
+			if !running.TryLock() {
+				onDelay()
+				running.Lock()
+			}
+			defer running.Unlock()
+			job.Run()
+		})
+	}
+}
+
+// execOnce 手动执行和重新执行, 重叠策略为 skip 或 queue 时不能和其他实例同时执行
+func (j *Job) execOnce(hosts []*models.Host) error {
+	if j.overlap == models.OverlapSkip || j.overlap == models.OverlapQueue {
+		if !j.running.TryLock() {
+			return ErrJobRunning
+		}
+		defer j.running.Unlock()
+	}
+	j.execHosts(hosts)
+	return nil
+}
+
+// delay 上一次执行还没有结束, 本次调度等待
+func (j *Job) delay() {
+	j.engine.logger.Infof("job, name: %s, previous run is still running, queued.", j.name)
+}
+
+// skip 记录一次被跳过的调度, 实例没有日志
+func (j *Job) skip() {
+	j.engine.logger.Infof("job, name: %s, previous run is still running, skipped.", j.name)
+
+	instance, err := models.InsertTaskInstance(j.ID, time.Now().Local())
+	if err != nil {
+		j.engine.logger.Errorf("error when create skipped instance, err: %v", err)
+		return
+	}
+	_ = instance.Finish(models.InstanceStatusSkipped)
+}
@@ -0,0 +1,71 @@
+package task
+
+import (
+	"errors"
+	"github.com/robfig/cron/v3"
+	"github.com/ssbeatty/oms/internal/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSkipIfStillRunning(t *testing.T) {
+	var (
+		running sync.Mutex
+		runs    int
+		skips   int
+	)
+	job := skipIfStillRunning(&running, func() { skips++ })(cron.FuncJob(func() { runs++ }))
+
+	job.Run()
+	if runs != 1 || skips != 0 {
+		t.Fatalf("runs = %d, skips = %d, want 1, 0", runs, skips)
+	}
+
+	// 手动执行持有锁时定时调度跳过
+	running.Lock()
+	job.Run()
+	running.Unlock()
+	if runs != 1 || skips != 1 {
+		t.Fatalf("runs = %d, skips = %d, want 1, 1", runs, skips)
+	}
+}
+
+func TestDelayIfStillRunning(t *testing.T) {
+	var (
+		running sync.Mutex
+		delayed = make(chan struct{}, 1)
+		done    = make(chan struct{})
+	)
+	job := delayIfStillRunning(&running, func() { delayed <- struct{}{} })(cron.FuncJob(func() { close(done) }))
+
+	running.Lock()
+	go job.Run()
+	select {
+	case <-delayed:
+	case <-time.After(time.Second):
+		t.Fatal("job is not delayed")
+	}
+	select {
+	case <-done:
+		t.Fatal("job runs before the previous run finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	running.Unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("job does not run after the previous run finished")
+	}
+}
+
+func TestExecOnceRunning(t *testing.T) {
+	for _, overlap := range []string{models.OverlapSkip, models.OverlapQueue} {
+		j := &Job{name: "test", overlap: overlap}
+		j.running.Lock()
+		if err := j.execOnce(nil); !errors.Is(err, ErrJobRunning) {
+			t.Errorf("overlap %s: execOnce() err = %v, want %v", overlap, err, ErrJobRunning)
+		}
+		j.running.Unlock()
+	}
+}
@@ -0,0 +1,217 @@
+package task
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/ssbeatty/oms/internal/models"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// 实时日志的事件类型
+	LogEventStart  = "start"  // 开始读取, 带有实例信息
+	LogEventHost   = "host"   // 一台主机执行结束, 之后的 output 都属于这台主机
+	LogEventOutput = "output" // 主机的输出
+	LogEventDone   = "done"   // 实例执行结束
+
+	tailPollInterval = 200 * time.Millisecond
+)
+
+type LogStartEvent struct {
+	Type       string    `json:"type"`
+	InstanceId int       `json:"instance_id"`
+	JobId      int       `json:"job_id"`
+	JobName    string    `json:"job_name"`
+	StartTime  time.Time `json:"start_time"`
+}
+
+type LogHostEvent struct {
+	Type     string `json:"type"`
+	HostId   int    `json:"host_id"`
+	HostName string `json:"hostname"`
+	Status   bool   `json:"status"`
+	ExitCode int    `json:"exit_code"` // 没有退出码时为 -1
+	Signal   string `json:"signal,omitempty"`
+	Duration int64  `json:"duration"` // 毫秒
+	Attempt  int    `json:"attempt"`  // 第几次尝试, 重试时同一台主机有多个事件
+}
+
+type LogOutputEvent struct {
+	Type   string `json:"type"`
+	HostId int    `json:"host_id"`
+	Data   string `json:"data"`
+}
+
+type LogDoneEvent struct {
+	Type      string `json:"type"`
+	Total     int    `json:"total"`
+	Success   int    `json:"success"`
+	Cancelled bool   `json:"cancelled"`
+	Timeout   bool   `json:"timeout"`
+}
+
+// logTailer 逐行解析日志, 连续的输出合并为一个事件
+type logTailer struct {
+	send      func(event interface{}) error
+	hostId    int
+	output    strings.Builder
+	hostNames map[int]string
+	status    map[int]bool // 每台主机最后一次尝试是否成功
+	done      bool
+}
+
+func (t *logTailer) line(line string) error {
+	switch {
+	case strings.HasPrefix(line, MarkText):
+		if err := t.flush(); err != nil {
+			return err
+		}
+		mark, err := ParseHostMark(line)
+		if err != nil {
+			return nil
+		}
+		t.hostId = mark.HostId
+		t.status[mark.HostId] = !mark.Failed
+		return t.send(&LogHostEvent{
+			Type:     LogEventHost,
+			HostId:   mark.HostId,
+			HostName: t.hostName(mark.HostId),
+			Status:   !mark.Failed,
+			ExitCode: mark.ExitCode,
+			Signal:   mark.Signal,
+			Duration: mark.Duration.Milliseconds(),
+			Attempt:  mark.Attempt,
+		})
+	case strings.HasPrefix(line, DoneMartText):
+		if err := t.flush(); err != nil {
+			return err
+		}
+		t.done = true
+		success := 0
+		for _, ok := range t.status {
+			if ok {
+				success++
+			}
+		}
+		return t.send(&LogDoneEvent{
+			Type:      LogEventDone,
+			Total:     len(t.status),
+			Success:   success,
+			Cancelled: strings.HasSuffix(line, CancelledText),
+			Timeout:   strings.HasSuffix(line, TimeoutText),
+		})
+	default:
+		t.output.WriteString(line)
+		t.output.WriteString("\n")
+		return nil
+	}
+}
+
+func (t *logTailer) flush() error {
+	if t.output.Len() == 0 {
+		return nil
+	}
+	defer t.output.Reset()
+
+	return t.send(&LogOutputEvent{Type: LogEventOutput, HostId: t.hostId, Data: t.output.String()})
+}
+
+func (t *logTailer) hostName(id int) string {
+	name, ok := t.hostNames[id]
+	if !ok {
+		if host, err := models.GetHostById(id); err == nil {
+			name = host.Name
+		}
+		t.hostNames[id] = name
+	}
+	return name
+}
+
+// TailInstanceLog 从头读取实例的日志并持续跟踪新写入的内容, 解析为事件后调用 send.
+// 读到结束标记, 或者实例已经结束并且日志已经读完时返回 nil
+func TailInstanceLog(ctx context.Context, instance *models.TaskInstance, send func(event interface{}) error) error {
+	err := send(&LogStartEvent{
+		Type:       LogEventStart,
+		InstanceId: instance.Id,
+		JobId:      instance.JobId,
+		JobName:    instance.Job.Name,
+		StartTime:  instance.StartTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		file    *os.File
+		reader  *bufio.Reader
+		partial string
+		tailer  = &logTailer{send: send, hostNames: make(map[int]string), status: make(map[int]bool)}
+		ticker  = time.NewTicker(tailPollInterval)
+	)
+	defer ticker.Stop()
+	defer func() {
+		if file != nil {
+			_ = file.Close()
+		}
+	}()
+
+	for {
+		// 先查询状态再读取, 结束状态之前写入的日志都能读到
+		finished := instance.IsFinished()
+		if !finished {
+			if latest, err := models.GetTaskInstanceById(instance.Id); err == nil {
+				finished = latest.IsFinished()
+			}
+		}
+
+		if file == nil {
+			file, err = os.Open(instance.LogPath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if file != nil {
+				reader = bufio.NewReader(file)
+			}
+		}
+
+		for reader != nil {
+			data, err := reader.ReadString('\n')
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			partial += data
+			if err != nil {
+				break
+			}
+			if err := tailer.line(strings.TrimSuffix(partial, "\n")); err != nil {
+				return err
+			}
+			partial = ""
+			if tailer.done {
+				return nil
+			}
+		}
+
+		if finished {
+			if partial != "" {
+				if err := tailer.line(partial); err != nil {
+					return err
+				}
+			}
+			return tailer.flush()
+		}
+		if err := tailer.flush(); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
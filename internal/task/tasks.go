@@ -70,3 +70,25 @@ func (m *Manager) CronClearUploadFiles() {
 	}
 
 }
+
+// CronClearUserSession clear expired user session and api token
+func (m *Manager) CronClearUserSession() {
+	if err := models.ClearExpiredSession(); err != nil {
+		m.logger.Errorf("error when clear expired user session, err: %v", err)
+	}
+	if err := models.ClearExpiredApiToken(); err != nil {
+		m.logger.Errorf("error when clear expired api token, err: %v", err)
+	}
+}
+
+// CronClearSessionRecording clear session recording out of retention
+func (m *Manager) CronClearSessionRecording() {
+	n, err := models.ClearSessionRecordings(time.Now().Add(-m.config().Recording.Retention))
+	if err != nil {
+		m.logger.Errorf("error when clear session recording, err: %v", err)
+		return
+	}
+	if n > 0 {
+		m.logger.Infof("clear %d session recordings", n)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"github.com/ssbeatty/oms/internal/models"
 	"github.com/ssbeatty/oms/internal/ssh"
 	"github.com/ssbeatty/oms/pkg/logger"
-	"github.com/ssbeatty/oms/pkg/transport"
 	"github.com/ssbeatty/oms/pkg/tunnel"
 	"github.com/ssbeatty/oms/pkg/utils"
 	"sync"
@@ -114,18 +113,15 @@ func (m *Manager) Close() {
 
 // AddTunnel create new tunnel
 func (m *Manager) AddTunnel(modelTunnel *models.Tunnel, host *models.Host) error {
-	var c = &transport.ClientConfig{
-		ID:       host.Id,
-		Host:     host.Addr,
-		Port:     host.Port,
-		User:     host.User,
-		Password: host.PassWord,
+	c, err := m.sshManager.NewClientConfig(host)
+	if err != nil {
+		return err
 	}
 
 	realTunnel := tunnel.NewSSHTunnel(c, modelTunnel.Destination, modelTunnel.Source, modelTunnel.Mode)
 	go realTunnel.Start()
 
-	_, err := models.UpdateTunnelStatus(modelTunnel.Id, realTunnel.Status(), realTunnel.GetErrorMsg())
+	_, err = models.UpdateTunnelStatus(modelTunnel.Id, realTunnel.Status(), realTunnel.GetErrorMsg())
 	if err != nil {
 		m.logger.Errorf("error when update model tunnel status, err: %v", err)
 	}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/web/payload"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var auditCSVHeader = []string{
+	"id", "created_at", "actor", "client_ip", "action", "path", "host_ids", "hosts", "summary", "result", "error",
+}
+
+func auditFilter(param *payload.GetAuditEventParam) *models.AuditFilter {
+	return &models.AuditFilter{
+		Actor:     param.Actor,
+		Action:    param.Action,
+		ClientIP:  param.ClientIP,
+		HostId:    param.HostId,
+		Result:    param.Result,
+		StartTime: param.StartTime,
+		EndTime:   param.EndTime,
+	}
+}
+
+// GetAuditEvents
+// @Summary 获取操作审计
+// @Description 分页获取操作审计, 按时间倒序
+// @Param actor query string false "操作用户"
+// @Param action query string false "操作, 模糊匹配, 例如 /api/v1/host, ws.cmd, terminal"
+// @Param client_ip query string false "客户端地址"
+// @Param host_id query int false "主机 ID"
+// @Param result query string false "结果 success/failure"
+// @Param start_time query string false "开始时间, 例如 2006-01-02 15:04:05"
+// @Param end_time query string false "结束时间, 例如 2006-01-02 15:04:05"
+// @Param page_num query int false  "页码数"
+// @Param page_size query int false  "分页尺寸" default(20)
+// @Tags audit
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=[]models.AuditEvent}
+// @Failure 400 {object} payload.Response
+// @Router /audit [get]
+func (s *Service) GetAuditEvents(c *Context) {
+	var param payload.GetAuditEventParam
+	err := c.ShouldBind(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		events, total, err := models.GetAuditEvents(auditFilter(&param), param.PageSize, param.PageNum)
+		if err != nil {
+			s.Logger.Errorf("get audit events error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(payload.PageData{
+			Data:    events,
+			Total:   total,
+			PageNum: param.PageNum,
+		})
+	}
+}
+
+// ExportAuditEvents
+// @Summary 导出操作审计
+// @Description 按条件导出操作审计为csv文件
+// @Param actor query string false "操作用户"
+// @Param action query string false "操作, 模糊匹配"
+// @Param client_ip query string false "客户端地址"
+// @Param host_id query int false "主机 ID"
+// @Param result query string false "结果 success/failure"
+// @Param start_time query string false "开始时间, 例如 2006-01-02 15:04:05"
+// @Param end_time query string false "结束时间, 例如 2006-01-02 15:04:05"
+// @Tags audit
+// @Accept x-www-form-urlencoded
+// @Produce text/csv
+// @Success 200
+// @Failure 400 {object} payload.Response
+// @Router /audit/export [get]
+func (s *Service) ExportAuditEvents(c *Context) {
+	var param payload.GetAuditEventParam
+	err := c.ShouldBind(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"audit-%s.csv\"", time.Now().Format("20060102150405")))
+	// excel 打开时需要 bom 才能识别 utf-8
+	_, _ = c.Writer.Write([]byte(Utf8Dom))
+
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write(auditCSVHeader)
+	err = models.ExportAuditEvents(auditFilter(&param), func(event *models.AuditEvent) error {
+		hostIds := make([]string, 0, len(event.HostIdList))
+		for _, id := range event.HostIdList {
+			hostIds = append(hostIds, strconv.Itoa(id))
+		}
+		return w.Write([]string{
+			strconv.Itoa(event.Id),
+			event.CreatedAt.Format(time.RFC3339),
+			csvEscape(event.Actor),
+			csvEscape(event.ClientIP),
+			csvEscape(event.Action),
+			csvEscape(event.Path),
+			strings.Join(hostIds, ","),
+			csvEscape(event.Hosts),
+			csvEscape(event.Summary),
+			csvEscape(event.Result),
+			csvEscape(event.Error),
+		})
+	})
+	if err != nil {
+		s.Logger.Errorf("export audit events error: %v", err)
+	}
+	w.Flush()
+}
+
+// csvEscape 以 = + - @ 等开头的值在表格软件中会被当作公式执行, 加上单引号前缀作为文本
+func csvEscape(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
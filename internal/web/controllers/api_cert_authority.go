@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"github.com/ssbeatty/oms/internal/models"
+	"net/http"
+)
+
+// GetCertAuthority
+// @Summary 获取内置CA
+// @Description 获取内置CA的公钥和指纹, 主机的 sshd 配置 TrustedUserCAKeys 信任该公钥后可以使用 use_ca 登录
+// @Tags cert_authority
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.CertAuthority}
+// @Failure 400 {object} payload.Response
+// @Router /ca [get]
+func (s *Service) GetCertAuthority(c *Context) {
+	ca, err := models.GetCertAuthority()
+	if err != nil {
+		c.ResponseError(err.Error())
+		return
+	}
+	c.ResponseOk(ca)
+}
+
+// GetCertAuthorityPublicKey
+// @Summary 获取内置CA公钥
+// @Description 以 authorized_keys 格式返回内置CA公钥, 可以直接写入 TrustedUserCAKeys 文件
+// @Tags cert_authority
+// @Produce plain
+// @Success 200 {string} string
+// @Failure 400 {object} payload.Response
+// @Router /ca/public_key [get]
+func (s *Service) GetCertAuthorityPublicKey(c *Context) {
+	ca, err := models.GetCertAuthority()
+	if err != nil {
+		c.ResponseError(err.Error())
+		return
+	}
+	c.String(http.StatusOK, ca.PublicKey+"\n")
+}
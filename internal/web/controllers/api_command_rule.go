@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/ssh"
+	"github.com/ssbeatty/oms/internal/web/payload"
+	"net/http"
+	"regexp"
+)
+
+// GetCommandRules
+// @Summary 获取所有危险命令规则
+// @Description 按匹配顺序获取所有危险命令规则
+// @Tags command_rule
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=[]models.CommandRule}
+// @Failure 400 {object} payload.Response
+// @Router /command/rule [get]
+func (s *Service) GetCommandRules(c *Context) {
+	rules, err := models.GetAllCommandRules()
+	if err != nil {
+		s.Logger.Errorf("get all command rules error: %v", err)
+		c.ResponseError(err.Error())
+		return
+	}
+	c.ResponseOk(rules)
+}
+
+// GetOneCommandRule
+// @Summary 获取单个危险命令规则
+// @Description 获取单个危险命令规则
+// @Param id path int true "规则 ID"
+// @Tags command_rule
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.CommandRule}
+// @Failure 400 {object} payload.Response
+// @Router /command/rule/{id} [get]
+func (s *Service) GetOneCommandRule(c *Context) {
+	var param payload.GetCommandRuleParam
+	err := c.ShouldBindUri(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		rule, err := models.GetCommandRuleById(param.Id)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(rule)
+	}
+}
+
+// PostCommandRule
+// @Summary 创建危险命令规则
+// @Description 创建危险命令规则, 按 priority 从小到大匹配, 每台主机使用第一条匹配的规则
+// @Param name formData string true "规则名称"
+// @Param pattern formData string true "匹配命令的正则表达式"
+// @Param action formData string true "动作" example(deny,confirm,allow)
+// @Param target_type formData string true "主机范围类型" example(all,host,group,tag)
+// @Param target_id formData int false "主机范围 ID"
+// @Param priority formData int false "优先级, 越小越先匹配"
+// @Param enable formData bool false "是否启用"
+// @Tags command_rule
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.CommandRule}
+// @Failure 400 {object} payload.Response
+// @Router /command/rule [post]
+func (s *Service) PostCommandRule(c *Context) {
+	var form payload.PostCommandRuleForm
+	err := c.ShouldBind(&form)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		if err := validateCommandRule(form.Pattern, form.TargetType, form.TargetId); err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		rule, err := models.InsertCommandRule(
+			form.Name, form.Pattern, form.Action, form.TargetType, form.TargetId, form.Priority, form.Enable)
+		if err != nil {
+			s.Logger.Errorf("insert command rule error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(rule)
+	}
+}
+
+// PutCommandRule
+// @Summary 更新危险命令规则
+// @Description 更新危险命令规则, 所有字段整体覆盖
+// @Param id formData int true "规则 ID"
+// @Param name formData string true "规则名称"
+// @Param pattern formData string true "匹配命令的正则表达式"
+// @Param action formData string true "动作" example(deny,confirm,allow)
+// @Param target_type formData string true "主机范围类型" example(all,host,group,tag)
+// @Param target_id formData int false "主机范围 ID"
+// @Param priority formData int false "优先级, 越小越先匹配"
+// @Param enable formData bool false "是否启用"
+// @Tags command_rule
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.CommandRule}
+// @Failure 400 {object} payload.Response
+// @Router /command/rule [put]
+func (s *Service) PutCommandRule(c *Context) {
+	var form payload.PutCommandRuleForm
+	err := c.ShouldBind(&form)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		if err := validateCommandRule(form.Pattern, form.TargetType, form.TargetId); err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		rule, err := models.UpdateCommandRule(
+			form.Id, form.Name, form.Pattern, form.Action, form.TargetType, form.TargetId, form.Priority, form.Enable)
+		if err != nil {
+			s.Logger.Errorf("update command rule error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(rule)
+	}
+}
+
+// DeleteCommandRule
+// @Summary 删除危险命令规则
+// @Description 删除危险命令规则
+// @Param id path int true "规则 ID"
+// @Tags command_rule
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response
+// @Failure 400 {object} payload.Response
+// @Router /command/rule/{id} [delete]
+func (s *Service) DeleteCommandRule(c *Context) {
+	var param payload.DeleteCommandRuleParam
+	err := c.ShouldBindUri(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		err := models.DeleteCommandRuleById(param.Id)
+		if err != nil {
+			s.Logger.Errorf("delete command rule error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(nil)
+	}
+}
+
+func validateCommandRule(pattern, targetType string, targetId int) error {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return err
+	}
+	if targetType == models.CommandRuleTargetAll {
+		return nil
+	}
+	if _, err := models.ParseHostList(targetType, targetId); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkCommand 按危险命令规则校验批量执行的命令和剧本每一步的命令, 不允许执行时返回错误响应,
+// 需要二次确认时响应中带有 confirm_token
+func (s *Service) checkCommand(c *Context, source, cmd string, steps []string, hosts []*models.Host, confirmToken string) bool {
+	err := s.sshManager.Guard().Check(&ssh.GuardRequest{
+		Source:       source,
+		User:         c.CurrentUser(),
+		ClientIP:     c.ClientIP(),
+		Cmd:          cmd,
+		Cmds:         steps,
+		Hosts:        hosts,
+		ConfirmToken: confirmToken,
+	})
+	if err == nil {
+		return true
+	}
+
+	var confirmErr *ssh.CommandConfirmError
+	if errors.As(err, &confirmErr) {
+		c.JSON(http.StatusOK, payload.GenerateErrorDataResponse(HttpStatusError, err.Error(), &payload.CommandConfirmResponse{
+			ConfirmToken: confirmErr.Token,
+			ExpiresAt:    confirmErr.ExpiresAt,
+		}))
+		return false
+	}
+	c.ResponseError(err.Error())
+	return false
+}
+
+// checkJobCommand 保存任务时校验任务的命令, 剧本任务校验剧本每一步的命令, 返回确认过的命令和主机, 定时执行时只放行确认过的
+func (s *Service) checkJobCommand(c *Context, cmdType, cmd string, cmdId int, executeType string, executeId int, confirmToken string) (models.GuardConfirmation, bool) {
+	var steps []string
+	if cmdType == ssh.CMDTypePlayer {
+		player, err := models.GetPlayBookById(cmdId)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return models.GuardConfirmation{}, false
+		}
+		steps, err = s.sshManager.PlayerCommands(player.Steps)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return models.GuardConfirmation{}, false
+		}
+		cmd = ""
+	}
+	hosts, err := models.ParseHostList(executeType, executeId)
+	if err != nil {
+		c.ResponseError(err.Error())
+		return models.GuardConfirmation{}, false
+	}
+	if !s.checkCommand(c, ssh.GuardSourceJob, cmd, steps, hosts, confirmToken) {
+		return models.GuardConfirmation{}, false
+	}
+	confirmation, err := s.sshManager.Guard().Confirmation(&ssh.GuardRequest{Cmd: cmd, Cmds: steps, Hosts: hosts})
+	if err != nil {
+		c.ResponseError(err.Error())
+		return models.GuardConfirmation{}, false
+	}
+	return confirmation, true
+}
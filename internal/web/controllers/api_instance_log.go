@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	wsl "github.com/gorilla/websocket"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/task"
+	"github.com/ssbeatty/oms/internal/web/payload"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GetWebsocketInstanceLog 实时推送任务实例的日志, 依次发送 start, host, output 和 done 事件,
+// 实例结束后以 1000 关闭连接, 发送的消息会被忽略
+func (s *Service) GetWebsocketInstanceLog(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, payload.GenerateErrorResponse(HttpStatusError, "can not parse param id"))
+		return
+	}
+	instance, err := models.GetTaskInstanceById(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, payload.GenerateErrorResponse(HttpStatusError, err.Error()))
+		return
+	}
+	if !s.allowJobId(&Context{Context: c}, instance.JobId) {
+		c.AbortWithStatusJSON(http.StatusForbidden, payload.GenerateErrorResponse(HttpStatusForbidden, payload.ErrHostForbidden))
+		return
+	}
+	wsConn, err := s.upGrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		s.Logger.Errorf("upgrade websocket failed, err: %v", err)
+		return
+	}
+	defer wsConn.Close()
+
+	// 客户端断开时停止读取日志
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := wsConn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = task.TailInstanceLog(ctx, instance, func(event interface{}) error {
+		return wsConn.WriteJSON(event)
+	})
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			s.Logger.Errorf("error when tail instance log, instance_id: %d, err: %v", instance.Id, err)
+		}
+		return
+	}
+	_ = wsConn.WriteControl(wsl.CloseMessage,
+		wsl.FormatCloseMessage(wsl.CloseNormalClosure, "instance done"), time.Now().Add(time.Second))
+}
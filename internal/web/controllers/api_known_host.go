@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/ssh"
+	"github.com/ssbeatty/oms/internal/web/payload"
+)
+
+// GetKnownHost
+// @Summary 获取主机公钥
+// @Description 获取主机记录的公钥指纹, 以及校验失败时待确认的公钥指纹
+// @Param host_id query int true "主机 ID"
+// @Tags known_host
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.KnownHost}
+// @Failure 400 {object} payload.Response
+// @Router /known_host [get]
+func (s *Service) GetKnownHost(c *Context) {
+	var param payload.GetKnownHostParam
+	err := c.ShouldBind(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		if !c.AllowHost(param.HostId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		knownHost, err := models.GetKnownHostByHostId(param.HostId)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(knownHost)
+	}
+}
+
+// AcceptKnownHost
+// @Summary 确认主机的新公钥
+// @Description 主机公钥变化后, 使用最近一次连接时远端提供的公钥替换记录的公钥
+// @Param host_id formData int true "主机 ID"
+// @Tags known_host
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.KnownHost}
+// @Failure 400 {object} payload.Response
+// @Router /known_host/accept [post]
+func (s *Service) AcceptKnownHost(c *Context) {
+	var form payload.AcceptKnownHostForm
+	err := c.ShouldBind(&form)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		host, err := models.GetHostById(form.HostId)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		knownHost, err := models.AcceptKnownHostPending(host.Id)
+		if err != nil {
+			s.Logger.Errorf("accept known host error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		s.sshManager.RemoveCache(host)
+		s.Logger.Infof("user: %s accept host key, addr: %s, fingerprint: %s",
+			c.CurrentUser().Username, knownHost.Addr, knownHost.Fingerprint)
+		c.ResponseOk(knownHost)
+	}
+}
+
+// DeleteKnownHost
+// @Summary 重置主机公钥
+// @Description 删除记录的主机公钥, 下次连接时重新记录
+// @Param host_id path int true "主机 ID"
+// @Tags known_host
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response
+// @Failure 400 {object} payload.Response
+// @Router /known_host/{host_id} [delete]
+func (s *Service) DeleteKnownHost(c *Context) {
+	var param payload.DeleteKnownHostParam
+	err := c.ShouldBindUri(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		host, err := models.GetHostById(param.HostId)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		err = models.DeleteKnownHostByHostId(host.Id)
+		if err != nil {
+			s.Logger.Errorf("delete known host error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		s.sshManager.RemoveCache(host)
+		c.ResponseOk(nil)
+	}
+}
+
+// ImportKnownHosts
+// @Summary 导入known_hosts文件
+// @Description 导入OpenSSH的known_hosts文件, 已存在的记录会被覆盖, 记录到地址匹配的主机
+// @Param file formData file true "known_hosts文件"
+// @Tags known_host
+// @Accept multipart/form-data
+// @Produce json
+// @Success 200 {object} payload.Response{data=payload.ImportKnownHostsResponse}
+// @Failure 400 {object} payload.Response
+// @Router /known_host/import [post]
+func (s *Service) ImportKnownHosts(c *Context) {
+	var form payload.ImportKnownHostsForm
+	err := c.ShouldBind(&form)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		data, err := c.readFormFile(form.File)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		total, err := ssh.ImportKnownHosts(data)
+		if err != nil {
+			s.Logger.Errorf("import known hosts error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(payload.ImportKnownHostsResponse{Total: total})
+	}
+}
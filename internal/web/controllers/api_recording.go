@@ -0,0 +1,271 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/web/payload"
+	"github.com/ssbeatty/oms/pkg/asciicast"
+	"github.com/ssbeatty/oms/pkg/transport"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultRecordingSearchLimit = 100
+	recordingSearchMatches      = 5
+)
+
+// RecordingSearchResult 录像和其中匹配关键字的位置
+type RecordingSearchResult struct {
+	Recording *models.SessionRecording `json:"recording"`
+	Matches   []asciicast.Match        `json:"matches"`
+}
+
+// newSessionRecorder 为web终端创建录像文件, 未开启录像时返回 nil
+func (s *Service) newSessionRecorder(c *gin.Context, host *models.Host, cols, rows int) (*models.SessionRecording, *asciicast.Writer, error) {
+	if !s.recordConf.Enable {
+		return nil, nil, nil
+	}
+	if cols <= 0 || rows <= 0 {
+		cols, rows = transport.DefaultPtyCols, transport.DefaultPtyRows
+	}
+	record, err := models.InsertSessionRecording(host, currentUser(c), c.ClientIP(), cols, rows, s.recordConf.WithInput)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(record.FilePath), os.ModePerm); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(record.FilePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	recorder, err := asciicast.NewWriter(f, asciicast.Header{
+		Width:  cols,
+		Height: rows,
+		Title:  fmt.Sprintf("%s@%s(%s)", host.User, host.Name, record.Username),
+		Env:    map[string]string{"TERM": "xterm"},
+	})
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	return record, recorder, nil
+}
+
+// allowRecording 管理员可以查看全部录像, 其他用户只能查看自己的录像
+func (c *Context) allowRecording(record *models.SessionRecording) bool {
+	user := c.CurrentUser()
+	return user.IsAdmin() || user.Id == record.UserId
+}
+
+// GetSessionRecordings
+// @Summary 获取终端录像
+// @Description 分页获取终端录像, 非管理员只能看到自己的录像
+// @Param host_id query int false "主机 ID"
+// @Param user_id query int false "用户 ID"
+// @Param start_time query string false "开始时间, 例如 2006-01-02 15:04:05"
+// @Param end_time query string false "结束时间, 例如 2006-01-02 15:04:05"
+// @Param page_num query int false  "页码数"
+// @Param page_size query int false  "分页尺寸" default(20)
+// @Tags recording
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=[]models.SessionRecording}
+// @Failure 400 {object} payload.Response
+// @Router /recording [get]
+func (s *Service) GetSessionRecordings(c *Context) {
+	var param payload.GetSessionRecordingParam
+	err := c.ShouldBind(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		filter := &models.SessionRecordingFilter{
+			HostId:    param.HostId,
+			UserId:    param.UserId,
+			StartTime: param.StartTime,
+			EndTime:   param.EndTime,
+		}
+		if user := c.CurrentUser(); !user.IsAdmin() {
+			filter.UserId = user.Id
+		}
+		records, total, err := models.GetSessionRecordings(filter, param.PageSize, param.PageNum)
+		if err != nil {
+			s.Logger.Errorf("get session recordings error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(payload.PageData{
+			Data:    records,
+			Total:   total,
+			PageNum: param.PageNum,
+		})
+	}
+}
+
+// GetOneSessionRecording
+// @Summary 获取单个终端录像
+// @Description 获取单个终端录像
+// @Param id path int true "录像 ID"
+// @Tags recording
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.SessionRecording}
+// @Failure 400 {object} payload.Response
+// @Router /recording/{id} [get]
+func (s *Service) GetOneSessionRecording(c *Context) {
+	var param payload.SessionRecordingIdParam
+	err := c.ShouldBindUri(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		record, err := models.GetSessionRecordingById(param.Id)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		if !c.allowRecording(record) {
+			c.ResponseError(payload.ErrForbidden)
+			return
+		}
+		c.ResponseOk(record)
+	}
+}
+
+// DownloadSessionRecording
+// @Summary 下载终端录像
+// @Description 下载 asciicast v2 格式的录像文件, 可以使用 asciinema play 或者 asciinema-player 回放
+// @Param id path int true "录像 ID"
+// @Tags recording
+// @Accept x-www-form-urlencoded
+// @Produce application/octet-stream
+// @Success 200
+// @Failure 400 {object} payload.Response
+// @Router /recording/{id}/download [get]
+func (s *Service) DownloadSessionRecording(c *Context) {
+	var param payload.SessionRecordingIdParam
+	err := c.ShouldBindUri(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		record, err := models.GetSessionRecordingById(param.Id)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		if !c.allowRecording(record) {
+			c.ResponseError(payload.ErrForbidden)
+			return
+		}
+		file, err := os.Open(record.FilePath)
+		if err != nil {
+			s.Logger.Errorf("open session recording error: %v", err)
+			c.Status(http.StatusNotFound)
+			return
+		}
+		defer file.Close()
+
+		fh, err := file.Stat()
+		if err != nil {
+			s.Logger.Errorf("error when Stat file, err: %v", err)
+			c.String(http.StatusOK, "file stat error")
+			return
+		}
+		c.Header("Content-Type", "application/x-asciicast")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fh.Name()))
+		http.ServeContent(c.Writer, c.Request, fh.Name(), fh.ModTime(), file)
+	}
+}
+
+// DeleteSessionRecording
+// @Summary 删除终端录像
+// @Description 删除终端录像和录像文件
+// @Param id path int true "录像 ID"
+// @Tags recording
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response
+// @Failure 400 {object} payload.Response
+// @Router /recording/{id} [delete]
+func (s *Service) DeleteSessionRecording(c *Context) {
+	var param payload.SessionRecordingIdParam
+	err := c.ShouldBindUri(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		err := models.DeleteSessionRecordingById(param.Id)
+		if err != nil {
+			s.Logger.Errorf("delete session recording error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(nil)
+	}
+}
+
+// SearchSessionRecordings
+// @Summary 搜索终端录像
+// @Description 在最近的录像输出中搜索关键字, 忽略大小写和终端控制字符
+// @Param keyword query string true "关键字"
+// @Param host_id query int false "主机 ID"
+// @Param user_id query int false "用户 ID"
+// @Param start_time query string false "开始时间, 例如 2006-01-02 15:04:05"
+// @Param end_time query string false "结束时间, 例如 2006-01-02 15:04:05"
+// @Param limit query int false "最多搜索的录像数量" default(100)
+// @Tags recording
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=[]RecordingSearchResult}
+// @Failure 400 {object} payload.Response
+// @Router /recording/search [get]
+func (s *Service) SearchSessionRecordings(c *Context) {
+	var param payload.SearchSessionRecordingParam
+	err := c.ShouldBind(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+		return
+	}
+	if param.Limit == 0 {
+		param.Limit = defaultRecordingSearchLimit
+	}
+	filter := &models.SessionRecordingFilter{
+		HostId:    param.HostId,
+		UserId:    param.UserId,
+		StartTime: param.StartTime,
+		EndTime:   param.EndTime,
+	}
+	if user := c.CurrentUser(); !user.IsAdmin() {
+		filter.UserId = user.Id
+	}
+	records, err := models.SearchSessionRecordings(filter, param.Limit)
+	if err != nil {
+		s.Logger.Errorf("search session recordings error: %v", err)
+		c.ResponseError(err.Error())
+		return
+	}
+
+	results := make([]*RecordingSearchResult, 0)
+	for _, record := range records {
+		matches, err := searchRecordingFile(record.FilePath, param.Keyword)
+		if err != nil {
+			s.Logger.Debugf("search session recording %d error: %v", record.Id, err)
+			continue
+		}
+		if len(matches) > 0 {
+			results = append(results, &RecordingSearchResult{Recording: record, Matches: matches})
+		}
+	}
+	c.ResponseOk(results)
+}
+
+func searchRecordingFile(filePath, keyword string) ([]asciicast.Match, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return asciicast.Search(f, keyword, recordingSearchMatches)
+}
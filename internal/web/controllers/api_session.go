@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/web/payload"
+	"github.com/ssbeatty/oms/internal/web/websocket"
+	"net/http"
+	"time"
+)
+
+// GetLiveSessions
+// @Summary 获取在线终端
+// @Description 获取正在使用的web终端, 包括主机、用户、开始时间、来源 IP 和传输的字节数
+// @Tags session
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=[]websocket.LiveSession}
+// @Failure 400 {object} payload.Response
+// @Router /session [get]
+func (s *Service) GetLiveSessions(c *Context) {
+	c.ResponseOk(s.sessions.List())
+}
+
+// KillLiveSession
+// @Summary 强制关闭在线终端
+// @Description 强制关闭web终端, 用户的 websocket 会收到关闭码为 4001 的关闭消息
+// @Param id path string true "终端 ID"
+// @Tags session
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response
+// @Failure 400 {object} payload.Response
+// @Router /session/{id} [delete]
+func (s *Service) KillLiveSession(c *Context) {
+	var param payload.LiveSessionIdParam
+	err := c.ShouldBindUri(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		live, err := s.sessions.Get(param.Id)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		c.AuditHosts([]*models.Host{{Id: live.HostId, Name: live.HostName}})
+		c.AuditSummary("user=%s client_ip=%s", live.Username, live.ClientIP)
+
+		reason := "terminated by admin"
+		if user := c.CurrentUser(); user != nil {
+			reason = fmt.Sprintf("terminated by %s", user.Username)
+		}
+		if err := s.sessions.Kill(param.Id, reason); err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(nil)
+	}
+}
+
+// WatchLiveSession 只读旁观在线终端, 只会收到终端输出, 发送的消息会被忽略
+func (s *Service) WatchLiveSession(c *gin.Context) {
+	live, err := s.sessions.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, payload.GenerateErrorResponse(HttpStatusError, err.Error()))
+		return
+	}
+	wsConn, err := s.upGrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		s.Logger.Errorf("upgrade websocket failed, err: %v", err)
+		return
+	}
+	defer wsConn.Close()
+
+	hosts := []*models.Host{{Id: live.HostId, Name: live.HostName}}
+	start := time.Now()
+	s.auditEvent(c, websocket.AuditActionTerminalWatch, fmt.Sprintf("user=%s", live.Username), hosts, nil)
+	live.Watch(wsConn)
+	s.auditEvent(c, websocket.AuditActionTerminalUnwatch,
+		fmt.Sprintf("user=%s duration=%s", live.Username, time.Since(start).Round(time.Second)), hosts, nil)
+}
+
+// JoinLiveSession 通过共享链接加入终端, 需要有主机的权限, 持有控制权后才能输入
+func (s *Service) JoinLiveSession(c *gin.Context) {
+	live, err := s.sessions.GetByShareToken(c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, payload.GenerateErrorResponse(HttpStatusError, err.Error()))
+		return
+	}
+	if !(&Context{Context: c}).AllowHost(live.HostId) {
+		c.AbortWithStatusJSON(http.StatusForbidden, payload.GenerateErrorResponse(HttpStatusForbidden, payload.ErrHostForbidden))
+		return
+	}
+	wsConn, err := s.upGrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		s.Logger.Errorf("upgrade websocket failed, err: %v", err)
+		return
+	}
+	defer wsConn.Close()
+
+	hosts := []*models.Host{{Id: live.HostId, Name: live.HostName}}
+	start := time.Now()
+	s.auditEvent(c, websocket.AuditActionTerminalJoin, fmt.Sprintf("owner=%s", live.Username), hosts, nil)
+	live.Join(wsConn, currentUser(c), c.ClientIP())
+	s.auditEvent(c, websocket.AuditActionTerminalLeave,
+		fmt.Sprintf("owner=%s duration=%s", live.Username, time.Since(start).Round(time.Second)), hosts, nil)
+}
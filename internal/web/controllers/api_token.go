@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/web/payload"
+	"time"
+)
+
+// GetApiTokens
+// @Summary 获取当前用户的api token
+// @Description 获取当前用户的api token, 不包含token明文
+// @Tags token
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=[]models.ApiToken}
+// @Failure 400 {object} payload.Response
+// @Router /token [get]
+func (s *Service) GetApiTokens(c *Context) {
+	tokens, err := models.GetApiTokensByUserId(c.CurrentUser().Id)
+	if err != nil {
+		s.Logger.Errorf("get api tokens error: %v", err)
+		c.ResponseError(err.Error())
+		return
+	}
+	c.ResponseOk(tokens)
+}
+
+// PostApiToken
+// @Summary 创建api token
+// @Description 创建api token, token明文只在创建时返回一次, 请求时使用 Authorization: Bearer <token>
+// @Param name formData string true "名称"
+// @Param scopes formData string true "权限, 逗号分隔" example(read,exec,write)
+// @Param expire_days formData integer true "有效天数"
+// @Tags token
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=payload.PostApiTokenResponse}
+// @Failure 400 {object} payload.Response
+// @Router /token [post]
+func (s *Service) PostApiToken(c *Context) {
+	var form payload.PostApiTokenForm
+	err := c.ShouldBind(&form)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		// 不允许使用 api token 再创建 token
+		if currentApiToken(c.Context) != nil {
+			c.ResponseError(payload.ErrApiTokenScope)
+			return
+		}
+		scopes, err := models.ParseScopes(form.Scopes)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		raw, token, err := models.InsertApiToken(
+			c.CurrentUser().Id, form.Name, scopes, time.Duration(form.ExpireDays)*24*time.Hour)
+		if err != nil {
+			s.Logger.Errorf("insert api token error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(payload.PostApiTokenResponse{
+			Token:    raw,
+			ApiToken: token,
+		})
+	}
+}
+
+// DeleteApiToken
+// @Summary 吊销api token
+// @Description 吊销api token, 管理员可以吊销任意用户的token
+// @Param id path int true  "token ID"
+// @Tags token
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response
+// @Failure 400 {object} payload.Response
+// @Router /token/{id} [delete]
+func (s *Service) DeleteApiToken(c *Context) {
+	var param payload.DeleteApiTokenParam
+	err := c.ShouldBindUri(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		token, err := models.GetApiTokenById(param.Id)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		user := c.CurrentUser()
+		if token.UserId != user.Id && !user.IsAdmin() {
+			c.ResponseError(payload.ErrForbidden)
+			return
+		}
+		err = models.DeleteApiTokenById(param.Id)
+		if err != nil {
+			s.Logger.Errorf("delete api token error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(nil)
+	}
+}
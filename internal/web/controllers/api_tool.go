@@ -24,7 +24,6 @@ import (
 	"net/http"
 	"os"
 	"path"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -50,6 +49,12 @@ var (
 // @Param type query string true "执行者类型" example(host,group,tag)
 // @Param cmd query string true "命令"
 // @Param sudo query bool false "是否sudo执行"
+// @Param confirm_token query string false "危险命令的二次确认 token"
+// @Param max_parallel query int false "同时执行的最大主机数, 0 不限制"
+// @Param batch_size query int false "每批的主机数, 0 不分批"
+// @Param batch_percent query int false "每批占主机总数的百分比"
+// @Param batch_pause query int false "批次之间暂停的秒数"
+// @Param abort_percent query int false "一批结束时失败的主机超过已执行主机的这个百分比则中止剩余的批次, 0 不中止"
 // @Tags tool
 // @Accept x-www-form-urlencoded
 // @Produce json
@@ -69,8 +74,17 @@ func (s *Service) RunCmd(c *Context) {
 			c.ResponseError("")
 			return
 		}
+		// 部分主机没有权限时拒绝整个请求, 不静默跳过
+		if !c.AllowHosts(hosts) {
+			c.AbortWithStatusJSON(http.StatusForbidden, payload.GenerateErrorResponse(HttpStatusForbidden, payload.ErrHostForbidden))
+			return
+		}
+		c.AuditHosts(hosts)
+		if !s.checkCommand(c, ssh.GuardSourceToolsCmd, params.Cmd, nil, hosts, params.ConfirmToken) {
+			return
+		}
 		// do cmd
-		results := s.RunCmdExec(hosts, params.Cmd, params.Sudo)
+		results := s.RunCmdExec(hosts, params.Cmd, params.Sudo, userName(c.CurrentUser()), execStrategy(params.ExecStrategyForm))
 
 		c.ResponseOk(results)
 	}
@@ -93,7 +107,11 @@ func (s *Service) GetPathInfo(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
-		results, err := s.GetPathInfoExec(params.HostId, params.Id)
+		if !c.AllowHost(params.HostId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		results, err := s.GetPathInfoExec(params.HostId, params.Id, userName(c.CurrentUser()))
 		if err != nil {
 			data := payload.GenerateErrorResponse(HttpStatusError, err.Error())
 			c.JSON(http.StatusOK, data)
@@ -120,7 +138,11 @@ func (s *Service) DownLoadFile(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
-		file := s.DownloadFile(params.HostId, params.Id)
+		if !c.AllowHost(params.HostId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		file := s.DownloadFile(params.HostId, params.Id, userName(c.CurrentUser()))
 		if file != nil {
 			defer file.Close()
 
@@ -175,7 +197,11 @@ func (s *Service) DeleteFile(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
-		err = s.DeleteFileOrDir(params.HostId, params.Id)
+		if !c.AllowHost(params.HostId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		err = s.DeleteFileOrDir(params.HostId, params.Id, userName(c.CurrentUser()))
 		if err != nil {
 			c.ResponseError(err.Error())
 		} else {
@@ -202,7 +228,11 @@ func (s *Service) MakeDirRemote(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
-		err = s.MakeDir(params.HostId, params.Id, params.Dir)
+		if !c.AllowHost(params.HostId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		err = s.MakeDir(params.HostId, params.Id, params.Dir, userName(c.CurrentUser()))
 		if err != nil {
 			c.ResponseError(err.Error())
 		} else {
@@ -231,11 +261,17 @@ func (s *Service) ExecJob(c *Context) {
 		if err != nil {
 			s.Logger.Errorf("error when get job, err: %v", err)
 			c.ResponseError(err.Error())
+			return
+		}
+		if !c.AllowJob(job) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
 		}
 		err = s.taskManager.ExecJob(job)
 		if err != nil {
 			s.Logger.Errorf("error when start job, err: %v", err)
 			c.ResponseError(err.Error())
+			return
 		}
 
 		c.ResponseOk(job)
@@ -262,11 +298,17 @@ func (s *Service) StartJob(c *Context) {
 		if err != nil {
 			s.Logger.Errorf("error when get job, err: %v", err)
 			c.ResponseError(err.Error())
+			return
+		}
+		if !c.AllowJob(job) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
 		}
 		err = s.taskManager.StartJob(job)
 		if err != nil {
 			s.Logger.Errorf("error when start job, err: %v", err)
 			c.ResponseError(err.Error())
+			return
 		}
 
 		_ = models.RefreshJob(job)
@@ -295,11 +337,17 @@ func (s *Service) StopJob(c *Context) {
 		if err != nil {
 			s.Logger.Errorf("error when get job, err: %v", err)
 			c.ResponseError(err.Error())
+			return
+		}
+		if !c.AllowJob(job) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
 		}
 		err = s.taskManager.StopJob(job.Id)
 		if err != nil {
 			s.Logger.Errorf("error when stop job, err: %v", err)
 			c.ResponseError(err.Error())
+			return
 		}
 
 		_ = models.RefreshJob(job)
@@ -325,7 +373,11 @@ func (s *Service) FilePreview(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
-		file := s.DownloadFile(params.HostId, params.Id)
+		if !c.AllowHost(params.HostId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		file := s.DownloadFile(params.HostId, params.Id, userName(c.CurrentUser()))
 		if file != nil {
 			defer file.Close()
 
@@ -375,7 +427,11 @@ func (s *Service) ModifyFile(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
-		file := s.GetRWFile(params.HostId, params.Id)
+		if !c.AllowHost(params.HostId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		file := s.GetRWFile(params.HostId, params.Id, userName(c.CurrentUser()))
 		if file != nil {
 			defer file.Close()
 			ModifyContentByte, err := base64.StdEncoding.DecodeString(params.ModifyContent)
@@ -409,6 +465,7 @@ func (s *Service) ModifyFile(c *Context) {
 func (s *Service) FileUploadV2(c *Context) {
 	var id int
 	var remoteFile, dType string
+	var uploaded []string
 	files := make(map[string]int)
 
 	// map [filename(url encode)] = size(int)
@@ -477,12 +534,20 @@ func (s *Service) FileUploadV2(c *Context) {
 					c.JSON(http.StatusOK, data)
 					return
 				}
+				if !c.AllowHosts(hosts) {
+					c.AbortWithStatusJSON(http.StatusForbidden, payload.GenerateErrorResponse(HttpStatusForbidden, payload.ErrHostForbidden))
+					return
+				}
 				// 每一个文件对应一个context如果 文件传输一半终止了 其下面所有的传输终止
 				ctx, cancel := context.WithCancel(context.Background())
 
 				fName := part.FileName()
 				escape := base64.StdEncoding.EncodeToString([]byte(fName))
 
+				uploaded = append(uploaded, fName)
+				c.AuditHosts(hosts)
+				c.AuditSummary("type=%s id=%d remote=%s files=%s", dType, id, remoteFile, strings.Join(uploaded, ","))
+
 				p := path.Join(path.Join(s.conf.DataPath, config.DefaultTmpPath), fmt.Sprintf("multipart-%d-%s", int(time.Now().Unix()), fName))
 				tempFile := ssh.TempFile{
 					Name: fName,
@@ -497,7 +562,7 @@ func (s *Service) FileUploadV2(c *Context) {
 				}
 
 				// 在传输每个文件到tmp的同时就开始复制其到sftp客户端
-				go s.UploadFileStream(hosts, &tempFile, remoteFile, ctx)
+				go s.UploadFileStream(hosts, &tempFile, remoteFile, userName(c.CurrentUser()), ctx)
 
 				n, err := io.Copy(tmp, part)
 				if err != nil {
@@ -645,6 +710,10 @@ func (s *Service) DownloadInstanceLog(c *Context) {
 			c.ResponseError(err.Error())
 			return
 		}
+		if !s.allowJobId(c, instance.JobId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
 		file, err := os.OpenFile(instance.LogPath, os.O_RDONLY, fs.ModePerm)
 		if file != nil && err == nil {
 			defer file.Close()
@@ -694,15 +763,20 @@ func (s *Service) GetInstanceLog(c *Context) {
 			c.ResponseError(err.Error())
 			return
 		}
+		if !s.allowJobId(c, instance.JobId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
 		file, err := os.OpenFile(instance.LogPath, os.O_RDONLY, fs.ModePerm)
 		if file != nil && err == nil {
 			defer file.Close()
 
 			var (
-				buffer         bytes.Buffer
-				host           *models.Host
-				idx            int
-				total, success int
+				buffer bytes.Buffer
+				host   *models.Host
+				idx    int
+				// 每台主机最后一次尝试是否成功
+				status = make(map[int]bool)
 			)
 			buffer.WriteString(blue(strings.Repeat("#", 40)) + "\r\n\r\n")
 			buffer.WriteString(green("#  start run  #\r\n"))
@@ -723,31 +797,49 @@ func (s *Service) GetInstanceLog(c *Context) {
 
 				if strings.HasPrefix(line, task.MarkText) {
 					idx++
-					total++
 
-					idRaw := regexp.MustCompile("\\d+").FindString(line)
-					hostId, err := strconv.Atoi(idRaw)
+					mark, err := task.ParseHostMark(line)
 					if err != nil {
 						s.Logger.Errorf("error when parse host_id from log, instance_id: %d, err: %v", instance.Id, err)
 						continue
 					}
+					status[mark.HostId] = !mark.Failed
 
-					host, err = models.GetHostById(hostId)
+					host, err = models.GetHostById(mark.HostId)
 					if err != nil {
 						continue
 					}
-					if strings.HasSuffix(line, task.ErrorText) {
+					if mark.Failed {
 						buffer.WriteString(red(fmt.Sprintf("## Seq: %d host info ##\r\n", idx)))
 					} else {
-						success++
 						buffer.WriteString(green(fmt.Sprintf("## Seq: %d host info ##\r\n", idx)))
 					}
 					buffer.WriteString(fmt.Sprintf("Host: %s\tId: %s\r\n", blue(host.Name), blue(host.Id)))
 					buffer.WriteString(fmt.Sprintf("Addr: %s\r\n", blue(fmt.Sprintf("%s:%d", host.Addr, host.Port))))
+					if mark.Signal != "" {
+						buffer.WriteString(fmt.Sprintf("Exit: %s\tSignal: %s\tUsage: %s\r\n", blue(mark.ExitCode), blue(mark.Signal), blue(mark.Duration)))
+					} else {
+						buffer.WriteString(fmt.Sprintf("Exit: %s\tUsage: %s\r\n", blue(mark.ExitCode), blue(mark.Duration)))
+					}
+					if mark.Attempt > 1 {
+						buffer.WriteString(fmt.Sprintf("Attempt: %s\r\n", blue(mark.Attempt)))
+					}
 					buffer.WriteString(strings.Repeat("-", 40) + "\r\n")
 				} else if strings.HasPrefix(line, task.DoneMartText) {
+					total, success := len(status), 0
+					for _, ok := range status {
+						if ok {
+							success++
+						}
+					}
 					buffer.WriteString("\r\n")
-					buffer.WriteString(blue(fmt.Sprintf("执行完毕, 一共: %d个主机, 成功: %d个\r\n", total, success)))
+					if strings.HasSuffix(line, task.TimeoutText) {
+						buffer.WriteString(red(fmt.Sprintf("执行超时, 一共: %d个主机, 成功: %d个\r\n", total, success)))
+					} else if strings.HasSuffix(line, task.CancelledText) {
+						buffer.WriteString(red(fmt.Sprintf("执行被取消, 一共: %d个主机, 成功: %d个\r\n", total, success)))
+					} else {
+						buffer.WriteString(blue(fmt.Sprintf("执行完毕, 一共: %d个主机, 成功: %d个\r\n", total, success)))
+					}
 				} else {
 					buffer.WriteString(line)
 					buffer.WriteString("\r\n")
@@ -767,23 +859,218 @@ func (s *Service) GetInstanceLog(c *Context) {
 	}
 }
 
+// GetInstanceHostResults
+// @Summary 获取任务实例每台主机的结果
+// @Description 获取任务实例每台主机的执行状态、退出码和耗时, 可以按状态过滤
+// @Param instance_id query integer true "实例 ID"
+// @Param status query string false "状态" example(success,failed,skipped,cancelled,timeout)
+// @Tags job
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=[]models.TaskInstanceHostResult}
+// @Failure 400 {object} payload.Response
+// @Router /task/instance/host [get]
+func (s *Service) GetInstanceHostResults(c *Context) {
+	var param payload.GetTaskInstanceHostParam
+	err := c.ShouldBind(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		instance, err := models.GetTaskInstanceById(param.InstanceId)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		if !s.allowJobId(c, instance.JobId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		results, err := models.GetTaskInstanceHostResults(instance.Id, param.Status)
+		if err != nil {
+			s.Logger.Errorf("get instance host results error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(results)
+	}
+}
+
+// GetInstanceHostOutput
+// @Summary 获取任务实例一台主机的输出
+// @Description 从实例日志中读取一台主机的输出
+// @Param id query integer true "主机结果 ID"
+// @Tags job
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=string}
+// @Failure 400 {object} payload.Response
+// @Router /task/instance/host/output [get]
+func (s *Service) GetInstanceHostOutput(c *Context) {
+	var param payload.GetTaskInstanceHostOutputParam
+	err := c.ShouldBind(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		result, err := models.GetTaskInstanceHostResultById(param.Id)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		instance, err := models.GetTaskInstanceById(result.InstanceId)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		if !s.allowJobId(c, instance.JobId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		file, err := os.Open(instance.LogPath)
+		if err != nil {
+			c.ResponseError("can not found logs")
+			return
+		}
+		defer file.Close()
+
+		output := make([]byte, result.OutputSize)
+		_, err = file.ReadAt(output, result.OutputOffset)
+		if err != nil {
+			s.Logger.Errorf("error when read host output, result_id: %d, err: %v", result.Id, err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(string(output))
+	}
+}
+
+// RerunInstance
+// @Summary 重新执行任务实例中失败的主机
+// @Description 在任务实例中失败或被跳过并且仍然属于任务的主机上重新执行一次, 生成新的实例
+// @Param instance_id formData integer true "实例 ID"
+// @Tags job
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.Job}
+// @Failure 400 {object} payload.Response
+// @Router /task/instance/rerun [post]
+func (s *Service) RerunInstance(c *Context) {
+	var form payload.RerunTaskInstanceForm
+	err := c.ShouldBind(&form)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		instance, err := models.GetTaskInstanceById(form.InstanceId)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		job, err := models.GetJobById(instance.JobId)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		if !c.AllowJob(job) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		results, err := models.GetTaskInstanceHostResults(instance.Id, "")
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		// 结果按 id 排序, 重试过的主机以最后一次尝试为准
+		failed := make(map[int]bool)
+		for _, result := range results {
+			failed[result.HostId] = result.Status != models.HostResultSuccess
+		}
+		jobHosts, err := models.ParseHostList(job.ExecuteType, job.ExecuteID)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		var hosts []*models.Host
+		for _, host := range jobHosts {
+			if failed[host.Id] {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			c.ResponseError("no failed hosts to rerun")
+			return
+		}
+		c.AuditHosts(hosts)
+
+		err = s.taskManager.ExecJobHosts(job, hosts)
+		if err != nil {
+			s.Logger.Errorf("error when rerun job, err: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+
+		c.ResponseOk(job)
+	}
+}
+
+// CancelInstance
+// @Summary 取消正在执行的任务实例
+// @Description 关闭正在执行的主机的远端会话, 剩余的主机不再执行, 所有主机结束后实例的状态为 cancelled
+// @Param instance_id formData integer true "实例 ID"
+// @Tags job
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.TaskInstance}
+// @Failure 400 {object} payload.Response
+// @Router /task/instance/cancel [post]
+func (s *Service) CancelInstance(c *Context) {
+	var form payload.CancelTaskInstanceForm
+	err := c.ShouldBind(&form)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		instance, err := models.GetTaskInstanceById(form.InstanceId)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		if !c.AllowJob(&instance.Job) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		err = s.taskManager.CancelInstance(instance.Id)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+
+		c.ResponseOk(instance)
+	}
+}
+
 // DataExport
 // @Summary 导出资产文件csv
-// @Description 导出资产文件csv
+// @Description 导出资产文件csv, 不传口令时不导出密码和密钥, 传入口令时导出全部数据并使用口令加密文件
+// @Param passphrase formData string false "加密口令"
 // @Tags tool
 // @Accept x-www-form-urlencoded
 // @Produce application/octet-stream
 // @Success 200
 // @Failure 400 {object} payload.Response
-// @Router /tools/export [get]
+// @Router /tools/export [post]
 func (s *Service) DataExport(c *Context) {
 	var (
-		b    bytes.Buffer
-		data []models.HostExport
+		b     bytes.Buffer
+		data  []models.HostExport
+		param payload.DataExportParam
 	)
 
 	defer b.Reset()
 
+	if err := c.ShouldBind(&param); err != nil {
+		c.ResponseError(err.Error())
+		return
+	}
+	withSecret := param.Passphrase != ""
+
 	hosts, err := models.GetAllHost()
 	if err != nil {
 		c.ResponseError(err.Error())
@@ -810,6 +1097,10 @@ func (s *Service) DataExport(c *Context) {
 			KeyName:     host.PrivateKey.Name,
 			KeyPhrase:   host.PrivateKey.Passphrase,
 		})
+		if !withSecret {
+			row := &data[len(data)-1]
+			row.PassWord, row.KeyFile, row.KeyPhrase = "", "", ""
+		}
 	}
 
 	// 写入UTF-8 BOM
@@ -820,15 +1111,26 @@ func (s *Service) DataExport(c *Context) {
 		return
 	}
 
+	content, filename := b.Bytes(), "export.csv"
+	if withSecret {
+		content, err = utils.EncryptWithPassphrase(param.Passphrase, content)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		filename = "export.csv.enc"
+	}
+
 	c.Writer.Header().Set("Content-type", "application/octet-stream")
-	c.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%s", "export.csv"))
-	c.String(http.StatusOK, b.String())
+	c.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%s", filename))
+	c.Data(http.StatusOK, "application/octet-stream", content)
 }
 
 // DataImport
 // @Summary 导入资产文件csv
 // @Description 导入资产文件csv
 // @Param files formData file true "csv文件"
+// @Param passphrase formData string false "加密文件的口令"
 // @Tags tool
 // @Accept x-www-form-urlencoded
 // @Produce json
@@ -872,6 +1174,14 @@ func (s *Service) DataImport(c *Context) {
 		return
 	}
 
+	if utils.IsPassphraseEncrypted(content) {
+		content, err = utils.DecryptWithPassphrase(c.PostForm("passphrase"), content)
+		if err != nil {
+			c.ResponseError("decrypt file error, please check the passphrase")
+			return
+		}
+	}
+
 	// issue https://github.com/gocarina/gocsv/issues/191
 	content = bytes.TrimPrefix(content, []byte(Utf8Dom))
 
@@ -938,7 +1248,7 @@ func (s *Service) DataImport(c *Context) {
 				privateKey *models.PrivateKey
 			)
 			if !models.ExistedPrivateKey(row.KeyFile) {
-				privateKey, err = models.InsertPrivateKey(row.KeyName, row.KeyFile, row.KeyPhrase)
+				privateKey, err = models.InsertPrivateKey(row.KeyName, row.KeyFile, row.KeyPhrase, "")
 				if err == nil {
 					resp.CreatePrivateKey = append(resp.CreatePrivateKey, privateKey.Name)
 				}
@@ -950,7 +1260,7 @@ func (s *Service) DataImport(c *Context) {
 
 		if !models.ExistedHost(row.Name, row.Addr) {
 			h, err := models.InsertHost(
-				row.Name, row.User, row.Addr, row.Port, row.PassWord, groupId, tags, privateKeyID, row.VNCPort,
+				row.Name, row.User, row.Addr, row.Port, row.PassWord, groupId, tags, privateKeyID, row.VNCPort, 0, "", "", "", false,
 			)
 			if err == nil {
 				resp.CreateHost = append(resp.CreateHost, h.Name)
@@ -0,0 +1,282 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/web/payload"
+	"net/http"
+)
+
+// @BasePath /api/v1
+
+// Login
+// @Summary 用户登录
+// @Description 用户登录, 成功后写入cookie并返回token
+// @Param username formData string true "用户名"
+// @Param password formData string true "密码"
+// @Tags user
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=payload.LoginResponse}
+// @Failure 400 {object} payload.Response
+// @Router /login [post]
+func (s *Service) Login(c *Context) {
+	var form payload.LoginForm
+	err := c.ShouldBind(&form)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		user, err := models.AuthUser(form.Username, form.Password)
+		if err != nil {
+			s.Logger.Warnf("user: %s login failed from %s, err: %v", form.Username, c.ClientIP(), err)
+			c.ResponseError(err.Error())
+			return
+		}
+		token, session, err := models.InsertUserSession(user, c.ClientIP(), s.authConf.SessionExpire)
+		if err != nil {
+			s.Logger.Errorf("create user session error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(AuthCookieName, token, int(s.authConf.SessionExpire.Seconds()), "/", "", false, true)
+		c.ResponseOk(payload.LoginResponse{
+			Token:    token,
+			ExpireAt: session.ExpireAt.Unix(),
+			User:     user,
+		})
+	}
+}
+
+// Logout
+// @Summary 退出登录
+// @Description 退出登录
+// @Tags user
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response
+// @Failure 400 {object} payload.Response
+// @Router /logout [post]
+func (s *Service) Logout(c *Context) {
+	token := getRequestToken(c.Context)
+	if token != "" {
+		if err := models.DeleteUserSession(token); err != nil {
+			s.Logger.Errorf("delete user session error: %v", err)
+		}
+	}
+	c.SetCookie(AuthCookieName, "", -1, "/", "", false, true)
+	c.ResponseOk(nil)
+}
+
+// GetCurrentUser
+// @Summary 获取当前登录用户
+// @Description 获取当前登录用户
+// @Tags user
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.User}
+// @Failure 400 {object} payload.Response
+// @Router /user/current [get]
+func (s *Service) GetCurrentUser(c *Context) {
+	c.ResponseOk(c.CurrentUser())
+}
+
+// GetUsers
+// @Summary 获取所有用户
+// @Description 获取所有用户
+// @Tags user
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=[]models.User}
+// @Failure 400 {object} payload.Response
+// @Router /user [get]
+func (s *Service) GetUsers(c *Context) {
+	users, err := models.GetAllUser()
+	if err != nil {
+		s.Logger.Errorf("get all user error: %v", err)
+		c.ResponseError(err.Error())
+		return
+	}
+	c.ResponseOk(users)
+}
+
+// GetOneUser
+// @Summary 获取单个用户
+// @Description 获取单个用户
+// @Param id path int true  "用户 ID"
+// @Tags user
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.User}
+// @Failure 400 {object} payload.Response
+// @Router /user/{id} [get]
+func (s *Service) GetOneUser(c *Context) {
+	var param payload.GetUserParam
+	err := c.ShouldBindUri(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		user, err := models.GetUserById(param.Id)
+		if err != nil {
+			s.Logger.Errorf("get one user error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(user)
+	}
+}
+
+// PostUser
+// @Summary 创建用户
+// @Description 创建用户
+// @Param username formData string true "用户名"
+// @Param password formData string true "密码"
+// @Param role formData string true "角色" example(admin,operator,readonly)
+// @Param grants formData string false "授权范围序列化字符串" example([{"type": "tag", "target_id": 1}])
+// @Tags user
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.User}
+// @Failure 400 {object} payload.Response
+// @Router /user [post]
+func (s *Service) PostUser(c *Context) {
+	var form payload.PostUserForm
+	err := c.ShouldBind(&form)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		if models.ExistedUser(form.Username) {
+			c.ResponseError("username already existed")
+			return
+		}
+		grants, err := parseUserGrants(form.Grants)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		user, err := models.InsertUser(form.Username, form.Password, form.Role)
+		if err != nil {
+			s.Logger.Errorf("insert user error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		if err := models.UpdateUserGrants(user.Id, grants); err != nil {
+			s.Logger.Errorf("update user grants error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		user, err = models.GetUserById(user.Id)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(user)
+	}
+}
+
+// PutUser
+// @Summary 更新用户
+// @Description 更新用户, 修改密码或禁用后该用户所有会话失效
+// @Param id formData integer true "用户 ID"
+// @Param username formData string false "用户名"
+// @Param password formData string false "密码"
+// @Param role formData string false "角色" example(admin,operator,readonly)
+// @Param grants formData string false "授权范围序列化字符串, 传入时覆盖原有授权" example([{"type": "tag", "target_id": 1}])
+// @Param disabled formData bool false "是否禁用, 不传时保持不变"
+// @Tags user
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response{data=models.User}
+// @Failure 400 {object} payload.Response
+// @Router /user [put]
+func (s *Service) PutUser(c *Context) {
+	var form payload.PutUserForm
+	err := c.ShouldBind(&form)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		if form.Disabled != nil && *form.Disabled && form.Id == c.CurrentUser().Id {
+			c.ResponseError("can not disable yourself")
+			return
+		}
+		if form.Role != "" && form.Role != models.RoleAdmin && form.Id == c.CurrentUser().Id {
+			c.ResponseError("can not downgrade yourself")
+			return
+		}
+		grants, err := parseUserGrants(form.Grants)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		user, err := models.UpdateUser(form.Id, form.Username, form.Password, form.Role, form.Disabled)
+		if err != nil {
+			s.Logger.Errorf("update user error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		if form.Grants != "" {
+			if err := models.UpdateUserGrants(user.Id, grants); err != nil {
+				s.Logger.Errorf("update user grants error: %v", err)
+				c.ResponseError(err.Error())
+				return
+			}
+		}
+		user, err = models.GetUserById(user.Id)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(user)
+	}
+}
+
+// DeleteUser
+// @Summary 删除用户
+// @Description 删除用户
+// @Param id path int true  "用户 ID"
+// @Tags user
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Success 200 {object} payload.Response
+// @Failure 400 {object} payload.Response
+// @Router /user/{id} [delete]
+func (s *Service) DeleteUser(c *Context) {
+	var param payload.DeleteUserParam
+	err := c.ShouldBindUri(&param)
+	if err != nil {
+		c.ResponseError(err.Error())
+	} else {
+		if param.Id == c.CurrentUser().Id {
+			c.ResponseError("can not delete yourself")
+			return
+		}
+		err := models.DeleteUserById(param.Id)
+		if err != nil {
+			s.Logger.Errorf("delete user error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		c.ResponseOk(nil)
+	}
+}
+
+// parseUserGrants 解析授权范围 [{"type": "tag", "target_id": 1}]
+func parseUserGrants(raw string) ([]models.UserGrant, error) {
+	var grants []models.UserGrant
+	if raw == "" {
+		return grants, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &grants); err != nil {
+		return nil, errors.New("parse grants error")
+	}
+	for _, grant := range grants {
+		switch grant.Type {
+		case models.GrantTypeHost, models.GrantTypeGroup, models.GrantTypeTag:
+		default:
+			return nil, errors.New("grant type must be host, group or tag")
+		}
+	}
+	return grants, nil
+}
@@ -69,8 +69,16 @@ func (s *Service) GetHosts(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
+		var query map[string]interface{}
+		if ids, all := c.hostScope(); !all {
+			hostIds := make([]int, 0, len(ids))
+			for id := range ids {
+				hostIds = append(hostIds, id)
+			}
+			query = map[string]interface{}{"id": hostIds}
+		}
 		total, err := models.GetPaginateQuery[*[]*models.Host](
-			&hosts, param.PageSize, param.PageNum, nil, true)
+			&hosts, param.PageSize, param.PageNum, query, true)
 		if err != nil {
 			s.Logger.Errorf("get all host error: %v", err)
 			c.ResponseError(err.Error())
@@ -100,6 +108,10 @@ func (s *Service) GetOneHost(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
+		if !c.AllowHost(param.Id) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
 		host, err := models.GetHostByIdWithPreload(param.Id)
 		if err != nil {
 			s.Logger.Errorf("get one host error: %v", err)
@@ -122,6 +134,11 @@ func (s *Service) GetOneHost(c *Context) {
 // @Param private_key_id formData integer false "密钥ID"
 // @Param tags formData string false "标签ID列表序列化字符串"
 // @Param vnc_port formData integer false "VNC端口"
+// @Param jump_host_id formData integer false "跳板机ID"
+// @Param proxy formData string false "代理地址, 例如 socks5://127.0.0.1:1080, 为空时使用全局代理, 为 direct 时不使用代理"
+// @Param proxy_user formData string false "代理用户名"
+// @Param proxy_password formData string false "代理密码"
+// @Param use_ca formData bool false "使用内置CA签发的临时证书登录"
 // @Tags host
 // @Accept x-www-form-urlencoded
 // @Produce json
@@ -136,7 +153,15 @@ func (s *Service) PostHost(c *Context) {
 	} else {
 		var tags []int
 		_ = json.Unmarshal([]byte(form.Tags), &tags)
-		host, err := models.InsertHost(form.HostName, form.User, form.Addr, form.Port, form.PassWord, form.Group, tags, form.PrivateKeyId, form.VNCPort)
+		form.Proxy, form.ProxyUser, form.ProxyPassword, err = parseHostProxy(form.Proxy, form.ProxyUser, form.ProxyPassword)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		host, err := models.InsertHost(
+			form.HostName, form.User, form.Addr, form.Port, form.PassWord, form.Group, tags, form.PrivateKeyId, form.VNCPort,
+			form.JumpHostId, form.Proxy, form.ProxyUser, form.ProxyPassword, form.UseCA,
+		)
 		if err != nil {
 			s.Logger.Errorf("insert host error: %v", err)
 			c.ResponseError(err.Error())
@@ -159,6 +184,11 @@ func (s *Service) PostHost(c *Context) {
 // @Param private_key_id formData integer false "密钥ID"
 // @Param tags formData string false "标签ID列表序列化字符串"
 // @Param vnc_port formData integer false "VNC端口"
+// @Param jump_host_id formData integer false "跳板机ID, 不传时不修改, 为 0 时取消跳板机"
+// @Param proxy formData string false "代理地址, 例如 socks5://127.0.0.1:1080, 为空时不修改, 为 direct 时不使用代理, 为 global 时使用全局代理"
+// @Param proxy_user formData string false "代理用户名"
+// @Param proxy_password formData string false "代理密码"
+// @Param use_ca formData bool false "使用内置CA签发的临时证书登录, 不传时不修改"
 // @Tags host
 // @Accept x-www-form-urlencoded
 // @Produce json
@@ -173,7 +203,15 @@ func (s *Service) PutHost(c *Context) {
 	} else {
 		var tags []int
 		_ = json.Unmarshal([]byte(form.Tags), &tags)
-		host, err := models.UpdateHost(form.Id, form.HostName, form.User, form.Addr, form.Port, form.PassWord, form.Group, tags, form.PrivateKeyId, form.VNCPort)
+		form.Proxy, form.ProxyUser, form.ProxyPassword, err = parseHostProxy(form.Proxy, form.ProxyUser, form.ProxyPassword)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		host, err := models.UpdateHost(
+			form.Id, form.HostName, form.User, form.Addr, form.Port, form.PassWord, form.Group, tags, form.PrivateKeyId, form.VNCPort,
+			form.JumpHostId, form.Proxy, form.ProxyUser, form.ProxyPassword, form.UseCA,
+		)
 		if err != nil {
 			s.Logger.Errorf("update host error: %v", err)
 			c.ResponseError(err.Error())
@@ -262,6 +300,7 @@ func (s *Service) GetOnePrivateKey(c *Context) {
 // @Param name formData string true "密钥名称"
 // @Param passphrase formData string false "密钥密码"
 // @Param key_file formData file true "密钥文件"
+// @Param cert_file formData file false "密钥对应的证书文件(-cert.pub)"
 // @Tags private_key
 // @Accept x-www-form-urlencoded
 // @Produce json
@@ -280,7 +319,12 @@ func (s *Service) PostPrivateKey(c *Context) {
 			c.ResponseError(err.Error())
 			return
 		}
-		privateKey, err := models.InsertPrivateKey(form.Name, string(fileBytes), form.Passphrase)
+		certBytes, err := s.readCertFile(c, form.CertFile)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		privateKey, err := models.InsertPrivateKey(form.Name, string(fileBytes), form.Passphrase, string(certBytes))
 		if err != nil {
 			s.Logger.Errorf("insert privateKey error: %v", err)
 			c.ResponseError(err.Error())
@@ -297,6 +341,7 @@ func (s *Service) PostPrivateKey(c *Context) {
 // @Param name formData string false "密钥名称"
 // @Param passphrase formData string false "密钥密码"
 // @Param key_file formData file false "密钥文件"
+// @Param cert_file formData file false "密钥对应的证书文件(-cert.pub)"
 // @Tags private_key
 // @Accept x-www-form-urlencoded
 // @Produce json
@@ -318,7 +363,12 @@ func (s *Service) PutPrivateKey(c *Context) {
 				return
 			}
 		}
-		privateKey, err := models.UpdatePrivateKey(form.Id, form.Name, string(fileBytes), form.Passphrase)
+		certBytes, err := s.readCertFile(c, form.CertFile)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		privateKey, err := models.UpdatePrivateKey(form.Id, form.Name, string(fileBytes), form.Passphrase, string(certBytes))
 		if err != nil {
 			s.Logger.Errorf("update privateKey error: %v", err)
 			c.ResponseError(err.Error())
@@ -405,6 +455,8 @@ func (s *Service) GetOneGroup(c *Context) {
 // @Param name formData string true "组名称"
 // @Param params formData string false "组参数"
 // @Param mode formData int true "组类型" example(0:主机模式,1:匹配模式)
+// @Param idle_timeout formData int false "终端空闲超时秒数, 0 使用全局配置, 小于 0 不限制"
+// @Param max_duration formData int false "终端最长时长秒数, 0 使用全局配置, 小于 0 不限制"
 // @Tags group
 // @Accept x-www-form-urlencoded
 // @Produce json
@@ -423,6 +475,14 @@ func (s *Service) PostGroup(c *Context) {
 			c.ResponseError(err.Error())
 			return
 		}
+		if form.IdleTimeout != 0 || form.MaxDuration != 0 {
+			group, err = models.UpdateGroupSessionLimit(group.Id, &form.IdleTimeout, &form.MaxDuration)
+			if err != nil {
+				s.Logger.Errorf("update group session limit error: %v", err)
+				c.ResponseError(err.Error())
+				return
+			}
+		}
 		c.ResponseOk(group)
 	}
 }
@@ -434,6 +494,8 @@ func (s *Service) PostGroup(c *Context) {
 // @Param name formData string false "组名称"
 // @Param params formData string false "组参数"
 // @Param mode formData int false "组类型" example(0:主机模式,1:匹配模式)
+// @Param idle_timeout formData int false "终端空闲超时秒数, 0 使用全局配置, 小于 0 不限制, 不传时保持不变"
+// @Param max_duration formData int false "终端最长时长秒数, 0 使用全局配置, 小于 0 不限制, 不传时保持不变"
 // @Tags group
 // @Accept x-www-form-urlencoded
 // @Produce json
@@ -452,6 +514,14 @@ func (s *Service) PutGroup(c *Context) {
 			c.ResponseError(err.Error())
 			return
 		}
+		if form.IdleTimeout != nil || form.MaxDuration != nil {
+			group, err = models.UpdateGroupSessionLimit(group.Id, form.IdleTimeout, form.MaxDuration)
+			if err != nil {
+				s.Logger.Errorf("update group session limit error: %v", err)
+				c.ResponseError(err.Error())
+				return
+			}
+		}
 		c.ResponseOk(group)
 	}
 }
@@ -632,7 +702,13 @@ func (s *Service) GetTunnels(c *Context) {
 			c.ResponseError(err.Error())
 			return
 		}
-		c.ResponseOk(tunnels)
+		ret := make([]*models.Tunnel, 0, len(tunnels))
+		for _, tunnel := range tunnels {
+			if c.AllowHost(tunnel.HostId) {
+				ret = append(ret, tunnel)
+			}
+		}
+		c.ResponseOk(ret)
 	}
 }
 
@@ -658,6 +734,10 @@ func (s *Service) GetOneTunnel(c *Context) {
 			c.ResponseError(err.Error())
 			return
 		}
+		if !c.AllowHost(tunnel.HostId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
 		c.ResponseOk(tunnel)
 	}
 }
@@ -681,6 +761,10 @@ func (s *Service) PostTunnel(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
+		if !c.AllowHost(form.HostId) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
 		host, err := models.GetHostById(form.HostId)
 		if err != nil {
 			s.Logger.Errorf("create tunnel error when get host: %v", err)
@@ -725,6 +809,10 @@ func (s *Service) PutTunnel(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
+		if !s.allowTunnel(c, form.Id) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
 		tunnel, err := models.UpdateTunnel(form.Id, form.Mode, form.Source, form.Destination)
 		if err != nil {
 			s.Logger.Errorf("update tunnel error: %v", err)
@@ -761,6 +849,10 @@ func (s *Service) DeleteTunnel(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
+		if !s.allowTunnel(c, param.Id) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
 		err := models.DeleteTunnelById(param.Id)
 		if err != nil {
 			s.Logger.Errorf("delete tunnel error: %v", err)
@@ -794,7 +886,7 @@ func (s *Service) GetJobs(c *Context) {
 			c.ResponseError(err.Error())
 			return
 		}
-		c.ResponseOk(jobs)
+		c.ResponseOk(s.filterJobs(c, jobs))
 	}
 }
 
@@ -820,6 +912,10 @@ func (s *Service) GetOneJob(c *Context) {
 			c.ResponseError(err.Error())
 			return
 		}
+		if !c.AllowJob(job) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
 		c.ResponseOk(job)
 	}
 }
@@ -835,6 +931,18 @@ func (s *Service) GetOneJob(c *Context) {
 // @Param cmd_type formData string true "任务命令类型" example(cmd,player)
 // @Param execute_id formData integer true "执行者 ID"
 // @Param execute_type formData string true "执行者类型" example(host,group,tag)
+// @Param confirm_token formData string false "危险命令的二次确认 token"
+// @Param overlap_policy formData string false "上一次调度还在执行时的策略, 默认 allow" example(allow,skip,queue)
+// @Param max_parallel formData int false "同时执行的最大主机数, 0 不限制"
+// @Param batch_size formData int false "每批的主机数, 0 不分批"
+// @Param batch_percent formData int false "每批占主机总数的百分比"
+// @Param batch_pause formData int false "批次之间暂停的秒数"
+// @Param abort_percent formData int false "一批结束时失败的主机超过已执行主机的这个百分比则中止剩余的批次, 0 不中止"
+// @Param timeout formData int false "一次执行的超时秒数, 0 不限制"
+// @Param host_timeout formData int false "每台主机每次尝试的超时秒数, 0 不限制"
+// @Param retry_count formData int false "失败后重试的次数, 最多 10"
+// @Param retry_backoff formData int false "第一次重试前等待的秒数, 之后每次翻倍"
+// @Param retry_on formData string false "哪些失败需要重试" example(all,connect,exit)
 // @Tags job
 // @Accept x-www-form-urlencoded
 // @Produce json
@@ -856,13 +964,39 @@ func (s *Service) PostJob(c *Context) {
 			c.ResponseError("cmd_id can not null")
 			return
 		}
+		if !c.AllowTarget(form.ExecuteType, form.ExecuteID) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		confirmation, ok := s.checkJobCommand(c, form.CmdType, form.Cmd, form.CmdId, form.ExecuteType, form.ExecuteID, form.ConfirmToken)
+		if !ok {
+			return
+		}
 		job, err := models.InsertJob(
-			form.Name, form.Type, form.Spec, form.Cmd, form.ExecuteID, form.CmdId, form.ExecuteType, form.CmdType)
+			form.Name, form.Type, form.Spec, form.Cmd, form.ExecuteID, form.CmdId, form.ExecuteType, form.CmdType, form.OverlapPolicy)
 		if err != nil {
 			s.Logger.Errorf("insert job error: %v", err)
 			c.ResponseError(err.Error())
 			return
 		}
+		job, err = models.UpdateJobStrategy(job.Id, execStrategy(form.ExecStrategyForm))
+		if err != nil {
+			s.Logger.Errorf("update job strategy error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		job, err = models.UpdateJobRetryPolicy(job.Id, mergeRetryPolicy(models.RetryPolicy{}, form.RetryPolicyForm))
+		if err != nil {
+			s.Logger.Errorf("update job retry policy error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		job, err = models.UpdateJobGuardConfirmation(job.Id, confirmation)
+		if err != nil {
+			s.Logger.Errorf("update job guard confirmation error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
 		realJob, err := s.taskManager.NewRealJobWithRegister(job, string(task.JobStatusSchedule))
 		if err != nil {
 			c.ResponseError(err.Error())
@@ -888,6 +1022,18 @@ func (s *Service) PostJob(c *Context) {
 // @Param cmd formData string false "任务命令"
 // @Param cmd_id formData integer false "剧本ID"
 // @Param cmd_type formData string false "任务命令类型" example(cmd,player)
+// @Param confirm_token formData string false "危险命令的二次确认 token"
+// @Param overlap_policy formData string false "上一次调度还在执行时的策略, 默认 allow" example(allow,skip,queue)
+// @Param max_parallel formData int false "同时执行的最大主机数, 0 不限制"
+// @Param batch_size formData int false "每批的主机数, 0 不分批"
+// @Param batch_percent formData int false "每批占主机总数的百分比"
+// @Param batch_pause formData int false "批次之间暂停的秒数"
+// @Param abort_percent formData int false "一批结束时失败的主机超过已执行主机的这个百分比则中止剩余的批次, 0 不中止"
+// @Param timeout formData int false "一次执行的超时秒数, 0 不限制"
+// @Param host_timeout formData int false "每台主机每次尝试的超时秒数, 0 不限制"
+// @Param retry_count formData int false "失败后重试的次数, 最多 10"
+// @Param retry_backoff formData int false "第一次重试前等待的秒数, 之后每次翻倍"
+// @Param retry_on formData string false "哪些失败需要重试" example(all,connect,exit)
 // @Tags job
 // @Accept x-www-form-urlencoded
 // @Produce json
@@ -905,13 +1051,64 @@ func (s *Service) PutJob(c *Context) {
 			c.ResponseError(err.Error())
 			return
 		}
+		if !s.allowJobId(c, form.Id) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		if form.ExecuteID != 0 && !c.AllowTarget(form.ExecuteType, form.ExecuteID) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
+		old, err := models.GetJobById(form.Id)
+		if err != nil {
+			c.ResponseError(err.Error())
+			return
+		}
+		cmd, cmdType, cmdId, executeType, executeId := old.Cmd, old.CmdType, old.CmdId, old.ExecuteType, old.ExecuteID
+		if form.Cmd != "" {
+			cmd = form.Cmd
+		}
+		if form.CmdId != 0 {
+			cmdId = form.CmdId
+		}
+		if form.CmdType != "" {
+			cmdType = form.CmdType
+		}
+		if form.ExecuteID != 0 {
+			executeId = form.ExecuteID
+		}
+		if form.ExecuteType != "" {
+			executeType = form.ExecuteType
+		}
+		confirmation, ok := s.checkJobCommand(c, cmdType, cmd, cmdId, executeType, executeId, form.ConfirmToken)
+		if !ok {
+			return
+		}
 
-		job, err := models.UpdateJob(form.Id, form.Name, form.Type, form.Spec, form.Cmd, form.CmdType, form.CmdId, form.ExecuteID, form.ExecuteType)
+		job, err := models.UpdateJob(form.Id, form.Name, form.Type, form.Spec, form.Cmd, form.CmdType, form.CmdId, form.ExecuteID, form.ExecuteType, form.OverlapPolicy)
 		if err != nil {
 			s.Logger.Errorf("update job error: %v", err)
 			c.ResponseError(err.Error())
 			return
 		}
+		job, err = models.UpdateJobStrategy(job.Id, mergeExecStrategy(old.ExecStrategy, form.ExecStrategyForm))
+		if err != nil {
+			s.Logger.Errorf("update job strategy error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		job, err = models.UpdateJobRetryPolicy(job.Id, mergeRetryPolicy(old.RetryPolicy, form.RetryPolicyForm))
+		if err != nil {
+			s.Logger.Errorf("update job retry policy error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
+		job, err = models.UpdateJobGuardConfirmation(job.Id, confirmation)
+		if err != nil {
+			s.Logger.Errorf("update job guard confirmation error: %v", err)
+			c.ResponseError(err.Error())
+			return
+		}
 		// 这个错误忽略是为了修改时候只要确认停止即可
 		_ = s.taskManager.UnRegister(form.Id, false)
 
@@ -946,6 +1143,10 @@ func (s *Service) DeleteJob(c *Context) {
 	if err != nil {
 		c.ResponseError(err.Error())
 	} else {
+		if !s.allowJobId(c, param.Id) {
+			c.ResponseError(payload.ErrHostForbidden)
+			return
+		}
 		err = s.taskManager.RemoveJob(param.Id)
 		if err != nil {
 			s.Logger.Errorf("error when remove job, err: %v", err)
@@ -958,7 +1159,7 @@ func (s *Service) DeleteJob(c *Context) {
 
 // GetInstances
 // @Summary 获取所有任务执行结果
-// @Description 获取所有任务执行结果
+// @Description 获取所有任务执行结果, host_results 中带有每台主机的结果
 // @Param job_id query int false  "任务 ID"
 // @Param page_num query int false  "页码数"
 // @Param page_size query int false  "分页尺寸" default(20)
@@ -979,13 +1180,34 @@ func (s *Service) GetInstances(c *Context) {
 	} else {
 		var instances []*models.TaskInstance
 		if param.JobId != 0 {
+			if !s.allowJobId(c, param.JobId) {
+				c.ResponseError(payload.ErrHostForbidden)
+				return
+			}
 			total, err = models.GetPaginateQuery[*[]*models.TaskInstance](
 				&instances, param.PageSize, param.PageNum, map[string]interface{}{
 					"job_id": param.JobId,
-				}, false)
+				}, true)
+		} else if c.CurrentUser().IsAdmin() {
+			total, err = models.GetPaginateQuery[*[]*models.TaskInstance](
+				&instances, param.PageSize, param.PageNum, nil, true)
 		} else {
+			// 非管理员只能看到有权限的任务的执行记录
+			var jobs []*models.Job
+			jobs, err = models.GetAllJob()
+			if err != nil {
+				s.Logger.Errorf("get jobs error: %v", err)
+				c.ResponseError(err.Error())
+				return
+			}
+			jobIds := make([]int, 0)
+			for _, job := range s.filterJobs(c, jobs) {
+				jobIds = append(jobIds, job.Id)
+			}
 			total, err = models.GetPaginateQuery[*[]*models.TaskInstance](
-				&instances, param.PageSize, param.PageNum, nil, false)
+				&instances, param.PageSize, param.PageNum, map[string]interface{}{
+					"job_id": jobIds,
+				}, true)
 		}
 		if err != nil {
 			s.Logger.Errorf("get instances error: %v", err)
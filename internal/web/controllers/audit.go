@@ -0,0 +1,252 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/web/payload"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	auditTargetsKey = "auditTargets"
+	auditHostsKey   = "auditHosts"
+	auditSummaryKey = "auditSummary"
+
+	auditSummaryMaxLen = 1024
+	auditValueMaxLen   = 128
+	auditBodyMaxLen    = 4096
+	auditRedacted      = "******"
+)
+
+var (
+	// auditGetRoutes 会执行操作或者导出数据的 GET 接口也需要审计
+	auditGetRoutes = map[string]struct{}{
+		"/api/v1/tools/cmd":      {},
+		"/api/v1/tools/download": {},
+		"/api/v1/tools/export":   {},
+	}
+	auditRedactParams = []string{"password", "passphrase", "secret", "token"}
+)
+
+type auditTarget struct {
+	Type string
+	Id   int
+}
+
+// auditWriter 缓存响应的前 auditBodyMaxLen 字节, 用于判断接口是否返回了错误
+type auditWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if remain := auditBodyMaxLen - w.body.Len(); remain > 0 {
+		if len(b) > remain {
+			w.body.Write(b[:remain])
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// auditTarget 记录本次操作涉及的主机, 由 AllowHost 和 AllowTarget 调用
+func (c *Context) auditTarget(pType string, id int) {
+	var targets []auditTarget
+	if val, ok := c.Get(auditTargetsKey); ok {
+		targets = val.([]auditTarget)
+	}
+	for _, t := range targets {
+		if t.Type == pType && t.Id == id {
+			return
+		}
+	}
+	c.Set(auditTargetsKey, append(targets, auditTarget{Type: pType, Id: id}))
+}
+
+// AuditHosts 记录本次操作实际执行的主机
+func (c *Context) AuditHosts(hosts []*models.Host) {
+	c.Set(auditHostsKey, hosts)
+}
+
+// AuditSummary 补充请求参数之外的操作信息, 例如上传的文件名
+func (c *Context) AuditSummary(format string, args ...interface{}) {
+	c.Set(auditSummaryKey, fmt.Sprintf(format, args...))
+}
+
+// Audit 审计中间件, 记录 rest api 的修改操作, 需要在 AuthRequired 之后使用
+func (s *Service) Audit(c *gin.Context) {
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || c.Request.Method == http.MethodOptions {
+		if _, ok := auditGetRoutes[c.FullPath()]; !ok {
+			c.Next()
+			return
+		}
+	}
+
+	writer := &auditWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+
+	c.Next()
+
+	event := &models.AuditEvent{
+		ClientIP: c.ClientIP(),
+		Action:   fmt.Sprintf("%s %s", c.Request.Method, c.FullPath()),
+		Path:     c.Request.URL.Path,
+		Summary:  auditRequestSummary(c),
+		Result:   models.AuditResultSuccess,
+	}
+	if user := currentUser(c); user != nil {
+		event.UserId = user.Id
+		event.Actor = user.Username
+	}
+	event.SetHosts(auditHosts(c))
+
+	if c.Writer.Status() >= http.StatusBadRequest {
+		event.Result = models.AuditResultFailure
+		event.Error = http.StatusText(c.Writer.Status())
+	}
+	var resp payload.Response
+	if strings.Contains(c.Writer.Header().Get("Content-Type"), "json") &&
+		json.Unmarshal(writer.body.Bytes(), &resp) == nil && resp.Type == payload.RespTypeError {
+		event.Result = models.AuditResultFailure
+		event.Error = resp.Msg
+	}
+
+	if err := models.InsertAuditEvent(event); err != nil {
+		s.Logger.Errorf("insert audit event error: %v", err)
+	}
+}
+
+// auditEvent 记录不经过 Audit 中间件的操作, 例如 websocket 终端
+func (s *Service) auditEvent(c *gin.Context, action, summary string, hosts []*models.Host, err error) {
+	event := &models.AuditEvent{
+		ClientIP: c.ClientIP(),
+		Action:   action,
+		Path:     c.Request.URL.Path,
+		Summary:  summary,
+		Result:   models.AuditResultSuccess,
+	}
+	if user := currentUser(c); user != nil {
+		event.UserId = user.Id
+		event.Actor = user.Username
+	}
+	event.SetHosts(hosts)
+	if err != nil {
+		event.Result = models.AuditResultFailure
+		event.Error = err.Error()
+	}
+	if err := models.InsertAuditEvent(event); err != nil {
+		s.Logger.Errorf("insert audit event error: %v", err)
+	}
+}
+
+// auditHosts 合并 AuditHosts 记录的主机和权限校验时记录的目标
+func auditHosts(c *gin.Context) []*models.Host {
+	var (
+		hosts []*models.Host
+		seen  = make(map[int]struct{})
+	)
+	add := func(list []*models.Host) {
+		for _, host := range list {
+			if _, ok := seen[host.Id]; ok {
+				continue
+			}
+			seen[host.Id] = struct{}{}
+			hosts = append(hosts, host)
+		}
+	}
+	if val, ok := c.Get(auditHostsKey); ok {
+		add(val.([]*models.Host))
+	}
+	if val, ok := c.Get(auditTargetsKey); ok {
+		for _, t := range val.([]auditTarget) {
+			list, err := models.ParseHostList(t.Type, t.Id)
+			if err != nil {
+				continue
+			}
+			add(list)
+		}
+	}
+	return hosts
+}
+
+// auditRequestSummary 路径参数和表单参数, 敏感参数脱敏, 过长的值截断
+func auditRequestSummary(c *gin.Context) string {
+	var parts []string
+	for _, p := range c.Params {
+		parts = append(parts, fmt.Sprintf("%s=%s", p.Key, p.Value))
+	}
+
+	form := c.Request.Form
+	if form == nil {
+		form = c.Request.URL.Query()
+	}
+	parts = append(parts, auditValues(form)...)
+	if c.Request.MultipartForm != nil {
+		for key, files := range c.Request.MultipartForm.File {
+			for _, file := range files {
+				parts = append(parts, fmt.Sprintf("%s=@%s(%d)", key, file.Filename, file.Size))
+			}
+		}
+	}
+	if val, ok := c.Get(auditSummaryKey); ok {
+		parts = append(parts, val.(string))
+	}
+
+	return auditTruncate(strings.Join(parts, " "), auditSummaryMaxLen)
+}
+
+// auditTruncate 按字节截断, 不截断多字节字符
+func auditTruncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
+
+func auditValues(values url.Values) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range values[key] {
+			if auditSensitive(key) {
+				if value != "" {
+					value = auditRedacted
+				}
+			} else {
+				value = auditTruncate(value, auditValueMaxLen)
+			}
+			parts = append(parts, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	return parts
+}
+
+func auditSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range auditRedactParams {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
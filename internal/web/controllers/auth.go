@@ -0,0 +1,252 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/web/payload"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	HttpStatusUnauthorized = "401"
+	HttpStatusForbidden    = "403"
+
+	AuthCookieName = "oms_token"
+	authUserKey    = "oms_user"
+	authHostsKey   = "oms_hosts"
+	authTokenKey   = "oms_api_token"
+	bearerPrefix   = "Bearer "
+)
+
+var execScopePaths = map[string]struct{}{
+	"/api/v1/job/exec":  {},
+	"/api/v1/tools/cmd": {},
+}
+
+// getRequestToken 依次从 Authorization header, cookie 和 websocket 的 query 中获取token
+func getRequestToken(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, bearerPrefix) {
+		return strings.TrimSpace(strings.TrimPrefix(header, bearerPrefix))
+	}
+	if cookie, err := c.Cookie(AuthCookieName); err == nil && cookie != "" {
+		return cookie
+	}
+	// 浏览器的 websocket 无法自定义 header
+	if strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		return c.Query("token")
+	}
+	return ""
+}
+
+func currentUser(c *gin.Context) *models.User {
+	if val, ok := c.Get(authUserKey); ok {
+		return val.(*models.User)
+	}
+	return nil
+}
+
+// userName 内置CA签发证书时记录的用户名
+func userName(user *models.User) string {
+	if user == nil {
+		return ""
+	}
+	return user.Username
+}
+
+// AuthRequired 登录校验中间件 保护 rest api, websocket 和 metrics
+func (s *Service) AuthRequired(c *gin.Context) {
+	token := getRequestToken(c)
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, payload.GenerateErrorResponse(HttpStatusUnauthorized, payload.ErrUnauthorized))
+		return
+	}
+	if strings.HasPrefix(token, models.ApiTokenPrefix) {
+		apiToken, err := models.GetApiTokenByToken(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, payload.GenerateErrorResponse(HttpStatusUnauthorized, payload.ErrUnauthorized))
+			return
+		}
+		if !apiToken.HasScope(requestScope(c)) {
+			c.AbortWithStatusJSON(http.StatusForbidden, payload.GenerateErrorResponse(HttpStatusForbidden, payload.ErrApiTokenScope))
+			return
+		}
+		c.Set(authTokenKey, apiToken)
+		c.Set(authUserKey, &apiToken.User)
+		c.Next()
+		return
+	}
+
+	user, err := models.GetUserBySessionToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, payload.GenerateErrorResponse(HttpStatusUnauthorized, payload.ErrUnauthorized))
+		return
+	}
+
+	c.Set(authUserKey, user)
+	c.Next()
+}
+
+// requestScope 请求需要的api token权限, 执行类接口需要 exec, 其他写操作需要 write
+func requestScope(c *gin.Context) string {
+	path := c.FullPath()
+	if _, ok := execScopePaths[path]; ok || strings.HasPrefix(path, "/ws/") {
+		return models.ScopeExec
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		return models.ScopeRead
+	default:
+		return models.ScopeWrite
+	}
+}
+
+// currentApiToken 通过api token认证时返回该token
+func currentApiToken(c *gin.Context) *models.ApiToken {
+	if val, ok := c.Get(authTokenKey); ok {
+		return val.(*models.ApiToken)
+	}
+	return nil
+}
+
+// RoleRequired 角色校验中间件 需要在 AuthRequired 之后使用
+func (s *Service) RoleRequired(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := currentUser(c)
+		if user == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, payload.GenerateErrorResponse(HttpStatusUnauthorized, payload.ErrUnauthorized))
+			return
+		}
+		for _, role := range roles {
+			if user.Role == role {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, payload.GenerateErrorResponse(HttpStatusForbidden, payload.ErrForbidden))
+	}
+}
+
+// hostScope 当前用户可访问的主机范围, 同一个请求内只解析一次
+func (c *Context) hostScope() (map[int]struct{}, bool) {
+	if val, ok := c.Get(authHostsKey); ok {
+		return val.(map[int]struct{}), false
+	}
+	user := c.CurrentUser()
+	if user == nil {
+		return map[int]struct{}{}, false
+	}
+	ids, all, err := models.GetUserHostIds(user)
+	if err != nil {
+		return map[int]struct{}{}, false
+	}
+	if all {
+		return nil, true
+	}
+	c.Set(authHostsKey, ids)
+	return ids, false
+}
+
+// AllowHost 当前用户是否有该主机的权限
+func (c *Context) AllowHost(hostId int) bool {
+	c.auditTarget("host", hostId)
+	ids, all := c.hostScope()
+	if all {
+		return true
+	}
+	_, ok := ids[hostId]
+	return ok
+}
+
+// FilterHosts 过滤出当前用户有权限的主机
+func (c *Context) FilterHosts(hosts []*models.Host) []*models.Host {
+	ids, all := c.hostScope()
+	if all {
+		return hosts
+	}
+	var ret []*models.Host
+	for _, host := range hosts {
+		if _, ok := ids[host.Id]; ok {
+			ret = append(ret, host)
+		}
+	}
+	return ret
+}
+
+// AllowTarget 当前用户是否有 host/group/tag 解析出的全部主机的权限
+func (c *Context) AllowTarget(pType string, id int) bool {
+	c.auditTarget(pType, id)
+	if _, all := c.hostScope(); all {
+		return true
+	}
+	hosts, err := models.ParseHostList(pType, id)
+	if err != nil || len(hosts) == 0 {
+		return false
+	}
+	return c.AllowHosts(hosts)
+}
+
+// AllowHosts 当前用户是否有全部主机的权限
+func (c *Context) AllowHosts(hosts []*models.Host) bool {
+	return len(c.FilterHosts(hosts)) == len(hosts)
+}
+
+// AllowJob 任务的执行范围必须全部在当前用户的授权内
+func (c *Context) AllowJob(job *models.Job) bool {
+	return c.AllowTarget(job.ExecuteType, job.ExecuteID)
+}
+
+func (s *Service) filterJobs(c *Context, jobs []*models.Job) []*models.Job {
+	if c.CurrentUser().IsAdmin() {
+		return jobs
+	}
+	ret := make([]*models.Job, 0, len(jobs))
+	for _, job := range jobs {
+		if c.AllowJob(job) {
+			ret = append(ret, job)
+		}
+	}
+	return ret
+}
+
+func (s *Service) allowJobId(c *Context, id int) bool {
+	if c.CurrentUser().IsAdmin() {
+		return true
+	}
+	job, err := models.GetJobById(id)
+	if err != nil {
+		return false
+	}
+	return c.AllowJob(job)
+}
+
+func (s *Service) allowTunnel(c *Context, id int) bool {
+	if c.CurrentUser().IsAdmin() {
+		return true
+	}
+	tunnel, err := models.GetTunnelById(id)
+	if err != nil {
+		return false
+	}
+	return c.AllowHost(tunnel.HostId)
+}
+
+// CheckOrigin 浏览器请求的 Origin 必须和请求的 Host 相同或者在 auth.allowed_origins 中,
+// 登录状态保存在 cookie 中, 放行任意来源会让其他网站以当前用户的身份调用接口和打开终端
+func (s *Service) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range s.authConf.AllowedOrigins {
+		if strings.EqualFold(strings.TrimRight(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
@@ -3,16 +3,23 @@ package controllers
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
-	wsl "github.com/gorilla/websocket"
 	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/ssh"
+	"github.com/ssbeatty/oms/internal/web/payload"
 	"github.com/ssbeatty/oms/internal/web/websocket"
 	"github.com/ssbeatty/oms/web"
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 )
 
-const IndexPage = "dist/index.html"
+const (
+	IndexPage = "dist/index.html"
+
+	maxMultiTerminalHosts = 32
+)
 
 func (s *Service) GetIndexPage(c *gin.Context) {
 	bytes, err := web.EmbeddedFiles.ReadFile(IndexPage)
@@ -22,32 +29,33 @@ func (s *Service) GetIndexPage(c *gin.Context) {
 	c.Data(http.StatusOK, "", bytes)
 }
 
-var upGrader = wsl.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024 * 1024 * 10,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
 // GetWebsocketIndex default websocket router
 func (s *Service) GetWebsocketIndex(c *gin.Context) {
-	wsConn, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+	wsConn, err := s.upGrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		s.Logger.Errorf("upgrade websocket failed, err: %v", err)
 	}
-	ws := websocket.NewWSConnect(wsConn, s).InitHandlers()
+	ws := websocket.NewWSConnect(wsConn, s).SetUser(currentUser(c)).SetClientIP(c.ClientIP()).InitHandlers()
 	ws.Serve()
 }
 
 // GetWebsocketSSH func websocket ssh
+// 携带 session_token 时重新连接浏览器断开后保留的终端
 func (s *Service) GetWebsocketSSH(c *gin.Context) {
 	idStr := c.Param("id")
 	// get pty windows size
 	cols, _ := strconv.Atoi(c.Query("cols"))
 	rows, _ := strconv.Atoi(c.Query("rows"))
 	id, _ := strconv.Atoi(idStr)
-	wsConn, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+	if !(&Context{Context: c}).AllowHost(id) {
+		c.AbortWithStatusJSON(http.StatusForbidden, payload.GenerateErrorResponse(HttpStatusForbidden, payload.ErrHostForbidden))
+		return
+	}
+	if token := c.Query("session_token"); token != "" {
+		s.reattachWebsocketSSH(c, id, token, cols, rows)
+		return
+	}
+	wsConn, err := s.upGrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		s.Logger.Errorf("upgrade websocket failed, err: %v", err)
 		return
@@ -59,27 +67,183 @@ func (s *Service) GetWebsocketSSH(c *gin.Context) {
 		s.Logger.Errorf("can not get host")
 		return
 	}
-	client, err := s.sshManager.NewClient(host)
+	client, err := s.sshManager.NewClientWithOptions(host, ssh.ClientOptions{
+		Prompt: websocket.NewTerminalPrompt(wsConn),
+		User:   userName(currentUser(c)),
+	})
 	if err != nil {
 		s.Logger.Errorf("transport new client failed, err: %v", err)
+		s.auditEvent(c, websocket.AuditActionTerminalOpen, "", []*models.Host{host}, err)
+		websocket.WriteTerminalError(wsConn, err)
 		return
 	}
 
 	ssConn, err := websocket.NewSshConn(cols, rows, client)
 	if err != nil {
 		s.Logger.Errorf("new ssh connect failed, err: %v", err)
+		s.auditEvent(c, websocket.AuditActionTerminalOpen, "", []*models.Host{host}, err)
+		return
+	}
+	record, recorder, err := s.newSessionRecorder(c, host, cols, rows)
+	if err != nil {
+		s.Logger.Errorf("create session recorder failed, err: %v", err)
+	} else if recorder != nil {
+		ssConn.SetRecorder(recorder, s.recordConf.WithInput)
+	}
+	if s.termConf.GracePeriod > 0 {
+		ssConn.SetScrollback(s.termConf.Scrollback)
+	}
+	ssConn.SetLimit(s.sessionLimit(host))
+
+	start := time.Now()
+	s.auditEvent(c, websocket.AuditActionTerminalOpen, fmt.Sprintf("cols=%d rows=%d", cols, rows), []*models.Host{host}, nil)
+
+	live := s.sessions.Register(host, currentUser(c), c.ClientIP(), ssConn, s.termConf.GracePeriod)
+	if record != nil {
+		live.RecordingId = record.Id
+	}
+
+	go ssConn.SendComboOutput()
+	go ssConn.SessionWait()
+
+	// 浏览器断开后终端可能继续保留, 终端结束时再清理
+	cc := c.Copy()
+	go func() {
+		<-ssConn.Done()
+		s.sessions.Unregister(live)
+		ssConn.Close()
+		if recorder != nil {
+			if err := models.UpdateSessionRecordingDone(record.Id, recorder.Size(), recorder.Duration()); err != nil {
+				s.Logger.Errorf("update session recording failed, err: %v", err)
+			}
+		}
+		s.auditEvent(cc, websocket.AuditActionTerminalClose,
+			closeSummary(time.Since(start), ssConn.CloseReason()), []*models.Host{host}, nil)
+		s.Logger.Info("websocket ssh finished")
+	}()
+
+	live.Attach(wsConn, 0, 0)
+}
+
+// reattachWebsocketSSH 重新连接保留的终端, 只有终端所有者可以重连
+func (s *Service) reattachWebsocketSSH(c *gin.Context, hostId int, token string, cols, rows int) {
+	live, err := s.sessions.GetByAttachToken(token)
+	if err != nil || live.HostId != hostId {
+		c.AbortWithStatusJSON(http.StatusNotFound, payload.GenerateErrorResponse(HttpStatusError, websocket.ErrSessionNotFound.Error()))
 		return
 	}
-	ws := websocket.NewWSConnect(wsConn, nil)
+	if user := currentUser(c); user == nil || user.Id != live.UserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, payload.GenerateErrorResponse(HttpStatusForbidden, payload.ErrForbidden))
+		return
+	}
+	wsConn, err := s.upGrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		s.Logger.Errorf("upgrade websocket failed, err: %v", err)
+		return
+	}
+	defer wsConn.Close()
+
+	s.auditEvent(c, websocket.AuditActionTerminalReattach, fmt.Sprintf("cols=%d rows=%d", cols, rows),
+		[]*models.Host{{Id: live.HostId, Name: live.HostName}}, nil)
+	live.Attach(wsConn, cols, rows)
+}
+
+// GetWebsocketSSHGroup 多主机终端, 一个 websocket 连接同时打开组或者标签下的主机, 输入可以广播到所有主机
+func (s *Service) GetWebsocketSSHGroup(c *gin.Context) {
+	var param payload.MultiTerminalParams
+	if err := c.ShouldBindQuery(&param); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, payload.GenerateErrorResponse(HttpStatusError, err.Error()))
+		return
+	}
+	ctx := &Context{Context: c}
+	hosts, err := models.ParseHostList(param.Type, param.Id)
+	if err != nil || len(hosts) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, payload.GenerateErrorResponse(HttpStatusError, payload.ErrHostParseEmpty))
+		return
+	}
+	if !ctx.AllowHosts(hosts) {
+		c.AbortWithStatusJSON(http.StatusForbidden, payload.GenerateErrorResponse(HttpStatusForbidden, payload.ErrHostForbidden))
+		return
+	}
+	if len(hosts) > maxMultiTerminalHosts {
+		c.AbortWithStatusJSON(http.StatusBadRequest, payload.GenerateErrorResponse(HttpStatusError,
+			fmt.Sprintf("too many hosts, at most %d", maxMultiTerminalHosts)))
+		return
+	}
+	wsConn, err := s.upGrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		s.Logger.Errorf("upgrade websocket failed, err: %v", err)
+		return
+	}
+	defer wsConn.Close()
+
+	start := time.Now()
+	s.auditEvent(c, websocket.AuditActionTerminalOpen,
+		fmt.Sprintf("broadcast %s=%d cols=%d rows=%d", param.Type, param.Id, param.Cols, param.Rows), hosts, nil)
+	defer func() {
+		s.auditEvent(c, websocket.AuditActionTerminalClose,
+			fmt.Sprintf("broadcast duration=%s", time.Since(start).Round(time.Second)), hosts, nil)
+	}()
+
+	term := websocket.NewMultiTerminal(wsConn, len(hosts))
+	wg := sync.WaitGroup{}
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host *models.Host) {
+			defer wg.Done()
+			s.serveMultiTerminalPane(c, term, host, param.Cols, param.Rows)
+		}(host)
+	}
+	term.Serve()
+	wg.Wait()
+	s.Logger.Info("websocket multi terminal finished")
+}
+
+func (s *Service) serveMultiTerminalPane(c *gin.Context, term *websocket.MultiTerminal, host *models.Host, cols, rows int) {
+	client, err := s.sshManager.NewClientWithOptions(host, ssh.ClientOptions{User: userName(currentUser(c))})
+	if err != nil {
+		s.Logger.Errorf("transport new client failed, err: %v", err)
+		term.PaneError(host, err)
+		return
+	}
+	ssConn, err := websocket.NewSshConn(cols, rows, client)
+	if err != nil {
+		s.Logger.Errorf("new ssh connect failed, err: %v", err)
+		term.PaneError(host, err)
+		return
+	}
+	record, recorder, err := s.newSessionRecorder(c, host, cols, rows)
+	if err != nil {
+		s.Logger.Errorf("create session recorder failed, err: %v", err)
+	} else if recorder != nil {
+		ssConn.SetRecorder(recorder, s.recordConf.WithInput)
+		defer func() {
+			if err := models.UpdateSessionRecordingDone(record.Id, recorder.Size(), recorder.Duration()); err != nil {
+				s.Logger.Errorf("update session recording failed, err: %v", err)
+			}
+		}()
+	}
 	defer ssConn.Close()
 
-	quitChan := make(chan struct{}, 3)
-	go ssConn.SendComboOutput(ws.Conn, quitChan)
-	go ssConn.ReceiveWsMsg(wsConn, quitChan)
-	go ssConn.SessionWait(quitChan)
+	// 每台主机单独计算空闲时间, 排除在广播之外的主机没有输入时会先断开
+	ssConn.SetLimit(s.sessionLimit(host))
+
+	// 和单个终端一样登记, 管理员可以旁观或者强制关闭其中一台主机
+	live := s.sessions.Register(host, currentUser(c), c.ClientIP(), ssConn, 0)
+	if record != nil {
+		live.RecordingId = record.Id
+	}
+	defer s.sessions.Unregister(live)
 
-	<-quitChan
-	s.Logger.Info("websocket ssh finished")
+	if !term.AddPane(host, ssConn) {
+		ssConn.Quit()
+		return
+	}
+	go ssConn.SendComboOutput()
+	go ssConn.SessionWait()
+
+	<-ssConn.Done()
+	term.PaneExit(host, ssConn.CloseReason())
 }
 
 // GetWebsocketVNC func websocket vnc proxy
@@ -90,7 +254,11 @@ func (s *Service) GetWebsocketVNC(c *gin.Context) {
 	if err != nil {
 		return
 	}
-	wsConn, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+	if !(&Context{Context: c}).AllowHost(id) {
+		c.AbortWithStatusJSON(http.StatusForbidden, payload.GenerateErrorResponse(HttpStatusForbidden, payload.ErrHostForbidden))
+		return
+	}
+	wsConn, err := s.upGrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		s.Logger.Errorf("upgrade websocket failed, err: %v", err)
 	}
@@ -105,13 +273,60 @@ func (s *Service) GetWebsocketVNC(c *gin.Context) {
 	vnc, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host.Addr, host.VNCPort))
 	if err != nil {
 		s.Logger.Errorf("failed to bind to the VNC Server: %s", err)
+		s.auditEvent(c, websocket.AuditActionVNCOpen, "", []*models.Host{host}, err)
 		return
 	}
-
 	quitChan := make(chan struct{})
 	forward := websocket.NewVNCForward(wsConn, vnc, s.Logger, quitChan)
+	forward.SetLimit(s.sessionLimit(host))
 	defer forward.Close()
 
+	start := time.Now()
+	s.auditEvent(c, websocket.AuditActionVNCOpen, "", []*models.Host{host}, nil)
+	defer func() {
+		s.auditEvent(c, websocket.AuditActionVNCClose,
+			closeSummary(time.Since(start), forward.CloseReason()), []*models.Host{host}, nil)
+	}()
+
 	forward.Serve()
 	s.Logger.Info("websocket vnc finished")
 }
+
+// sessionLimit 主机所在组配置了超时时使用组的配置, 否则使用全局配置
+func (s *Service) sessionLimit(host *models.Host) websocket.SessionLimit {
+	limit := websocket.SessionLimit{
+		IdleTimeout: s.termConf.IdleTimeout,
+		MaxDuration: s.termConf.MaxDuration,
+		WarnBefore:  s.termConf.WarnBefore,
+	}
+	if host.GroupId == 0 {
+		return limit
+	}
+	group, err := models.GetGroupById(host.GroupId)
+	if err != nil {
+		return limit
+	}
+	limit.IdleTimeout = groupLimit(group.IdleTimeout, limit.IdleTimeout)
+	limit.MaxDuration = groupLimit(group.MaxDuration, limit.MaxDuration)
+	return limit
+}
+
+// groupLimit 组的配置为 0 时使用全局配置, 小于 0 时不限制
+func groupLimit(seconds int, global time.Duration) time.Duration {
+	switch {
+	case seconds > 0:
+		return time.Duration(seconds) * time.Second
+	case seconds < 0:
+		return 0
+	default:
+		return global
+	}
+}
+
+func closeSummary(duration time.Duration, reason string) string {
+	summary := fmt.Sprintf("duration=%s", duration.Round(time.Second))
+	if reason != "" {
+		summary += fmt.Sprintf(" reason=%s", reason)
+	}
+	return summary
+}
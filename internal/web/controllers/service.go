@@ -3,12 +3,15 @@ package controllers
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
+	wsl "github.com/gorilla/websocket"
 	"github.com/ssbeatty/oms/internal/config"
 	"github.com/ssbeatty/oms/internal/metrics"
+	"github.com/ssbeatty/oms/internal/models"
 	"github.com/ssbeatty/oms/internal/ssh"
 	"github.com/ssbeatty/oms/internal/task"
 	"github.com/ssbeatty/oms/internal/tunnel"
 	"github.com/ssbeatty/oms/internal/web/payload"
+	"github.com/ssbeatty/oms/internal/web/websocket"
 	"github.com/ssbeatty/oms/pkg/logger"
 	"io/ioutil"
 	"mime/multipart"
@@ -20,13 +23,19 @@ type Service struct {
 	Addr          string
 	Logger        *logger.Logger
 	conf          config.App
+	authConf      config.Auth
+	recordConf    config.Recording
+	termConf      config.Terminal
 	taskManager   *task.Manager
 	tunnelManager *tunnel.Manager
 	sshManager    *ssh.Manager
 	metrics       *metrics.Manager
+	sessions      *websocket.SessionRegistry
+	upGrader      wsl.Upgrader
 }
 
-func NewService(conf config.App, sshManager *ssh.Manager, taskManager *task.Manager, tunnelManager *tunnel.Manager) *Service {
+func NewService(cfg *config.Conf, sshManager *ssh.Manager, taskManager *task.Manager, tunnelManager *tunnel.Manager) *Service {
+	conf := cfg.App
 	service := &Service{
 		Addr:          fmt.Sprintf("%s:%d", conf.Addr, conf.Port),
 		sshManager:    sshManager,
@@ -35,6 +44,15 @@ func NewService(conf config.App, sshManager *ssh.Manager, taskManager *task.Mana
 		metrics:       metrics.NewManager(sshManager, taskManager, tunnelManager).Init(),
 		Logger:        logger.NewLogger("web"),
 		conf:          conf,
+		authConf:      cfg.Auth,
+		recordConf:    cfg.Recording,
+		termConf:      cfg.Terminal,
+		sessions:      websocket.NewSessionRegistry(),
+	}
+	service.upGrader = wsl.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024 * 1024 * 10,
+		CheckOrigin:     service.CheckOrigin,
 	}
 
 	return service
@@ -44,6 +62,11 @@ type Context struct {
 	*gin.Context
 }
 
+// CurrentUser 获取当前请求的登录用户 由 AuthRequired 注入
+func (c *Context) CurrentUser() *models.User {
+	return currentUser(c.Context)
+}
+
 func (c *Context) ResponseError(msg string) {
 	d := payload.GenerateErrorResponse(HttpStatusError, msg)
 	c.JSON(http.StatusOK, d)
@@ -6,10 +6,12 @@ import (
 	"github.com/pkg/sftp"
 	"github.com/ssbeatty/oms/internal/models"
 	"github.com/ssbeatty/oms/internal/ssh"
+	"github.com/ssbeatty/oms/internal/web/payload"
 	"github.com/ssbeatty/oms/internal/web/websocket"
 	"github.com/ssbeatty/oms/pkg/transport"
 	"github.com/ssbeatty/oms/pkg/utils"
 	"io/fs"
+	"mime/multipart"
 	"os"
 	"path"
 	"path/filepath"
@@ -42,62 +44,93 @@ func (s *Service) GetSSHManager() *ssh.Manager {
 	return s.sshManager
 }
 
-// RunCmdOneAsync 搭配RunCmd使用
-func (s *Service) RunCmdOneAsync(host *models.Host, cmd string, sudo bool, ch chan *ssh.Result, wg *sync.WaitGroup) {
-	var msg []byte
-	var result *ssh.Result
-	client, err := s.sshManager.NewClient(host)
+// RunCmdOne 搭配RunCmdExec使用
+func (s *Service) RunCmdOne(host *models.Host, cmd string, sudo bool, user string) *ssh.Result {
+	var (
+		res *transport.ExecResult
+		ctx = context.Background()
+	)
+
+	client, err := s.sshManager.NewClientWithOptions(host, ssh.ClientOptions{User: user})
 	if err != nil {
-		ch <- &ssh.Result{HostId: host.Id, HostName: host.Name, Status: false, Msg: err.Error(), Addr: host.Addr}
-		return
+		return ssh.NewErrorResult(host, err)
 	}
-	session, err := client.NewPty()
+	session, err := client.NewSession()
 	if err != nil {
-		s.Logger.Errorf("RunCmdOneAsync create new session failed, err: %v", err)
-		ch <- &ssh.Result{HostId: host.Id, HostName: host.Name, Status: false, Msg: err.Error(), Addr: host.Addr}
-		return
+		s.Logger.Errorf("RunCmdOne create new session failed, err: %v", err)
+		return ssh.NewErrorResult(host, err)
 	}
 	defer session.Close()
 
 	if sudo && client.GetTargetMachineOs() != transport.GOOSWindows {
-		msg, err = session.Sudo(cmd, host.PassWord)
+		res, err = session.SudoExecContext(ctx, cmd, host.PassWord)
 	} else {
-		msg, err = session.Output(cmd)
-	}
-	if err != nil {
-		result = &ssh.Result{HostId: host.Id, HostName: host.Name, Status: false, Msg: string(msg), Addr: host.Addr}
-	} else {
-		result = &ssh.Result{HostId: host.Id, HostName: host.Name, Status: true, Msg: string(msg), Addr: host.Addr}
+		res, err = session.ExecContext(ctx, cmd)
 	}
 
-	ch <- result
-	wg.Done()
+	return ssh.NewExecResult(host, res, err)
 }
 
-// RunCmdExec 用于http接口
-func (s *Service) RunCmdExec(hosts []*models.Host, cmd string, sudo bool) []*ssh.Result {
-	var results []*ssh.Result
-	channel := make(chan *ssh.Result, len(hosts))
-	defer close(channel)
-	wg := sync.WaitGroup{}
-	for _, host := range hosts {
-		wg.Add(1)
-		go s.RunCmdOneAsync(host, cmd, sudo, channel, &wg)
-	}
-	wg.Wait()
-	for i := 0; i < len(hosts); i++ {
-		results = append(results, <-channel)
+// RunCmdExec 用于http接口, 按策略分批执行, 因为失败过多没有执行的主机返回 ssh.ErrBatchAborted
+func (s *Service) RunCmdExec(hosts []*models.Host, cmd string, sudo bool, user string, strategy models.ExecStrategy) []*ssh.Result {
+	var (
+		mu      sync.Mutex
+		results []*ssh.Result
+	)
+	skipped := ssh.RunWithStrategy(context.Background(), strategy, hosts, func(host *models.Host) bool {
+		result := s.RunCmdOne(host, cmd, sudo, user)
+
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, result)
+		return result.Status
+	})
+	for _, host := range skipped {
+		results = append(results, ssh.NewErrorResult(host, ssh.ErrBatchAborted))
 	}
 	return results
 }
 
-func (s *Service) UploadFileStream(hosts []*models.Host, tmp *ssh.TempFile, remotePath string, ctx context.Context) {
+// execStrategy 表单中的批量执行策略
+func execStrategy(form payload.ExecStrategyForm) models.ExecStrategy {
+	return mergeExecStrategy(models.ExecStrategy{}, form)
+}
+
+// mergeExecStrategy 用表单中传了的字段覆盖 strategy
+func mergeExecStrategy(strategy models.ExecStrategy, form payload.ExecStrategyForm) models.ExecStrategy {
+	setInt(&strategy.MaxParallel, form.MaxParallel)
+	setInt(&strategy.BatchSize, form.BatchSize)
+	setInt(&strategy.BatchPercent, form.BatchPercent)
+	setInt(&strategy.BatchPause, form.BatchPause)
+	setInt(&strategy.AbortPercent, form.AbortPercent)
+	return strategy
+}
+
+func setInt(dst *int, v *int) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// mergeRetryPolicy 用表单中传了的字段覆盖 policy
+func mergeRetryPolicy(policy models.RetryPolicy, form payload.RetryPolicyForm) models.RetryPolicy {
+	setInt(&policy.Timeout, form.Timeout)
+	setInt(&policy.HostTimeout, form.HostTimeout)
+	setInt(&policy.RetryCount, form.RetryCount)
+	setInt(&policy.RetryBackoff, form.RetryBackoff)
+	if form.RetryOn != "" {
+		policy.RetryOn = form.RetryOn
+	}
+	return policy
+}
+
+func (s *Service) UploadFileStream(hosts []*models.Host, tmp *ssh.TempFile, remotePath, user string, ctx context.Context) {
 	// 引用计数
 	atomic.AddInt32(&tmp.Num, int32(len(hosts)))
 
 	for _, host := range hosts {
 		go func(host *models.Host) {
-			client, err := s.sshManager.NewClientWithSftp(host)
+			client, err := s.sshManager.NewClientWithSftp(host, ssh.ClientOptions{User: user})
 			if err != nil {
 				return
 			}
@@ -107,7 +140,7 @@ func (s *Service) UploadFileStream(hosts []*models.Host, tmp *ssh.TempFile, remo
 	}
 }
 
-func (s *Service) GetPathInfoExec(hostId int, p string) (*FilePath, error) {
+func (s *Service) GetPathInfoExec(hostId int, p, user string) (*FilePath, error) {
 	filePath := &FilePath{}
 	var results []*FileInfo
 	var folderChains []*FileInfo
@@ -116,7 +149,7 @@ func (s *Service) GetPathInfoExec(hostId int, p string) (*FilePath, error) {
 	if err != nil {
 		return nil, err
 	}
-	client, err := s.sshManager.NewClientWithSftp(host)
+	client, err := s.sshManager.NewClientWithSftp(host, ssh.ClientOptions{User: user})
 	if err != nil {
 		return nil, err
 	}
@@ -189,12 +222,12 @@ func (s *Service) GetPathInfoExec(hostId int, p string) (*FilePath, error) {
 	return filePath, nil
 }
 
-func (s *Service) DownloadFile(hostId int, path string) *sftp.File {
+func (s *Service) DownloadFile(hostId int, path, user string) *sftp.File {
 	host, err := models.GetHostById(hostId)
 	if err != nil {
 		return nil
 	}
-	client, err := s.sshManager.NewClientWithSftp(host)
+	client, err := s.sshManager.NewClientWithSftp(host, ssh.ClientOptions{User: user})
 	if err != nil {
 		return nil
 	}
@@ -205,12 +238,12 @@ func (s *Service) DownloadFile(hostId int, path string) *sftp.File {
 	return file
 }
 
-func (s *Service) DeleteFileOrDir(hostId int, path string) error {
+func (s *Service) DeleteFileOrDir(hostId int, path, user string) error {
 	host, err := models.GetHostById(hostId)
 	if err != nil {
 		return err
 	}
-	client, err := s.sshManager.NewClientWithSftp(host)
+	client, err := s.sshManager.NewClientWithSftp(host, ssh.ClientOptions{User: user})
 	if err != nil {
 		return err
 	}
@@ -228,12 +261,12 @@ func (s *Service) DeleteFileOrDir(hostId int, path string) error {
 	return nil
 }
 
-func (s *Service) MakeDir(hostId int, p, dir string) error {
+func (s *Service) MakeDir(hostId int, p, dir, user string) error {
 	host, err := models.GetHostById(hostId)
 	if err != nil {
 		return err
 	}
-	client, err := s.sshManager.NewClientWithSftp(host)
+	client, err := s.sshManager.NewClientWithSftp(host, ssh.ClientOptions{User: user})
 	if err != nil {
 		return err
 	}
@@ -255,98 +288,137 @@ func (s *Service) MakeDir(hostId int, p, dir string) error {
 	return client.MkdirAll(realPath)
 }
 
-func (s *Service) runCmdWithContext(host *models.Host, cmd ssh.Command, ch chan *ssh.Result, ctx context.Context) {
+func (s *Service) runCmdWithContext(host *models.Host, cmd ssh.Command, user string, ch chan *ssh.Result, ctx context.Context) {
 	var (
-		msg    []byte
+		res    *transport.ExecResult
 		result *ssh.Result
 	)
 
-	client, err := s.sshManager.NewClientWithSftp(host)
+	client, err := s.sshManager.NewClientWithSftp(host, ssh.ClientOptions{User: user})
 	if err != nil {
-		result = &ssh.Result{HostId: host.Id, HostName: host.Name, Status: false, Msg: err.Error(), Addr: host.Addr}
-		ch <- result
+		ch <- ssh.NewErrorResult(host, err)
 		return
 	}
-	session, err := client.NewSessionWithPty(cmd.WindowSize.Cols, cmd.WindowSize.Rows)
+	session, err := client.NewSession()
 	if err != nil {
 		s.Logger.Errorf("RunCmdWithContext error when create new session failed, err: %v", err)
-		result = &ssh.Result{HostId: host.Id, HostName: host.Name, Status: false, Msg: err.Error(), Addr: host.Addr}
-		ch <- result
+		ch <- ssh.NewErrorResult(host, err)
 		return
 	}
+	defer session.Close()
 
 	if cmd.Sudo && client.GetTargetMachineOs() != transport.GOOSWindows {
-		msg, err = session.SudoContext(ctx, cmd.Params, host.PassWord)
+		res, err = session.SudoExecContext(ctx, cmd.Params, host.PassWord)
 	} else {
-		msg, err = session.OutputContext(ctx, cmd.Params)
+		res, err = session.ExecContext(ctx, cmd.Params)
 	}
 
-	if err != nil {
-		// ctx 超时返回ctx.Err
-		if ctx.Err() != nil {
-			result = &ssh.Result{HostId: host.Id, HostName: host.Name, Status: false, Msg: ctx.Err().Error(), Addr: host.Addr}
-		} else {
-			result = &ssh.Result{HostId: host.Id, HostName: host.Name, Status: false, Msg: string(msg), Addr: host.Addr}
-		}
-	} else {
-		result = &ssh.Result{HostId: host.Id, HostName: host.Name, Status: true, Msg: string(msg), Addr: host.Addr}
+	result = ssh.NewExecResult(host, res, err)
+	// ctx 超时返回ctx.Err
+	if err != nil && ctx.Err() != nil {
+		result.Msg = ctx.Err().Error()
 	}
 
 	ch <- result
 }
 
-func (s *Service) runPlayerWithContext(host *models.Host, cmd ssh.Command, ch chan *ssh.Result, ctx context.Context) {
-	var (
-		msg    []byte
-		result *ssh.Result
-	)
-
-	client, err := s.sshManager.NewClient(host)
+func (s *Service) runPlayerWithContext(host *models.Host, cmd ssh.Command, user string, ch chan *ssh.Result, ctx context.Context) {
+	client, err := s.sshManager.NewClientWithOptions(host, ssh.ClientOptions{User: user})
 	if err != nil {
-		result = &ssh.Result{HostId: host.Id, HostName: host.Name, Status: false, Msg: err.Error(), Addr: host.Addr}
-		ch <- result
+		ch <- ssh.NewErrorResult(host, err)
 		return
 	}
 
 	steps, err := s.sshManager.ParseSteps(cmd.Params)
 	if err != nil {
-		result = &ssh.Result{HostId: host.Id, HostName: host.Name, Status: false, Msg: err.Error(), Addr: host.Addr}
-		ch <- result
+		ch <- ssh.NewErrorResult(host, err)
 		return
 	}
 
 	player := ssh.NewPlayer(client, steps, cmd.Sudo, &cmd.WindowSize)
 
-	msg, err = player.Run(ctx)
+	start := time.Now()
+	msg, err := player.Run(ctx)
 
-	if err != nil {
-		result = &ssh.Result{HostId: host.Id, HostName: host.Name, Status: false, Msg: string(msg), Addr: host.Addr}
-	} else {
-		result = &ssh.Result{HostId: host.Id, HostName: host.Name, Status: true, Msg: string(msg), Addr: host.Addr}
-	}
-
-	ch <- result
+	ch <- ssh.NewPlayerResult(host, player, msg, time.Since(start), err)
 }
 
-// RunCmdWithContext 使用在websocket接口上
-func (s *Service) RunCmdWithContext(host *models.Host, cmd ssh.Command, ch chan *ssh.Result) {
-	ctx, cancel := context.WithTimeout(context.Background(), websocket.DefaultSSHCMDTimeout)
+// RunCmdWithContext 使用在websocket接口上, ctx 取消时中断执行, user 为当前的oms用户
+func (s *Service) RunCmdWithContext(ctx context.Context, host *models.Host, cmd ssh.Command, user string, ch chan *ssh.Result) {
+	ctx, cancel := context.WithTimeout(ctx, websocket.DefaultSSHCMDTimeout)
 	defer cancel()
 	switch cmd.Type {
 	case ssh.CMDTypeShell:
-		s.runCmdWithContext(host, cmd, ch, ctx)
+		s.runCmdWithContext(host, cmd, user, ch, ctx)
 	case ssh.CMDTypePlayer:
-		s.runPlayerWithContext(host, cmd, ch, ctx)
+		s.runPlayerWithContext(host, cmd, user, ch, ctx)
 	}
 }
 
+// outputWriter 把会话的输出转发给 ssh.OutputFunc
+type outputWriter struct {
+	stream string
+	output ssh.OutputFunc
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.output(w.stream, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// RunCmdStream 使用在websocket接口上, 输出实时回调 output, 返回的结果中不包含输出.
+// 命令在没有 pty 的会话上执行以区分 stdout 和 stderr, 剧本每一步执行完成后回调这一步的输出
+func (s *Service) RunCmdStream(ctx context.Context, host *models.Host, cmd ssh.Command, user string, output ssh.OutputFunc) *ssh.Result {
+	ctx, cancel := context.WithTimeout(ctx, websocket.DefaultSSHCMDTimeout)
+	defer cancel()
+
+	client, err := s.sshManager.NewClientWithSftp(host, ssh.ClientOptions{User: user})
+	if err != nil {
+		return ssh.NewErrorResult(host, err)
+	}
+
+	if cmd.Type == ssh.CMDTypePlayer {
+		steps, err := s.sshManager.ParseSteps(cmd.Params)
+		if err != nil {
+			return ssh.NewErrorResult(host, err)
+		}
+		player := ssh.NewPlayer(client, steps, cmd.Sudo, &cmd.WindowSize)
+		player.SetOutput(&outputWriter{stream: ssh.StreamStdout, output: output})
+		start := time.Now()
+		_, err = player.Run(ctx)
+		return ssh.NewPlayerResult(host, player, nil, time.Since(start), err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		s.Logger.Errorf("RunCmdStream error when create new session failed, err: %v", err)
+		return ssh.NewErrorResult(host, err)
+	}
+	defer session.Close()
+
+	stdout := &outputWriter{stream: ssh.StreamStdout, output: output}
+	stderr := &outputWriter{stream: ssh.StreamStderr, output: output}
+	start := time.Now()
+	if cmd.Sudo && client.GetTargetMachineOs() != transport.GOOSWindows {
+		err = session.SudoStreamContext(ctx, cmd.Params, host.PassWord, stdout, stderr)
+	} else {
+		err = session.StreamContext(ctx, cmd.Params, stdout, stderr)
+	}
+
+	return ssh.NewExecResult(host, &transport.ExecResult{
+		ExitCode: transport.ExitCode(err),
+		Signal:   transport.ExitSignal(err),
+		Duration: time.Since(start),
+	}, err)
+}
+
 // GetRWFile 获取可读写的 sftp.File
-func (s *Service) GetRWFile(hostId int, path string) *sftp.File {
+func (s *Service) GetRWFile(hostId int, path, user string) *sftp.File {
 	host, err := models.GetHostById(hostId)
 	if err != nil {
 		return nil
 	}
-	client, err := s.sshManager.NewClientWithSftp(host)
+	client, err := s.sshManager.NewClientWithSftp(host, ssh.ClientOptions{User: user})
 	if err != nil {
 		return nil
 	}
@@ -356,3 +428,31 @@ func (s *Service) GetRWFile(hostId int, path string) *sftp.File {
 	}
 	return file
 }
+
+// parseHostProxy 检查主机的代理地址, 地址中的认证信息转存到加密保存的代理密码中
+func parseHostProxy(proxy, user, password string) (string, string, string, error) {
+	if proxy == "" || proxy == models.ProxyDirect || proxy == models.ProxyGlobal {
+		return proxy, "", "", nil
+	}
+	p, err := transport.ParseProxy(proxy, user, password)
+	if err != nil {
+		return "", "", "", err
+	}
+	return fmt.Sprintf("%s://%s", p.Type, p.Addr), p.User, p.Password, nil
+}
+
+// readCertFile 读取并检查密钥的证书, 没有上传时返回空
+func (s *Service) readCertFile(c *Context, header *multipart.FileHeader) ([]byte, error) {
+	if header == nil {
+		return nil, nil
+	}
+	certBytes, err := c.readFormFile(header)
+	if err != nil {
+		s.Logger.Errorf("read form cert_file error: %v", err)
+		return nil, err
+	}
+	if _, err := transport.ParseCertificate(certBytes); err != nil {
+		return nil, err
+	}
+	return certBytes, nil
+}
@@ -0,0 +1,16 @@
+package payload
+
+type PostApiTokenForm struct {
+	Name       string `form:"name" binding:"required"`
+	Scopes     string `form:"scopes" binding:"required"`
+	ExpireDays int    `form:"expire_days" binding:"required,min=1,max=3650"`
+}
+
+type PostApiTokenResponse struct {
+	Token    string      `json:"token"`
+	ApiToken interface{} `json:"api_token"`
+}
+
+type DeleteApiTokenParam struct {
+	Id int `uri:"id" binding:"required"`
+}
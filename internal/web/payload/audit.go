@@ -0,0 +1,14 @@
+package payload
+
+import "time"
+
+type GetAuditEventParam struct {
+	Page
+	Actor     string    `form:"actor"`
+	Action    string    `form:"action"`
+	ClientIP  string    `form:"client_ip"`
+	HostId    int       `form:"host_id"`
+	Result    string    `form:"result" binding:"omitempty,oneof=success failure"`
+	StartTime time.Time `form:"start_time" time_format:"2006-01-02 15:04:05"`
+	EndTime   time.Time `form:"end_time" time_format:"2006-01-02 15:04:05"`
+}
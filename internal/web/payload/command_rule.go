@@ -0,0 +1,38 @@
+package payload
+
+import "time"
+
+type GetCommandRuleParam struct {
+	Id int `uri:"id" binding:"required"`
+}
+
+type PostCommandRuleForm struct {
+	Name       string `form:"name" binding:"required"`
+	Pattern    string `form:"pattern" binding:"required"`
+	Action     string `form:"action" binding:"required,oneof=deny confirm allow"`
+	TargetType string `form:"target_type" binding:"required,oneof=all host group tag"`
+	TargetId   int    `form:"target_id"`
+	Priority   int    `form:"priority"`
+	Enable     bool   `form:"enable"`
+}
+
+type PutCommandRuleForm struct {
+	Id         int    `form:"id" binding:"required"`
+	Name       string `form:"name" binding:"required"`
+	Pattern    string `form:"pattern" binding:"required"`
+	Action     string `form:"action" binding:"required,oneof=deny confirm allow"`
+	TargetType string `form:"target_type" binding:"required,oneof=all host group tag"`
+	TargetId   int    `form:"target_id"`
+	Priority   int    `form:"priority"`
+	Enable     bool   `form:"enable"`
+}
+
+type DeleteCommandRuleParam struct {
+	Id int `uri:"id" binding:"required"`
+}
+
+// CommandConfirmResponse 命令需要二次确认时返回, 携带 confirm_token 重新提交
+type CommandConfirmResponse struct {
+	ConfirmToken string    `json:"confirm_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
@@ -2,6 +2,10 @@ package payload
 
 const (
 	ErrHostParseEmpty = "parse host array empty"
+	ErrUnauthorized   = "unauthorized"
+	ErrForbidden      = "permission denied"
+	ErrHostForbidden  = "no permission for host"
+	ErrApiTokenScope  = "api token scope not allowed"
 	RespTypeMsg       = "msg"
 	RespTypeError     = "error"
 	RespTypeData      = "data"
@@ -26,6 +30,11 @@ func GenerateErrorResponse(code string, msg string) Response {
 	return Response{code, msg, nil, RespTypeError}
 }
 
+// GenerateErrorDataResponse 需要调用方进一步处理的错误, 例如命令需要二次确认
+func GenerateErrorDataResponse(code string, msg string, data interface{}) Response {
+	return Response{code, msg, data, RespTypeError}
+}
+
 type Page struct {
 	PageNum  int `form:"page_num"`
 	PageSize int `form:"page_size"`
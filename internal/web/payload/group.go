@@ -7,16 +7,20 @@ type GetGroupParam struct {
 }
 
 type PostGroupForm struct {
-	Name   string `form:"name" binding:"required"`
-	Params string `form:"params"`
-	Mode   int    `form:"mode"`
+	Name        string `form:"name" binding:"required"`
+	Params      string `form:"params"`
+	Mode        int    `form:"mode"`
+	IdleTimeout int    `form:"idle_timeout"`
+	MaxDuration int    `form:"max_duration"`
 }
 
 type PutGroupForm struct {
-	Id     int    `form:"id" binding:"required"`
-	Name   string `form:"name"`
-	Params string `form:"params"`
-	Mode   int    `form:"mode"`
+	Id          int    `form:"id" binding:"required"`
+	Name        string `form:"name"`
+	Params      string `form:"params"`
+	Mode        int    `form:"mode"`
+	IdleTimeout *int   `form:"idle_timeout"`
+	MaxDuration *int   `form:"max_duration"`
 }
 
 type DeleteGroupParam struct {
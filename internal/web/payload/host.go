@@ -11,28 +11,38 @@ type GetHostParam struct {
 }
 
 type PostHostForm struct {
-	HostName     string `form:"hostname" binding:"required"`
-	User         string `form:"user" binding:"required"`
-	Addr         string `form:"addr" binding:"required,ip_addr|hostname"`
-	Port         int    `form:"port" binding:"required,min=0,max=65535"`
-	PassWord     string `form:"password"`
-	Group        int    `form:"group"`
-	PrivateKeyId int    `form:"private_key_id" binding:"required_without=PassWord"`
-	Tags         string `form:"tags"`
-	VNCPort      int    `form:"vnc_port"`
+	HostName      string `form:"hostname" binding:"required"`
+	User          string `form:"user" binding:"required"`
+	Addr          string `form:"addr" binding:"required,ip_addr|hostname"`
+	Port          int    `form:"port" binding:"required,min=0,max=65535"`
+	PassWord      string `form:"password"`
+	Group         int    `form:"group"`
+	PrivateKeyId  int    `form:"private_key_id" binding:"required_without_all=PassWord UseCA"`
+	Tags          string `form:"tags"`
+	VNCPort       int    `form:"vnc_port"`
+	JumpHostId    int    `form:"jump_host_id"`
+	Proxy         string `form:"proxy"`
+	ProxyUser     string `form:"proxy_user"`
+	ProxyPassword string `form:"proxy_password"`
+	UseCA         bool   `form:"use_ca"`
 }
 
 type PutHostForm struct {
-	Id           int    `form:"id" binding:"required"`
-	HostName     string `form:"hostname"`
-	User         string `form:"user"`
-	Addr         string `form:"addr" binding:"len=0|ip_addr|hostname"`
-	Port         int    `form:"port" binding:"min=0,max=65535"`
-	PassWord     string `form:"password"`
-	Group        int    `form:"group"`
-	PrivateKeyId int    `form:"private_key_id"`
-	Tags         string `form:"tags"`
-	VNCPort      int    `form:"vnc_port"`
+	Id            int    `form:"id" binding:"required"`
+	HostName      string `form:"hostname"`
+	User          string `form:"user"`
+	Addr          string `form:"addr" binding:"len=0|ip_addr|hostname"`
+	Port          int    `form:"port" binding:"min=0,max=65535"`
+	PassWord      string `form:"password"`
+	Group         int    `form:"group"`
+	PrivateKeyId  int    `form:"private_key_id"`
+	Tags          string `form:"tags"`
+	VNCPort       int    `form:"vnc_port"`
+	JumpHostId    *int   `form:"jump_host_id" binding:"omitempty,min=0"`
+	Proxy         string `form:"proxy"`
+	ProxyUser     string `form:"proxy_user"`
+	ProxyPassword string `form:"proxy_password"`
+	UseCA         *bool  `form:"use_ca"`
 }
 
 type DeleteHostParam struct {
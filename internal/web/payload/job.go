@@ -8,27 +8,53 @@ type GetJobParam struct {
 	Id int `uri:"id" binding:"required"`
 }
 
+// ExecStrategyForm 批量执行的策略, 参考 models.ExecStrategy, 没有传的字段为 nil, 修改任务时保持不变
+type ExecStrategyForm struct {
+	MaxParallel  *int `form:"max_parallel" binding:"omitempty,min=0"`
+	BatchSize    *int `form:"batch_size" binding:"omitempty,min=0"`
+	BatchPercent *int `form:"batch_percent" binding:"omitempty,min=0,max=100"`
+	BatchPause   *int `form:"batch_pause" binding:"omitempty,min=0"`
+	AbortPercent *int `form:"abort_percent" binding:"omitempty,min=0,max=100"`
+}
+
+// RetryPolicyForm 任务的超时和重试策略, 参考 models.RetryPolicy, 没有传的字段修改任务时保持不变
+type RetryPolicyForm struct {
+	Timeout      *int   `form:"timeout" binding:"omitempty,min=0"`
+	HostTimeout  *int   `form:"host_timeout" binding:"omitempty,min=0"`
+	RetryCount   *int   `form:"retry_count" binding:"omitempty,min=0,max=10"`
+	RetryBackoff *int   `form:"retry_backoff" binding:"omitempty,min=0"`
+	RetryOn      string `form:"retry_on" binding:"omitempty,oneof=all connect exit"`
+}
+
 type PostJobForm struct {
-	Name        string `form:"name" binding:"required"`
-	Type        string `form:"type" binding:"required"`
-	Spec        string `form:"spec"`
-	Cmd         string `form:"cmd"`
-	CmdId       int    `form:"cmd_id"`
-	CmdType     string `form:"cmd_type" binding:"required"`
-	ExecuteID   int    `form:"execute_id" binding:"required"`
-	ExecuteType string `form:"execute_type" binding:"required"`
+	Name          string `form:"name" binding:"required"`
+	Type          string `form:"type" binding:"required"`
+	Spec          string `form:"spec"`
+	Cmd           string `form:"cmd"`
+	CmdId         int    `form:"cmd_id"`
+	CmdType       string `form:"cmd_type" binding:"required"`
+	ExecuteID     int    `form:"execute_id" binding:"required"`
+	ExecuteType   string `form:"execute_type" binding:"required"`
+	ConfirmToken  string `form:"confirm_token"`
+	OverlapPolicy string `form:"overlap_policy" binding:"omitempty,oneof=allow skip queue"`
+	ExecStrategyForm
+	RetryPolicyForm
 }
 
 type PutJobForm struct {
-	Id          int    `form:"id" binding:"required"`
-	Name        string `form:"name"`
-	Type        string `form:"type"`
-	Spec        string `form:"spec"`
-	Cmd         string `form:"cmd"`
-	CmdId       int    `form:"cmd_id"`
-	CmdType     string `form:"cmd_type"`
-	ExecuteID   int    `form:"execute_id"`
-	ExecuteType string `form:"execute_type"`
+	Id            int    `form:"id" binding:"required"`
+	Name          string `form:"name"`
+	Type          string `form:"type"`
+	Spec          string `form:"spec"`
+	Cmd           string `form:"cmd"`
+	CmdId         int    `form:"cmd_id"`
+	CmdType       string `form:"cmd_type"`
+	ExecuteID     int    `form:"execute_id"`
+	ExecuteType   string `form:"execute_type"`
+	ConfirmToken  string `form:"confirm_token"`
+	OverlapPolicy string `form:"overlap_policy" binding:"omitempty,oneof=allow skip queue"`
+	ExecStrategyForm
+	RetryPolicyForm
 }
 
 type DeleteJobParam struct {
@@ -48,6 +74,23 @@ type GetTaskInstanceLogParam struct {
 	Id int `form:"id" binding:"required"`
 }
 
+type GetTaskInstanceHostParam struct {
+	InstanceId int    `form:"instance_id" binding:"required"`
+	Status     string `form:"status" binding:"omitempty,oneof=success failed skipped cancelled timeout"`
+}
+
+type GetTaskInstanceHostOutputParam struct {
+	Id int `form:"id" binding:"required"`
+}
+
+type RerunTaskInstanceForm struct {
+	InstanceId int `form:"instance_id" binding:"required"`
+}
+
+type CancelTaskInstanceForm struct {
+	InstanceId int `form:"instance_id" binding:"required"`
+}
+
 type DeleteTaskInstanceFrom struct {
 	JobId     int   `form:"job_id"`
 	TimeStamp int64 `form:"time_stamp"`
@@ -0,0 +1,23 @@
+package payload
+
+import "mime/multipart"
+
+type GetKnownHostParam struct {
+	HostId int `form:"host_id" binding:"required"`
+}
+
+type AcceptKnownHostForm struct {
+	HostId int `form:"host_id" binding:"required"`
+}
+
+type DeleteKnownHostParam struct {
+	HostId int `uri:"host_id" binding:"required"`
+}
+
+type ImportKnownHostsForm struct {
+	File *multipart.FileHeader `form:"file" binding:"required"`
+}
+
+type ImportKnownHostsResponse struct {
+	Total int `json:"total"`
+}
@@ -12,6 +12,7 @@ type PostPrivateKeyForm struct {
 	Name       string                `form:"name" binding:"required"`
 	Passphrase string                `form:"passphrase"`
 	KeyFile    *multipart.FileHeader `form:"key_file" binding:"required"`
+	CertFile   *multipart.FileHeader `form:"cert_file"`
 }
 
 type PutPrivateKeyForm struct {
@@ -19,6 +20,7 @@ type PutPrivateKeyForm struct {
 	Name       string                `form:"name"`
 	Passphrase string                `form:"passphrase"`
 	KeyFile    *multipart.FileHeader `form:"key_file"`
+	CertFile   *multipart.FileHeader `form:"cert_file"`
 }
 
 type DeletePrivateKeyParam struct {
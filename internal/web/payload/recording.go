@@ -0,0 +1,28 @@
+package payload
+
+import "time"
+
+type GetSessionRecordingParam struct {
+	Page
+	HostId    int       `form:"host_id"`
+	UserId    int       `form:"user_id"`
+	StartTime time.Time `form:"start_time" time_format:"2006-01-02 15:04:05"`
+	EndTime   time.Time `form:"end_time" time_format:"2006-01-02 15:04:05"`
+}
+
+type SearchSessionRecordingParam struct {
+	Keyword   string    `form:"keyword" binding:"required"`
+	HostId    int       `form:"host_id"`
+	UserId    int       `form:"user_id"`
+	StartTime time.Time `form:"start_time" time_format:"2006-01-02 15:04:05"`
+	EndTime   time.Time `form:"end_time" time_format:"2006-01-02 15:04:05"`
+	Limit     int       `form:"limit" binding:"omitempty,min=1,max=500"`
+}
+
+type SessionRecordingIdParam struct {
+	Id int `uri:"id" binding:"required"`
+}
+
+type LiveSessionIdParam struct {
+	Id string `uri:"id" binding:"required"`
+}
@@ -1,10 +1,19 @@
 package payload
 
 type CmdParams struct {
+	Id           int    `form:"id" binding:"required"`
+	Sudo         bool   `form:"sudo"`
+	Type         string `form:"type" binding:"required"`
+	Cmd          string `form:"cmd" binding:"required"`
+	ConfirmToken string `form:"confirm_token"`
+	ExecStrategyForm
+}
+
+type MultiTerminalParams struct {
 	Id   int    `form:"id" binding:"required"`
-	Sudo bool   `form:"sudo"`
 	Type string `form:"type" binding:"required"`
-	Cmd  string `form:"cmd" binding:"required"`
+	Cols int    `form:"cols"`
+	Rows int    `form:"rows"`
 }
 
 type OptionsFileParams struct {
@@ -24,6 +33,10 @@ type MkdirParams struct {
 	Dir string `form:"dir" binding:"required"`
 }
 
+type DataExportParam struct {
+	Passphrase string `form:"passphrase"`
+}
+
 type ImportResponse struct {
 	CreateGroup      []string `json:"create_group"`
 	CreateTag        []string `json:"create_tag"`
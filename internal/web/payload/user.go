@@ -0,0 +1,36 @@
+package payload
+
+type LoginForm struct {
+	Username string `form:"username" binding:"required"`
+	Password string `form:"password" binding:"required"`
+}
+
+type LoginResponse struct {
+	Token    string      `json:"token"`
+	ExpireAt int64       `json:"expire_at"`
+	User     interface{} `json:"user"`
+}
+
+type GetUserParam struct {
+	Id int `uri:"id" binding:"required"`
+}
+
+type PostUserForm struct {
+	Username string `form:"username" binding:"required"`
+	Password string `form:"password" binding:"required,min=6"`
+	Role     string `form:"role" binding:"required,oneof=admin operator readonly"`
+	Grants   string `form:"grants"`
+}
+
+type PutUserForm struct {
+	Id       int    `form:"id" binding:"required"`
+	Username string `form:"username"`
+	Password string `form:"password" binding:"len=0|min=6"`
+	Role     string `form:"role" binding:"omitempty,oneof=admin operator readonly"`
+	Grants   string `form:"grants"`
+	Disabled *bool  `form:"disabled"`
+}
+
+type DeleteUserParam struct {
+	Id int `uri:"id" binding:"required"`
+}
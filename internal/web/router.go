@@ -16,6 +16,7 @@ import (
 
 	"github.com/ssbeatty/oms/docs"
 	"github.com/ssbeatty/oms/internal/config"
+	"github.com/ssbeatty/oms/internal/models"
 	"github.com/ssbeatty/oms/internal/ssh"
 	"github.com/ssbeatty/oms/internal/task"
 	"github.com/ssbeatty/oms/internal/tunnel"
@@ -79,22 +80,28 @@ func Logger(logger *logger.Logger, notLogged ...string) gin.HandlerFunc {
 	}
 }
 
-func CORS(ctx *gin.Context) {
-	method := ctx.Request.Method
+// CORS 只对 checkOrigin 允许的来源返回跨域响应头
+func CORS(checkOrigin func(r *http.Request) bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		method := ctx.Request.Method
+
+		// set response header
+		if origin := ctx.Request.Header.Get("Origin"); origin != "" && checkOrigin(ctx.Request) {
+			ctx.Header("Access-Control-Allow-Origin", origin)
+			ctx.Header("Access-Control-Allow-Credentials", "true")
+			ctx.Header("Access-Control-Allow-Headers",
+				"Content-Type, Access-Control-Allow-Headers, Authorization, X-Requested-With, X-Files")
+			ctx.Header("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
+			ctx.Header("Vary", "Origin")
+		}
 
-	// set response header
-	ctx.Header("Access-Control-Allow-Origin", ctx.Request.Header.Get("Origin"))
-	ctx.Header("Access-Control-Allow-Credentials", "true")
-	ctx.Header("Access-Control-Allow-Headers",
-		"Content-Type, Access-Control-Allow-Headers, Authorization, X-Requested-With, X-Files")
-	ctx.Header("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
+		if method == "OPTIONS" || method == "HEAD" {
+			ctx.AbortWithStatus(http.StatusNoContent)
+			return
+		}
 
-	if method == "OPTIONS" || method == "HEAD" {
-		ctx.AbortWithStatus(http.StatusNoContent)
-		return
+		ctx.Next()
 	}
-
-	ctx.Next()
 }
 
 // exportHeaders export header Content-Disposition for axios
@@ -125,7 +132,7 @@ func Handle(h HandlerFunc) gin.HandlerFunc {
 func InitRouter(s *controllers.Service) *controllers.Service {
 	r := gin.New()
 
-	r.Use(gin.Recovery()).Use(CORS).Use(exportHeaders)
+	r.Use(gin.Recovery()).Use(CORS(s.CheckOrigin)).Use(exportHeaders)
 
 	// swagger docs
 	docs.SwaggerInfo.BasePath = "/api/v1"
@@ -136,7 +143,7 @@ func InitRouter(s *controllers.Service) *controllers.Service {
 	}
 
 	// metrics
-	r.GET("/metrics", prometheusHandler())
+	r.GET("/metrics", s.AuthRequired, prometheusHandler())
 
 	static := &web.ServeFileSystem{
 		E:    web.EmbeddedFiles,
@@ -156,107 +163,170 @@ func InitRouter(s *controllers.Service) *controllers.Service {
 		}
 	})
 
+	// 只读用户只能查看, 操作员可以在授权的主机上执行操作, 管理员管理资产和用户
+	adminRole := s.RoleRequired(models.RoleAdmin)
+	operatorRole := s.RoleRequired(models.RoleAdmin, models.RoleOperator)
+
 	// websocket
-	r.GET("/ws/index", s.GetWebsocketIndex)
-	r.GET("/ws/ssh/:id", s.GetWebsocketSSH)
-	r.GET("/ws/vnc/:id", s.GetWebsocketVNC)
+	ws := r.Group("/ws", s.AuthRequired)
+	{
+		ws.GET("/index", s.GetWebsocketIndex)
+		ws.GET("/ssh-group", operatorRole, s.GetWebsocketSSHGroup)
+		ws.GET("/ssh/:id", operatorRole, s.GetWebsocketSSH)
+		ws.GET("/vnc/:id", operatorRole, s.GetWebsocketVNC)
+		ws.GET("/session/:id/watch", adminRole, s.WatchLiveSession)
+		ws.GET("/session/join/:token", operatorRole, s.JoinLiveSession)
+		ws.GET("/task/instance/:id/log", s.GetWebsocketInstanceLog)
+	}
+
+	// public api
+	r.POST("/api/v1/login", s.Audit, Handle(s.Login))
+	// version
+	r.GET("/api/v1/version", Handle(s.GetVersion))
 
 	// restapi
-	apiV1 := r.Group("/api/v1")
+	apiV1 := r.Group("/api/v1", s.AuthRequired, s.Audit)
 	{
+		// user
+		apiV1.POST("/logout", Handle(s.Logout))
+		apiV1.GET("/user/current", Handle(s.GetCurrentUser))
+		apiV1.GET("/user", adminRole, Handle(s.GetUsers))
+		apiV1.GET("/user/:id", adminRole, Handle(s.GetOneUser))
+		apiV1.POST("/user", adminRole, Handle(s.PostUser))
+		apiV1.PUT("/user", adminRole, Handle(s.PutUser))
+		apiV1.DELETE("/user/:id", adminRole, Handle(s.DeleteUser))
+
+		// audit
+		apiV1.GET("/audit", adminRole, Handle(s.GetAuditEvents))
+		apiV1.GET("/audit/export", adminRole, Handle(s.ExportAuditEvents))
+
+		// session recording
+		apiV1.GET("/recording", Handle(s.GetSessionRecordings))
+		apiV1.GET("/recording/search", Handle(s.SearchSessionRecordings))
+		apiV1.GET("/recording/:id", Handle(s.GetOneSessionRecording))
+		apiV1.GET("/recording/:id/download", Handle(s.DownloadSessionRecording))
+		apiV1.DELETE("/recording/:id", adminRole, Handle(s.DeleteSessionRecording))
+
+		// live session
+		apiV1.GET("/session", adminRole, Handle(s.GetLiveSessions))
+		apiV1.DELETE("/session/:id", adminRole, Handle(s.KillLiveSession))
+
+		// api token
+		apiV1.GET("/token", Handle(s.GetApiTokens))
+		apiV1.POST("/token", Handle(s.PostApiToken))
+		apiV1.DELETE("/token/:id", Handle(s.DeleteApiToken))
+
 		apiV1.GET("/host", Handle(s.GetHosts))
 		apiV1.GET("/host/:id", Handle(s.GetOneHost))
-		apiV1.POST("/host", Handle(s.PostHost))
-		apiV1.PUT("/host", Handle(s.PutHost))
-		apiV1.DELETE("/host/:id", Handle(s.DeleteHost))
+		apiV1.POST("/host", adminRole, Handle(s.PostHost))
+		apiV1.PUT("/host", adminRole, Handle(s.PutHost))
+		apiV1.DELETE("/host/:id", adminRole, Handle(s.DeleteHost))
+
+		apiV1.GET("/known_host", Handle(s.GetKnownHost))
+		apiV1.POST("/known_host/accept", adminRole, Handle(s.AcceptKnownHost))
+		apiV1.POST("/known_host/import", adminRole, Handle(s.ImportKnownHosts))
+		apiV1.DELETE("/known_host/:host_id", adminRole, Handle(s.DeleteKnownHost))
+
+		// cert authority
+		apiV1.GET("/ca", Handle(s.GetCertAuthority))
+		apiV1.GET("/ca/public_key", Handle(s.GetCertAuthorityPublicKey))
 
 		apiV1.GET("/private_key", Handle(s.GetPrivateKeys))
 		apiV1.GET("/private_key/:id", Handle(s.GetOnePrivateKey))
-		apiV1.POST("/private_key", Handle(s.PostPrivateKey))
-		apiV1.PUT("/private_key", Handle(s.PutPrivateKey))
-		apiV1.DELETE("/private_key/:id", Handle(s.DeletePrivateKey))
+		apiV1.POST("/private_key", adminRole, Handle(s.PostPrivateKey))
+		apiV1.PUT("/private_key", adminRole, Handle(s.PutPrivateKey))
+		apiV1.DELETE("/private_key/:id", adminRole, Handle(s.DeletePrivateKey))
 
 		apiV1.GET("/group", Handle(s.GetGroups))
 		apiV1.GET("/group/:id", Handle(s.GetOneGroup))
-		apiV1.POST("/group", Handle(s.PostGroup))
-		apiV1.PUT("/group", Handle(s.PutGroup))
-		apiV1.DELETE("/group/:id", Handle(s.DeleteGroup))
+		apiV1.POST("/group", adminRole, Handle(s.PostGroup))
+		apiV1.PUT("/group", adminRole, Handle(s.PutGroup))
+		apiV1.DELETE("/group/:id", adminRole, Handle(s.DeleteGroup))
 
 		apiV1.GET("/tag", Handle(s.GetTags))
 		apiV1.GET("/tag/:id", Handle(s.GetOneTag))
-		apiV1.POST("/tag", Handle(s.PostTag))
-		apiV1.PUT("/tag", Handle(s.PutTag))
-		apiV1.DELETE("/tag/:id", Handle(s.DeleteTag))
+		apiV1.POST("/tag", adminRole, Handle(s.PostTag))
+		apiV1.PUT("/tag", adminRole, Handle(s.PutTag))
+		apiV1.DELETE("/tag/:id", adminRole, Handle(s.DeleteTag))
 
 		apiV1.GET("/tunnel", Handle(s.GetTunnels))
 		apiV1.GET("/tunnel/:id", Handle(s.GetOneTunnel))
-		apiV1.POST("/tunnel", Handle(s.PostTunnel))
-		apiV1.PUT("/tunnel", Handle(s.PutTunnel))
-		apiV1.DELETE("/tunnel/:id", Handle(s.DeleteTunnel))
+		apiV1.POST("/tunnel", operatorRole, Handle(s.PostTunnel))
+		apiV1.PUT("/tunnel", operatorRole, Handle(s.PutTunnel))
+		apiV1.DELETE("/tunnel/:id", operatorRole, Handle(s.DeleteTunnel))
 
 		apiV1.GET("/job", Handle(s.GetJobs))
 		apiV1.GET("/job/:id", Handle(s.GetOneJob))
-		apiV1.POST("/job", Handle(s.PostJob))
-		apiV1.PUT("/job", Handle(s.PutJob))
-		apiV1.DELETE("/job/:id", Handle(s.DeleteJob))
+		apiV1.POST("/job", operatorRole, Handle(s.PostJob))
+		apiV1.PUT("/job", operatorRole, Handle(s.PutJob))
+		apiV1.DELETE("/job/:id", operatorRole, Handle(s.DeleteJob))
 		//apiV1.GET("/job/tail", Handle(s.GetLogStream))
-		apiV1.POST("/job/exec", Handle(s.ExecJob))
-		apiV1.POST("/job/start", Handle(s.StartJob))
-		apiV1.POST("/job/stop", Handle(s.StopJob))
+		apiV1.POST("/job/exec", operatorRole, Handle(s.ExecJob))
+		apiV1.POST("/job/start", operatorRole, Handle(s.StartJob))
+		apiV1.POST("/job/stop", operatorRole, Handle(s.StopJob))
 		apiV1.GET("/task/instance", Handle(s.GetInstances))
-		apiV1.DELETE("/task/instance", Handle(s.DeleteInstances))
+		apiV1.DELETE("/task/instance", adminRole, Handle(s.DeleteInstances))
 		apiV1.GET("/task/instance/log/download", Handle(s.DownloadInstanceLog))
 		apiV1.GET("/task/instance/log/get", Handle(s.GetInstanceLog))
+		apiV1.GET("/task/instance/host", Handle(s.GetInstanceHostResults))
+		apiV1.GET("/task/instance/host/output", Handle(s.GetInstanceHostOutput))
+		apiV1.POST("/task/instance/rerun", operatorRole, Handle(s.RerunInstance))
+		apiV1.POST("/task/instance/cancel", operatorRole, Handle(s.CancelInstance))
 
 		// command
 		apiV1.GET("/command/history", Handle(s.GetCommandHistory))
-		apiV1.DELETE("/command/history/:id", Handle(s.DeleteCommandHistory))
+		apiV1.DELETE("/command/history/:id", adminRole, Handle(s.DeleteCommandHistory))
+
+		apiV1.GET("/command/rule", adminRole, Handle(s.GetCommandRules))
+		apiV1.GET("/command/rule/:id", adminRole, Handle(s.GetOneCommandRule))
+		apiV1.POST("/command/rule", adminRole, Handle(s.PostCommandRule))
+		apiV1.PUT("/command/rule", adminRole, Handle(s.PutCommandRule))
+		apiV1.DELETE("/command/rule/:id", adminRole, Handle(s.DeleteCommandRule))
 
 		apiV1.GET("/quick_command", Handle(s.GetQuicklyCommand))
 		apiV1.GET("/quick_command/:id", Handle(s.GetOneQuicklyCommand))
-		apiV1.POST("/quick_command", Handle(s.PostQuicklyCommand))
-		apiV1.PUT("/quick_command", Handle(s.PutQuicklyCommand))
-		apiV1.DELETE("/quick_command/:id", Handle(s.DeleteQuicklyCommand))
+		apiV1.POST("/quick_command", operatorRole, Handle(s.PostQuicklyCommand))
+		apiV1.PUT("/quick_command", operatorRole, Handle(s.PutQuicklyCommand))
+		apiV1.DELETE("/quick_command/:id", operatorRole, Handle(s.DeleteQuicklyCommand))
 
 		// tools
-		apiV1.GET("/tools/cmd", Handle(s.RunCmd))
-		apiV1.GET("/tools/preview", Handle(s.FilePreview))
-		apiV1.GET("/tools/browse", Handle(s.GetPathInfo))
-		apiV1.POST("/tools/mkdir", Handle(s.MakeDirRemote))
-		apiV1.POST("/tools/modify", Handle(s.ModifyFile))
-		apiV1.GET("/tools/download", Handle(s.DownLoadFile))
-		apiV1.POST("/tools/delete", Handle(s.DeleteFile))
-		apiV1.GET("/tools/export", Handle(s.DataExport))
-		apiV1.POST("/tools/import", Handle(s.DataImport))
+		apiV1.GET("/tools/cmd", operatorRole, Handle(s.RunCmd))
+		apiV1.GET("/tools/preview", operatorRole, Handle(s.FilePreview))
+		apiV1.GET("/tools/browse", operatorRole, Handle(s.GetPathInfo))
+		apiV1.POST("/tools/mkdir", operatorRole, Handle(s.MakeDirRemote))
+		apiV1.POST("/tools/modify", operatorRole, Handle(s.ModifyFile))
+		apiV1.GET("/tools/download", operatorRole, Handle(s.DownLoadFile))
+		apiV1.POST("/tools/delete", operatorRole, Handle(s.DeleteFile))
+		apiV1.GET("/tools/export", adminRole, Handle(s.DataExport))
+		apiV1.POST("/tools/export", adminRole, Handle(s.DataExport))
+		apiV1.POST("/tools/import", adminRole, Handle(s.DataImport))
 
 		// steam version
-		apiV1.POST("/tools/upload", Handle(s.FileUploadV2))
-		apiV1.POST("/tools/upload/cancel", Handle(s.FileUploadCancel))
+		apiV1.POST("/tools/upload", operatorRole, Handle(s.FileUploadV2))
+		apiV1.POST("/tools/upload/cancel", operatorRole, Handle(s.FileUploadCancel))
 
 		// player scheme
 		apiV1.GET("/schema", Handle(s.GetPluginSchema))
-		apiV1.POST("/cache/upload", Handle(s.CacheUpload))
+		apiV1.POST("/cache/upload", operatorRole, Handle(s.CacheUpload))
 		apiV1.GET("/player", Handle(s.GetPlayBooks))
 		apiV1.GET("/player/:id", Handle(s.GetOnePlayBook))
-		apiV1.POST("/player", Handle(s.PostPlayBook))
-		apiV1.PUT("/player", Handle(s.PutPlayBook))
-		apiV1.DELETE("/player/:id", Handle(s.DeletePlayBook))
-		apiV1.POST("/plugin/upload", Handle(s.PluginUpload))
+		apiV1.POST("/player", operatorRole, Handle(s.PostPlayBook))
+		apiV1.PUT("/player", operatorRole, Handle(s.PutPlayBook))
+		apiV1.DELETE("/player/:id", operatorRole, Handle(s.DeletePlayBook))
+		apiV1.POST("/plugin/upload", adminRole, Handle(s.PluginUpload))
 
-		apiV1.POST("/player/import", Handle(s.PlayerImport))
+		apiV1.POST("/player/import", adminRole, Handle(s.PlayerImport))
 		apiV1.GET("/player/export", Handle(s.PlayerExport))
-
-		// version
-		apiV1.GET("/version", Handle(s.GetVersion))
 	}
 	s.Engine = r
 
 	return s
 }
 
-func Serve(conf config.App, sshManager *ssh.Manager, taskManager *task.Manager, tunnelManager *tunnel.Manager) {
+func Serve(cfg *config.Conf, sshManager *ssh.Manager, taskManager *task.Manager, tunnelManager *tunnel.Manager) {
+	conf := cfg.App
 	gin.SetMode(gin.ReleaseMode)
-	s := InitRouter(controllers.NewService(conf, sshManager, taskManager, tunnelManager))
+	s := InitRouter(controllers.NewService(cfg, sshManager, taskManager, tunnelManager))
 
 	s.Logger.Infof("Listening and serving HTTP on %s", s.Addr)
 	go func() {
@@ -0,0 +1,250 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/internal/ssh"
+	"github.com/ssbeatty/oms/internal/web/payload"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+const (
+	// 流式执行命令的消息, 同一台主机的 output 和 exit 消息按 seq 递增
+	streamTypeStart  = "start"  // 开始执行, 带有批次 ID 和主机列表
+	streamTypeOutput = "output" // 主机的一段输出
+	streamTypeExit   = "exit"   // 主机执行结束
+)
+
+// CmdCancelRequest 取消流式执行的命令, host_id 为 0 时取消整个批次
+type CmdCancelRequest struct {
+	BatchId string `json:"batch_id"`
+	HostId  int    `json:"host_id"`
+}
+
+type streamHost struct {
+	HostId   int    `json:"host_id"`
+	HostName string `json:"hostname"`
+	Addr     string `json:"addr"`
+}
+
+type streamStartMessage struct {
+	Type    string        `json:"type"`
+	BatchId string        `json:"batch_id"`
+	Hosts   []*streamHost `json:"hosts"`
+}
+
+type streamOutputMessage struct {
+	Type    string `json:"type"`
+	BatchId string `json:"batch_id"`
+	HostId  int    `json:"host_id"`
+	Seq     int    `json:"seq"`
+	Stream  string `json:"stream"` // stdout 或 stderr
+	Data    string `json:"data"`
+}
+
+type streamExitMessage struct {
+	Type     string `json:"type"`
+	BatchId  string `json:"batch_id"`
+	HostId   int    `json:"host_id"`
+	HostName string `json:"hostname"`
+	Seq      int    `json:"seq"`
+	Status   bool   `json:"status"`
+	ExitCode int    `json:"exit_code"` // 没有退出码(连接失败, 超时, 被取消)时为 -1
+	Signal   string `json:"signal,omitempty"`
+	Duration int64  `json:"duration"` // 毫秒
+	Error    string `json:"error,omitempty"`
+	Canceled bool   `json:"canceled"`
+}
+
+// cmdBatch 正在流式执行的一批命令
+type cmdBatch struct {
+	id      string
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	cancels map[int]context.CancelFunc
+}
+
+func (b *cmdBatch) add(hostId int, cancel context.CancelFunc) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cancels[hostId] = cancel
+}
+
+// cancelHost hostId 为 0 时取消所有主机
+func (b *cmdBatch) cancelHost(hostId int) bool {
+	if hostId == 0 {
+		b.cancel()
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cancel, ok := b.cancels[hostId]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// hostStream 一台主机的输出, 保证 seq 和发送顺序一致, 被截断的多字节字符和下一段输出一起发送
+type hostStream struct {
+	mu      sync.Mutex
+	seq     int
+	pending map[string][]byte
+}
+
+func (h *hostStream) write(stream string, data []byte, send func(seq int, stream, text string)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	data = append(h.pending[stream], data...)
+	data, h.pending[stream] = splitIncomplete(data)
+	if len(data) == 0 {
+		return
+	}
+	h.seq++
+	send(h.seq, stream, string(data))
+}
+
+// flush 发送剩余的输出并返回结束消息的 seq
+func (h *hostStream) flush(send func(seq int, stream, text string)) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, stream := range []string{ssh.StreamStdout, ssh.StreamStderr} {
+		if data := h.pending[stream]; len(data) > 0 {
+			h.seq++
+			send(h.seq, stream, string(data))
+		}
+	}
+	h.pending = nil
+	h.seq++
+	return h.seq
+}
+
+// splitIncomplete 拆出末尾不完整的多字节字符
+func splitIncomplete(data []byte) ([]byte, []byte) {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return data[:i], append([]byte(nil), data[i:]...)
+			}
+			break
+		}
+	}
+	return data, nil
+}
+
+// streamCmd 按策略执行命令并实时发送每台主机的输出, 阻塞到所有主机结束, 返回执行和失败的主机数
+func (w *WSConnect) streamCmd(cmd ssh.Command, hosts []*models.Host, strategy models.ExecStrategy) (int, int) {
+	ctx, cancel := w.closeContext()
+	defer cancel()
+
+	batch := &cmdBatch{id: uuid.NewString(), cancel: cancel, cancels: make(map[int]context.CancelFunc)}
+	w.batches.Store(batch.id, batch)
+	defer w.batches.Delete(batch.id)
+
+	start := &streamStartMessage{Type: streamTypeStart, BatchId: batch.id}
+	for _, host := range hosts {
+		start.Hosts = append(start.Hosts, &streamHost{HostId: host.Id, HostName: host.Name, Addr: host.Addr})
+	}
+	w.WriteMsg(payload.GenerateDataResponse(WSStatusSuccess, "success", start))
+
+	var failed int32
+	skipped := ssh.RunWithStrategy(ctx, strategy, hosts, func(host *models.Host) bool {
+		hostCtx, hostCancel := context.WithCancel(ctx)
+		defer hostCancel()
+		batch.add(host.Id, hostCancel)
+
+		if !w.streamHost(hostCtx, batch.id, host, cmd) {
+			atomic.AddInt32(&failed, 1)
+			return false
+		}
+		return true
+	})
+	for _, host := range skipped {
+		w.WriteMsg(payload.GenerateDataResponse(WSStatusSuccess, "success", &streamExitMessage{
+			Type:     streamTypeExit,
+			BatchId:  batch.id,
+			HostId:   host.Id,
+			HostName: host.Name,
+			Seq:      1,
+			ExitCode: -1,
+			Error:    ssh.ErrBatchAborted.Error(),
+			Canceled: ctx.Err() != nil,
+		}))
+	}
+
+	return len(hosts) - len(skipped), int(failed) + len(skipped)
+}
+
+// closeContext 连接断开时结束的 context
+func (w *WSConnect) closeContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-w.closer:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (w *WSConnect) streamHost(ctx context.Context, batchId string, host *models.Host, cmd ssh.Command) bool {
+	hs := &hostStream{pending: make(map[string][]byte)}
+	send := func(seq int, stream, text string) {
+		w.WriteMsg(payload.GenerateDataResponse(WSStatusSuccess, "success", &streamOutputMessage{
+			Type:    streamTypeOutput,
+			BatchId: batchId,
+			HostId:  host.Id,
+			Seq:     seq,
+			Stream:  stream,
+			Data:    text,
+		}))
+	}
+
+	res := w.engine.RunCmdStream(ctx, host, cmd, w.userName(), func(stream string, data []byte) {
+		hs.write(stream, data, send)
+	})
+
+	exit := &streamExitMessage{
+		Type:     streamTypeExit,
+		BatchId:  batchId,
+		HostId:   host.Id,
+		HostName: host.Name,
+		Seq:      hs.flush(send),
+		Status:   res.Status,
+		ExitCode: res.ExitCode,
+		Signal:   res.Signal,
+		Duration: res.Duration,
+		Error:    res.Error,
+		Canceled: ctx.Err() != nil,
+	}
+	w.WriteMsg(payload.GenerateDataResponse(WSStatusSuccess, "success", exit))
+
+	return exit.Status
+}
+
+// HandlerCmdCancel 取消流式执行的命令
+func (w *WSConnect) HandlerCmdCancel(conn *websocket.Conn, msg *WsMsg) {
+	w.logger.Infof("handler cmd cancel recv a message: %s", msg.Body)
+
+	req := &CmdCancelRequest{}
+	err := json.Unmarshal(msg.Body, req)
+	if err != nil {
+		w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, "can not parse payload"))
+		return
+	}
+	val, ok := w.batches.Load(req.BatchId)
+	if !ok || !val.(*cmdBatch).cancelHost(req.HostId) {
+		w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, "batch or host not found"))
+		return
+	}
+	w.WriteMsg(payload.GenerateMsgResponse(WSStatusSuccess, "cancel success"))
+}
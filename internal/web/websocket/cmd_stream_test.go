@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"testing"
+)
+
+func TestSplitIncomplete(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantHead string
+		wantTail string
+	}{
+		{"empty", "", "", ""},
+		{"ascii", "hello", "hello", ""},
+		{"complete rune", "ab中", "ab中", ""},
+		{"one byte of three", "ab\xe4", "ab", "\xe4"},
+		{"two bytes of three", "ab\xe4\xb8", "ab", "\xe4\xb8"},
+		{"three bytes of four", "a\xf0\x9f\x98", "a", "\xf0\x9f\x98"},
+		{"only incomplete", "\xe4\xb8", "", "\xe4\xb8"},
+		// 不是合法 utf8 的字节原样发送, 不会一直留在缓冲中
+		{"stray continuation", "ab\x80", "ab\x80", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, tail := splitIncomplete([]byte(tt.data))
+			if string(head) != tt.wantHead || string(tail) != tt.wantTail {
+				t.Errorf("splitIncomplete(%q) = %q, %q, want %q, %q", tt.data, head, tail, tt.wantHead, tt.wantTail)
+			}
+		})
+	}
+}
+
+func TestSplitIncompleteJoin(t *testing.T) {
+	text := []byte("输出: 你好, world")
+	for i := 0; i <= len(text); i++ {
+		head, tail := splitIncomplete(text[:i])
+		got := string(head) + string(append(tail, text[i:]...))
+		if got != string(text) {
+			t.Fatalf("split at %d: %q", i, got)
+		}
+		if len(tail) >= 4 {
+			t.Fatalf("split at %d: tail %q is too long", i, tail)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package websocket
 
 import (
+	"context"
 	"github.com/ssbeatty/oms/internal/models"
 	"github.com/ssbeatty/oms/internal/ssh"
 )
 
 type WebService interface {
-	RunCmdWithContext(host *models.Host, cmd ssh.Command, ch chan *ssh.Result)
+	RunCmdWithContext(ctx context.Context, host *models.Host, cmd ssh.Command, user string, ch chan *ssh.Result)
+	RunCmdStream(ctx context.Context, host *models.Host, cmd ssh.Command, user string, output ssh.OutputFunc) *ssh.Result
 	GetSSHManager() *ssh.Manager
 }
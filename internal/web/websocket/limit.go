@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// CloseIdleTimeout 长时间没有输入被断开时 websocket 的关闭码
+	CloseIdleTimeout = 4003
+	// CloseMaxDuration 超过最长时长被断开时 websocket 的关闭码
+	CloseMaxDuration = 4004
+
+	ReasonIdleTimeout = "idle timeout"
+	ReasonMaxDuration = "max duration reached"
+
+	messageTypeWarning = "warning"
+	limitCheckInterval = time.Second
+)
+
+// SessionLimit 交互式会话的空闲超时和最长时长, 为 0 时不限制
+type SessionLimit struct {
+	IdleTimeout time.Duration
+	MaxDuration time.Duration
+	WarnBefore  time.Duration
+}
+
+func (l SessionLimit) enabled() bool {
+	return l.IdleTimeout > 0 || l.MaxDuration > 0
+}
+
+// warningMessage 会话即将被断开的提醒
+type warningMessage struct {
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	Message   string `json:"message"`
+	Remaining int    `json:"remaining"` // 剩余秒数
+}
+
+type limiter struct {
+	limit     SessionLimit
+	start     time.Time
+	lastInput int64 // unix nano
+}
+
+func newLimiter(limit SessionLimit) *limiter {
+	now := time.Now()
+	return &limiter{
+		limit:     limit,
+		start:     now,
+		lastInput: now.UnixNano(),
+	}
+}
+
+// touch 收到输入
+func (l *limiter) touch() {
+	if l != nil {
+		atomic.StoreInt64(&l.lastInput, time.Now().UnixNano())
+	}
+}
+
+// run 定时检查, 即将超时时调用 warn, 超时后调用 expire 并返回
+func (l *limiter) run(done <-chan struct{}, warn func(*warningMessage), expire func(code int, reason string)) {
+	ticker := time.NewTicker(limitCheckInterval)
+	defer ticker.Stop()
+
+	var (
+		maxWarned  bool
+		idleWarned int64 // 提醒时的最后输入时间, 之后有输入会重新提醒
+	)
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if l.limit.MaxDuration > 0 {
+				remaining := l.start.Add(l.limit.MaxDuration).Sub(now)
+				if remaining <= 0 {
+					expire(CloseMaxDuration, ReasonMaxDuration)
+					return
+				}
+				if remaining <= l.limit.WarnBefore && !maxWarned {
+					maxWarned = true
+					warn(newWarning(ReasonMaxDuration, remaining,
+						fmt.Sprintf("session reaches the maximum duration %s", l.limit.MaxDuration)))
+				}
+			}
+			if l.limit.IdleTimeout > 0 {
+				last := atomic.LoadInt64(&l.lastInput)
+				remaining := time.Unix(0, last).Add(l.limit.IdleTimeout).Sub(now)
+				if remaining <= 0 {
+					expire(CloseIdleTimeout, ReasonIdleTimeout)
+					return
+				}
+				if remaining <= l.limit.WarnBefore && idleWarned != last {
+					idleWarned = last
+					warn(newWarning(ReasonIdleTimeout, remaining,
+						fmt.Sprintf("no input for %s", (l.limit.IdleTimeout-remaining).Round(time.Second))))
+				}
+			}
+		}
+	}
+}
+
+func newWarning(reason string, remaining time.Duration, detail string) *warningMessage {
+	seconds := int(remaining.Round(time.Second).Seconds())
+	return &warningMessage{
+		Type:      messageTypeWarning,
+		Reason:    reason,
+		Message:   fmt.Sprintf("%s, will be disconnected in %d seconds", detail, seconds),
+		Remaining: seconds,
+	}
+}
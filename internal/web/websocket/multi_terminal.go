@@ -0,0 +1,212 @@
+package websocket
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/pkg/logger"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// 多主机终端的消息, 服务端发送的消息都带有 host_id
+	multiTypeOpen   = "open"   // 主机终端已连接
+	multiTypeData   = "data"   // 主机终端的输出
+	multiTypeError  = "error"  // 主机终端连接失败
+	multiTypeExit   = "exit"   // 主机终端已退出, 超时断开时带有 reason
+	multiTypeInput  = "input"  // 输入, host_id 为 0 时广播到所有未排除的主机
+	multiTypeResize = "resize" // 调整窗口大小, host_id 为 0 时调整所有主机
+	multiTypeToggle = "toggle" // 把主机从广播中排除或者加回
+)
+
+// multiMessage 多主机终端的消息帧
+type multiMessage struct {
+	Type     string `json:"type"`
+	HostId   int    `json:"host_id"`
+	HostName string `json:"host_name,omitempty"`
+	Addr     string `json:"addr,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Enable   *bool  `json:"enable,omitempty"`
+	// 超时提醒和超时断开的原因
+	Reason    string `json:"reason,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Remaining int    `json:"remaining,omitempty"`
+}
+
+// multiRequest 客户端发送的消息, input 的 data 为文本
+type multiRequest struct {
+	Type   string `json:"type"`
+	HostId int    `json:"host_id"`
+	Data   string `json:"data"`
+	Cols   int    `json:"cols"`
+	Rows   int    `json:"rows"`
+	Enable bool   `json:"enable"`
+}
+
+type pane struct {
+	host    *models.Host
+	session *SSHSession
+	enable  bool // 是否接收广播的输入
+}
+
+// MultiTerminal 一个 websocket 连接复用多个主机的终端, 每个主机的输出带上主机 ID 单独转发,
+// 键盘输入可以同时发给所有主机
+type MultiTerminal struct {
+	conn     *websocket.Conn
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	panes    map[int]*pane
+	expected int // 需要连接的主机数
+	finished int // 连接失败或者已退出的主机数
+	closed   bool
+	logger   *logger.Logger
+}
+
+func NewMultiTerminal(conn *websocket.Conn, expected int) *MultiTerminal {
+	return &MultiTerminal{
+		conn:     conn,
+		panes:    make(map[int]*pane),
+		expected: expected,
+		logger:   logger.NewLogger("multiTerminal"),
+	}
+}
+
+func (m *MultiTerminal) writeJSON(v interface{}) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	return m.conn.WriteJSON(v)
+}
+
+// AddPane 添加已连接的主机终端, 连接已经关闭时返回 false, 需要调用方关闭 session
+func (m *MultiTerminal) AddPane(host *models.Host, session *SSHSession) bool {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return false
+	}
+	m.panes[host.Id] = &pane{host: host, session: session, enable: true}
+	m.mu.Unlock()
+
+	session.writeMu.Lock()
+	session.output = func(data []byte) error {
+		return m.writeJSON(&multiMessage{Type: multiTypeData, HostId: host.Id, Data: data})
+	}
+	session.warn = func(msg *warningMessage) error {
+		return m.writeJSON(&multiMessage{
+			Type: msg.Type, HostId: host.Id, Reason: msg.Reason, Message: msg.Message, Remaining: msg.Remaining,
+		})
+	}
+	session.writeMu.Unlock()
+	_ = m.writeJSON(&multiMessage{Type: multiTypeOpen, HostId: host.Id, HostName: host.Name, Addr: host.Addr})
+	return true
+}
+
+// PaneError 主机终端连接失败
+func (m *MultiTerminal) PaneError(host *models.Host, err error) {
+	_ = m.writeJSON(&multiMessage{Type: multiTypeError, HostId: host.Id, HostName: host.Name, Addr: host.Addr, Error: err.Error()})
+	m.finish()
+}
+
+// PaneExit 主机终端退出, 所有主机都退出后关闭连接, reason 为服务端主动结束终端的原因
+func (m *MultiTerminal) PaneExit(host *models.Host, reason string) {
+	m.mu.Lock()
+	delete(m.panes, host.Id)
+	m.mu.Unlock()
+
+	_ = m.writeJSON(&multiMessage{Type: multiTypeExit, HostId: host.Id, Reason: reason})
+	m.finish()
+}
+
+func (m *MultiTerminal) finish() {
+	m.mu.Lock()
+	m.finished++
+	done := m.finished >= m.expected
+	m.mu.Unlock()
+
+	if done {
+		_ = m.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "all sessions closed"), time.Now().Add(closeWriteTimeout))
+		_ = m.conn.Close()
+	}
+}
+
+// Serve 处理客户端的输入, 阻塞到连接断开, 返回后所有主机终端都会结束
+func (m *MultiTerminal) Serve() {
+	defer m.close()
+
+	for {
+		_, data, err := m.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		req := multiRequest{}
+		if err := json.Unmarshal(data, &req); err != nil {
+			m.logger.Errorf("unmarshal multi terminal message error: %v", err)
+			continue
+		}
+		switch req.Type {
+		case multiTypeInput:
+			for _, p := range m.targets(req.HostId, true) {
+				p.session.ownerInput([]byte(req.Data))
+			}
+		case multiTypeResize:
+			if req.Cols <= 0 || req.Rows <= 0 {
+				continue
+			}
+			for _, p := range m.targets(req.HostId, false) {
+				p.session.resize(req.Cols, req.Rows)
+			}
+		case multiTypeToggle:
+			m.toggle(req.HostId, req.Enable)
+		}
+	}
+}
+
+// targets hostId 为 0 时返回所有主机, broadcast 为 true 时跳过被排除的主机
+func (m *MultiTerminal) targets(hostId int, broadcast bool) []*pane {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if hostId != 0 {
+		if p, ok := m.panes[hostId]; ok {
+			return []*pane{p}
+		}
+		return nil
+	}
+	ret := make([]*pane, 0, len(m.panes))
+	for _, p := range m.panes {
+		if p.enable || !broadcast {
+			ret = append(ret, p)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].host.Id < ret[j].host.Id
+	})
+	return ret
+}
+
+func (m *MultiTerminal) toggle(hostId int, enable bool) {
+	m.mu.Lock()
+	p, ok := m.panes[hostId]
+	if ok {
+		p.enable = enable
+	}
+	m.mu.Unlock()
+
+	if ok {
+		_ = m.writeJSON(&multiMessage{Type: multiTypeToggle, HostId: hostId, Enable: &enable})
+	}
+}
+
+func (m *MultiTerminal) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	for _, p := range m.panes {
+		p.session.Quit()
+	}
+}
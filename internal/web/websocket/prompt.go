@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/ssbeatty/oms/pkg/transport"
+	"time"
+)
+
+const (
+	messageTypePrompt = "prompt"
+	// promptTimeout 等待用户输入动态口令的时间, 和 sshd 默认的 LoginGraceTime 一致
+	promptTimeout = 2 * time.Minute
+)
+
+// promptMessage keyboard-interactive 的问题, 前端回复 {"type": "prompt", "answers": [...]}
+type promptMessage struct {
+	Type        string   `json:"type"`
+	Name        string   `json:"name"`
+	Instruction string   `json:"instruction"`
+	Questions   []string `json:"questions"`
+	Echos       []bool   `json:"echos"`
+}
+
+type promptAnswer struct {
+	Type    string   `json:"type"`
+	Answers []string `json:"answers"`
+}
+
+// NewTerminalPrompt 终端建立ssh连接时通过websocket询问用户动态口令, 只能在开始转发终端数据之前使用
+func NewTerminalPrompt(wsConn *websocket.Conn) transport.KeyboardInteractiveFunc {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		err := wsConn.WriteJSON(&promptMessage{
+			Type:        messageTypePrompt,
+			Name:        name,
+			Instruction: instruction,
+			Questions:   questions,
+			Echos:       echos,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_ = wsConn.SetReadDeadline(time.Now().Add(promptTimeout))
+		defer wsConn.SetReadDeadline(time.Time{})
+		for {
+			_, data, err := wsConn.ReadMessage()
+			if err != nil {
+				return nil, err
+			}
+			// 忽略连接建立前的按键和窗口大小的消息
+			var answer promptAnswer
+			if json.Unmarshal(data, &answer) != nil || answer.Type != messageTypePrompt {
+				continue
+			}
+			return answer.Answers, nil
+		}
+	}
+}
+
+// WriteTerminalError 连接失败时在终端中显示错误
+func WriteTerminalError(wsConn *websocket.Conn, err error) {
+	_ = wsConn.WriteJSON(&message{Type: "data", Data: []byte("\r\n" + err.Error() + "\r\n")})
+}
@@ -0,0 +1,49 @@
+package websocket
+
+import (
+	"testing"
+)
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []string
+		want   string
+	}{
+		{"empty", 8, nil, ""},
+		{"not full", 8, []string{"abc", "de"}, "abcde"},
+		{"exactly full", 8, []string{"abcd", "efgh"}, "abcdefgh"},
+		{"wrap", 8, []string{"abcdef", "ghij"}, "cdefghij"},
+		{"wrap many times", 4, []string{"ab", "cd", "ef", "g"}, "defg"},
+		{"larger than buffer", 4, []string{"ab", "cdefghij"}, "ghij"},
+		{"write after large", 4, []string{"abcdefgh", "ij"}, "ghij"},
+		// 开头被截断的多字节字符会被去掉
+		{"truncated rune", 5, []string{"a中文"}, "文"},
+		{"whole runes", 6, []string{"中文"}, "中文"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRingBuffer(tt.size)
+			for _, w := range tt.writes {
+				r.Write([]byte(w))
+			}
+			if got := string(r.Bytes()); got != tt.want {
+				t.Errorf("Bytes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRingBufferBytesIsCopy(t *testing.T) {
+	r := newRingBuffer(4)
+	r.Write([]byte("abc"))
+	data := r.Bytes()
+	r.Write([]byte("def"))
+	if string(data) != "abc" {
+		t.Errorf("Bytes() result changed to %q after write", data)
+	}
+	if got := string(r.Bytes()); got != "cdef" {
+		t.Errorf("Bytes() = %q, want %q", got, "cdef")
+	}
+}
@@ -0,0 +1,423 @@
+package websocket
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/ssbeatty/oms/internal/models"
+	"github.com/ssbeatty/oms/pkg/logger"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// watcherBuffer 旁观者的发送队列, 写满时丢弃输出, 避免慢的旁观者阻塞终端
+	watcherBuffer = 256
+	// CloseTerminated 终端被管理员强制关闭时 websocket 的关闭码
+	CloseTerminated = 4001
+	// CloseReattached 终端在其他地方重新连接时旧连接的关闭码
+	CloseReattached = 4002
+
+	// messageTypeSession 终端保留时发给所有者的重连信息
+	messageTypeSession = "session"
+
+	closeWriteTimeout = time.Second
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// LiveSession 正在使用的web终端
+type LiveSession struct {
+	Id           string         `json:"id"`
+	HostId       int            `json:"host_id"`
+	HostName     string         `json:"host_name"`
+	Addr         string         `json:"addr"`
+	UserId       int            `json:"user_id"`
+	Username     string         `json:"username"`
+	ClientIP     string         `json:"client_ip"`
+	StartTime    time.Time      `json:"start_time"`
+	BytesIn      int64          `json:"bytes_in"`  // 用户输入的字节数
+	BytesOut     int64          `json:"bytes_out"` // 终端输出的字节数
+	Watchers     int            `json:"watchers"`
+	RecordingId  int            `json:"recording_id"`
+	Shared       bool           `json:"shared"`
+	Detached     bool           `json:"detached"` // 所有者已断开, 等待重连
+	Participants []*Participant `json:"participants"`
+
+	registry     *SessionRegistry
+	session      *SSHSession
+	grace        time.Duration // 所有者断开后终端保留的时间
+	token        string        // 重连使用的 token
+	detachedAt   time.Time
+	detachGen    int
+	graceTimer   *time.Timer
+	mu           sync.Mutex
+	watchers     map[*watcher]struct{}
+	owner        *Participant
+	participants map[string]*Participant
+	controller   string // 持有控制权的参与者
+	shareToken   string
+	closed       bool
+}
+
+// sessionMessage 终端的重连信息, 断开后在 grace_period 秒内使用 /ws/ssh/:id?session_token=token 重新连接
+type sessionMessage struct {
+	Type        string `json:"type"`
+	Id          string `json:"id"`
+	Token       string `json:"token"`
+	GracePeriod int    `json:"grace_period"`
+}
+
+type watcher struct {
+	conn *websocket.Conn
+	ch   chan interface{}
+	once sync.Once
+	done chan struct{}
+}
+
+// SessionRegistry 记录所有正在使用的web终端
+type SessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*LiveSession
+	tokens   map[string]string // 共享链接的 token -> 终端 ID
+	logger   *logger.Logger
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[string]*LiveSession),
+		tokens:   make(map[string]string),
+		logger:   logger.NewLogger("sessionRegistry"),
+	}
+}
+
+// Register 终端开始转发数据前登记, 终端结束时需要调用 Unregister, grace 为 0 时所有者断开后立即结束终端
+func (r *SessionRegistry) Register(host *models.Host, user *models.User, clientIP string, session *SSHSession, grace time.Duration) *LiveSession {
+	live := &LiveSession{
+		Id:           uuid.NewString(),
+		HostId:       host.Id,
+		HostName:     host.Name,
+		Addr:         host.Addr,
+		ClientIP:     clientIP,
+		StartTime:    time.Now(),
+		registry:     r,
+		session:      session,
+		grace:        grace,
+		token:        uuid.NewString(),
+		watchers:     make(map[*watcher]struct{}),
+		participants: make(map[string]*Participant),
+	}
+	if user != nil {
+		live.UserId = user.Id
+		live.Username = user.Username
+	}
+	live.owner = newParticipant(RoleOwner, user, clientIP, nil)
+	live.participants[live.owner.Id] = live.owner
+	live.controller = live.owner.Id
+	session.live = live
+
+	r.mu.Lock()
+	r.sessions[live.Id] = live
+	r.mu.Unlock()
+
+	return live
+}
+
+// Unregister 移除终端并断开所有旁观者和参与者
+func (r *SessionRegistry) Unregister(live *LiveSession) {
+	r.mu.Lock()
+	delete(r.sessions, live.Id)
+	for token, id := range r.tokens {
+		if id == live.Id {
+			delete(r.tokens, token)
+		}
+	}
+	r.mu.Unlock()
+
+	live.close()
+}
+
+// List 按开始时间排序的终端快照
+func (r *SessionRegistry) List() []*LiveSession {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ret := make([]*LiveSession, 0, len(r.sessions))
+	for _, live := range r.sessions {
+		ret = append(ret, live.snapshot())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].StartTime.Before(ret[j].StartTime)
+	})
+	return ret
+}
+
+func (r *SessionRegistry) Get(id string) (*LiveSession, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	live, ok := r.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return live, nil
+}
+
+// GetByShareToken 通过共享链接的 token 获取终端
+func (r *SessionRegistry) GetByShareToken(token string) (*LiveSession, error) {
+	r.mu.RLock()
+	id, ok := r.tokens[token]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return r.Get(id)
+}
+
+// GetByAttachToken 通过重连 token 获取终端
+func (r *SessionRegistry) GetByAttachToken(token string) (*LiveSession, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, live := range r.sessions {
+		if live.token == token {
+			return live, nil
+		}
+	}
+	return nil, ErrSessionNotFound
+}
+
+// Kill 强制关闭终端, 用户会收到关闭码为 CloseTerminated 的关闭消息
+func (r *SessionRegistry) Kill(id, reason string) error {
+	live, err := r.Get(id)
+	if err != nil {
+		return err
+	}
+	r.logger.Infof("kill session %s, host: %s, user: %s, reason: %s", live.Id, live.HostName, live.Username, reason)
+
+	live.session.Terminate(CloseTerminated, reason)
+	return nil
+}
+
+func (l *LiveSession) snapshot() *LiveSession {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return &LiveSession{
+		Id:           l.Id,
+		HostId:       l.HostId,
+		HostName:     l.HostName,
+		Addr:         l.Addr,
+		UserId:       l.UserId,
+		Username:     l.Username,
+		ClientIP:     l.ClientIP,
+		StartTime:    l.StartTime,
+		BytesIn:      atomic.LoadInt64(&l.BytesIn),
+		BytesOut:     atomic.LoadInt64(&l.BytesOut),
+		Watchers:     len(l.watchers),
+		RecordingId:  l.RecordingId,
+		Shared:       l.shareToken != "",
+		Detached:     !l.detachedAt.IsZero(),
+		Participants: l.participantList(),
+	}
+}
+
+// Attach 终端所有者连接或重新连接, 调整窗口大小并回放缓冲区中的输出, 阻塞到连接断开或者终端结束.
+// 同一时间只有一个所有者连接, 之前的连接会被断开
+func (l *LiveSession) Attach(conn *websocket.Conn, cols, rows int) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.detachGen++
+	l.detachedAt = time.Time{}
+	if l.graceTimer != nil {
+		l.graceTimer.Stop()
+		l.graceTimer = nil
+	}
+	l.mu.Unlock()
+
+	if cols > 0 && rows > 0 {
+		l.session.resize(cols, rows)
+	}
+	if old := l.session.attach(conn, true); old != nil {
+		_ = old.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(CloseReattached, "session attached elsewhere"), time.Now().Add(closeWriteTimeout))
+		_ = old.Close()
+	}
+	if l.grace > 0 {
+		_ = l.session.writeJSON(&sessionMessage{
+			Type:        messageTypeSession,
+			Id:          l.Id,
+			Token:       l.token,
+			GracePeriod: int(l.grace.Seconds()),
+		})
+	}
+
+	readDone := make(chan struct{})
+	go func() {
+		l.session.ReceiveWsMsg(conn)
+		close(readDone)
+	}()
+	select {
+	case <-l.session.Done():
+	case <-readDone:
+		l.detach(conn)
+	}
+}
+
+// detach 所有者的连接断开, 终端保留 grace 时间等待重连
+func (l *LiveSession) detach(conn *websocket.Conn) {
+	if !l.session.detach(conn) {
+		// 已经被新的连接替换
+		return
+	}
+	if l.grace <= 0 {
+		l.session.Quit()
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.detachGen++
+	gen := l.detachGen
+	l.detachedAt = time.Now()
+	l.registry.logger.Infof("session %s detached, host: %s, user: %s, wait %s for reattach", l.Id, l.HostName, l.Username, l.grace)
+	l.graceTimer = time.AfterFunc(l.grace, func() {
+		l.mu.Lock()
+		expired := l.detachGen == gen
+		l.mu.Unlock()
+		if expired {
+			l.registry.logger.Infof("session %s not reattached in %s, close it", l.Id, l.grace)
+			l.session.Quit()
+		}
+	})
+}
+
+// Watch 只读旁观终端, 阻塞到旁观者断开或者终端结束, 旁观者发送的消息都会被忽略
+func (l *LiveSession) Watch(conn *websocket.Conn) {
+	w := newWatcher(conn)
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.watchers[w] = struct{}{}
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		delete(l.watchers, w)
+		l.mu.Unlock()
+		w.stop()
+	}()
+
+	w.serve(nil)
+}
+
+func newWatcher(conn *websocket.Conn) *watcher {
+	return &watcher{
+		conn: conn,
+		ch:   make(chan interface{}, watcherBuffer),
+		done: make(chan struct{}),
+	}
+}
+
+// serve 转发发送队列中的消息, 阻塞到连接断开或者发送队列关闭
+func (w *watcher) serve(onMessage func(msgType int, data []byte)) {
+	go func() {
+		defer w.stop()
+		for {
+			msgType, data, err := w.conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if onMessage != nil {
+				onMessage(msgType, data)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case msg, ok := <-w.ch:
+			if !ok {
+				_ = w.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session closed"), time.Now().Add(closeWriteTimeout))
+				return
+			}
+			if err := w.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// push 不阻塞的加入发送队列, 队列已满时丢弃
+func (w *watcher) push(msg interface{}) {
+	select {
+	case w.ch <- msg:
+	default:
+	}
+}
+
+func (w *watcher) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+// broadcast 把终端输出发给旁观者和共享终端的参与者
+func (l *LiveSession) broadcast(data []byte) {
+	atomic.AddInt64(&l.BytesOut, int64(len(data)))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed || (len(l.watchers) == 0 && len(l.participants) <= 1) {
+		return
+	}
+	msg := &message{Type: "data", Data: append([]byte(nil), data...)}
+	for w := range l.watchers {
+		w.push(msg)
+	}
+	for _, p := range l.participants {
+		if p.watcher != nil {
+			p.watcher.push(msg)
+		}
+	}
+}
+
+func (l *LiveSession) input(n int) {
+	atomic.AddInt64(&l.BytesIn, int64(n))
+}
+
+func (l *LiveSession) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+	l.closed = true
+	if l.graceTimer != nil {
+		l.graceTimer.Stop()
+	}
+	for w := range l.watchers {
+		close(w.ch)
+	}
+	for _, p := range l.participants {
+		if p.watcher != nil {
+			close(p.watcher.ch)
+		}
+	}
+}
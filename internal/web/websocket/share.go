@@ -0,0 +1,257 @@
+package websocket
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/ssbeatty/oms/internal/models"
+	"sort"
+	"time"
+)
+
+const (
+	// 共享终端的控制消息, 由终端的 websocket 收发
+	messageTypeShare    = "share"    // 终端所有者请求共享链接: {"type": "share"}
+	messageTypeControl  = "control"  // 移交控制权: {"type": "control", "to": "参与者 ID"}
+	messageTypePresence = "presence" // 参与者列表, 参与者变化或控制权移交时推送
+
+	RoleOwner = "owner"
+	RoleGuest = "guest"
+
+	// ShareJoinPath 加入共享终端的 websocket 地址前缀
+	ShareJoinPath = "/ws/session/join/"
+)
+
+var (
+	ErrNotController      = errors.New("only the participant in control can hand over control")
+	ErrParticipantMissing = errors.New("participant not found")
+)
+
+// terminalMessage 终端收到的 json 消息, 没有 type 时为窗口大小
+type terminalMessage struct {
+	Type string `json:"type"`
+	To   string `json:"to"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+type shareMessage struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+	Url   string `json:"url"`
+}
+
+type errorMessage struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+type presenceMessage struct {
+	Type         string         `json:"type"`
+	Self         string         `json:"self"` // 接收者自己的参与者 ID
+	Controller   string         `json:"controller"`
+	Participants []*Participant `json:"participants"`
+}
+
+// Participant 共享终端的参与者, 终端所有者也是参与者
+type Participant struct {
+	Id       string    `json:"id"`
+	UserId   int       `json:"user_id"`
+	Username string    `json:"username"`
+	ClientIP string    `json:"client_ip"`
+	Role     string    `json:"role"`
+	Control  bool      `json:"control"`
+	JoinedAt time.Time `json:"joined_at"`
+
+	// watcher 参与者的发送队列, 所有者为 nil, 直接写入终端的连接
+	watcher *watcher
+}
+
+func newParticipant(role string, user *models.User, clientIP string, conn *websocket.Conn) *Participant {
+	p := &Participant{
+		Id:       uuid.NewString(),
+		ClientIP: clientIP,
+		Role:     role,
+		JoinedAt: time.Now(),
+	}
+	if user != nil {
+		p.UserId = user.Id
+		p.Username = user.Username
+	}
+	if conn != nil {
+		p.watcher = newWatcher(conn)
+	}
+	return p
+}
+
+// Join 加入共享终端, 阻塞到参与者断开或者终端结束
+func (l *LiveSession) Join(conn *websocket.Conn, user *models.User, clientIP string) {
+	p := newParticipant(RoleGuest, user, clientIP, conn)
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.participants[p.Id] = p
+	l.mu.Unlock()
+
+	l.registry.logger.Infof("%s join session %s, host: %s", p.Username, l.Id, l.HostName)
+	l.sendPresence()
+	defer l.leave(p)
+
+	p.watcher.serve(func(msgType int, data []byte) {
+		l.session.handleMessage(p, msgType, data)
+	})
+}
+
+// leave 参与者离开, 持有的控制权交还给终端所有者
+func (l *LiveSession) leave(p *Participant) {
+	l.mu.Lock()
+	delete(l.participants, p.Id)
+	if l.controller == p.Id {
+		l.controller = l.owner.Id
+	}
+	l.mu.Unlock()
+
+	p.watcher.stop()
+	l.sendPresence()
+}
+
+// share 生成共享链接的 token, 终端结束前一直有效
+func (l *LiveSession) share() string {
+	l.mu.Lock()
+	token := l.shareToken
+	created := token == ""
+	if created {
+		token = uuid.NewString()
+		l.shareToken = token
+	}
+	l.mu.Unlock()
+
+	// 不能在持有 l.mu 时获取 registry 的锁, List 的加锁顺序相反
+	if created {
+		l.registry.mu.Lock()
+		l.registry.tokens[token] = l.Id
+		l.registry.mu.Unlock()
+	}
+	return token
+}
+
+func (l *LiveSession) inControl(p *Participant) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return p != nil && l.controller == p.Id
+}
+
+// handOver 持有控制权的参与者把控制权交给其他参与者, 终端所有者可以随时收回控制权
+func (l *LiveSession) handOver(from *Participant, to string) error {
+	l.mu.Lock()
+	if l.controller != from.Id && !(from == l.owner && to == l.owner.Id) {
+		l.mu.Unlock()
+		return ErrNotController
+	}
+	target, ok := l.participants[to]
+	if !ok {
+		l.mu.Unlock()
+		return ErrParticipantMissing
+	}
+	l.controller = target.Id
+	l.mu.Unlock()
+
+	l.registry.logger.Infof("session %s control handed over from %s to %s", l.Id, from.Username, target.Username)
+	l.sendPresence()
+	return nil
+}
+
+// participantList 按加入时间排序的参与者快照, 调用前需要持有锁
+func (l *LiveSession) participantList() []*Participant {
+	ret := make([]*Participant, 0, len(l.participants))
+	for _, p := range l.participants {
+		cp := *p
+		cp.Control = p.Id == l.controller
+		cp.watcher = nil
+		ret = append(ret, &cp)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].JoinedAt.Before(ret[j].JoinedAt)
+	})
+	return ret
+}
+
+// sendPresence 把参与者列表发给所有参与者
+func (l *LiveSession) sendPresence() {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	list := l.participantList()
+	for _, p := range l.participants {
+		if p.watcher != nil {
+			p.watcher.push(&presenceMessage{
+				Type:         messageTypePresence,
+				Self:         p.Id,
+				Controller:   l.controller,
+				Participants: list,
+			})
+		}
+	}
+	presence := &presenceMessage{
+		Type:         messageTypePresence,
+		Self:         l.owner.Id,
+		Controller:   l.controller,
+		Participants: list,
+	}
+	l.mu.Unlock()
+
+	l.send(l.owner, presence)
+}
+
+// send 发送消息给参与者, 参与者的发送队列在终端结束时关闭, 需要持有锁再写入
+func (l *LiveSession) send(p *Participant, msg interface{}) {
+	if p.watcher != nil {
+		l.mu.Lock()
+		if !l.closed {
+			p.watcher.push(msg)
+		}
+		l.mu.Unlock()
+		return
+	}
+	if err := l.session.writeJSON(msg); err != nil {
+		l.registry.logger.Debugf("send message to session %s owner error: %v", l.Id, err)
+	}
+}
+
+// handleControl 处理共享终端的控制消息
+func (s *SSHSession) handleControl(p *Participant, msg *terminalMessage) {
+	live := s.live
+	if live == nil || p == nil {
+		return
+	}
+	switch msg.Type {
+	case messageTypeShare:
+		if p.Role != RoleOwner {
+			live.send(p, &errorMessage{Type: messageTypeShare, Error: "only the owner can share the session"})
+			return
+		}
+		token := live.share()
+		s.logger.Infof("session %s shared by %s", live.Id, p.Username)
+		live.send(p, &shareMessage{Type: messageTypeShare, Token: token, Url: ShareJoinPath + token})
+	case messageTypeControl:
+		if err := live.handOver(p, msg.To); err != nil {
+			live.send(p, &errorMessage{Type: messageTypeControl, Error: err.Error()})
+		}
+	case messageTypePresence:
+		live.mu.Lock()
+		presence := &presenceMessage{
+			Type:         messageTypePresence,
+			Self:         p.Id,
+			Controller:   live.controller,
+			Participants: live.participantList(),
+		}
+		live.mu.Unlock()
+		live.send(p, presence)
+	}
+}
@@ -4,10 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"github.com/gorilla/websocket"
-	"github.com/ssbeatty/oms/internal/ssh"
+	"github.com/ssbeatty/oms/pkg/asciicast"
 	"github.com/ssbeatty/oms/pkg/logger"
 	"github.com/ssbeatty/oms/pkg/transport"
 	"sync"
+	"time"
 )
 
 const (
@@ -58,6 +59,17 @@ type SSHSession struct {
 	once                           sync.Once
 	logger                         *logger.Logger
 	comboOutput                    *wsBufferWriter
+	recorder                       *asciicast.Writer
+	recordInput                    bool
+	live                           *LiveSession
+	quit                           chan struct{}
+	writeMu                        sync.Mutex                  // 终端共享后 presence 等消息会从其他协程写入
+	conn                           *websocket.Conn             // 终端所有者的连接, 断开等待重连时为 nil, 由 writeMu 保护
+	scrollback                     *ringBuffer                 // 重连时回放的输出
+	output                         func([]byte) error          // 不为空时终端输出交给它处理, 多主机终端用来加上主机 ID
+	warn                           func(*warningMessage) error // 不为空时超时提醒交给它处理, 多主机终端用来加上主机 ID, 由 writeMu 保护
+	limiter                        *limiter
+	closeReason                    string // 服务端主动结束终端的原因, 由 writeMu 保护
 	ZModemSZ, ZModemRZ, ZModemSZOO bool
 }
 
@@ -77,24 +89,83 @@ func NewSshConn(cols, rows int, sshClient *transport.Client) (*SSHSession, error
 		once:        sync.Once{},
 		Session:     sshSession,
 		comboOutput: comboWriter,
+		quit:        make(chan struct{}),
 		logger:      logger.NewLogger("webSSH"),
 	}, nil
 }
 
+// SetRecorder 录制终端的输出和窗口变化, withInput 为 true 时同时录制输入, zmodem 传输的内容不会录制
+func (s *SSHSession) SetRecorder(recorder *asciicast.Writer, withInput bool) {
+	s.recorder = recorder
+	s.recordInput = withInput
+}
+
+// SetScrollback 保留最近 size 字节的输出, 重新连接时回放
+func (s *SSHSession) SetScrollback(size int) {
+	if size > 0 {
+		s.scrollback = newRingBuffer(size)
+	}
+}
+
+// SetLimit 设置空闲超时和最长时长, 即将超时时提醒终端所有者, 超时后结束终端
+func (s *SSHSession) SetLimit(limit SessionLimit) {
+	if !limit.enabled() {
+		return
+	}
+	s.limiter = newLimiter(limit)
+	go s.limiter.run(s.quit, func(msg *warningMessage) {
+		s.writeMu.Lock()
+		warn := s.warn
+		s.writeMu.Unlock()
+		if warn != nil {
+			_ = warn(msg)
+			return
+		}
+		_ = s.writeJSON(msg)
+	}, s.Terminate)
+}
+
+// Terminate 断开终端所有者的连接并结束终端, reason 会作为关闭消息发给所有者
+func (s *SSHSession) Terminate(code int, reason string) {
+	s.writeMu.Lock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+	s.writeMu.Unlock()
+
+	s.logger.Infof("terminate ssh session, reason: %s", reason)
+	s.closeConn(code, reason)
+	s.Quit()
+}
+
+// CloseReason 服务端主动结束终端的原因, 用户断开或者 shell 退出时为空
+func (s *SSHSession) CloseReason() string {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.closeReason
+}
+
 func (s *SSHSession) Close() {
 	if s.Session != nil {
 		s.Session.Close()
 	}
-
+	if s.recorder != nil {
+		if err := s.recorder.Close(); err != nil {
+			s.logger.Errorf("close session recorder failed, err: %v", err)
+		}
+	}
 }
 
 // ReceiveWsMsg  receive websocket msg do some handling then write into ssh.session.stdin
-func (s *SSHSession) ReceiveWsMsg(wsConn *websocket.Conn, exitCh chan struct{}) {
-	//tells other go routine quit
-	defer s.setQuit(exitCh)
+// 连接断开时只返回, 由 LiveSession 决定结束终端还是等待重连
+func (s *SSHSession) ReceiveWsMsg(wsConn *websocket.Conn) {
+	var owner *Participant
+	if s.live != nil {
+		owner = s.live.owner
+	}
 	for {
 		select {
-		case <-exitCh:
+		case <-s.quit:
 			return
 		default:
 			// read websocket msg
@@ -103,35 +174,149 @@ func (s *SSHSession) ReceiveWsMsg(wsConn *websocket.Conn, exitCh chan struct{})
 				s.logger.Errorf("reading webSocket message failed, err: %v", err)
 				return
 			}
+			s.handleMessage(owner, msgType, wsData)
+		}
+	}
+}
 
-			if msgType == websocket.BinaryMessage {
-				goto SEND
-			}
-
-			// 每次传输一个或多个char
-			if len(wsData) > minSizeOfResizeMsg {
-				// resize 或者 粘贴
-				resize := ssh.WindowSize{}
-				err := json.Unmarshal(wsData, &resize)
-				if err != nil {
-					s.logger.Errorf("unmarshal resize error: %v", err)
-					// 粘贴内容
-					goto SEND
-				}
-				if resize.Cols > 0 && resize.Rows > 0 {
-					if err := s.Session.WindowChange(resize.Rows, resize.Cols); err != nil {
-						s.logger.Errorf("ssh pty change windows size failed, err: %v", err)
-					}
-				}
-				break
+// handleMessage 处理终端参与者发送的消息, 只有持有控制权的参与者可以输入和调整窗口大小
+func (s *SSHSession) handleMessage(p *Participant, msgType int, wsData []byte) {
+	// 每次传输一个或多个char
+	if msgType != websocket.BinaryMessage && len(wsData) > minSizeOfResizeMsg {
+		// resize、控制消息 或者 粘贴
+		msg := terminalMessage{}
+		err := json.Unmarshal(wsData, &msg)
+		if err == nil {
+			if msg.Type != "" {
+				s.handleControl(p, &msg)
+				return
 			}
-		SEND:
-			decodeBytes := wsData
-			if _, err := s.Session.Write(decodeBytes); err != nil {
-				s.logger.Errorf("ws cmd bytes write to ssh.stdin pipe failed, err: %v", err)
+			if msg.Cols > 0 && msg.Rows > 0 && s.inControl(p) {
+				s.resize(msg.Cols, msg.Rows)
 			}
+			return
+		}
+		// 粘贴内容
+		s.logger.Errorf("unmarshal resize error: %v", err)
+	}
+
+	if !s.inControl(p) {
+		return
+	}
+	s.input(wsData, msgType != websocket.BinaryMessage)
+}
+
+// ownerInput 终端所有者的文本输入, 控制权交给其他参与者后忽略
+func (s *SSHSession) ownerInput(data []byte) {
+	var owner *Participant
+	if s.live != nil {
+		owner = s.live.owner
+	}
+	if s.inControl(owner) {
+		s.input(data, true)
+	}
+}
+
+// input 写入终端的标准输入, zmodem 等二进制数据不录制
+func (s *SSHSession) input(data []byte, record bool) {
+	s.limiter.touch()
+	if s.live != nil {
+		s.live.input(len(data))
+	}
+	if s.recorder != nil && s.recordInput && record {
+		_ = s.recorder.WriteInput(data)
+	}
+	if _, err := s.Session.Write(data); err != nil {
+		s.logger.Errorf("ws cmd bytes write to ssh.stdin pipe failed, err: %v", err)
+	}
+}
+
+// resize 调整终端窗口大小
+func (s *SSHSession) resize(cols, rows int) {
+	if err := s.Session.WindowChange(rows, cols); err != nil {
+		s.logger.Errorf("ssh pty change windows size failed, err: %v", err)
+	}
+	if s.recorder != nil {
+		_ = s.recorder.WriteResize(cols, rows)
+	}
+}
+
+func (s *SSHSession) inControl(p *Participant) bool {
+	return s.live == nil || s.live.inControl(p)
+}
+
+func (s *SSHSession) writeJSON(v interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.WriteJSON(v)
+}
+
+func (s *SSHSession) writeMessage(messageType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// writeOutput 终端输出写入回放缓冲区并发给终端所有者, 和 attach 互斥保证回放的输出不重复也不丢失
+func (s *SSHSession) writeOutput(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.scrollback != nil {
+		s.scrollback.Write(data)
+	}
+	if s.output != nil {
+		return s.output(data)
+	}
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.WriteJSON(&message{Type: "data", Data: data})
+}
+
+// attach 切换终端所有者的连接, 回放缓冲区中的输出, 返回被替换的连接
+func (s *SSHSession) attach(conn *websocket.Conn, replay bool) *websocket.Conn {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	old := s.conn
+	s.conn = conn
+	if replay && s.scrollback != nil {
+		if data := s.scrollback.Bytes(); len(data) > 0 {
+			_ = conn.WriteJSON(&message{Type: "data", Data: data})
 		}
 	}
+	return old
+}
+
+// detach 连接断开, 如果 conn 已经被新的连接替换则返回 false
+func (s *SSHSession) detach(conn *websocket.Conn) bool {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.conn != conn {
+		return false
+	}
+	s.conn = nil
+	return true
+}
+
+// closeConn 发送关闭消息并断开终端所有者的连接
+func (s *SSHSession) closeConn(code int, reason string) {
+	s.writeMu.Lock()
+	conn := s.conn
+	s.writeMu.Unlock()
+
+	if conn != nil {
+		_ = conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason), time.Now().Add(closeWriteTimeout))
+		_ = conn.Close()
+	}
 }
 
 func ByteContains(x, y []byte) bool {
@@ -142,14 +327,14 @@ func ByteContains(x, y []byte) bool {
 	return true
 }
 
-func (s *SSHSession) SendComboOutput(wsConn *websocket.Conn, exitCh chan struct{}) {
+func (s *SSHSession) SendComboOutput() {
 	//tells other go routine quit
-	defer s.setQuit(exitCh)
+	defer s.Quit()
 
-	copyToMessage := func(r *wsBufferWriter, conn *websocket.Conn) {
+	copyToMessage := func(r *wsBufferWriter) {
 		for {
 			select {
-			case <-exitCh:
+			case <-s.quit:
 				return
 			default:
 				var n int
@@ -169,20 +354,20 @@ func (s *SSHSession) SendComboOutput(wsConn *websocket.Conn, exitCh chan struct{
 					// 下载多个文件）。
 					if n < 2 {
 						// 手动发送 ZModemSZEndOO
-						conn.WriteMessage(websocket.BinaryMessage, ZModemSZEndOO)
+						s.writeMessage(websocket.BinaryMessage, ZModemSZEndOO)
 					} else if n == 2 {
 						if buff[0] == ZModemSZEndOO[0] && buff[1] == ZModemSZEndOO[1] {
-							conn.WriteMessage(websocket.BinaryMessage, ZModemSZEndOO)
+							s.writeMessage(websocket.BinaryMessage, ZModemSZEndOO)
 						} else {
 							// 手动发送 ZModemSZEndOO
-							conn.WriteMessage(websocket.BinaryMessage, ZModemSZEndOO)
+							s.writeMessage(websocket.BinaryMessage, ZModemSZEndOO)
 						}
 					} else {
 						if buff[0] == ZModemSZEndOO[0] && buff[1] == ZModemSZEndOO[1] {
-							conn.WriteMessage(websocket.BinaryMessage, buff[:2])
+							s.writeMessage(websocket.BinaryMessage, buff[:2])
 						} else {
 							// 手动发送 ZModemSZEndOO
-							conn.WriteMessage(websocket.BinaryMessage, ZModemSZEndOO)
+							s.writeMessage(websocket.BinaryMessage, ZModemSZEndOO)
 						}
 					}
 				} else {
@@ -190,26 +375,26 @@ func (s *SSHSession) SendComboOutput(wsConn *websocket.Conn, exitCh chan struct{
 						if uint32(n) == defaultBufferSize {
 							// 如果读取的长度为 buffsize，则认为是在传输数据，
 							// 这样可以提高 sz 下载速率，很低概率会误判 zmodem 取消操作
-							conn.WriteMessage(websocket.BinaryMessage, buff[:n])
+							s.writeMessage(websocket.BinaryMessage, buff[:n])
 						} else {
 							if ok := ByteContains(buff[:n], ZModemSZEnd); ok {
 								s.ZModemSZ = false
 								s.ZModemSZOO = true
-								conn.WriteMessage(websocket.BinaryMessage, ZModemSZEnd)
+								s.writeMessage(websocket.BinaryMessage, ZModemSZEnd)
 							} else if ok := ByteContains(buff[:n], ZModemCancel); ok {
 								s.ZModemSZ = false
-								conn.WriteMessage(websocket.BinaryMessage, buff[:n])
+								s.writeMessage(websocket.BinaryMessage, buff[:n])
 							} else {
-								conn.WriteMessage(websocket.BinaryMessage, buff[:n])
+								s.writeMessage(websocket.BinaryMessage, buff[:n])
 							}
 						}
 					} else if s.ZModemRZ {
 						if ok := ByteContains(buff[:n], ZModemRZEnd); ok {
 							s.ZModemRZ = false
-							conn.WriteMessage(websocket.BinaryMessage, ZModemRZEnd)
+							s.writeMessage(websocket.BinaryMessage, ZModemRZEnd)
 						} else if ok := ByteContains(buff[:n], ZModemCancel); ok {
 							s.ZModemRZ = false
-							conn.WriteMessage(websocket.BinaryMessage, buff[:n])
+							s.writeMessage(websocket.BinaryMessage, buff[:n])
 						} else {
 							// rz 上传过程中服务器端还是会给客户端发送一些信息，比如心跳
 							//conn.WriteJSON(&message{Type: messageTypeConsole, Data: buff[:n]})
@@ -221,13 +406,13 @@ func (s *SSHSession) SendComboOutput(wsConn *websocket.Conn, exitCh chan struct{
 								if endIndex != -1 {
 									ctrl := append(ZModemRZCtrlStart, buff[startIndex+len(ZModemRZCtrlStart):endIndex]...)
 									ctrl = append(ctrl, ZModemRZCtrlEnd1...)
-									conn.WriteMessage(websocket.BinaryMessage, ctrl)
+									s.writeMessage(websocket.BinaryMessage, ctrl)
 								} else {
 									endIndex = bytes.Index(buff[:n], ZModemRZCtrlEnd2)
 									if endIndex != -1 {
 										ctrl := append(ZModemRZCtrlStart, buff[startIndex+len(ZModemRZCtrlStart):endIndex]...)
 										ctrl = append(ctrl, ZModemRZCtrlEnd2...)
-										conn.WriteMessage(websocket.BinaryMessage, ctrl)
+										s.writeMessage(websocket.BinaryMessage, ctrl)
 									}
 								}
 							}
@@ -235,21 +420,27 @@ func (s *SSHSession) SendComboOutput(wsConn *websocket.Conn, exitCh chan struct{
 					} else {
 						if ok := ByteContains(buff[:n], ZModemSZStart); ok {
 							s.ZModemSZ = true
-							conn.WriteMessage(websocket.BinaryMessage, ZModemSZStart)
+							s.writeMessage(websocket.BinaryMessage, ZModemSZStart)
 						} else if ok = ByteContains(buff[:n], ZModemRZStart); ok {
 							s.ZModemRZ = true
-							conn.WriteMessage(websocket.BinaryMessage, ZModemRZStart)
+							s.writeMessage(websocket.BinaryMessage, ZModemRZStart)
 						} else if ok = ByteContains(buff[:n], ZModemRZEStart); ok {
 							s.ZModemRZ = true
-							conn.WriteMessage(websocket.BinaryMessage, ZModemRZEStart)
+							s.writeMessage(websocket.BinaryMessage, ZModemRZEStart)
 						} else if ok = ByteContains(buff[:n], ZModemRZSStart); ok {
 							s.ZModemRZ = true
-							conn.WriteMessage(websocket.BinaryMessage, ZModemRZSStart)
+							s.writeMessage(websocket.BinaryMessage, ZModemRZSStart)
 						} else if ok = ByteContains(buff[:n], ZModemRZESStart); ok {
 							s.ZModemRZ = true
-							conn.WriteMessage(websocket.BinaryMessage, ZModemRZESStart)
+							s.writeMessage(websocket.BinaryMessage, ZModemRZESStart)
 						} else {
-							conn.WriteJSON(&message{Type: "data", Data: buff})
+							s.writeOutput(buff)
+							if s.recorder != nil {
+								_ = s.recorder.WriteOutput(buff)
+							}
+							if s.live != nil {
+								s.live.broadcast(buff)
+							}
 						}
 					}
 				}
@@ -259,19 +450,26 @@ func (s *SSHSession) SendComboOutput(wsConn *websocket.Conn, exitCh chan struct{
 		}
 	}
 
-	copyToMessage(s.comboOutput, wsConn)
+	copyToMessage(s.comboOutput)
 
 }
 
-func (s *SSHSession) SessionWait(quitChan chan struct{}) {
+// SessionWait 远程 shell 退出后结束终端
+func (s *SSHSession) SessionWait() {
 	if err := s.Session.Wait(); err != nil {
 		s.logger.Errorf("ssh session wait failed, err: %v", err)
-		s.setQuit(quitChan)
 	}
+	s.Quit()
 }
 
-func (s *SSHSession) setQuit(ch chan struct{}) {
+// Quit 结束终端, 可以重复调用
+func (s *SSHSession) Quit() {
 	s.once.Do(func() {
-		close(ch)
+		close(s.quit)
 	})
 }
+
+// Done 终端结束时关闭
+func (s *SSHSession) Done() <-chan struct{} {
+	return s.quit
+}
@@ -1,18 +1,33 @@
 package websocket
 
 import (
+	"encoding/binary"
 	"github.com/gorilla/websocket"
 	"github.com/ssbeatty/oms/pkg/logger"
 	"net"
 	"sync"
+	"time"
+)
+
+// RFB 客户端消息类型, 只有键盘和鼠标事件算作用户输入
+const (
+	rfbSetPixelFormat           = 0
+	rfbSetEncodings             = 2
+	rfbFramebufferUpdateRequest = 3
+	rfbKeyEvent                 = 4
+	rfbPointerEvent             = 5
+	rfbClientCutText            = 6
 )
 
 type VNCForward struct {
-	once     sync.Once
-	logger   *logger.Logger
-	quitChan chan struct{}
-	wsConn   *websocket.Conn
-	tcpConn  net.Conn
+	once        sync.Once
+	logger      *logger.Logger
+	quitChan    chan struct{}
+	wsConn      *websocket.Conn
+	tcpConn     net.Conn
+	writeMu     sync.Mutex
+	limiter     *limiter
+	closeReason string // 服务端主动断开的原因, 由 writeMu 保护
 }
 
 func NewVNCForward(wsConn *websocket.Conn, tcpConn net.Conn, logger *logger.Logger, quitChan chan struct{}) *VNCForward {
@@ -25,9 +40,30 @@ func NewVNCForward(wsConn *websocket.Conn, tcpConn net.Conn, logger *logger.Logg
 	}
 }
 
+// SetLimit 设置空闲超时和最长时长, 提醒以文本消息发送, noVNC 会忽略文本消息
+func (vf *VNCForward) SetLimit(limit SessionLimit) {
+	if limit.enabled() {
+		vf.limiter = newLimiter(limit)
+	}
+}
+
+// CloseReason 服务端主动断开的原因, 用户断开时为空
+func (vf *VNCForward) CloseReason() string {
+	vf.writeMu.Lock()
+	defer vf.writeMu.Unlock()
+	return vf.closeReason
+}
+
 func (vf *VNCForward) Serve() {
 	go vf.forwardTcp()
 	go vf.forwardWeb()
+	if vf.limiter != nil {
+		go vf.limiter.run(vf.quitChan, func(msg *warningMessage) {
+			vf.writeMu.Lock()
+			defer vf.writeMu.Unlock()
+			_ = vf.wsConn.WriteJSON(msg)
+		}, vf.terminate)
+	}
 
 	<-vf.quitChan
 }
@@ -60,7 +96,10 @@ func (vf *VNCForward) forwardTcp() {
 				vf.logger.Errorf("reading from TCP failed: %s", err)
 				return
 			} else {
-				if err := vf.wsConn.WriteMessage(websocket.BinaryMessage, tcpBuffer[0:n]); err != nil {
+				vf.writeMu.Lock()
+				err := vf.wsConn.WriteMessage(websocket.BinaryMessage, tcpBuffer[0:n])
+				vf.writeMu.Unlock()
+				if err != nil {
 					vf.logger.Errorf("writing to WS failed: %s", err)
 					return
 				}
@@ -88,6 +127,9 @@ func (vf *VNCForward) forwardWeb() {
 
 			_, buffer, err := vf.wsConn.ReadMessage()
 			if err == nil {
+				if rfbUserInput(buffer) {
+					vf.limiter.touch()
+				}
 				if _, err := vf.tcpConn.Write(buffer); err != nil {
 					vf.logger.Errorf("writing to TCP failed: %s", err)
 					return
@@ -100,8 +142,53 @@ func (vf *VNCForward) forwardWeb() {
 	}
 }
 
+func (vf *VNCForward) terminate(code int, reason string) {
+	vf.writeMu.Lock()
+	vf.closeReason = reason
+	vf.writeMu.Unlock()
+
+	vf.logger.Infof("terminate vnc forward, reason: %s", reason)
+	_ = vf.wsConn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(closeWriteTimeout))
+	vf.setQuit()
+}
+
 func (vf *VNCForward) setQuit() {
 	vf.once.Do(func() {
 		close(vf.quitChan)
 	})
 }
+
+// rfbUserInput 检查一帧中的 RFB 客户端消息是否包含键盘或鼠标事件
+// noVNC 每次发送都会单独成帧, 帧的开头就是消息类型, 定时的画面刷新请求不会重置空闲时间
+func rfbUserInput(buf []byte) bool {
+	for len(buf) > 0 {
+		var size int
+		switch buf[0] {
+		case rfbKeyEvent, rfbPointerEvent:
+			return true
+		case rfbSetPixelFormat:
+			size = 20
+		case rfbSetEncodings:
+			if len(buf) < 4 {
+				return false
+			}
+			size = 4 + 4*int(binary.BigEndian.Uint16(buf[2:4]))
+		case rfbFramebufferUpdateRequest:
+			size = 10
+		case rfbClientCutText:
+			if len(buf) < 8 {
+				return false
+			}
+			size = 8 + int(binary.BigEndian.Uint32(buf[4:8]))
+		default:
+			// 握手阶段的数据或者不认识的消息
+			return false
+		}
+		if size > len(buf) {
+			return false
+		}
+		buf = buf[size:]
+	}
+	return false
+}
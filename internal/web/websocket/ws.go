@@ -3,6 +3,7 @@ package websocket
 import (
 	"encoding/json"
 	"github.com/gorilla/websocket"
+	"github.com/ssbeatty/oms/internal/models"
 	"github.com/ssbeatty/oms/internal/ssh"
 	"github.com/ssbeatty/oms/pkg/logger"
 	"github.com/ssbeatty/oms/pkg/transport"
@@ -20,6 +21,8 @@ type WSConnect struct {
 	*websocket.Conn
 	mu             sync.Mutex
 	engine         WebService
+	user           *models.User
+	clientIP       string
 	handlers       map[string]WsHandler
 	closer         chan struct{}
 	once           sync.Once
@@ -27,6 +30,7 @@ type WSConnect struct {
 	logger         *logger.Logger
 	size           ssh.WindowSize
 	existSubscribe map[string]chan struct{}
+	batches        sync.Map // 流式执行的命令批次
 }
 
 type WsMsg struct {
@@ -51,6 +55,66 @@ func NewWSConnect(conn *websocket.Conn, engine WebService) *WSConnect {
 	return c
 }
 
+// SetUser 设置连接所属的用户, 用于过滤有权限的主机
+func (w *WSConnect) SetUser(user *models.User) *WSConnect {
+	w.user = user
+	return w
+}
+
+// SetClientIP 设置客户端地址, 用于审计
+func (w *WSConnect) SetClientIP(ip string) *WSConnect {
+	w.clientIP = ip
+	return w
+}
+
+// audit 记录 websocket 中执行的操作
+func (w *WSConnect) audit(action, summary string, hosts []*models.Host, err error) {
+	event := &models.AuditEvent{
+		ClientIP: w.clientIP,
+		Action:   action,
+		Summary:  summary,
+		Result:   models.AuditResultSuccess,
+	}
+	if w.user != nil {
+		event.UserId = w.user.Id
+		event.Actor = w.user.Username
+	}
+	event.SetHosts(hosts)
+	if err != nil {
+		event.Result = models.AuditResultFailure
+		event.Error = err.Error()
+	}
+	if err := models.InsertAuditEvent(event); err != nil {
+		w.logger.Errorf("insert audit event error: %v", err)
+	}
+}
+
+// userName 当前用户的用户名, 使用内置CA时写入证书
+func (w *WSConnect) userName() string {
+	if w.user == nil {
+		return ""
+	}
+	return w.user.Username
+}
+
+// filterHosts 过滤出当前用户有权限的主机
+func (w *WSConnect) filterHosts(hosts []*models.Host) []*models.Host {
+	if w.user == nil {
+		return nil
+	}
+	filtered, err := models.FilterHostsByUser(w.user, hosts)
+	if err != nil {
+		w.logger.Errorf("filter hosts by user error: %v", err)
+		return nil
+	}
+	return filtered
+}
+
+// allowHosts 当前用户是否有全部主机的权限
+func (w *WSConnect) allowHosts(hosts []*models.Host) bool {
+	return len(w.filterHosts(hosts)) == len(hosts)
+}
+
 func (w *WSConnect) subscribeExisted(key string) (chan struct{}, bool) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
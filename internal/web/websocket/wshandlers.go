@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -10,6 +11,7 @@ import (
 	"github.com/ssbeatty/oms/internal/web/payload"
 	"github.com/ssbeatty/oms/pkg/transport"
 	"github.com/ssbeatty/oms/pkg/utils"
+	"sync"
 	"time"
 )
 
@@ -18,6 +20,17 @@ const (
 	WSStatusError         = "-1"
 	defaultSSHCMDTimeout  = 120
 	DefaultStatusInterval = 2 * time.Second
+
+	AuditActionCmd              = "ws.cmd"
+	AuditActionTerminalOpen     = "terminal.open"
+	AuditActionTerminalClose    = "terminal.close"
+	AuditActionTerminalWatch    = "terminal.watch"
+	AuditActionTerminalUnwatch  = "terminal.unwatch"
+	AuditActionTerminalJoin     = "terminal.join"
+	AuditActionTerminalLeave    = "terminal.leave"
+	AuditActionTerminalReattach = "terminal.reattach"
+	AuditActionVNCOpen          = "vnc.open"
+	AuditActionVNCClose         = "vnc.close"
 )
 
 var (
@@ -25,11 +38,14 @@ var (
 )
 
 type Request struct {
-	Type  string `json:"type"`
-	Id    int    `json:"id"`
-	Cmd   string `json:"cmd"`
-	CType string `json:"cmd_type"`
-	CmdId int    `json:"cmd_id"`
+	Type         string `json:"type"`
+	Id           int    `json:"id"`
+	Cmd          string `json:"cmd"`
+	CType        string `json:"cmd_type"`
+	CmdId        int    `json:"cmd_id"`
+	ConfirmToken string `json:"confirm_token"`
+	Stream       bool   `json:"stream"` // 实时发送每台主机的输出, 可以通过 WS_CMD_CANCEL 取消
+	models.ExecStrategy
 }
 
 type HostStatusRequest struct {
@@ -39,10 +55,11 @@ type HostStatusRequest struct {
 
 func (w *WSConnect) InitHandlers() *WSConnect {
 	w.handlers = map[string]WsHandler{
-		"WS_CMD":      w.HandlerSSHShell,
-		"FILE_STATUS": w.HandlerFTaskStatus,
-		"HOST_STATUS": w.HandlerHostStatus,
-		"RESIZE":      w.HandlerResize,
+		"WS_CMD":        w.HandlerSSHShell,
+		"WS_CMD_CANCEL": w.HandlerCmdCancel,
+		"FILE_STATUS":   w.HandlerFTaskStatus,
+		"HOST_STATUS":   w.HandlerHostStatus,
+		"RESIZE":        w.HandlerResize,
 	}
 	return w
 }
@@ -66,22 +83,58 @@ func (w *WSConnect) HandlerSSHShell(conn *websocket.Conn, msg *WsMsg) {
 	w.logger.Infof("handler ssh shell recv a message: %s", msg.Body)
 	var (
 		execNum int
+		failed  int
 		req     = &Request{}
-		ch      = make(chan *ssh.Result)
 	)
 
-	defer close(ch)
-
 	err := json.Unmarshal(msg.Body, req)
 	if err != nil {
 		w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, "can not parse payload"))
 		return
 	}
+	if err := req.ExecStrategy.Validate(); err != nil {
+		w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, err.Error()))
+		return
+	}
+	if w.user == nil || !w.user.CanOperate() {
+		w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, payload.ErrForbidden))
+		return
+	}
 	hosts, err := models.ParseHostList(req.Type, req.Id)
 	if err != nil || len(hosts) == 0 {
 		w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, "host empty"))
 		return
 	}
+	if !w.allowHosts(hosts) {
+		w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, payload.ErrHostForbidden))
+		return
+	}
+
+	// TODO sudo 由host本身管理
+	cmd := ssh.Command{
+		Type:       ssh.CMDTypeShell,
+		Params:     req.Cmd,
+		Sudo:       true,
+		WindowSize: w.size,
+	}
+	var steps []string
+	if req.CType == ssh.CMDTypePlayer {
+		player, err := models.GetPlayBookById(req.CmdId)
+		if err != nil {
+			w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, "playbook not found"))
+			return
+		}
+		steps, err = w.engine.GetSSHManager().PlayerCommands(player.Steps)
+		if err != nil {
+			w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, err.Error()))
+			return
+		}
+		cmd.Type = ssh.CMDTypePlayer
+		cmd.Params = player.Steps
+	}
+	if !w.checkCommand(req, steps, hosts) {
+		return
+	}
 	defer func() {
 		w.logger.Infof("cmd exec success, total: %d, exec: %d", len(hosts), execNum)
 		// insert command history to database
@@ -91,43 +144,86 @@ func (w *WSConnect) HandlerSSHShell(conn *websocket.Conn, msg *WsMsg) {
 		}
 	}()
 
-	for _, host := range hosts {
-		// TODO sudo 由host本身管理
-		switch req.CType {
-		case ssh.CMDTypePlayer:
-			player, err := models.GetPlayBookById(req.CmdId)
-			if err != nil {
-				w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, "playbook not found"))
-				return
-			}
-			cmd := ssh.Command{
-				Type:       ssh.CMDTypePlayer,
-				Params:     player.Steps,
-				Sudo:       true,
-				WindowSize: w.size,
-			}
-			go w.engine.RunCmdWithContext(host, cmd, ch)
-		default:
-			cmd := ssh.Command{
-				Type:       ssh.CMDTypeShell,
-				Params:     req.Cmd,
-				Sudo:       true,
-				WindowSize: w.size,
-			}
-			go w.engine.RunCmdWithContext(host, cmd, ch)
+	if req.Stream {
+		execNum, failed = w.streamCmd(cmd, hosts, req.ExecStrategy)
+	} else {
+		execNum, failed = w.runCmd(cmd, hosts, req.ExecStrategy)
+	}
+
+	var auditErr error
+	if failed > 0 {
+		auditErr = fmt.Errorf("%d of %d hosts failed", failed, len(hosts))
+	}
+	summary := fmt.Sprintf("cmd=%s", req.Cmd)
+	if req.CType == ssh.CMDTypePlayer {
+		summary = fmt.Sprintf("player=%d", req.CmdId)
+	}
+	w.audit(AuditActionCmd, summary, hosts, auditErr)
+
+	w.WriteMsg(payload.GenerateMsgResponse(
+		WSStatusSuccess, fmt.Sprintf("cmd exec success, total: %d, exec: %d", len(hosts), execNum)))
+}
+
+// runCmd 按策略执行命令, 每台主机结束时发送结果, 返回执行和失败的主机数
+func (w *WSConnect) runCmd(cmd ssh.Command, hosts []*models.Host, strategy models.ExecStrategy) (int, int) {
+	ctx, cancel := w.closeContext()
+	defer cancel()
+
+	var (
+		mu          sync.Mutex
+		seq, failed int
+	)
+	send := func(res *ssh.Result) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		res.Seq = seq
+		seq++
+		if !res.Status {
+			failed++
 		}
+		w.WriteMsg(payload.GenerateDataResponse(WSStatusSuccess, "success", res))
 	}
 
-	for i := 0; i < len(hosts); i++ {
+	skipped := ssh.RunWithStrategy(ctx, strategy, hosts, func(host *models.Host) bool {
+		ch := make(chan *ssh.Result, 1)
+		w.engine.RunCmdWithContext(ctx, host, cmd, w.userName(), ch)
 		res := <-ch
-		res.Seq = i
+		send(res)
+		return res.Status
+	})
+	for _, host := range skipped {
+		send(ssh.NewErrorResult(host, ssh.ErrBatchAborted))
+	}
 
-		execNum++
-		w.WriteMsg(payload.GenerateDataResponse(WSStatusSuccess, "success", res))
+	return len(hosts) - len(skipped), failed
+}
+
+// checkCommand 按危险命令规则校验命令和剧本每一步的命令, 需要二次确认时返回 confirm_token
+func (w *WSConnect) checkCommand(req *Request, steps []string, hosts []*models.Host) bool {
+	err := w.engine.GetSSHManager().Guard().Check(&ssh.GuardRequest{
+		Source:       ssh.GuardSourceWsCmd,
+		User:         w.user,
+		ClientIP:     w.clientIP,
+		Cmd:          req.Cmd,
+		Cmds:         steps,
+		Hosts:        hosts,
+		ConfirmToken: req.ConfirmToken,
+	})
+	if err == nil {
+		return true
 	}
 
-	w.WriteMsg(payload.GenerateMsgResponse(
-		WSStatusSuccess, fmt.Sprintf("cmd exec success, total: %d, exec: %d", len(hosts), execNum)))
+	var confirmErr *ssh.CommandConfirmError
+	if errors.As(err, &confirmErr) {
+		w.WriteMsg(payload.GenerateErrorDataResponse(WSStatusError, err.Error(), &payload.CommandConfirmResponse{
+			ConfirmToken: confirmErr.Token,
+			ExpiresAt:    confirmErr.ExpiresAt,
+		}))
+		return false
+	}
+	w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, err.Error()))
+	return false
 }
 
 func (w *WSConnect) HandlerFTaskStatus(conn *websocket.Conn, msg *WsMsg) {
@@ -179,8 +275,12 @@ func (w *WSConnect) HandlerHostStatus(conn *websocket.Conn, msg *WsMsg) {
 		w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, "parse host array empty"))
 		return
 	}
+	if !w.allowHosts(hosts) {
+		w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, payload.ErrHostForbidden))
+		return
+	}
 
-	client, err := w.engine.GetSSHManager().NewClient(hosts[0])
+	client, err := w.engine.GetSSHManager().NewClientWithOptions(hosts[0], ssh.ClientOptions{User: w.userName()})
 	if err != nil {
 		w.WriteMsg(payload.GenerateErrorResponse(WSStatusError, fmt.Sprintf("error when new ssh client, id: %d", hosts[0].Id)))
 		return
@@ -0,0 +1,152 @@
+// Package asciicast 读写 asciicast v2 格式的终端录像
+// https://docs.asciinema.org/manual/asciicast/v2/
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	Version = 2
+
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+)
+
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Writer 写入录像, 并发安全, 输出被截断的多字节字符会留到下一次写入
+type Writer struct {
+	mu      sync.Mutex
+	w       io.WriteCloser
+	buf     *bufio.Writer
+	start   time.Time
+	pending map[string][]byte
+	size    int64
+	closed  bool
+}
+
+func NewWriter(w io.WriteCloser, header Header) (*Writer, error) {
+	start := time.Now()
+	header.Version = Version
+	if header.Timestamp == 0 {
+		header.Timestamp = start.Unix()
+	}
+	cw := &Writer{
+		w:       w,
+		buf:     bufio.NewWriter(w),
+		start:   start,
+		pending: make(map[string][]byte),
+	}
+	b, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if err := cw.writeLine(b); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (w *Writer) writeLine(b []byte) error {
+	n, err := w.buf.Write(append(b, '\n'))
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) writeEvent(code string, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	if code != EventResize {
+		data = append(w.pending[code], data...)
+		w.pending[code] = nil
+		if tail := incompleteRune(data); tail > 0 {
+			w.pending[code] = append([]byte(nil), data[len(data)-tail:]...)
+			data = data[:len(data)-tail]
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	elapsed := time.Since(w.start).Seconds()
+	b, err := json.Marshal([]interface{}{json.Number(fmt.Sprintf("%.6f", elapsed)), code, string(data)})
+	if err != nil {
+		return err
+	}
+	return w.writeLine(b)
+}
+
+// WriteOutput 记录终端输出
+func (w *Writer) WriteOutput(data []byte) error {
+	return w.writeEvent(EventOutput, data)
+}
+
+// WriteInput 记录用户输入
+func (w *Writer) WriteInput(data []byte) error {
+	return w.writeEvent(EventInput, data)
+}
+
+// WriteResize 记录终端大小变化
+func (w *Writer) WriteResize(cols, rows int) error {
+	return w.writeEvent(EventResize, []byte(fmt.Sprintf("%dx%d", cols, rows)))
+}
+
+// Duration 录像开始到现在的时长
+func (w *Writer) Duration() time.Duration {
+	return time.Since(w.start)
+}
+
+// Size 已写入的字节数
+func (w *Writer) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.buf.Flush(); err != nil {
+		_ = w.w.Close()
+		return err
+	}
+	return w.w.Close()
+}
+
+// incompleteRune 末尾不完整的 utf-8 字符的字节数
+func incompleteRune(b []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if !utf8.RuneStart(c) {
+			continue
+		}
+		if c >= utf8.RuneSelf && !utf8.FullRune(b[len(b)-i:]) {
+			return i
+		}
+		return 0
+	}
+	return 0
+}
@@ -0,0 +1,93 @@
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	searchContext  = 40
+	maxLineSize    = 4 * 1024 * 1024
+	searchTailSize = 1024
+)
+
+// ansiEscape 终端控制序列, 搜索前去掉
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[@-Z\\-_]|\r`)
+
+type Match struct {
+	Time float64 `json:"time"` // 匹配的输出在录像中的秒数
+	Text string  `json:"text"` // 匹配位置前后的文本
+}
+
+// StripANSI 去掉终端控制序列
+func StripANSI(s string) string {
+	return ansiEscape.ReplaceAllString(s, "")
+}
+
+// Search 在录像的输出中查找关键字, 忽略大小写, 最多返回 limit 个结果
+func Search(r io.Reader, keyword string, limit int) ([]Match, error) {
+	var (
+		matches []Match
+		// tail 保留上一段输出的末尾, 关键字可能被拆到多个事件中
+		tail    string
+		scanner = bufio.NewScanner(r)
+	)
+	if keyword == "" {
+		return nil, nil
+	}
+	// 直接在原文上忽略大小写匹配, 大小写转换后字节长度可能变化, 不能用转换后的下标截取原文
+	re := regexp.MustCompile("(?i)" + regexp.QuoteMeta(keyword))
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	// 第一行为 header
+	if !scanner.Scan() {
+		return nil, scanner.Err()
+	}
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			continue
+		}
+		if code, _ := event[1].(string); code != EventOutput {
+			continue
+		}
+		elapsed, _ := event[0].(float64)
+		data, _ := event[2].(string)
+
+		text := tail + StripANSI(data)
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			// 只保留结束在本次输出中的匹配, 避免 tail 中的匹配重复计算
+			if loc[1] <= len(tail) {
+				continue
+			}
+			matches = append(matches, Match{Time: elapsed, Text: snippet(text, loc[0], loc[1]-loc[0])})
+			if limit > 0 && len(matches) >= limit {
+				return matches, nil
+			}
+		}
+
+		if len(text) > searchTailSize {
+			text = text[len(text)-searchTailSize:]
+		}
+		tail = text
+	}
+	return matches, scanner.Err()
+}
+
+func snippet(text string, idx, n int) string {
+	start := idx - searchContext
+	if start < 0 {
+		start = 0
+	}
+	end := idx + n + searchContext
+	if end > len(text) {
+		end = len(text)
+	}
+	if start > end {
+		start = end
+	}
+	return strings.ToValidUTF8(text[start:end], "")
+}
@@ -85,6 +85,10 @@ func (l *Logger) Errorf(format string, args ...interface{}) {
 	l.entry.Errorf(format, args...)
 }
 
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.entry.Warnf(format, args...)
+}
+
 func (l *Logger) Printf(format string, args ...interface{}) {
 	l.entry.Printf(format, args...)
 }
@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"sync"
+	"time"
+)
+
+// ExecResult 命令的执行结果, Combined 为 stdout 和 stderr 按到达顺序合并的输出
+type ExecResult struct {
+	Stdout   []byte
+	Stderr   []byte
+	Combined []byte
+	ExitCode int    // 没有退出码时为 -1
+	Signal   string // 被信号终止时的信号名, 例如 KILL, TERM
+	Duration time.Duration
+}
+
+// execCollector 同时收集分开的和合并的输出
+type execCollector struct {
+	mu       sync.Mutex
+	stdout   bytes.Buffer
+	stderr   bytes.Buffer
+	combined bytes.Buffer
+}
+
+type execWriter struct {
+	c   *execCollector
+	buf *bytes.Buffer
+}
+
+func (w *execWriter) Write(p []byte) (int, error) {
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+
+	w.buf.Write(p)
+	return w.c.combined.Write(p)
+}
+
+func (c *execCollector) result(start time.Time, err error) *ExecResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return &ExecResult{
+		Stdout:   c.stdout.Bytes(),
+		Stderr:   c.stderr.Bytes(),
+		Combined: c.combined.Bytes(),
+		ExitCode: ExitCode(err),
+		Signal:   ExitSignal(err),
+		Duration: time.Since(start),
+	}
+}
+
+// ExecContext 执行命令并分别收集 stdout 和 stderr, 需要在没有 pty 的会话上执行.
+// 命令启动后总是返回结果, err 为命令本身的错误(非 0 退出码, 被取消等)
+func (s *Session) ExecContext(ctx context.Context, cmd string) (*ExecResult, error) {
+	c := &execCollector{}
+	start := time.Now()
+	err := s.StreamContext(ctx, cmd, &execWriter{c: c, buf: &c.stdout}, &execWriter{c: c, buf: &c.stderr})
+
+	return c.result(start, err), err
+}
+
+// SudoExecContext 使用 sudo 执行命令, 参考 ExecContext
+func (s *Session) SudoExecContext(ctx context.Context, cmd, passwd string) (*ExecResult, error) {
+	c := &execCollector{}
+	start := time.Now()
+	err := s.SudoStreamContext(ctx, cmd, passwd, &execWriter{c: c, buf: &c.stdout}, &execWriter{c: c, buf: &c.stderr})
+
+	return c.result(start, err), err
+}
+
+// ExitSignal 远端命令被信号终止时的信号名, 否则返回空字符串
+func ExitSignal(err error) string {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Signal()
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+var (
+	ErrNotCertificate = errors.New("not an ssh certificate")
+)
+
+// KeyboardInteractiveFunc 回答 keyboard-interactive 的问题, 和 ssh.KeyboardInteractiveChallenge 一致
+type KeyboardInteractiveFunc func(name, instruction string, questions []string, echos []bool) ([]string, error)
+
+// PromptRequiredError 主机需要输入动态口令等信息, 但是当前连接无法询问用户
+type PromptRequiredError struct {
+	Questions []string
+}
+
+func (e *PromptRequiredError) Error() string {
+	return fmt.Sprintf("keyboard-interactive prompt %q requires a terminal to answer", strings.Join(e.Questions, ", "))
+}
+
+// AuthWithKeyboardInteractive 密码提示使用主机的密码回答, 其他问题交给 prompt
+func AuthWithKeyboardInteractive(password string, prompt KeyboardInteractiveFunc) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		var (
+			answers = make([]string, len(questions))
+			others  []int
+		)
+		for i, q := range questions {
+			if !echos[i] && password != "" && isPasswordPrompt(q) {
+				answers[i] = password
+				continue
+			}
+			others = append(others, i)
+		}
+		if len(others) == 0 {
+			return answers, nil
+		}
+
+		var (
+			otherQuestions = make([]string, len(others))
+			otherEchos     = make([]bool, len(others))
+		)
+		for i, idx := range others {
+			otherQuestions[i] = questions[idx]
+			otherEchos[i] = echos[idx]
+		}
+		if prompt == nil {
+			return nil, &PromptRequiredError{Questions: otherQuestions}
+		}
+		otherAnswers, err := prompt(name, instruction, otherQuestions, otherEchos)
+		if err != nil {
+			return nil, err
+		}
+		if len(otherAnswers) != len(others) {
+			return nil, fmt.Errorf("keyboard-interactive want %d answers but got %d", len(others), len(otherAnswers))
+		}
+		for i, idx := range others {
+			answers[idx] = otherAnswers[i]
+		}
+		return answers, nil
+	})
+}
+
+func isPasswordPrompt(question string) bool {
+	q := strings.ToLower(question)
+	return strings.Contains(q, "password") || strings.Contains(q, "passphrase")
+}
@@ -0,0 +1,366 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeSocks5 代理服务端的应答, 用于在 net.Pipe 上模拟握手
+type fakeSocks5 struct {
+	method     byte   // 协商返回的认证方式
+	authStatus byte   // 用户名密码认证的结果
+	reply      byte   // 连接请求的应答码
+	bind       []byte // 应答中的绑定地址, 包含地址类型和端口
+
+	// 服务端收到的内容
+	methods  []byte
+	user     string
+	password string
+	target   string
+}
+
+func (f *fakeSocks5) serve(conn net.Conn) error {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	f.methods = make([]byte, head[1])
+	if _, err := io.ReadFull(conn, f.methods); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{socks5Version, f.method}); err != nil {
+		return err
+	}
+	switch f.method {
+	case socks5AuthNoAccept:
+		return nil
+	case socks5AuthPassword:
+		user, err := readSocks5String(conn, 1)
+		if err != nil {
+			return err
+		}
+		password, err := readSocks5String(conn, 0)
+		if err != nil {
+			return err
+		}
+		f.user, f.password = user, password
+		if _, err := conn.Write([]byte{socks5PasswordVersion, f.authStatus}); err != nil {
+			return err
+		}
+		if f.authStatus != 0x00 {
+			return nil
+		}
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return err
+	}
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		domain, err := readSocks5String(conn, 0)
+		if err != nil {
+			return err
+		}
+		host = domain
+	default:
+		return errors.New("unknown address type")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return err
+	}
+	f.target = net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+	resp := append([]byte{socks5Version, f.reply, 0x00}, f.bind...)
+	if _, err := conn.Write(resp); err != nil {
+		return err
+	}
+	if f.reply == 0x00 {
+		_, err := conn.Write([]byte("SSH-2.0-fake\r\n"))
+		return err
+	}
+	return nil
+}
+
+// readSocks5String 读取一个长度前缀的字符串, skip 为长度前需要跳过的字节数
+func readSocks5String(conn net.Conn, skip int) (string, error) {
+	buf := make([]byte, skip+1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	s := make([]byte, buf[skip])
+	if _, err := io.ReadFull(conn, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+var bindIPv4 = []byte{socks5AddrIPv4, 127, 0, 0, 1, 0x04, 0x38}
+
+// runSocks5 在 net.Pipe 上执行握手, 返回客户端的错误和握手后客户端读到的第一行
+func runSocks5(t *testing.T, p *ProxyConfig, f *fakeSocks5, addr string) (string, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = f.serve(server)
+		_ = server.Close()
+	}()
+
+	err := p.socks5Connect(client, addr)
+	var line string
+	if err == nil {
+		line, _ = bufio.NewReader(client).ReadString('\n')
+	}
+	_ = client.Close()
+	<-done
+	return line, err
+}
+
+func TestSocks5Connect(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   string
+		addr   string
+		server fakeSocks5
+		target string
+	}{
+		{"no auth ipv4", "", "10.0.0.1:22", fakeSocks5{method: socks5AuthNone, bind: bindIPv4}, "10.0.0.1:22"},
+		{"no auth domain", "", "example.com:2222", fakeSocks5{method: socks5AuthNone, bind: bindIPv4}, "example.com:2222"},
+		{"no auth ipv6", "", "[::1]:22", fakeSocks5{method: socks5AuthNone, bind: bindIPv4}, "[::1]:22"},
+		{"password", "admin", "10.0.0.1:22", fakeSocks5{method: socks5AuthPassword, bind: bindIPv4}, "10.0.0.1:22"},
+		{"user but no auth required", "admin", "10.0.0.1:22", fakeSocks5{method: socks5AuthNone, bind: bindIPv4}, "10.0.0.1:22"},
+		{
+			"bind ipv6", "", "10.0.0.1:22",
+			fakeSocks5{method: socks5AuthNone, bind: append(append([]byte{socks5AddrIPv6}, net.IPv6loopback...), 0, 22)},
+			"10.0.0.1:22",
+		},
+		{
+			"bind domain", "", "10.0.0.1:22",
+			fakeSocks5{method: socks5AuthNone, bind: append([]byte{socks5AddrDomain, 5}, "proxy\x00\x16"...)},
+			"10.0.0.1:22",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyConfig{Type: ProxyTypeSocks5, User: tt.user, Password: "secret"}
+			f := tt.server
+			line, err := runSocks5(t, p, &f, tt.addr)
+			if err != nil {
+				t.Fatalf("socks5Connect() error = %v", err)
+			}
+			if f.target != tt.target {
+				t.Errorf("target = %s, want %s", f.target, tt.target)
+			}
+			// 绑定地址需要被完整读掉, 之后的数据属于ssh
+			if line != "SSH-2.0-fake\r\n" {
+				t.Errorf("data after handshake = %q", line)
+			}
+			wantMethods := []byte{socks5AuthNone}
+			if tt.user != "" {
+				wantMethods = []byte{socks5AuthNone, socks5AuthPassword}
+			}
+			if string(f.methods) != string(wantMethods) {
+				t.Errorf("methods = %v, want %v", f.methods, wantMethods)
+			}
+			if f.method == socks5AuthPassword && (f.user != tt.user || f.password != "secret") {
+				t.Errorf("credentials = %s:%s, want %s:secret", f.user, f.password, tt.user)
+			}
+		})
+	}
+}
+
+func TestSocks5ConnectAuthFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   string
+		server fakeSocks5
+	}{
+		{"wrong password", "admin", fakeSocks5{method: socks5AuthPassword, authStatus: 0x01}},
+		{"no acceptable method", "", fakeSocks5{method: socks5AuthNoAccept}},
+		{"password required without user", "", fakeSocks5{method: socks5AuthPassword}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyConfig{Type: ProxyTypeSocks5, User: tt.user, Password: "wrong"}
+			f := tt.server
+			_, err := runSocks5(t, p, &f, "10.0.0.1:22")
+			if !errors.Is(err, ErrProxyAuth) {
+				t.Errorf("socks5Connect() error = %v, want %v", err, ErrProxyAuth)
+			}
+		})
+	}
+
+	f := fakeSocks5{method: 0x03}
+	_, err := runSocks5(t, &ProxyConfig{Type: ProxyTypeSocks5}, &f, "10.0.0.1:22")
+	if err == nil || !strings.Contains(err.Error(), "unsupported socks auth method 3") {
+		t.Errorf("socks5Connect() error = %v, want unsupported auth method", err)
+	}
+}
+
+func TestSocks5ConnectReply(t *testing.T) {
+	for code, msg := range socks5Replies {
+		f := fakeSocks5{method: socks5AuthNone, reply: code, bind: bindIPv4}
+		_, err := runSocks5(t, &ProxyConfig{Type: ProxyTypeSocks5}, &f, "10.0.0.1:22")
+		if err == nil || err.Error() != "connect 10.0.0.1:22: "+msg {
+			t.Errorf("reply %d: error = %v, want %s", code, err, msg)
+		}
+	}
+
+	f := fakeSocks5{method: socks5AuthNone, reply: 0x09, bind: bindIPv4}
+	_, err := runSocks5(t, &ProxyConfig{Type: ProxyTypeSocks5}, &f, "10.0.0.1:22")
+	if err == nil || !strings.Contains(err.Error(), "unknown socks reply 9") {
+		t.Errorf("reply 9: error = %v, want unknown socks reply", err)
+	}
+}
+
+// runHttpConnect 在 net.Pipe 上执行 CONNECT, 服务端返回 resp
+func runHttpConnect(t *testing.T, p *ProxyConfig, resp string) (*http.Request, string, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	var req *http.Request
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		var err error
+		req, err = http.ReadRequest(bufio.NewReader(server))
+		if err != nil {
+			return
+		}
+		_, _ = server.Write([]byte(resp))
+	}()
+
+	err := p.httpConnect(client, "10.0.0.1:22")
+	var line string
+	if err == nil {
+		line, _ = bufio.NewReader(client).ReadString('\n')
+	}
+	_ = client.Close()
+	<-done
+	return req, line, err
+}
+
+func TestHttpConnect(t *testing.T) {
+	p := &ProxyConfig{Type: ProxyTypeHttp, User: "admin", Password: "secret"}
+	req, line, err := runHttpConnect(t, p, "HTTP/1.1 200 Connection established\r\n\r\nSSH-2.0-fake\r\n")
+	if err != nil {
+		t.Fatalf("httpConnect() error = %v", err)
+	}
+	if req.Method != http.MethodConnect || req.Host != "10.0.0.1:22" {
+		t.Errorf("request = %s %s, want CONNECT 10.0.0.1:22", req.Method, req.Host)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+	if got := req.Header.Get("Proxy-Authorization"); got != auth {
+		t.Errorf("Proxy-Authorization = %q, want %q", got, auth)
+	}
+	// 响应头之后的数据不能被代理握手读走
+	if line != "SSH-2.0-fake\r\n" {
+		t.Errorf("data after handshake = %q", line)
+	}
+
+	req, _, err = runHttpConnect(t, &ProxyConfig{Type: ProxyTypeHttp}, "HTTP/1.1 200 OK\r\n\r\n")
+	if err != nil {
+		t.Fatalf("httpConnect() without auth error = %v", err)
+	}
+	if got := req.Header.Get("Proxy-Authorization"); got != "" {
+		t.Errorf("Proxy-Authorization = %q, want empty", got)
+	}
+}
+
+func TestHttpConnectFailure(t *testing.T) {
+	p := &ProxyConfig{Type: ProxyTypeHttp, User: "admin", Password: "wrong"}
+	_, _, err := runHttpConnect(t, p, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+	if !errors.Is(err, ErrProxyAuth) {
+		t.Errorf("httpConnect() error = %v, want %v", err, ErrProxyAuth)
+	}
+
+	_, _, err = runHttpConnect(t, p, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+	if err == nil || err.Error() != "connect 10.0.0.1:22: 403 Forbidden" {
+		t.Errorf("httpConnect() error = %v, want 403 Forbidden", err)
+	}
+
+	_, _, err = runHttpConnect(t, p, "HTTP/1.1 200 OK\r\n"+strings.Repeat("X-Pad: 0\r\n", 1000))
+	if err == nil || err.Error() != "proxy response header too long" {
+		t.Errorf("httpConnect() error = %v, want header too long", err)
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	tests := []struct {
+		raw      string
+		user     string
+		password string
+		want     ProxyConfig
+		err      error
+	}{
+		{"socks5://127.0.0.1", "", "", ProxyConfig{Type: ProxyTypeSocks5, Addr: "127.0.0.1:1080"}, nil},
+		{"socks5h://u:p@127.0.0.1:7890", "", "", ProxyConfig{Type: ProxyTypeSocks5, Addr: "127.0.0.1:7890", User: "u", Password: "p"}, nil},
+		{"http://u:p@proxy", "admin", "secret", ProxyConfig{Type: ProxyTypeHttp, Addr: "proxy:80", User: "admin", Password: "secret"}, nil},
+		{"https://proxy:443", "", "", ProxyConfig{}, ErrProxyType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			p, err := ParseProxy(tt.raw, tt.user, tt.password)
+			if err != tt.err {
+				t.Fatalf("ParseProxy() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && *p != tt.want {
+				t.Errorf("ParseProxy() = %+v, want %+v", *p, tt.want)
+			}
+		})
+	}
+}
+
+func TestSerializeProxy(t *testing.T) {
+	newConfig := func(proxy *ProxyConfig) *ClientConfig {
+		return &ClientConfig{Host: "10.0.0.2", Port: 22, Proxy: proxy}
+	}
+	configs := []*ClientConfig{
+		newConfig(nil),
+		newConfig(&ProxyConfig{Type: ProxyTypeSocks5, Addr: "10.1.0.1:1080"}),
+		newConfig(&ProxyConfig{Type: ProxyTypeSocks5, Addr: "10.2.0.1:1080"}),
+		newConfig(&ProxyConfig{Type: ProxyTypeHttp, Addr: "10.1.0.1:1080"}),
+		newConfig(&ProxyConfig{Type: ProxyTypeSocks5, Addr: "10.1.0.1:1080", User: "ops"}),
+	}
+	keys := make(map[string]int)
+	for i, c := range configs {
+		key := c.Serialize()
+		if j, ok := keys[key]; ok {
+			t.Errorf("config %d and %d share the pool key %q", j, i, key)
+		}
+		keys[key] = i
+	}
+
+	// 密码不能出现在 key 中
+	c := newConfig(&ProxyConfig{Type: ProxyTypeSocks5, Addr: "10.1.0.1:1080", User: "ops", Password: "secret"})
+	if key := c.Serialize(); strings.Contains(key, "secret") {
+		t.Errorf("pool key %q contains the proxy password", key)
+	}
+	// 使用跳板机时代理不生效
+	jump := func() (*Client, error) { return nil, nil }
+	a := &ClientConfig{Host: "10.0.0.2", JumpID: 1, JumpClient: jump}
+	b := &ClientConfig{Host: "10.0.0.2", JumpID: 1, JumpClient: jump, Proxy: configs[1].Proxy}
+	if a.Serialize() != b.Serialize() {
+		t.Errorf("proxy changes the pool key of jump host connection: %q, %q", a.Serialize(), b.Serialize())
+	}
+}
@@ -3,6 +3,7 @@ package transport
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/pkg/sftp"
 	"github.com/ssbeatty/oms/pkg/utils"
 	"golang.org/x/crypto/ssh"
@@ -66,11 +67,52 @@ type ClientConfig struct {
 	Password   string `json:"password"`
 	Passphrase string `json:"passphrase"`
 	KeyBytes   []byte `json:"key_bytes"`
+	CertBytes  []byte `json:"cert_bytes"` // 密钥对应的 -cert.pub 证书
 	Port       int    `json:"port"`
+
+	// Prompt 回答 keyboard-interactive 中密码以外的问题, 例如动态口令, 为空时无法登录需要动态口令的主机
+	Prompt KeyboardInteractiveFunc `json:"-"`
+	// Signers 优先使用的签名, 例如内置CA签发的临时证书, 只在建立新连接时调用
+	Signers SignersFunc `json:"-"`
+	// Owner 连接所属的用户, 不为空时不同用户的连接不共用
+	Owner string `json:"-"`
+
+	// HostKeyCallback 为空时不校验主机公钥
+	HostKeyCallback   ssh.HostKeyCallback `json:"-"`
+	HostKeyAlgorithms []string            `json:"-"`
+
+	// JumpID 跳板机ID, JumpClient 不为空时通过跳板机建立tcp连接, 类似 ssh -J
+	JumpID     int            `json:"-"`
+	JumpClient JumpClientFunc `json:"-"`
+
+	// Proxy 不为空时通过代理建立tcp连接, 使用跳板机时不生效
+	Proxy *ProxyConfig `json:"-"`
+}
+
+// JumpClientFunc 在拨号时获取跳板机的连接, 跳板机断开重连后也能拿到新的连接
+type JumpClientFunc func() (*Client, error)
+
+// SignersFunc 在登录时生成签名, 复用缓存的连接时不需要签发证书
+type SignersFunc func() ([]ssh.Signer, error)
+
+// Serialize 连接池的 key, 代理后面的主机也可能使用相同的内网地址, 不同代理的连接不共用
+func (h *ClientConfig) Serialize() string {
+	key := SerializeAddr(h.Host, h.Port, h.JumpID)
+	if h.Proxy != nil && h.JumpClient == nil {
+		key += "|" + h.Proxy.String()
+	}
+	if h.Owner != "" {
+		key += "#" + h.Owner
+	}
+	return key
 }
 
-func (h *ClientConfig) Serialize() int64 {
-	return utils.InetAtoN(h.Host, h.Port)
+// SerializeAddr 连接的唯一标识, 不同跳板机后面的主机可能使用相同的内网地址
+func SerializeAddr(host string, port, jumpID int) string {
+	if port == 0 {
+		port = 22
+	}
+	return fmt.Sprintf("%d/%s", jumpID, net.JoinHostPort(host, strconv.Itoa(port)))
 }
 
 type conn struct {
@@ -366,6 +408,42 @@ func (s *Session) OutputContext(ctx context.Context, cmd string) ([]byte, error)
 	return s.sshSession.CombinedOutput(cmd)
 }
 
+// StreamContext 执行命令, 输出实时写入 stdout 和 stderr, ctx 结束时向远端进程发送 SIGTERM 并关闭会话.
+// 需要在没有 pty 的会话上执行, 否则 stderr 会合并到 stdout
+func (s *Session) StreamContext(ctx context.Context, cmd string, stdout, stderr io.Writer) error {
+	s.SetStdout(stdout)
+	s.SetStderr(stderr)
+	if err := s.Start(cmd); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		_ = s.sshSession.Signal(ssh.SIGTERM)
+		_ = s.sshSession.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// ExitCode 远端命令的退出码, 没有退出码(连接断开, 被信号终止等)时返回 -1
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) && exitErr.Signal() == "" {
+		return exitErr.ExitStatus()
+	}
+	return -1
+}
+
 // AuthWithAgent use already authed user
 func AuthWithAgent() (ssh.AuthMethod, error) {
 	sock := os.Getenv("SSH_AUTH_SOCK")
@@ -387,6 +465,11 @@ func AuthWithAgent() (ssh.AuthMethod, error) {
 
 // AuthWithPrivateKeyBytes 直接通过秘钥的bytes
 func AuthWithPrivateKeyBytes(key []byte, password string) (ssh.AuthMethod, error) {
+	return AuthWithCertificate(key, password, nil)
+}
+
+// AuthWithCertificate 密钥附带证书时优先使用证书认证, 证书过期或者不被信任时再使用密钥
+func AuthWithCertificate(key []byte, password string, cert []byte) (ssh.AuthMethod, error) {
 	var signer ssh.Signer
 	var err error
 	if password == "" {
@@ -397,19 +480,90 @@ func AuthWithPrivateKeyBytes(key []byte, password string) (ssh.AuthMethod, error
 	if err != nil {
 		return nil, err
 	}
-	return ssh.PublicKeys(signer), nil
+	if len(cert) == 0 {
+		return ssh.PublicKeys(signer), nil
+	}
+
+	certificate, err := ParseCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	certSigner, err := ssh.NewCertSigner(certificate, signer)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(certSigner, signer), nil
+}
+
+// ParseCertificate 解析 authorized_keys 格式的用户证书
+func ParseCertificate(cert []byte) (*ssh.Certificate, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(cert)
+	if err != nil {
+		return nil, err
+	}
+	certificate, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, ErrNotCertificate
+	}
+	return certificate, nil
 }
 
 func Dial(network, addr string, config *ssh.ClientConfig) (net.Conn, *ssh.Client, error) {
-	conn, err := net.DialTimeout(network, addr, config.Timeout)
+	return DialWithProxy(nil, network, addr, config)
+}
+
+// DialWithProxy proxy 为空时直接连接
+func DialWithProxy(proxy *ProxyConfig, network, addr string, config *ssh.ClientConfig) (net.Conn, *ssh.Client, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if proxy != nil {
+		conn, err = proxy.Dial(network, addr, config.Timeout)
+	} else {
+		conn, err = net.DialTimeout(network, addr, config.Timeout)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
-	conn = newConn(conn)
+	return newClientConn(newConn(conn), addr, config)
+}
+
+// DialWithJump 通过跳板机的ssh连接建立到目标主机的tcp连接
+func DialWithJump(jump *Client, network, addr string, config *ssh.ClientConfig) (net.Conn, *ssh.Client, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	// ssh.Client.Dial 不支持超时
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := jump.sshClient.Dial(network, addr)
+		ch <- result{conn, err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return nil, nil, r.err
+		}
+		// 通道的连接不支持deadline, 不使用 newConn 包装
+		return newClientConn(r.conn, addr, config)
+	case <-time.After(config.Timeout):
+		go func() {
+			if r := <-ch; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, nil, fmt.Errorf("dial %s through jump host %s timeout", addr, jump.Conf.Host)
+	}
+}
 
+func newClientConn(conn net.Conn, addr string, config *ssh.ClientConfig) (net.Conn, *ssh.Client, error) {
 	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
+		_ = conn.Close()
 		return nil, nil, err
 	}
 	return conn, ssh.NewClient(c, chans, reqs), nil
@@ -418,18 +572,30 @@ func Dial(network, addr string, config *ssh.ClientConfig) (net.Conn, *ssh.Client
 // New 创建SSH client
 func New(config *ClientConfig) (client *Client, err error) {
 	clientConfig := &ssh.ClientConfig{
-		User:            config.User,
-		Timeout:         SSHDialTimeout,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // 忽略public key的安全验证
+		User:              config.User,
+		Timeout:           SSHDialTimeout,
+		HostKeyCallback:   config.HostKeyCallback,
+		HostKeyAlgorithms: config.HostKeyAlgorithms,
+	}
+	if clientConfig.HostKeyCallback == nil {
+		clientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey() // 忽略public key的安全验证
 	}
 
 	if config.Port == 0 {
 		config.Port = 22
 	}
 
-	// 1. private key bytes
+	// 0. 临时证书
+	if config.Signers != nil {
+		signers, err := config.Signers()
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signers...))
+	}
+	// 1. private key bytes, 有证书时同时使用证书
 	if config.KeyBytes != nil {
-		if auth, err := AuthWithPrivateKeyBytes(config.KeyBytes, config.Passphrase); err == nil {
+		if auth, err := AuthWithCertificate(config.KeyBytes, config.Passphrase, config.CertBytes); err == nil {
 			clientConfig.Auth = append(clientConfig.Auth, auth)
 		}
 	}
@@ -437,15 +603,36 @@ func New(config *ClientConfig) (client *Client, err error) {
 	if config.Password != "" {
 		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(config.Password))
 	}
-	// 3. agent 模式放在最后,这样当前两者都不能使用时可以采用Agent模式
+	// 3. keyboard-interactive 部分设备只支持这种方式输入密码, 或者需要输入动态口令
+	if config.Password != "" || config.Prompt != nil {
+		clientConfig.Auth = append(clientConfig.Auth, AuthWithKeyboardInteractive(config.Password, config.Prompt))
+	}
+	// 4. agent 模式放在最后,这样前面的方式都不能使用时可以采用Agent模式
 	if auth, err := AuthWithAgent(); err == nil {
 		clientConfig.Auth = append(clientConfig.Auth, auth)
 	}
 
-	conn, sshClient, err := Dial("tcp", net.JoinHostPort(config.Host, strconv.Itoa(config.Port)), clientConfig)
+	var (
+		conn      net.Conn
+		sshClient *ssh.Client
+		addr      = net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	)
+	if config.JumpClient != nil {
+		var jump *Client
+		jump, err = config.JumpClient()
+		if err != nil {
+			return client, errors.New("Failed to connect jump host: " + err.Error())
+		}
+		conn, sshClient, err = DialWithJump(jump, "tcp", addr, clientConfig)
+	} else {
+		conn, sshClient, err = DialWithProxy(config.Proxy, "tcp", addr, clientConfig)
+	}
 
-	if err != nil {
-		return client, errors.New("Failed to dial ssh: " + err.Error())
+	var proxyErr *ProxyError
+	if errors.As(err, &proxyErr) {
+		return client, fmt.Errorf("Failed to connect proxy: %w", err)
+	} else if err != nil {
+		return client, fmt.Errorf("Failed to dial ssh: %w", err)
 	}
 	client = &Client{
 		conn:      conn,
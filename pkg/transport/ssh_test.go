@@ -58,8 +58,14 @@ func init() {
 	}
 }
 
-func TestSampleCmd(t *testing.T) {
+func requireClient(t *testing.T) {
+	if client == nil {
+		t.Skip("no test host in ./hosts")
+	}
+}
 
+func TestSampleCmd(t *testing.T) {
+	requireClient(t)
 	session, err := client.NewPty()
 	assert.Nil(t, err)
 
@@ -70,7 +76,7 @@ func TestSampleCmd(t *testing.T) {
 }
 
 func TestSudoCmd(t *testing.T) {
-
+	requireClient(t)
 	session, err := client.NewPty()
 	assert.Nil(t, err)
 
@@ -88,6 +94,7 @@ func TestSudoCmd(t *testing.T) {
 }
 
 func TestLongTimeCmd(t *testing.T) {
+	requireClient(t)
 	quitCh := make(chan bool)
 
 	go func() {
@@ -121,6 +128,7 @@ func TestConnCache(t *testing.T) {
 }
 
 func TestNewClientWithSftp(t *testing.T) {
+	requireClient(t)
 	err := client.NewSftpClient()
 	assert.Nil(t, err)
 
@@ -142,6 +150,7 @@ func TestNewClientWithSftp(t *testing.T) {
 }
 
 func TestSSHStat(t *testing.T) {
+	requireClient(t)
 	status := transport.NewStatus()
 	for i := 0; i < 10; i++ {
 		transport.GetAllStats(client, status, nil)
@@ -153,6 +162,7 @@ func TestSSHStat(t *testing.T) {
 }
 
 func TestRunScript(t *testing.T) {
+	requireClient(t)
 	shell := `#/bin/bash
 ls -a
 echo 111
@@ -163,13 +173,14 @@ ls -lh
 	session, err := client.NewPty()
 	assert.Nil(t, err)
 
-	output, err := session.RunScript(shell, true)
+	output, err := session.RunScript(shell, true, "/tmp/oms-test")
 	assert.Nil(t, err)
 
 	fmt.Println(string(output))
 }
 
 func TestChmod(t *testing.T) {
+	requireClient(t)
 	err := client.Chmod("/root/test")
 
 	assert.Nil(t, err)
@@ -177,6 +188,7 @@ func TestChmod(t *testing.T) {
 }
 
 func TestConnectionPing(t *testing.T) {
+	requireClient(t)
 	ok, msg, err := client.SendRequest("keepalive@golang.org", true, nil)
 	if err != nil {
 		t.Error(err)
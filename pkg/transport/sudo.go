@@ -36,6 +36,29 @@ func (w *sudoWriter) Write(p []byte) (int, error) {
 	return w.b.Write(p)
 }
 
+// sudoPromptWriter 流式输出时在 stderr 中查找 sudo 的密码提示, 发送密码并去掉提示
+type sudoPromptWriter struct {
+	w     io.Writer
+	pw    string
+	stdin io.Writer
+	sent  bool
+}
+
+func (w *sudoPromptWriter) Write(p []byte) (int, error) {
+	if !w.sent && bytes.Contains(p, []byte(sudoPwPrompt)) {
+		w.sent = true
+		_, _ = w.stdin.Write([]byte(w.pw + "\n"))
+		w.pw = ""
+		if rest := bytes.Replace(p, []byte(sudoPwPrompt), nil, 1); len(rest) > 0 {
+			if _, err := w.w.Write(rest); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
+
 func (s *Session) hasSudoCommand() bool {
 	if s.hasSudo {
 		return true
@@ -113,3 +136,13 @@ func (s *Session) SudoContext(ctx context.Context, cmd, passwd string) ([]byte,
 
 	return w.b.Bytes(), err
 }
+
+// SudoStreamContext 使用 sudo 流式执行命令, 参考 StreamContext
+func (s *Session) SudoStreamContext(ctx context.Context, cmd, passwd string, stdout, stderr io.Writer) error {
+	if cmd == "" || !s.hasSudoCommand() {
+		return s.StreamContext(ctx, cmd, stdout, stderr)
+	}
+	cmd = "sudo -p " + sudoPwPrompt + " -S " + cmd
+
+	return s.StreamContext(ctx, cmd, stdout, &sudoPromptWriter{w: stderr, pw: passwd, stdin: s.stdin})
+}
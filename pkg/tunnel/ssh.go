@@ -136,6 +136,7 @@ func (s *SSHTunnel) start() {
 		s.client, err = transport.New(s.conf)
 		if err != nil {
 			s.logger.Errorf("error when tunnel create ssh client: %v", err)
+			s.SetErrorMsg("ssh connect error", err)
 			return
 		}
 	}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	passphraseSaltSize   = 16
+	passphraseIterations = 120000
+	aesKeySize           = 32
+)
+
+var (
+	// passphraseMagic 使用口令加密的文件头
+	passphraseMagic = []byte("OMSENC1\n")
+
+	ErrCipherText = errors.New("cipher text is invalid")
+)
+
+// DeriveKey 将任意长度的主密钥转换为 aes-256 的密钥
+func DeriveKey(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// AesGcmEncrypt 使用 aes-256-gcm 加密, 返回 nonce + 密文
+func AesGcmEncrypt(key, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+// AesGcmDecrypt 解密 AesGcmEncrypt 的结果
+func AesGcmDecrypt(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrCipherText
+	}
+	nonce, text := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, text, nil)
+	if err != nil {
+		return nil, ErrCipherText
+	}
+	return plain, nil
+}
+
+// EncryptWithPassphrase 使用口令加密文件, 格式为 magic + salt + nonce + 密文
+func EncryptWithPassphrase(passphrase string, plain []byte) ([]byte, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := pbkdf2.Key([]byte(passphrase), salt, passphraseIterations, aesKeySize, sha256.New)
+	data, err := AesGcmEncrypt(key, plain)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(passphraseMagic)
+	buf.Write(salt)
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// DecryptWithPassphrase 解密 EncryptWithPassphrase 的结果
+func DecryptWithPassphrase(passphrase string, data []byte) ([]byte, error) {
+	if !IsPassphraseEncrypted(data) {
+		return nil, ErrCipherText
+	}
+	data = data[len(passphraseMagic):]
+	if len(data) < passphraseSaltSize {
+		return nil, ErrCipherText
+	}
+	salt, text := data[:passphraseSaltSize], data[passphraseSaltSize:]
+	key := pbkdf2.Key([]byte(passphrase), salt, passphraseIterations, aesKeySize, sha256.New)
+	return AesGcmDecrypt(key, text)
+}
+
+// IsPassphraseEncrypted 是否为 EncryptWithPassphrase 加密的内容
+func IsPassphraseEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, passphraseMagic)
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestAesGcmRoundTrip(t *testing.T) {
+	key := DeriveKey("master")
+	plain := []byte("password")
+
+	data, err := AesGcmEncrypt(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, plain) {
+		t.Fatal("cipher text contains the plain text")
+	}
+	got, err := AesGcmDecrypt(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("AesGcmDecrypt() = %q, want %q", got, plain)
+	}
+
+	again, err := AesGcmEncrypt(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(data, again) {
+		t.Error("nonce is reused between encryptions")
+	}
+}
+
+func TestAesGcmDecryptInvalid(t *testing.T) {
+	key := DeriveKey("master")
+	data, err := AesGcmEncrypt(key, []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name string
+		key  []byte
+		data []byte
+	}{
+		{"wrong key", DeriveKey("other"), data},
+		{"tampered", key, tampered},
+		{"truncated", key, data[:4]},
+		{"empty", key, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := AesGcmDecrypt(tt.key, tt.data); !errors.Is(err, ErrCipherText) {
+				t.Errorf("AesGcmDecrypt() err = %v, want %v", err, ErrCipherText)
+			}
+		})
+	}
+}
+
+func TestPassphraseRoundTrip(t *testing.T) {
+	plain := []byte(`{"hosts": []}`)
+
+	data, err := EncryptWithPassphrase("passphrase", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPassphraseEncrypted(data) {
+		t.Fatal("encrypted data has no magic header")
+	}
+	if IsPassphraseEncrypted(plain) {
+		t.Fatal("plain data is treated as encrypted")
+	}
+	got, err := DecryptWithPassphrase("passphrase", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("DecryptWithPassphrase() = %q, want %q", got, plain)
+	}
+
+	if _, err := DecryptWithPassphrase("wrong", data); !errors.Is(err, ErrCipherText) {
+		t.Errorf("wrong passphrase err = %v, want %v", err, ErrCipherText)
+	}
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := DecryptWithPassphrase("passphrase", tampered); !errors.Is(err, ErrCipherText) {
+		t.Errorf("tampered err = %v, want %v", err, ErrCipherText)
+	}
+	if _, err := DecryptWithPassphrase("passphrase", plain); !errors.Is(err, ErrCipherText) {
+		t.Errorf("plain data err = %v, want %v", err, ErrCipherText)
+	}
+	if _, err := DecryptWithPassphrase("passphrase", passphraseMagic); !errors.Is(err, ErrCipherText) {
+		t.Errorf("header only err = %v, want %v", err, ErrCipherText)
+	}
+}
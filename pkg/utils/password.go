@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"strconv"
+	"strings"
+)
+
+const (
+	passwordHashAlgo       = "pbkdf2_sha256"
+	passwordHashIterations = 120000
+	passwordSaltSize       = 16
+	passwordKeySize        = 32
+)
+
+// RandomBytes 生成 n 字节的随机数据
+func RandomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// RandomToken 生成 n 字节的随机串, 使用 base64 url 编码
+func RandomToken(n int) (string, error) {
+	b, err := RandomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashSha256 sha256 摘要, 用于token等只需要比对的值
+func HashSha256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// HashPassword 生成 pbkdf2_sha256$iter$salt$key 格式的密码摘要
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, passwordHashIterations, passwordKeySize, sha256.New)
+
+	return fmt.Sprintf("%s$%d$%s$%s",
+		passwordHashAlgo,
+		passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// CheckPassword 校验明文密码和 HashPassword 生成的摘要是否匹配
+func CheckPassword(password, hashed string) bool {
+	args := strings.Split(hashed, "$")
+	if len(args) != 4 || args[0] != passwordHashAlgo {
+		return false
+	}
+	iter, err := strconv.Atoi(args[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(args[2])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(args[3])
+	if err != nil {
+		return false
+	}
+	actual := pbkdf2.Key([]byte(password), salt, iter, len(key), sha256.New)
+
+	return subtle.ConstantTimeCompare(actual, key) == 1
+}